@@ -47,22 +47,30 @@ type ConsumerInfo struct {
 }
 
 type ConsumerConfig struct {
-	Durable         string        `json:"durable_name,omitempty"`
-	DeliverSubject  string        `json:"deliver_subject,omitempty"`
-	DeliverPolicy   DeliverPolicy `json:"deliver_policy"`
-	OptStartSeq     uint64        `json:"opt_start_seq,omitempty"`
-	OptStartTime    *time.Time    `json:"opt_start_time,omitempty"`
-	AckPolicy       AckPolicy     `json:"ack_policy"`
-	AckWait         time.Duration `json:"ack_wait,omitempty"`
-	MaxDeliver      int           `json:"max_deliver,omitempty"`
-	FilterSubject   string        `json:"filter_subject,omitempty"`
-	ReplayPolicy    ReplayPolicy  `json:"replay_policy"`
-	RateLimit       uint64        `json:"rate_limit_bps,omitempty"` // Bits per sec
-	SampleFrequency string        `json:"sample_freq,omitempty"`
-	MaxWaiting      int           `json:"max_waiting,omitempty"`
-	MaxAckPending   int           `json:"max_ack_pending,omitempty"`
-	Heartbeat       time.Duration `json:"idle_heartbeat,omitempty"`
-	FlowControl     bool          `json:"flow_control,omitempty"`
+	Durable         string          `json:"durable_name,omitempty"`
+	DeliverSubject  string          `json:"deliver_subject,omitempty"`
+	DeliverPolicy   DeliverPolicy   `json:"deliver_policy"`
+	OptStartSeq     uint64          `json:"opt_start_seq,omitempty"`
+	OptStartTime    *time.Time      `json:"opt_start_time,omitempty"`
+	AckPolicy       AckPolicy       `json:"ack_policy"`
+	AckWait         time.Duration   `json:"ack_wait,omitempty"`
+	MaxDeliver      int             `json:"max_deliver,omitempty"`
+	BackOff         []time.Duration `json:"backoff,omitempty"`
+	FilterSubject   string          `json:"filter_subject,omitempty"`
+	FilterSubjects  []string        `json:"filter_subjects,omitempty"`
+	ReplayPolicy    ReplayPolicy    `json:"replay_policy"`
+	RateLimit       uint64          `json:"rate_limit_bps,omitempty"` // Bits per sec
+	SampleFrequency string          `json:"sample_freq,omitempty"`
+	MaxWaiting      int             `json:"max_waiting,omitempty"`
+	MaxAckPending   int             `json:"max_ack_pending,omitempty"`
+	Heartbeat       time.Duration   `json:"idle_heartbeat,omitempty"`
+	FlowControl     bool            `json:"flow_control,omitempty"`
+
+	// Limits for pull requests. Requests that do not set an expiration or
+	// max bytes will have these applied.
+	MaxRequestBatch    int           `json:"max_batch,omitempty"`
+	MaxRequestExpires  time.Duration `json:"max_expires,omitempty"`
+	MaxRequestMaxBytes int           `json:"max_bytes,omitempty"`
 
 	// Don't add to general clients.
 	Direct bool `json:"direct,omitempty"`
@@ -157,16 +165,22 @@ var (
 	AckAck = []byte("+ACK") // nil or no payload to ack subject also means ACK
 	AckOK  = []byte(OK)     // deprecated but +OK meant ack as well.
 
-	// Nack
+	// Nack, optionally followed by a delay, e.g. -NAK {"delay": "5s"}
 	AckNak = []byte("-NAK")
 	// Progress indicator
 	AckProgress = []byte("+WPI")
 	// Ack + Deliver the next message(s).
 	AckNext = []byte("+NXT")
-	// Terminate delivery of the message.
+	// Terminate delivery of the message, optionally followed by a reason.
 	AckTerm = []byte("+TERM")
 )
 
+// ConsumerNakOptions are the optional values that can follow a NAK.
+// The delay can be a duration string, e.g. "5s", or an integer in nanoseconds.
+type ConsumerNakOptions struct {
+	Delay json.RawMessage `json:"delay,omitempty"`
+}
+
 // Consumer is a jetstream consumer.
 type consumer struct {
 	mu                sync.RWMutex
@@ -201,6 +215,9 @@ type consumer struct {
 	outq              *jsOutQ
 	pending           map[uint64]*Pending
 	ptmr              *time.Timer
+	ptmrt             time.Time
+	wtmr              *time.Timer
+	wtmrt             time.Time
 	rdq               []uint64
 	rdqi              map[uint64]struct{}
 	rdc               map[uint64]uint64
@@ -210,7 +227,7 @@ type consumer struct {
 	store             ConsumerStore
 	active            bool
 	replay            bool
-	filterWC          bool
+	filters           *Sublist
 	dtmr              *time.Timer
 	gwdtmr            *time.Timer
 	dthresh           time.Duration
@@ -228,6 +245,7 @@ type consumer struct {
 	node    RaftNode
 	infoSub *subscription
 	lqsent  time.Time
+	uch     chan struct{}
 
 	// R>1 proposals
 	pch   chan struct{}
@@ -253,6 +271,30 @@ const (
 	JsDefaultMaxAckPending = 20_000
 )
 
+// setConsumerConfigDefaults will set the defaults for any fields not specified.
+func setConsumerConfigDefaults(config *ConsumerConfig) {
+	// If we have a backoff schedule the first value is our ack wait.
+	if config.AckWait == 0 && len(config.BackOff) > 0 {
+		config.AckWait = config.BackOff[0]
+	}
+	// Setup proper default for ack wait if we are in explicit ack mode.
+	if config.AckWait == 0 && (config.AckPolicy == AckExplicit || config.AckPolicy == AckAll) {
+		config.AckWait = JsAckWaitDefault
+	}
+	// Setup default of -1, meaning no limit for MaxDeliver.
+	if config.MaxDeliver == 0 {
+		config.MaxDeliver = -1
+	}
+	// Set proper default for max ack pending if we are ack explicit and none has been set.
+	if config.AckPolicy == AckExplicit && config.MaxAckPending == 0 {
+		config.MaxAckPending = JsDefaultMaxAckPending
+	}
+	// Set proper default for max waiting if we are in pull mode.
+	if config.DeliverSubject == _EMPTY_ && config.MaxWaiting == 0 {
+		config.MaxWaiting = JSWaitQueueDefaultMax
+	}
+}
+
 func (mset *stream) addConsumer(config *ConsumerConfig) (*consumer, error) {
 	return mset.addConsumerWithAssignment(config, _EMPTY_, nil)
 }
@@ -291,6 +333,9 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 		if config.Heartbeat > 0 && config.Heartbeat < 100*time.Millisecond {
 			return nil, fmt.Errorf("consumer idle heartbeat needs to be >= 100ms")
 		}
+		if config.MaxRequestBatch != 0 || config.MaxRequestExpires != 0 || config.MaxRequestMaxBytes != 0 {
+			return nil, fmt.Errorf("consumer max request limits require a pull based consumer")
+		}
 	} else {
 		// Pull mode / work queue mode require explicit ack.
 		if config.AckPolicy != AckExplicit {
@@ -307,16 +352,21 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 		if config.MaxWaiting < 0 {
 			return nil, fmt.Errorf("consumer max waiting needs to be positive")
 		}
-		// Set to default if not specified.
-		if config.MaxWaiting == 0 {
-			config.MaxWaiting = JSWaitQueueDefaultMax
-		}
 		if config.Heartbeat > 0 {
 			return nil, fmt.Errorf("consumer idle heartbeat requires a push based consumer")
 		}
 		if config.FlowControl {
 			return nil, fmt.Errorf("consumer flow control requires a push based consumer")
 		}
+		if config.MaxRequestBatch < 0 {
+			return nil, fmt.Errorf("consumer max request batch needs to be positive")
+		}
+		if config.MaxRequestExpires != 0 && config.MaxRequestExpires < time.Millisecond {
+			return nil, fmt.Errorf("consumer max request expires needs to be >= 1ms")
+		}
+		if config.MaxRequestMaxBytes < 0 {
+			return nil, fmt.Errorf("consumer max request max bytes needs to be positive")
+		}
 	}
 
 	// Direct need to be non-mapped ephemerals.
@@ -332,19 +382,27 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 		}
 	}
 
-	// Setup proper default for ack wait if we are in explicit ack mode.
-	if config.AckWait == 0 && (config.AckPolicy == AckExplicit || config.AckPolicy == AckAll) {
-		config.AckWait = JsAckWaitDefault
-	}
-	// Setup default of -1, meaning no limit for MaxDeliver.
-	if config.MaxDeliver == 0 {
-		config.MaxDeliver = -1
-	}
-	// Set proper default for max ack pending if we are ack explicit and none has been set.
-	if config.AckPolicy == AckExplicit && config.MaxAckPending == 0 {
-		config.MaxAckPending = JsDefaultMaxAckPending
+	// A backoff schedule replaces the ack wait, one value per delivery.
+	if len(config.BackOff) > 0 {
+		if config.AckPolicy == AckNone {
+			return nil, fmt.Errorf("consumer backoff requires an ack policy")
+		}
+		for _, d := range config.BackOff {
+			if d <= 0 {
+				return nil, fmt.Errorf("consumer backoff values need to be positive")
+			}
+		}
+		if config.MaxDeliver > 0 && len(config.BackOff) > config.MaxDeliver {
+			return nil, fmt.Errorf("consumer backoff can not have more values than max deliver")
+		}
+		if config.AckWait != 0 && config.AckWait != config.BackOff[0] {
+			return nil, fmt.Errorf("consumer ack wait conflicts with backoff")
+		}
 	}
 
+	// Set any defaults that were not specified.
+	setConsumerConfigDefaults(config)
+
 	// Make sure any partition subject is also a literal.
 	if config.FilterSubject != _EMPTY_ {
 		subjects, hasExt := mset.allSubjects()
@@ -353,6 +411,27 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 		}
 	}
 
+	// Multiple filter subjects need to be valid on their own and can not overlap.
+	if len(config.FilterSubjects) > 0 {
+		if config.FilterSubject != _EMPTY_ {
+			return nil, fmt.Errorf("consumer can not have both filter subject and filter subjects")
+		}
+		subjects, hasExt := mset.allSubjects()
+		for i, filter := range config.FilterSubjects {
+			if !IsValidSubject(filter) {
+				return nil, fmt.Errorf("consumer filter subject %q is not valid", filter)
+			}
+			if !validFilteredSubject(filter, subjects) && !hasExt {
+				return nil, fmt.Errorf("consumer filter subject %q is not a valid subset of the interest subjects", filter)
+			}
+			for _, other := range config.FilterSubjects[:i] {
+				if SubjectsCollide(filter, other) {
+					return nil, fmt.Errorf("consumer filter subjects %q and %q overlap", other, filter)
+				}
+			}
+		}
+	}
+
 	// Check on start position conflicts.
 	switch config.DeliverPolicy {
 	case DeliverAll:
@@ -420,16 +499,21 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 			ocfg := eo.config()
 			if reflect.DeepEqual(&ocfg, config) {
 				return eo, nil
-			} else {
+			} else if configsEqualSansDelivery(ocfg, *config) {
 				// If we are a push mode and not active and the only difference
 				// is deliver subject then update and return.
-				if configsEqualSansDelivery(ocfg, *config) && eo.hasNoLocalInterest() {
+				if eo.hasNoLocalInterest() {
 					eo.updateDeliverSubject(config.DeliverSubject)
 					return eo, nil
 				} else {
 					return nil, fmt.Errorf("consumer already exists")
 				}
 			}
+			// Otherwise this is an update, which is only allowed for some fields.
+			if err := eo.updateConfig(config); err != nil {
+				return nil, err
+			}
+			return eo, nil
 		}
 	}
 
@@ -457,10 +541,10 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 		}
 
 		if len(mset.consumers) > 0 {
-			if config.FilterSubject == _EMPTY_ {
+			if filters := config.filterSubjects(); len(filters) == 0 {
 				mset.mu.Unlock()
 				return nil, fmt.Errorf("multiple non-filtered consumers not allowed on workqueue stream")
-			} else if !mset.partitionUnique(config.FilterSubject) {
+			} else if !mset.partitionUnique(filters) {
 				// We have a partition but it is not unique amongst the others.
 				mset.mu.Unlock()
 				return nil, fmt.Errorf("filtered consumer not unique on workqueue stream")
@@ -486,6 +570,7 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 		active:  true,
 		qch:     make(chan struct{}),
 		mch:     make(chan struct{}, 1),
+		uch:     make(chan struct{}, 1),
 		sfreq:   int32(sampleFreq),
 		maxdc:   uint64(config.MaxDeliver),
 		maxp:    config.MaxAckPending,
@@ -518,26 +603,15 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 	}
 
 	// Check if we have a rate limit set.
-	if config.RateLimit != 0 {
-		// TODO(dlc) - Make sane values or error if not sane?
-		// We are configured in bits per sec so adjust to bytes.
-		rl := rate.Limit(config.RateLimit / 8)
-		// Burst should be set to maximum msg size for this account, etc.
-		var burst int
-		if mset.cfg.MaxMsgSize > 0 {
-			burst = int(mset.cfg.MaxMsgSize)
-		} else if mset.jsa.account.limits.mpay > 0 {
-			burst = int(mset.jsa.account.limits.mpay)
-		} else {
-			s := mset.jsa.account.srv
-			burst = int(s.getOpts().MaxPayload)
-		}
-		o.rlimit = rate.NewLimiter(rl, burst)
-	}
+	o.setRateLimit(config.RateLimit)
 
-	// Check if we have  filtered subject that is a wildcard.
-	if config.FilterSubject != _EMPTY_ && !subjectIsLiteral(config.FilterSubject) {
-		o.filterWC = true
+	// Check if we have a filtered subject that is a wildcard or multiple filtered subjects.
+	// Those are matched with a sublist, a single literal is just compared.
+	if len(config.FilterSubjects) > 0 || (config.FilterSubject != _EMPTY_ && !subjectIsLiteral(config.FilterSubject)) {
+		o.filters = NewSublistWithCache()
+		for _, filter := range config.filterSubjects() {
+			o.filters.Insert(&subscription{subject: []byte(filter)})
+		}
 	}
 
 	// already under lock, mset.Name() would deadlock
@@ -662,6 +736,18 @@ func (o *consumer) setConsumerAssignment(ca *consumerAssignment) {
 	if ca != nil {
 		o.node = ca.Group.node
 	}
+	// Let our monitor know our assignment changed.
+	select {
+	case o.uch <- struct{}{}:
+	default:
+	}
+}
+
+// Returns a channel that is signaled when our consumer assignment is updated.
+func (o *consumer) updateC() <-chan struct{} {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.uch
 }
 
 // Lock should be held.
@@ -1028,6 +1114,141 @@ func (o *consumer) watchGWinterest() {
 	o.mu.Unlock()
 }
 
+// Set the rate limit for the consumer, configured in bits per sec.
+// Lock should be held, as well as the stream lock.
+func (o *consumer) setRateLimit(bps uint64) {
+	if bps == 0 {
+		o.rlimit = nil
+		return
+	}
+	mset := o.mset
+	// TODO(dlc) - Make sane values or error if not sane?
+	// We are configured in bits per sec so adjust to bytes.
+	rl := rate.Limit(bps / 8)
+	// Burst should be set to maximum msg size for this account, etc.
+	var burst int
+	if mset.cfg.MaxMsgSize > 0 {
+		burst = int(mset.cfg.MaxMsgSize)
+	} else if mset.jsa.account.limits.mpay > 0 {
+		burst = int(mset.jsa.account.limits.mpay)
+	} else {
+		s := mset.jsa.account.srv
+		burst = int(s.getOpts().MaxPayload)
+	}
+	o.rlimit = rate.NewLimiter(rl, burst)
+}
+
+// checkNewConsumerConfig will make sure only the fields that can be
+// changed on a running consumer differ between cfg and ncfg.
+func checkNewConsumerConfig(cfg, ncfg *ConsumerConfig) error {
+	if reflect.DeepEqual(cfg, ncfg) {
+		return nil
+	}
+	if cfg.Durable != ncfg.Durable {
+		return fmt.Errorf("consumer durable name can not be updated")
+	}
+	if cfg.DeliverSubject == _EMPTY_ && ncfg.DeliverSubject != _EMPTY_ {
+		return fmt.Errorf("consumer can not be updated from pull to push based")
+	}
+	if cfg.DeliverSubject != _EMPTY_ && ncfg.DeliverSubject == _EMPTY_ {
+		return fmt.Errorf("consumer can not be updated from push to pull based")
+	}
+	if cfg.DeliverPolicy != ncfg.DeliverPolicy {
+		return fmt.Errorf("consumer deliver policy can not be updated")
+	}
+	if cfg.OptStartSeq != ncfg.OptStartSeq {
+		return fmt.Errorf("consumer start sequence can not be updated")
+	}
+	if (cfg.OptStartTime == nil) != (ncfg.OptStartTime == nil) ||
+		(cfg.OptStartTime != nil && !cfg.OptStartTime.Equal(*ncfg.OptStartTime)) {
+		return fmt.Errorf("consumer start time can not be updated")
+	}
+	if cfg.AckPolicy != ncfg.AckPolicy {
+		return fmt.Errorf("consumer ack policy can not be updated")
+	}
+	if cfg.FilterSubject != ncfg.FilterSubject {
+		return fmt.Errorf("consumer filter subject can not be updated")
+	}
+	if len(cfg.FilterSubjects) != len(ncfg.FilterSubjects) ||
+		(len(cfg.FilterSubjects) > 0 && !reflect.DeepEqual(cfg.FilterSubjects, ncfg.FilterSubjects)) {
+		return fmt.Errorf("consumer filter subjects can not be updated")
+	}
+	if cfg.ReplayPolicy != ncfg.ReplayPolicy {
+		return fmt.Errorf("consumer replay policy can not be updated")
+	}
+	if cfg.MaxWaiting != ncfg.MaxWaiting {
+		return fmt.Errorf("consumer max waiting can not be updated")
+	}
+	if cfg.FlowControl != ncfg.FlowControl {
+		return fmt.Errorf("consumer flow control can not be updated")
+	}
+	if cfg.Direct != ncfg.Direct {
+		return fmt.Errorf("consumer direct can not be updated")
+	}
+	return nil
+}
+
+// updateConfig will apply any changes to the mutable fields of a running consumer.
+// Our state is kept as is.
+func (o *consumer) updateConfig(cfg *ConsumerConfig) error {
+	o.mu.RLock()
+	mset := o.mset
+	o.mu.RUnlock()
+	if mset == nil {
+		return fmt.Errorf("consumer not valid")
+	}
+
+	// The rate limit needs the stream lock.
+	mset.mu.RLock()
+	o.mu.Lock()
+	if err := checkNewConsumerConfig(&o.cfg, cfg); err != nil {
+		o.mu.Unlock()
+		mset.mu.RUnlock()
+		return err
+	}
+	if cfg.DeliverSubject != o.cfg.DeliverSubject {
+		// Same as when only the delivery subject changes, we can not move an active push consumer.
+		if rr := o.acc.sl.Match(o.cfg.DeliverSubject); len(rr.psubs)+len(rr.qsubs) > 0 {
+			o.mu.Unlock()
+			mset.mu.RUnlock()
+			return fmt.Errorf("consumer deliver subject can not be updated while active")
+		}
+		// Force redeliver of all pending on change of delivery subject.
+		if len(o.pending) > 0 {
+			o.forceExpirePending()
+		}
+		o.acc.sl.ClearNotification(o.dsubj, o.inch)
+		o.dsubj = cfg.DeliverSubject
+		o.acc.sl.RegisterNotification(o.dsubj, o.inch)
+	}
+	if cfg.RateLimit != o.cfg.RateLimit {
+		o.setRateLimit(cfg.RateLimit)
+	}
+	if cfg.SampleFrequency != o.cfg.SampleFrequency {
+		sampleFreq, _ := strconv.Atoi(strings.TrimSuffix(cfg.SampleFrequency, "%"))
+		o.sfreq = int32(sampleFreq)
+	}
+	o.maxdc = uint64(cfg.MaxDeliver)
+	o.maxp = cfg.MaxAckPending
+	ackWaitChanged := cfg.AckWait != o.cfg.AckWait || !reflect.DeepEqual(cfg.BackOff, o.cfg.BackOff)
+	o.cfg = *cfg
+	// Pick up the new ack wait for anything pending.
+	if ackWaitChanged && o.ptmr != nil {
+		o.setPendingTimer(o.ackWait(0))
+	}
+	// Kick our delivery loop since max ack pending or heartbeats may have changed.
+	o.signalNewMessages()
+	store, ok := o.store.(*consumerFileStore)
+	o.mu.Unlock()
+	mset.mu.RUnlock()
+
+	// Write out new config.
+	if ok {
+		return store.updateConfig(*cfg)
+	}
+	return nil
+}
+
 // Config returns the consumer's configuration.
 func (o *consumer) config() ConsumerConfig {
 	o.mu.Lock()
@@ -1055,7 +1276,7 @@ func (o *consumer) forceExpirePending() {
 				p.Timestamp += off
 			}
 		}
-		o.ptmr.Reset(o.ackWait(0))
+		o.setPendingTimer(o.ackWait(0))
 	}
 	o.signalNewMessages()
 }
@@ -1086,7 +1307,7 @@ func (o *consumer) updateDeliverSubject(newDeliver string) {
 func configsEqualSansDelivery(a, b ConsumerConfig) bool {
 	// These were copied in so can set Delivery here.
 	a.DeliverSubject, b.DeliverSubject = _EMPTY_, _EMPTY_
-	return a == b
+	return reflect.DeepEqual(a, b)
 }
 
 // Helper to send a reply to an ack.
@@ -1119,12 +1340,12 @@ func (o *consumer) processAck(_ *subscription, c *client, subject, reply string,
 		o.processNextMsgReq(nil, c, subject, reply, msg[len(AckNext):])
 		c.pa.hdr = phdr
 		skipAckReply = true
-	case bytes.Equal(msg, AckNak):
-		o.processNak(sseq, dseq)
+	case bytes.HasPrefix(msg, AckNak):
+		o.processNak(sseq, dseq, dc, msg[len(AckNak):])
 	case bytes.Equal(msg, AckProgress):
 		o.progressUpdate(sseq)
-	case bytes.Equal(msg, AckTerm):
-		o.processTerm(sseq, dseq, dc)
+	case bytes.HasPrefix(msg, AckTerm):
+		o.processTerm(sseq, dseq, dc, string(bytes.TrimSpace(msg[len(AckTerm):])))
 	}
 
 	// Ack the ack if requested.
@@ -1256,8 +1477,29 @@ func (o *consumer) updateAcks(dseq, sseq uint64) {
 	}
 }
 
+// Parse the optional delay that can follow a NAK.
+// Anything we can not parse means no delay.
+func parseNakDelay(b []byte) time.Duration {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return 0
+	}
+	var opts ConsumerNakOptions
+	if err := json.Unmarshal(b, &opts); err != nil || len(opts.Delay) == 0 {
+		return 0
+	}
+	var ds string
+	if err := json.Unmarshal(opts.Delay, &ds); err == nil {
+		d, _ := time.ParseDuration(ds)
+		return d
+	}
+	var d time.Duration
+	json.Unmarshal(opts.Delay, &d)
+	return d
+}
+
 // Process a NAK.
-func (o *consumer) processNak(sseq, dseq uint64) {
+func (o *consumer) processNak(sseq, dseq, dc uint64, nak []byte) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 
@@ -1271,6 +1513,26 @@ func (o *consumer) processNak(sseq, dseq uint64) {
 			return
 		}
 	}
+
+	// If we have a delay we adjust the pending timestamp so it will expire after the delay.
+	// The timestamp is replicated so this survives a leader change.
+	if delay := parseNakDelay(nak); delay > 0 {
+		if p, ok := o.pending[sseq]; ok {
+			ttl := int64(o.cfg.AckWait)
+			if len(o.cfg.BackOff) > 0 {
+				ttl = o.backOff(sseq)
+			}
+			p.Timestamp = time.Now().UnixNano() - ttl + int64(delay)
+			o.updateDelivered(p.Sequence, sseq, dc, p.Timestamp)
+			o.removeFromRedeliverQueue(sseq)
+			// Make sure our pending timer fires in time for the delayed redelivery.
+			if due := o.ackWait(delay); o.ptmr == nil || time.Now().Add(due).Before(o.ptmrt) {
+				o.setPendingTimer(due)
+			}
+			return
+		}
+	}
+
 	// If already queued up also ignore.
 	if !o.onRedeliverQueue(sseq) {
 		o.addToRedeliverQueue(sseq)
@@ -1279,8 +1541,8 @@ func (o *consumer) processNak(sseq, dseq uint64) {
 	o.signalNewMessages()
 }
 
-// Process a TERM
-func (o *consumer) processTerm(sseq, dseq, dc uint64) {
+// Process a TERM, the reason is optional.
+func (o *consumer) processTerm(sseq, dseq, dc uint64, reason string) {
 	// Treat like an ack to suppress redelivery.
 	o.processAckMsg(sseq, dseq, dc, false)
 
@@ -1299,6 +1561,7 @@ func (o *consumer) processTerm(sseq, dseq, dc uint64) {
 		ConsumerSeq: dseq,
 		StreamSeq:   sseq,
 		Deliveries:  dc,
+		Reason:      reason,
 	}
 
 	j, err := json.Marshal(e)
@@ -1349,7 +1612,7 @@ func (o *consumer) applyState(state *ConsumerState) {
 
 	// Setup tracking timer if we have restored pending.
 	if len(o.pending) > 0 && o.ptmr == nil {
-		o.ptmr = time.AfterFunc(o.ackWait(0), o.checkPending)
+		o.setPendingTimer(o.ackWait(0))
 	}
 }
 
@@ -1626,30 +1889,43 @@ func (o *consumer) needAck(sseq uint64) bool {
 	return needAck
 }
 
+var (
+	errNextReqMaxBytes  = errors.New("max bytes needs to be positive")
+	errNextReqHeartbeat = errors.New("idle heartbeat value too large")
+)
+
 // Helper for the next message requests.
-func nextReqFromMsg(msg []byte) (time.Time, int, bool, error) {
+// Returns the expiration, batch size, max bytes, no wait and idle heartbeat.
+func nextReqFromMsg(msg []byte) (time.Time, int, int, bool, time.Duration, error) {
 	req := bytes.TrimSpace(msg)
 
 	switch {
 	case len(req) == 0:
-		return time.Time{}, 1, false, nil
+		return time.Time{}, 1, 0, false, 0, nil
 
 	case req[0] == '{':
 		var cr JSApiConsumerGetNextRequest
 		if err := json.Unmarshal(req, &cr); err != nil {
-			return time.Time{}, -1, false, err
+			return time.Time{}, -1, 0, false, 0, err
+		}
+		if cr.MaxBytes < 0 {
+			return time.Time{}, -1, 0, false, 0, errNextReqMaxBytes
+		}
+		// We want to send at least one heartbeat before the request expires.
+		if cr.Heartbeat < 0 || (cr.Expires > 0 && cr.Heartbeat*2 > cr.Expires) {
+			return time.Time{}, -1, 0, false, 0, errNextReqHeartbeat
 		}
 		if cr.Expires == time.Duration(0) {
-			return time.Time{}, cr.Batch, cr.NoWait, nil
+			return time.Time{}, cr.Batch, cr.MaxBytes, cr.NoWait, cr.Heartbeat, nil
 		}
-		return time.Now().Add(cr.Expires), cr.Batch, cr.NoWait, nil
+		return time.Now().Add(cr.Expires), cr.Batch, cr.MaxBytes, cr.NoWait, cr.Heartbeat, nil
 	default:
 		if n, err := strconv.Atoi(string(req)); err == nil {
-			return time.Time{}, n, false, nil
+			return time.Time{}, n, 0, false, 0, nil
 		}
 	}
 
-	return time.Time{}, 1, false, nil
+	return time.Time{}, 1, 0, false, 0, nil
 }
 
 // Represents a request that is on the internal waiting queue
@@ -1657,8 +1933,32 @@ type waitingRequest struct {
 	client  *client
 	reply   string
 	n       int // For batching
+	mb      int // Max bytes, 0 means no limit
+	b       int // Bytes delivered
 	expires time.Time
 	noWait  bool
+	hb      time.Duration
+	hbt     time.Time // When the next idle heartbeat is due
+}
+
+// Accounts for a message of sz bytes that will be delivered to this request.
+// Returns false if the request has a byte limit and the message does not fit.
+func (wr *waitingRequest) fits(sz int) bool {
+	if wr.mb > 0 && wr.b+sz > wr.mb {
+		return false
+	}
+	wr.b += sz
+	return true
+}
+
+// Returns if the request has a byte limit that has been used up.
+func (wr *waitingRequest) maxBytesReached() bool {
+	return wr.mb > 0 && wr.b >= wr.mb
+}
+
+// Size of a message for max bytes accounting.
+func pullMsgSize(subj string, hdr, msg []byte) int {
+	return len(subj) + len(hdr) + len(msg)
 }
 
 // waiting queue for requests that are waiting for new messages to arrive.
@@ -1729,17 +2029,25 @@ func (wq *waitQueue) pop() *waitingRequest {
 	if wr != nil {
 		wr.n--
 		if wr.n <= 0 {
-			wq.reqs[wq.rp] = nil
-			wq.rp = (wq.rp + 1) % cap(wq.reqs)
-			// Check if we are empty.
-			if wq.rp == wq.wp {
-				wq.rp, wq.wp = -1, 0
-			}
+			wq.removeCurrent()
 		}
 	}
 	return wr
 }
 
+// removeCurrent will remove the next request regardless of its batch size.
+func (wq *waitQueue) removeCurrent() {
+	if wq == nil || wq.rp < 0 {
+		return
+	}
+	wq.reqs[wq.rp] = nil
+	wq.rp = (wq.rp + 1) % cap(wq.reqs)
+	// Check if we are empty.
+	if wq.rp == wq.wp {
+		wq.rp, wq.wp = -1, 0
+	}
+}
+
 // processNextMsgReq will process a request for the next message available. A nil message payload means deliver
 // a single message. If the payload is a formal request or a number parseable with Atoi(), then we will send a
 // batch of messages without requiring another request to this endpoint, or an ACK.
@@ -1755,8 +2063,7 @@ func (o *consumer) processNextMsgReq(_ *subscription, c *client, _, reply string
 	}
 
 	sendErr := func(status int, description string) {
-		hdr := []byte(fmt.Sprintf("NATS/1.0 %d %s\r\n\r\n", status, description))
-		o.outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0, nil})
+		o.sendStatus(reply, status, description)
 	}
 
 	if o.isPushMode() {
@@ -1773,7 +2080,7 @@ func (o *consumer) processNextMsgReq(_ *subscription, c *client, _, reply string
 	}
 
 	// Check payload here to see if they sent in batch size or a formal request.
-	expires, batchSize, noWait, err := nextReqFromMsg(msg)
+	expires, batchSize, maxBytes, noWait, hb, err := nextReqFromMsg(msg)
 	if err != nil {
 		sendErr(400, fmt.Sprintf("Bad Request - %v", err))
 		return
@@ -1784,12 +2091,34 @@ func (o *consumer) processNextMsgReq(_ *subscription, c *client, _, reply string
 		return
 	}
 
+	// Check the limits set on the consumer for pull requests.
+	if max := o.cfg.MaxRequestBatch; max > 0 && batchSize > max {
+		sendErr(409, fmt.Sprintf("Exceeded MaxRequestBatch of %d", max))
+		return
+	}
+	if max := o.cfg.MaxRequestExpires; max > 0 && !noWait {
+		if expires.IsZero() {
+			expires = time.Now().Add(max)
+		} else if expires.After(time.Now().Add(max)) {
+			sendErr(409, fmt.Sprintf("Exceeded MaxRequestExpires of %v", max))
+			return
+		}
+	}
+	if max := o.cfg.MaxRequestMaxBytes; max > 0 {
+		if maxBytes == 0 {
+			maxBytes = max
+		} else if maxBytes > max {
+			sendErr(409, fmt.Sprintf("Exceeded MaxRequestMaxBytes of %d", max))
+			return
+		}
+	}
+
 	// In case we have to queue up this request.
-	wr := waitingRequest{client: c, reply: reply, n: batchSize, noWait: noWait, expires: expires}
+	wr := waitingRequest{client: c, reply: reply, n: batchSize, mb: maxBytes, noWait: noWait, expires: expires, hb: hb}
 
 	// If we are in replay mode, defer to processReplay for delivery.
 	if o.replay {
-		o.waiting.add(&wr)
+		o.addWaiting(&wr)
 		o.signalNewMessages()
 		return
 	}
@@ -1798,9 +2127,18 @@ func (o *consumer) processNextMsgReq(_ *subscription, c *client, _, reply string
 		for i, batchSize := 0, wr.n; i < batchSize; i++ {
 			// See if we have more messages available.
 			if subj, hdr, msg, seq, dc, ts, err := o.getNextMsg(); err == nil {
+				// If this would put us over our max bytes we are done.
+				if !wr.fits(pullMsgSize(subj, hdr, msg)) {
+					o.returnNextMsg(seq, dc)
+					sendErr(409, "Exceeded MaxBytes")
+					return
+				}
 				o.deliverMsg(reply, subj, hdr, msg, seq, dc, ts)
 				// Need to discount this from the total n for the request.
-				wr.n--
+				if wr.n--; wr.n > 0 && wr.maxBytesReached() {
+					sendErr(409, "Exceeded MaxBytes")
+					return
+				}
 			} else {
 				if wr.noWait {
 					switch err {
@@ -1810,7 +2148,7 @@ func (o *consumer) processNextMsgReq(_ *subscription, c *client, _, reply string
 						sendErr(404, "No Messages")
 					}
 				} else {
-					o.waiting.add(wr)
+					o.addWaiting(wr)
 				}
 				return
 			}
@@ -1840,6 +2178,105 @@ func (o *consumer) processNextMsgReq(_ *subscription, c *client, _, reply string
 	}
 }
 
+// Send a status only message, e.g. 409 or 404, to a pull request.
+// Lock should be held.
+func (o *consumer) sendStatus(reply string, status int, description string) {
+	hdr := []byte(fmt.Sprintf("NATS/1.0 %d %s\r\n\r\n", status, description))
+	o.outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0, nil})
+}
+
+// Queue up a pull request to wait for messages.
+// Lock should be held.
+func (o *consumer) addWaiting(wr *waitingRequest) {
+	if err := o.waiting.add(wr); err != nil {
+		return
+	}
+	if wr.hb > 0 {
+		wr.hbt = time.Now().Add(wr.hb)
+		o.setWaitingTimer(wr.hbt)
+	}
+	if !wr.expires.IsZero() {
+		o.setWaitingTimer(wr.expires)
+	}
+}
+
+// Make sure our timer for waiting requests fires by t.
+// Lock should be held.
+func (o *consumer) setWaitingTimer(t time.Time) {
+	if o.wtmr != nil && !o.wtmrt.IsZero() && !t.Before(o.wtmrt) {
+		return
+	}
+	o.wtmrt = t
+	if o.wtmr == nil {
+		o.wtmr = time.AfterFunc(time.Until(t), o.processWaiting)
+	} else {
+		o.wtmr.Reset(time.Until(t))
+	}
+}
+
+// Expires waiting pull requests and sends idle heartbeats to those that asked for them.
+// Heartbeats let clients tell no messages apart from no server.
+func (o *consumer) processWaiting() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.wtmrt = time.Time{}
+	if o.mset == nil || o.waiting == nil || !o.isLeader() {
+		return
+	}
+	o.expireWaiting()
+
+	const hdr = "NATS/1.0 100 Idle Heartbeat\r\n\r\n"
+	wq, now := o.waiting, time.Now()
+	var next time.Time
+	for i, n := wq.rp, wq.len(); n > 0; i, n = (i+1)%cap(wq.reqs), n-1 {
+		wr := wq.reqs[i]
+		if wr == nil {
+			continue
+		}
+		if !wr.expires.IsZero() {
+			if now.After(wr.expires) {
+				continue
+			}
+			if next.IsZero() || wr.expires.Before(next) {
+				next = wr.expires
+			}
+		}
+		if wr.hb == 0 {
+			continue
+		}
+		if !now.Before(wr.hbt) {
+			o.outq.send(&jsPubMsg{wr.reply, _EMPTY_, _EMPTY_, []byte(hdr), nil, nil, 0, nil})
+			wr.hbt = now.Add(wr.hb)
+		}
+		if next.IsZero() || wr.hbt.Before(next) {
+			next = wr.hbt
+		}
+	}
+	if !next.IsZero() {
+		o.setWaitingTimer(next)
+	}
+}
+
+// Return a message from getNextMsg that we could not deliver,
+// so that it will be the next one returned.
+// Lock should be held.
+func (o *consumer) returnNextMsg(seq, dc uint64) {
+	if dc == 1 {
+		o.sseq = seq
+		return
+	}
+	// Undo the delivery count and put back in front of the redelivery queue.
+	if o.rdc[seq]--; o.rdc[seq] == 0 {
+		delete(o.rdc, seq)
+	}
+	o.rdq = append([]uint64{seq}, o.rdq...)
+	if o.rdqi == nil {
+		o.rdqi = make(map[uint64]struct{})
+	}
+	o.rdqi[seq] = struct{}{}
+}
+
 // Increase the delivery count for this message.
 // ONLY used on redelivery semantics.
 // Lock should be held.
@@ -1873,19 +2310,32 @@ func (o *consumer) notifyDeliveryExceeded(sseq, dc uint64) {
 	o.sendAdvisory(o.deliveryExcEventT, j)
 }
 
+// Returns all of the filter subjects, if any.
+func (cfg *ConsumerConfig) filterSubjects() []string {
+	if cfg.FilterSubject != _EMPTY_ {
+		return []string{cfg.FilterSubject}
+	}
+	return cfg.FilterSubjects
+}
+
+// Returns if we have any filter subjects.
+// Lock should be held.
+func (o *consumer) isFiltered() bool {
+	return o.cfg.FilterSubject != _EMPTY_ || len(o.cfg.FilterSubjects) > 0
+}
+
 // Check to see if the candidate subject matches a filter if its present.
 // Lock should be held.
 func (o *consumer) isFilteredMatch(subj string) bool {
+	// If we are here we have a wildcard or multiple filter subjects.
+	if o.filters != nil {
+		return len(o.filters.Match(subj).psubs) > 0
+	}
 	// No filter is automatic match.
 	if o.cfg.FilterSubject == _EMPTY_ {
 		return true
 	}
-	if !o.filterWC {
-		return subj == o.cfg.FilterSubject
-	}
-	// If we are here we have a wildcard filter subject.
-	// TODO(dlc) at speed might be better to just do a sublist with L2 and/or possibly L1.
-	return subjectIsSubsetMatch(subj, o.cfg.FilterSubject)
+	return subj == o.cfg.FilterSubject
 }
 
 var (
@@ -1925,7 +2375,7 @@ func (o *consumer) getNextMsg() (subj string, hdr, msg []byte, seq uint64, dc ui
 		if err == nil {
 			if dc == 1 { // First delivery.
 				o.sseq++
-				if o.cfg.FilterSubject != _EMPTY_ && !o.isFilteredMatch(subj) {
+				if !o.isFilteredMatch(subj) {
 					o.updateSkipped()
 					continue
 				}
@@ -1947,10 +2397,12 @@ func (o *consumer) getNextMsg() (subj string, hdr, msg []byte, seq uint64, dc ui
 // Lock should be held.
 func (o *consumer) forceExpireFirstWaiting() *waitingRequest {
 	// FIXME(dlc) - Should we do advisory here as well?
-	wr := o.waiting.pop()
+	wr := o.waiting.peek()
 	if wr == nil {
 		return wr
 	}
+	// Remove the whole request, not just one of its batch.
+	o.waiting.removeCurrent()
 	// If we are expiring this and we think there is still interest, alert.
 	if rr := o.acc.sl.Match(wr.reply); len(rr.psubs)+len(rr.qsubs) > 0 && o.mset != nil {
 		// We still appear to have interest, so send alert as courtesy.
@@ -2037,6 +2489,7 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 			err         error
 			ts          int64
 			delay       time.Duration
+			endReq      string
 		)
 
 		o.mu.Lock()
@@ -2074,7 +2527,23 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 			}
 		}
 
-		if wr := o.waiting.pop(); wr != nil {
+		if wr := o.waiting.peek(); wr != nil {
+			// If this would put the request over its max bytes we end it and let the next one have the message.
+			if !wr.fits(pullMsgSize(subj, hdr, msg)) {
+				o.returnNextMsg(seq, dc)
+				o.waiting.removeCurrent()
+				o.sendStatus(wr.reply, 409, "Exceeded MaxBytes")
+				o.mu.Unlock()
+				continue
+			}
+			// If this uses up the max bytes, this is the last message for the request.
+			if wr.n > 1 && wr.maxBytesReached() {
+				wr.n, endReq = 1, wr.reply
+			}
+			if wr.hb > 0 {
+				wr.hbt = time.Now().Add(wr.hb)
+			}
+			o.waiting.pop()
 			dsubj = wr.reply
 		} else {
 			dsubj = o.dsubj
@@ -2115,6 +2584,11 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 		// Do actual delivery.
 		o.deliverMsg(dsubj, subj, hdr, msg, seq, dc, ts)
 
+		// Let the client know we ended the request early.
+		if endReq != _EMPTY_ {
+			o.sendStatus(endReq, 409, "Exceeded MaxBytes")
+		}
+
 		// Reset our idle heartbeat timer if set.
 		if hb != nil {
 			hb.Reset(hbd)
@@ -2129,6 +2603,18 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 			o.replay = false
 		}
 
+		// Check if our idle heartbeat was updated.
+		if o.cfg.Heartbeat != hbd {
+			if hb != nil {
+				hb.Stop()
+			}
+			if hbd, hb = o.hbTimer(); hb != nil {
+				hbc = hb.C
+			} else {
+				hbc = nil
+			}
+		}
+
 		// We will wait here for new messages to arrive.
 		mch, outq, odsubj, sseq, dseq := o.mch, o.outq, o.cfg.DeliverSubject, o.sseq-1, o.dseq-1
 		o.mu.Unlock()
@@ -2214,6 +2700,11 @@ func (o *consumer) deliverMsg(dsubj, subj string, hdr, msg []byte, seq, dc uint6
 		o.sendFlowControl()
 	}
 
+	// Store our delivery time when tracking pending, so a new leader or a
+	// restart will honor the ack wait or backoff for this delivery.
+	if p := o.pending[seq]; p != nil {
+		ts = p.Timestamp
+	}
 	// FIXME(dlc) - Capture errors?
 	o.updateDelivered(dseq, seq, dc, ts)
 }
@@ -2295,6 +2786,17 @@ func (o *consumer) sendFlowControl() {
 	o.outq.send(&jsPubMsg{subj, _EMPTY_, rply, hdr, nil, nil, 0, nil})
 }
 
+// Start or reset our pending timer to fire after d.
+// Lock should be held.
+func (o *consumer) setPendingTimer(d time.Duration) {
+	o.ptmrt = time.Now().Add(d)
+	if o.ptmr == nil {
+		o.ptmr = time.AfterFunc(d, o.checkPending)
+	} else {
+		o.ptmr.Reset(d)
+	}
+}
+
 // Tracks our outstanding pending acks. Only applicable to AckExplicit mode.
 // Lock should be held.
 func (o *consumer) trackPending(sseq, dseq uint64) {
@@ -2302,7 +2804,7 @@ func (o *consumer) trackPending(sseq, dseq uint64) {
 		o.pending = make(map[uint64]*Pending)
 	}
 	if o.ptmr == nil {
-		o.ptmr = time.AfterFunc(o.ackWait(0), o.checkPending)
+		o.setPendingTimer(o.ackWait(0))
 	}
 	if p, ok := o.pending[sseq]; ok {
 		p.Timestamp = time.Now().UnixNano()
@@ -2405,6 +2907,17 @@ func (o *consumer) removeFromRedeliverQueue(seq uint64) bool {
 	return false
 }
 
+// Returns how long to wait for an ack of sseq based on our backoff schedule.
+// The Nth redelivery waits BackOff[N], with the last value used for any after that.
+// Lock should be held.
+func (o *consumer) backOff(sseq uint64) int64 {
+	i := o.rdc[sseq]
+	if l := uint64(len(o.cfg.BackOff)); i >= l {
+		i = l - 1
+	}
+	return int64(o.cfg.BackOff[i])
+}
+
 // Checks the pending messages.
 func (o *consumer) checkPending() {
 	o.mu.Lock()
@@ -2422,6 +2935,9 @@ func (o *consumer) checkPending() {
 	// We may want to unlock here or warn if list is big.
 	var expired []uint64
 	for seq, p := range o.pending {
+		if len(o.cfg.BackOff) > 0 {
+			ttl = o.backOff(seq)
+		}
 		elapsed := now - p.Timestamp
 		if elapsed >= ttl {
 			if !o.onRedeliverQueue(seq) {
@@ -2449,7 +2965,7 @@ func (o *consumer) checkPending() {
 	}
 
 	if len(o.pending) > 0 {
-		o.ptmr.Reset(o.ackWait(time.Duration(next)))
+		o.setPendingTimer(o.ackWait(time.Duration(next)))
 	} else {
 		o.ptmr.Stop()
 		o.ptmr = nil
@@ -2566,7 +3082,7 @@ func (o *consumer) selectStartingSeqNo() {
 		} else if o.cfg.DeliverPolicy == DeliverLast {
 			o.sseq = stats.LastSeq
 			// If we are partitioned here we may need to walk backwards.
-			if o.cfg.FilterSubject != _EMPTY_ {
+			if o.isFiltered() {
 				o.selectSubjectLast()
 			}
 		} else if o.cfg.OptStartTime != nil {
@@ -2744,6 +3260,7 @@ func (o *consumer) stopWithFlags(dflag, doSignal, advisory bool) error {
 	sysc := o.sysc
 	o.sysc = nil
 	stopAndClearTimer(&o.ptmr)
+	stopAndClearTimer(&o.wtmr)
 	stopAndClearTimer(&o.dtmr)
 	stopAndClearTimer(&o.gwdtmr)
 	delivery := o.cfg.DeliverSubject
@@ -2892,7 +3409,7 @@ func (o *consumer) setInitialPending() {
 		return
 	}
 	// notFiltered means we want all messages.
-	notFiltered := o.cfg.FilterSubject == _EMPTY_
+	notFiltered := !o.isFiltered()
 	if !notFiltered {
 		// Check to see if we directly match the configured stream.
 		// Many clients will always send a filtered subject.
@@ -160,6 +160,7 @@ type ServerInfo struct {
 	Version   string    `json:"ver"`
 	Seq       uint64    `json:"seq"`
 	JetStream bool      `json:"jetstream"`
+	Tags      []string  `json:"tags,omitempty"`
 	Time      time.Time `json:"time"`
 }
 
@@ -268,6 +269,7 @@ RESET:
 	servername := s.info.Name
 	seqp := &s.sys.seq
 	js := s.info.JetStream
+	tags := s.getOpts().Tags
 	cluster := s.info.Cluster
 	if s.gateway.enabled {
 		cluster = s.getGatewayName()
@@ -297,6 +299,7 @@ RESET:
 				pm.si.Version = VERSION
 				pm.si.Time = time.Now().UTC()
 				pm.si.JetStream = js
+				pm.si.Tags = tags
 			}
 			var b []byte
 			if pm.msg != nil {
@@ -912,7 +915,7 @@ func (s *Server) remoteServerShutdown(sub *subscription, _ *client, subject, rep
 	}
 	// Additional processing here.
 	node := string(getHash(si.Name))
-	s.nodeToInfo.Store(node, nodeInfo{si.Name, si.Cluster, si.ID, true})
+	s.nodeToInfo.Store(node, nodeInfo{si.Name, si.Cluster, si.ID, si.Tags, true})
 }
 
 // remoteServerUpdate listens for statsz updates from other servers.
@@ -930,7 +933,7 @@ func (s *Server) remoteServerUpdate(sub *subscription, _ *client, subject, reply
 		s.sendStatsz(fmt.Sprintf(serverStatsSubj, s.info.ID))
 		s.mu.Unlock()
 	}
-	s.nodeToInfo.Store(node, nodeInfo{si.Name, si.Cluster, si.ID, false})
+	s.nodeToInfo.Store(node, nodeInfo{si.Name, si.Cluster, si.ID, si.Tags, false})
 }
 
 // updateRemoteServer is called when we have an update from a remote server.
@@ -961,7 +964,7 @@ func (s *Server) processNewServer(ms *ServerInfo) {
 	s.ensureGWsInterestOnlyForLeafNodes()
 	// Add to our nodeToName
 	node := string(getHash(ms.Name))
-	s.nodeToInfo.Store(node, nodeInfo{ms.Name, ms.Cluster, ms.ID, false})
+	s.nodeToInfo.Store(node, nodeInfo{ms.Name, ms.Cluster, ms.ID, ms.Tags, false})
 }
 
 // If GW is enabled on this server and there are any leaf node connections,
@@ -16,6 +16,9 @@ package server
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -36,6 +39,7 @@ import (
 
 	"github.com/klauspost/compress/s2"
 	"github.com/minio/highwayhash"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 type FileStoreConfig struct {
@@ -49,8 +53,99 @@ type FileStoreConfig struct {
 	SyncInterval time.Duration
 	// AsyncFlush allows async flush to batch write operations.
 	AsyncFlush bool
+	// Cipher is the cipher to use when encrypting new stores.
+	Cipher StoreCipher
+	// Archive is where message blocks are moved once they are no longer being written to
+	// and their last message is older than ArchiveAge. They are read back on demand.
+	Archive BlockArchive
+	// ArchiveAge is how old the last message in a block needs to be before it is archived.
+	ArchiveAge time.Duration
+	// Used to log errors we can not return, optional.
+	srv *Server
+}
+
+// BlockArchive is a secondary location for message blocks that are no longer being written to.
+// Block names are only unique within a store, so each store needs its own archive.
+type BlockArchive interface {
+	// Put will store the contents of r under name, replacing anything already stored.
+	Put(name string, r io.Reader) error
+	// Get returns a reader for the contents stored under name.
+	Get(name string) (io.ReadCloser, error)
+	// Remove will remove name from the archive.
+	Remove(name string) error
+}
+
+// NewDirBlockArchive returns a BlockArchive that keeps message blocks in a local directory,
+// usually on a different mount than the store itself.
+func NewDirBlockArchive(dir string) BlockArchive {
+	return &dirBlockArchive{dir: dir}
+}
+
+type dirBlockArchive struct {
+	dir string
+}
+
+func (a *dirBlockArchive) Put(name string, r io.Reader) error {
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so we never leave a partial block behind.
+	fn := path.Join(a.dir, name)
+	tmp := fn + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (a *dirBlockArchive) Get(name string) (io.ReadCloser, error) {
+	return os.Open(path.Join(a.dir, name))
+}
+
+func (a *dirBlockArchive) Remove(name string) error {
+	if err := os.Remove(path.Join(a.dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// StoreCipher is the cipher used for encrypting stores at rest.
+type StoreCipher int
+
+const (
+	// ChaCha is ChaCha20-Poly1305.
+	ChaCha StoreCipher = iota
+	// AES is AES-GCM.
+	AES
+)
+
+func (cipher StoreCipher) String() string {
+	switch cipher {
+	case ChaCha:
+		return "ChaCha20-Poly1305"
+	case AES:
+		return "AES-GCM"
+	default:
+		return "Unknown StoreCipher"
+	}
 }
 
+// Used to derive the key encryption keys for a given context.
+type keyGen func(context []byte) ([]byte, error)
+
 // FileStreamInfo allows us to remember created time.
 type FileStreamInfo struct {
 	Created time.Time
@@ -70,7 +165,10 @@ type fileStore struct {
 	ld       *LostStreamData
 	scb      StorageUpdateHandler
 	ageChk   *time.Timer
+	ttls     msgTTLIndex
+	psim     map[string]*psi
 	syncTmr  *time.Timer
+	archTmr  *time.Timer
 	cfg      FileStreamInfo
 	fcfg     FileStoreConfig
 	lmb      *msgBlock
@@ -78,12 +176,27 @@ type fileStore struct {
 	hh       hash.Hash64
 	qch      chan struct{}
 	cfs      []*consumerFileStore
+	prf      keyGen
+	aek      cipher.AEAD
+	seed     []byte
 	closed   bool
 	expiring bool
 	fip      bool
 	sips     int
 }
 
+// Per subject information across all of our message blocks.
+// Used to enforce per subject limits without scanning the blocks.
+type psi struct {
+	total uint64
+	first uint64
+	last  uint64
+	// The first message was removed, first is where to start looking for the new one.
+	firstNeedsUpdate bool
+	// The last message was removed, last is where to start looking backwards for the new one.
+	lastNeedsUpdate bool
+}
+
 // Represents a message store block and its data.
 type msgBlock struct {
 	// Here for 32bit systems and atomic.
@@ -95,6 +208,9 @@ type msgBlock struct {
 	mfd     *os.File
 	ifn     string
 	ifd     *os.File
+	kfn     string
+	afn     string
+	arch    bool
 	liwsz   int64
 	index   uint64
 	bytes   uint64
@@ -105,6 +221,9 @@ type msgBlock struct {
 	lrts    int64
 	llseq   uint64
 	hh      hash.Hash64
+	aek     cipher.AEAD
+	cmp     StoreCompression
+	rbytes  uint64
 	cache   *cache
 	cloads  uint64
 	cexp    time.Duration
@@ -112,7 +231,10 @@ type msgBlock struct {
 	werr    error
 	loading bool
 	flusher bool
+	closed  bool
 	dmap    map[uint64]struct{}
+	ttls    uint64
+	fss     map[string]*SimpleState
 	fch     chan struct{}
 	qch     chan struct{}
 	lchk    [8]byte
@@ -161,6 +283,16 @@ const (
 	blkScan = "%d.blk"
 	// used to scan index file names.
 	indexScan = "%d.idx"
+	// used to load per block encryption key files.
+	keyScan = "%d.key"
+	// used when rewriting a message block, e.g. when compressing.
+	tmpScan = "%d.tmp"
+	// used for the new key file when rewriting an encrypted message block.
+	keyTmpScan = "%d.key.tmp"
+	// used to mark message blocks that have been moved to the archive.
+	archScan = "%d.arc"
+	// Index of per message TTLs written on a clean shutdown.
+	ttlIndexFile = "ttls.idx"
 	// This is where we keep state on consumers.
 	consumerDir = "obs"
 	// Index file for a consumer.
@@ -179,9 +311,14 @@ const (
 	coalesceMinimum = 16 * 1024
 	// maxFlushWait is maximum we will wait to gather messages to flush.
 	maxFlushWait = 8 * time.Millisecond
+	// default age of the last message in a block before we archive it.
+	defaultArchiveAge = 7 * 24 * time.Hour
+	// maximum time between checks for blocks to archive.
+	maxArchiveCheckInterval = time.Minute
 	// Metafiles for streams and consumers.
 	JetStreamMetaFile    = "meta.inf"
 	JetStreamMetaFileSum = "meta.sum"
+	JetStreamMetaFileKey = "meta.key"
 
 	// Default stream block size.
 	defaultStreamBlockSize = 16 * 1024 * 1024 // 16MB
@@ -196,10 +333,10 @@ const (
 )
 
 func newFileStore(fcfg FileStoreConfig, cfg StreamConfig) (*fileStore, error) {
-	return newFileStoreWithCreated(fcfg, cfg, time.Now().UTC())
+	return newFileStoreWithCreated(fcfg, cfg, time.Now().UTC(), nil)
 }
 
-func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created time.Time) (*fileStore, error) {
+func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created time.Time, prf keyGen) (*fileStore, error) {
 	if cfg.Name == "" {
 		return nil, fmt.Errorf("name required")
 	}
@@ -219,6 +356,9 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	if fcfg.SyncInterval == 0 {
 		fcfg.SyncInterval = defaultSyncInterval
 	}
+	if fcfg.Archive != nil && fcfg.ArchiveAge == 0 {
+		fcfg.ArchiveAge = defaultArchiveAge
+	}
 
 	// Check the directory
 	if stat, err := os.Stat(fcfg.StoreDir); os.IsNotExist(err) {
@@ -237,6 +377,7 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	fs := &fileStore{
 		fcfg: fcfg,
 		cfg:  FileStreamInfo{Created: created, StreamConfig: cfg},
+		prf:  prf,
 		qch:  make(chan struct{}),
 	}
 
@@ -260,14 +401,20 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 		return nil, fmt.Errorf("could not create hash: %v", err)
 	}
 
+	// Setup our encryption keys if needed. Existing plaintext state will be converted.
+	meta := path.Join(fcfg.StoreDir, JetStreamMetaFile)
+	converted, err := fs.setupEncryption()
+	if err != nil {
+		return nil, err
+	}
+
 	// Recover our state.
 	if err := fs.recoverMsgs(); err != nil {
 		return nil, err
 	}
 
-	// Write our meta data iff does not exist.
-	meta := path.Join(fcfg.StoreDir, JetStreamMetaFile)
-	if _, err := os.Stat(meta); err != nil && os.IsNotExist(err) {
+	// Write our meta data iff does not exist or we just started encrypting.
+	if _, err := os.Stat(meta); converted || (err != nil && os.IsNotExist(err)) {
 		if err := fs.writeStreamMeta(); err != nil {
 			return nil, err
 		}
@@ -275,6 +422,10 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 
 	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
 
+	if fs.fcfg.Archive != nil {
+		fs.archTmr = time.AfterFunc(fs.archiveCheckInterval(), fs.archiveMsgBlocks)
+	}
+
 	return fs, nil
 }
 
@@ -302,17 +453,22 @@ func (fs *fileStore) UpdateConfig(cfg *StreamConfig) error {
 	// Limits checks and enforcement.
 	fs.enforceMsgLimit()
 	fs.enforceBytesLimit()
+	// Check if we need to apply a new or lower per subject limit.
+	if new_cfg.MaxMsgsPer > 0 && (old_cfg.MaxMsgsPer <= 0 || new_cfg.MaxMsgsPer < old_cfg.MaxMsgsPer) {
+		fs.enforcePerSubjectLimits()
+	}
 	// Do age timers.
 	if fs.ageChk == nil && fs.cfg.MaxAge != 0 {
 		fs.startAgeChk()
 	}
-	if fs.ageChk != nil && fs.cfg.MaxAge == 0 {
+	if fs.ageChk != nil && ((fs.cfg.MaxAge == 0 && fs.ttls.Len() == 0) || fs.cfg.Sealed) {
 		fs.ageChk.Stop()
 		fs.ageChk = nil
 	}
+	hasTTLs := fs.ttls.Len() > 0
 	fs.mu.Unlock()
 
-	if cfg.MaxAge != 0 {
+	if cfg.MaxAge != 0 || hasTTLs {
 		fs.expireMsgs()
 	}
 	return nil
@@ -354,17 +510,301 @@ func (fs *fileStore) writeStreamMeta() error {
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(meta, b, 0644); err != nil {
+	// Encrypt if needed.
+	if fs.aek != nil {
+		if b, err = sealWithNonce(fs.aek, b); err != nil {
+			return err
+		}
+	}
+	// Replace any existing meta in place, we may be converting it.
+	if err := writeFileAtomic(meta, b); err != nil {
 		return err
 	}
 	fs.hh.Reset()
 	fs.hh.Write(b)
 	checksum := hex.EncodeToString(fs.hh.Sum(nil))
 	sum := path.Join(fs.fcfg.StoreDir, JetStreamMetaFileSum)
-	if err := ioutil.WriteFile(sum, []byte(checksum), 0644); err != nil {
+	return writeFileAtomic(sum, []byte(checksum))
+}
+
+// Size of the seeds used for our encryption keys.
+const seedSize = 32
+
+// Setup our encryption keys if we have a key generator. Streams that were written in the
+// clear will be converted as they are recovered. Returns true if we are converting, which
+// means our meta file needs to be rewritten. Our key file is written first, so if we stopped
+// before our meta file was rewritten it is still in the clear and we will convert it again.
+// Lock should be held.
+func (fs *fileStore) setupEncryption() (bool, error) {
+	kfn := path.Join(fs.fcfg.StoreDir, JetStreamMetaFileKey)
+	ekey, err := ioutil.ReadFile(kfn)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if fs.prf == nil {
+		if err == nil {
+			return false, errNoEncryptionKey
+		}
+		return false, nil
+	}
+
+	var seed []byte
+	generated := err != nil
+	if !generated {
+		// Always use the cipher we were created with.
+		if fs.fcfg.Cipher, seed, err = decryptEncryptionKeys(fs.prf, fs.cfg.Name, ekey); err != nil {
+			return false, err
+		}
+	} else {
+		if seed, ekey, err = genEncryptionKeys(fs.prf, fs.fcfg.Cipher, fs.cfg.Name, seedSize); err != nil {
+			return false, err
+		}
+		if err := writeFileAtomic(kfn, ekey); err != nil {
+			return false, err
+		}
+	}
+	if fs.aek, err = genEncryptionKey(fs.fcfg.Cipher, seed); err != nil {
+		return false, err
+	}
+	fs.seed = seed
+
+	// If we have an existing meta file in the clear we are converting.
+	// Hold onto our original created time.
+	buf, err := ioutil.ReadFile(path.Join(fs.fcfg.StoreDir, JetStreamMetaFile))
+	if err != nil {
+		return false, nil
+	}
+	if !generated {
+		if _, err := openWithNonce(fs.aek, buf); err == nil || !json.Valid(buf) {
+			return false, nil
+		}
+	}
+	var cfg FileStreamInfo
+	if err := json.Unmarshal(buf, &cfg); err == nil && !cfg.Created.IsZero() {
+		fs.cfg.Created = cfg.Created
+	}
+	return true, nil
+}
+
+// Generate a random seed of size along with the contents of a key file, which holds the seed
+// sealed with a key encryption key derived from context. We record the cipher in the key file
+// so we can always recover regardless of configuration changes.
+func genEncryptionKeys(prf keyGen, sc StoreCipher, context string, size int) (seed, ekey []byte, err error) {
+	kek, err := genKeyEncryptionKey(prf, sc, context)
+	if err != nil {
+		return nil, nil, err
+	}
+	seed = make([]byte, size)
+	if _, err := crand.Read(seed); err != nil {
+		return nil, nil, err
+	}
+	ns := kek.NonceSize()
+	ekey = make([]byte, 1+ns, 1+ns+size+kek.Overhead())
+	ekey[0] = byte(sc)
+	nonce := ekey[1:]
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return seed, kek.Seal(ekey, nonce, seed, nil), nil
+}
+
+// Recover the cipher and seed from the contents of a key file.
+func decryptEncryptionKeys(prf keyGen, context string, ekey []byte) (StoreCipher, []byte, error) {
+	if len(ekey) == 0 {
+		return 0, nil, errBadKeyFile
+	}
+	sc := StoreCipher(ekey[0])
+	kek, err := genKeyEncryptionKey(prf, sc, context)
+	if err != nil {
+		return 0, nil, err
+	}
+	ns := kek.NonceSize()
+	if len(ekey) < 1+ns {
+		return 0, nil, errBadKeyFile
+	}
+	seed, err := kek.Open(nil, ekey[1:1+ns], ekey[1+ns:], nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not decrypt key file: %v", err)
+	}
+	return sc, seed, nil
+}
+
+func genKeyEncryptionKey(prf keyGen, sc StoreCipher, context string) (cipher.AEAD, error) {
+	rb, err := prf([]byte(context))
+	if err != nil {
+		return nil, err
+	}
+	return genEncryptionKey(sc, rb)
+}
+
+// Create the authenticated cipher for sc with key.
+func genEncryptionKey(sc StoreCipher, key []byte) (cipher.AEAD, error) {
+	switch sc {
+	case ChaCha:
+		return chacha20poly1305.NewX(key)
+	case AES:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, errUnknownCipher
+	}
+}
+
+// Encrypted message blocks are written as a sequence of frames, each holding the records of
+// one write sealed with the block key. A frame is laid out as
+//
+//	length(4) nonce sealed_records length(4) end(8)
+//
+// where length is that of the records in the clear and end is their end offset in the clear.
+// The trailer is authenticated so frames can not be moved around, and lets us find the last
+// frame and the size of the block in the clear without reading all of it.
+const (
+	blkFrameHdrSize     = 4
+	blkFrameTrailerSize = 4 + 8
+)
+
+// Seal buf, which holds records in the clear at offset off within our block, as a frame.
+func sealBlockFrame(aek cipher.AEAD, buf []byte, off int64) ([]byte, error) {
+	var le = binary.LittleEndian
+	ns := aek.NonceSize()
+	frame := make([]byte, blkFrameHdrSize+ns, blkFrameHdrSize+ns+len(buf)+aek.Overhead()+blkFrameTrailerSize)
+	le.PutUint32(frame, uint32(len(buf)))
+	nonce := frame[blkFrameHdrSize:]
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	var trailer [blkFrameTrailerSize]byte
+	le.PutUint32(trailer[0:], uint32(len(buf)))
+	le.PutUint64(trailer[4:], uint64(off)+uint64(len(buf)))
+	frame = aek.Seal(frame, nonce, buf, trailer[:])
+	return append(frame, trailer[:]...), nil
+}
+
+// Open the frames in buf, the first of which starts at offset off in the clear, and return
+// their records. If a frame is incomplete or does not authenticate, e.g. we stopped while
+// writing it, we return the records before it along with errBadFrame.
+func openBlockFrames(aek cipher.AEAD, buf []byte, off int64) ([]byte, error) {
+	var le = binary.LittleEndian
+	ns, ov := aek.NonceSize(), aek.Overhead()
+	var rbuf []byte
+	for len(buf) > 0 {
+		if len(buf) < blkFrameHdrSize {
+			return rbuf, errBadFrame
+		}
+		rl := int(le.Uint32(buf))
+		fl := blkFrameHdrSize + ns + rl + ov + blkFrameTrailerSize
+		if len(buf) < fl {
+			return rbuf, errBadFrame
+		}
+		trailer := buf[fl-blkFrameTrailerSize : fl]
+		if int(le.Uint32(trailer)) != rl || le.Uint64(trailer[4:]) != uint64(off)+uint64(len(rbuf)+rl) {
+			return rbuf, errBadFrame
+		}
+		nbuf, err := aek.Open(rbuf, buf[blkFrameHdrSize:blkFrameHdrSize+ns], buf[blkFrameHdrSize+ns:fl-blkFrameTrailerSize], trailer)
+		if err != nil {
+			return rbuf, errBadFrame
+		}
+		rbuf, buf = nbuf, buf[fl:]
+	}
+	return rbuf, nil
+}
+
+// Read the trailer of the last frame in our encrypted block file f of size.
+// Returns the length of the records in that frame and the size of our block in the clear.
+func readLastFrameTrailer(f *os.File, size int64) (int64, int64, error) {
+	if size == 0 {
+		return 0, 0, nil
+	}
+	if size < blkFrameHdrSize+blkFrameTrailerSize {
+		return 0, 0, errBadFrame
+	}
+	var trailer [blkFrameTrailerSize]byte
+	if _, err := f.ReadAt(trailer[:], size-blkFrameTrailerSize); err != nil {
+		return 0, 0, err
+	}
+	var le = binary.LittleEndian
+	return int64(le.Uint32(trailer[:])), int64(le.Uint64(trailer[4:])), nil
+}
+
+// Read and open the last frame in our encrypted block file f of size.
+// Lock should be held.
+func (mb *msgBlock) readLastFrame(f *os.File, size int64) ([]byte, error) {
+	rl, end, err := readLastFrameTrailer(f, size)
+	if err != nil {
+		return nil, err
+	}
+	fl := blkFrameHdrSize + int64(mb.aek.NonceSize()) + rl + int64(mb.aek.Overhead()) + blkFrameTrailerSize
+	if fl > size || rl > end {
+		return nil, errBadFrame
+	}
+	frame := make([]byte, fl)
+	if _, err := f.ReadAt(frame, size-fl); err != nil {
+		return nil, err
+	}
+	return openBlockFrames(mb.aek, frame, end-rl)
+}
+
+// Replace the records at offset off in the clear with nbytes. The frame holding them is
+// sealed again with a new nonce and written in place, since its size does not change.
+// Lock should be held.
+func (mb *msgBlock) rewriteFrameAt(nbytes []byte, off int64) error {
+	mfd, err := os.OpenFile(mb.mfn, os.O_RDWR, 0644)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer mfd.Close()
+	buf, err := ioutil.ReadAll(mfd)
+	if err != nil {
+		return err
+	}
+	var le = binary.LittleEndian
+	ns, ov := mb.aek.NonceSize(), mb.aek.Overhead()
+	for pos, loff := 0, int64(0); pos+blkFrameHdrSize <= len(buf); {
+		rl := int64(le.Uint32(buf[pos:]))
+		fl := blkFrameHdrSize + ns + int(rl) + ov + blkFrameTrailerSize
+		if pos+fl > len(buf) {
+			break
+		}
+		if off >= loff && off+int64(len(nbytes)) <= loff+rl {
+			rbuf, err := openBlockFrames(mb.aek, buf[pos:pos+fl], loff)
+			if err != nil {
+				return err
+			}
+			copy(rbuf[off-loff:], nbytes)
+			frame, err := sealBlockFrame(mb.aek, rbuf, loff)
+			if err != nil {
+				return err
+			}
+			if _, err = mfd.WriteAt(frame, int64(pos)); err == nil {
+				mfd.Sync()
+			}
+			return err
+		}
+		pos, loff = pos+fl, loff+rl
+	}
+	return errBadFrame
+}
+
+// Seal buf with a random nonce which is prepended to the result.
+func sealWithNonce(aek cipher.AEAD, buf []byte) ([]byte, error) {
+	ns := aek.NonceSize()
+	nonce := make([]byte, ns, ns+len(buf)+aek.Overhead())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aek.Seal(nonce, nonce, buf, nil), nil
+}
+
+// Open buf that was sealed with sealWithNonce.
+func openWithNonce(aek cipher.AEAD, buf []byte) ([]byte, error) {
+	ns := aek.NonceSize()
+	if len(buf) < ns {
+		return nil, errCorruptState
+	}
+	return aek.Open(nil, buf[:ns], buf[ns:], nil)
 }
 
 const msgHdrSize = 22
@@ -373,40 +813,75 @@ const checksumSize = 8
 // This is the max room needed for index header.
 const indexHdrSize = 7*binary.MaxVarintLen64 + hdrLen + checksumSize
 
-func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) *msgBlock {
+func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) (*msgBlock, error) {
 	mb := &msgBlock{fs: fs, index: index, cexp: fs.fcfg.CacheExpire}
 
 	mdir := path.Join(fs.fcfg.StoreDir, msgDir)
 	mb.mfn = path.Join(mdir, fi.Name())
 	mb.ifn = path.Join(mdir, fmt.Sprintf(indexScan, index))
+	mb.kfn = path.Join(mdir, fmt.Sprintf(keyScan, index))
+	mb.afn = path.Join(mdir, fmt.Sprintf(archScan, index))
 
 	if mb.hh == nil {
-		key := sha256.Sum256(fs.hashKeyForBlock(index))
-		mb.hh, _ = highwayhash.New64(key[:])
+		mb.hh, _ = fs.hashForBlock(index, true)
 	}
 
 	// Open up the message file, but we will try to recover from the index file.
 	// We will check that the last checksums match.
 	file, err := os.Open(mb.mfn)
 	if err != nil {
-		return nil
+		return nil, nil
 	}
 	defer file.Close()
 
+	// Load our encryption keys if needed. Blocks written in the clear will be converted.
+	if fs.aek != nil {
+		if err := mb.loadEncryptionKeys(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The size of our block file on disk, which may have changed if we were converted above.
+	rbytes := uint64(fi.Size())
+	if nfi, err := os.Stat(mb.mfn); err == nil {
+		rbytes = uint64(nfi.Size())
+	}
+
 	// Read our index file. Use this as source of truth if possible.
 	if err := mb.readIndexInfo(); err == nil {
 		// Quick sanity check here.
 		// Note this only checks that the message blk file is not newer then this file.
 		var lchk [8]byte
-		file.ReadAt(lchk[:], fi.Size()-8)
+		var hdr [compressedBlkHdrSize]byte
+		file.ReadAt(hdr[:], 0)
+		if mb.aek != nil {
+			// Our last checksum is inside of our last frame, which is all of a compressed block.
+			if buf, err := mb.readLastFrame(file, fi.Size()); err == nil {
+				if _, ok := compressedBlockType(buf); ok {
+					buf, err = mb.decompressIfNeeded(buf)
+				}
+				if err == nil && len(buf) >= checksumSize {
+					copy(lchk[:], buf[len(buf)-checksumSize:])
+				}
+			}
+		} else if _, ok := compressedBlockType(hdr[:]); ok {
+			// Our last checksum is inside of our compressed data.
+			if buf, err := mb.loadBlock(); err == nil && len(buf) >= checksumSize {
+				copy(lchk[:], buf[len(buf)-checksumSize:])
+			}
+		} else {
+			file.ReadAt(lchk[:], fi.Size()-8)
+		}
 		if bytes.Equal(lchk[:], mb.lchk[:]) {
+			mb.rbytes = rbytes
 			fs.blks = append(fs.blks, mb)
-			return mb
+			return mb, nil
 		}
 	}
 
 	// Close here since we need to rebuild state.
 	file.Close()
+	mb.rbytes = rbytes
 
 	// If we get data loss rebuilding the message block state record that with the fs itself.
 	if ld, _ := mb.rebuildState(); ld != nil {
@@ -416,63 +891,577 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) *msgBlock {
 	mb.writeIndexInfo()
 	fs.blks = append(fs.blks, mb)
 	fs.lmb = mb
-	return mb
+	return mb, nil
 }
 
-func (fs *fileStore) lostData() *LostStreamData {
-	fs.mu.RLock()
-	defer fs.mu.RUnlock()
-	if fs.ld == nil {
-		return nil
+// Recover a message block that was moved to the archive from its index.
+// If our index is not usable we need to bring the block back to rebuild our state.
+func (fs *fileStore) recoverArchivedMsgBlock(index uint64) (*msgBlock, error) {
+	if fs.fcfg.Archive == nil {
+		return nil, fmt.Errorf("message block %d is archived but no archive is configured", index)
 	}
-	nld := *fs.ld
-	return &nld
-}
+	mb := &msgBlock{fs: fs, index: index, cexp: fs.fcfg.CacheExpire, arch: true}
 
-func (fs *fileStore) rebuildState(ld *LostStreamData) {
-	if fs.ld != nil {
-		fs.ld.Msgs = append(fs.ld.Msgs, ld.Msgs...)
-		msgs := fs.ld.Msgs
-		sort.Slice(msgs, func(i, j int) bool { return msgs[i] < msgs[j] })
-		fs.ld.Bytes += ld.Bytes
-	} else {
-		fs.ld = ld
+	mdir := path.Join(fs.fcfg.StoreDir, msgDir)
+	mb.mfn = path.Join(mdir, fmt.Sprintf(blkScan, index))
+	mb.ifn = path.Join(mdir, fmt.Sprintf(indexScan, index))
+	mb.kfn = path.Join(mdir, fmt.Sprintf(keyScan, index))
+	mb.afn = path.Join(mdir, fmt.Sprintf(archScan, index))
+	mb.hh, _ = fs.hashForBlock(index, true)
+
+	// Load our encryption keys if needed. Blocks written in the clear will be converted.
+	if fs.aek != nil {
+		if err := mb.loadEncryptionKeys(); err != nil {
+			return nil, err
+		}
 	}
-	fs.state.Msgs, fs.state.Bytes = 0, 0
-	fs.state.FirstSeq, fs.state.LastSeq = 0, 0
 
-	for _, mb := range fs.blks {
-		mb.mu.RLock()
-		fs.state.Msgs += mb.msgs
-		fs.state.Bytes += mb.bytes
-		if fs.state.FirstSeq == 0 || mb.first.seq < fs.state.FirstSeq {
-			fs.state.FirstSeq = mb.first.seq
-			fs.state.FirstTime = time.Unix(0, mb.first.ts).UTC()
+	if err := mb.readIndexInfo(); err != nil {
+		mb.mu.Lock()
+		err = mb.unarchive()
+		mb.mu.Unlock()
+		if err != nil {
+			return nil, err
 		}
-		fs.state.LastSeq = mb.last.seq
-		fs.state.LastTime = time.Unix(0, mb.last.ts).UTC()
-		mb.mu.RUnlock()
+		if fi, err := os.Stat(mb.mfn); err == nil {
+			mb.rbytes = uint64(fi.Size())
+		}
+		if ld, _ := mb.rebuildState(); ld != nil {
+			fs.rebuildState(ld)
+		}
+		mb.writeIndexInfo()
 	}
+	fs.blks = append(fs.blks, mb)
+	return mb, nil
 }
 
-func (mb *msgBlock) rebuildState() (*LostStreamData, error) {
-	mb.mu.Lock()
-	defer mb.mu.Unlock()
-
-	startLastSeq := mb.last.seq
+// Load our encryption keys. If we do not have any this block was written
+// in the clear, so we will generate new keys and convert it.
+func (mb *msgBlock) loadEncryptionKeys() error {
+	// Check for a new key file left over from a block rewrite that did not complete.
+	// The block is renamed in place before its key file, so if the new block is still
+	// in its temporary file we keep our old keys, otherwise we need the new ones.
+	mdir := path.Dir(mb.kfn)
+	tkfn := path.Join(mdir, fmt.Sprintf(keyTmpScan, mb.index))
+	if _, err := os.Stat(tkfn); err == nil {
+		if _, err := os.Stat(path.Join(mdir, fmt.Sprintf(tmpScan, mb.index))); err == nil {
+			os.Remove(tkfn)
+		} else if err := os.Rename(tkfn, mb.kfn); err != nil {
+			return err
+		}
+	}
+	ekey, err := ioutil.ReadFile(mb.kfn)
+	if os.IsNotExist(err) {
+		return mb.convertToEncrypted()
+	}
+	if err != nil {
+		return err
+	}
+	sc, seed, err := decryptEncryptionKeys(mb.fs.prf, mb.encryptionContext(), ekey)
+	if err != nil {
+		return err
+	}
+	if sc != mb.fs.fcfg.Cipher || len(seed) != seedSize {
+		return errBadKeyFile
+	}
+	return mb.setEncryptionKeys(seed)
+}
 
-	// Clear state we need to rebuild.
-	mb.msgs, mb.bytes = 0, 0
-	mb.last.seq, mb.last.ts = 0, 0
-	firstNeedsSet := true
+// Generate new encryption keys and write out our key file.
+func (mb *msgBlock) genEncryptionKeys() error {
+	fs := mb.fs
+	seed, ekey, err := genEncryptionKeys(fs.prf, fs.fcfg.Cipher, mb.encryptionContext(), seedSize)
+	if err != nil {
+		return err
+	}
+	if err := mb.setEncryptionKeys(seed); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(mb.kfn, ekey, 0644)
+}
 
-	buf, err := ioutil.ReadFile(mb.mfn)
+func (mb *msgBlock) setEncryptionKeys(seed []byte) error {
+	aek, err := genEncryptionKey(mb.fs.fcfg.Cipher, seed)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	mb.aek = aek
+	return nil
+}
 
-	addToDmap := func(seq uint64) {
-		if seq == 0 {
+func (mb *msgBlock) encryptionContext() string {
+	return fmt.Sprintf("%s:%d", mb.fs.cfg.Name, mb.index)
+}
+
+// Convert a message block and its index that were written in the clear.
+func (mb *msgBlock) convertToEncrypted() error {
+	buf, err := mb.readBlockFile()
+	if err != nil {
+		return err
+	}
+	if buf, err = mb.decompressIfNeeded(buf); err != nil {
+		return err
+	}
+	// Read our index while still in the clear so we keep our delete map.
+	hasIndex := mb.readIndexInfo() == nil
+	// Our checksums are keyed with our secret now.
+	copy(mb.lchk[0:], rehashMsgBlock(buf, mb.hh))
+	// This will generate our encryption keys.
+	if err := mb.writeBlock(buf, mb.cmp); err != nil {
+		return err
+	}
+	if !hasIndex {
+		return nil
+	}
+	err = mb.writeIndexInfo()
+	mb.closeFDs()
+	return err
+}
+
+// Replace our message block file with buf, encrypting it with new keys if needed.
+// The block and its key file are written to temporary files and renamed in place, block
+// first, so a crash at any point leaves a block and key file that match. See loadEncryptionKeys.
+// Lock should be held.
+func (mb *msgBlock) replaceBlockFile(buf []byte) error {
+	fs := mb.fs
+	mdir := path.Dir(mb.mfn)
+
+	var seed, ekey []byte
+	if fs.aek != nil {
+		var err error
+		if seed, ekey, err = genEncryptionKeys(fs.prf, fs.fcfg.Cipher, mb.encryptionContext(), seedSize); err != nil {
+			return err
+		}
+		aek, err := genEncryptionKey(fs.fcfg.Cipher, seed)
+		if err != nil {
+			return err
+		}
+		if len(buf) > 0 {
+			if buf, err = sealBlockFrame(aek, buf, 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	tmp := path.Join(mdir, fmt.Sprintf(tmpScan, mb.index))
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	tkfn := path.Join(mdir, fmt.Sprintf(keyTmpScan, mb.index))
+	if ekey != nil {
+		if err := ioutil.WriteFile(tkfn, ekey, 0644); err != nil {
+			os.Remove(tkfn)
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, mb.mfn); err != nil {
+		os.Remove(tkfn)
+		os.Remove(tmp)
+		return err
+	}
+	mb.rbytes = uint64(len(buf))
+	// Our block is in place so from here on we need to use the new keys.
+	if ekey != nil {
+		if err := mb.setEncryptionKeys(seed); err != nil {
+			return err
+		}
+		if err := os.Rename(tkfn, mb.kfn); err != nil {
+			return err
+		}
+	}
+	// If we had our file open make sure we have the new one.
+	if mb.mfd != nil {
+		mb.mfd.Close()
+		mfd, err := os.OpenFile(mb.mfn, os.O_RDWR, 0644)
+		if err != nil {
+			mb.mfd = nil
+			return err
+		}
+		mb.mfd = mfd
+	}
+	return nil
+}
+
+// Recalculate the checksums for all records in buf with hh.
+// Will return the last checksum.
+func rehashMsgBlock(buf []byte, hh hash.Hash64) []byte {
+	var le = binary.LittleEndian
+	lchk := make([]byte, checksumSize)
+	for index, lbuf := uint32(0), uint32(len(buf)); index+msgHdrSize < lbuf; {
+		hdr := buf[index : index+msgHdrSize]
+		rl := le.Uint32(hdr[0:])
+		slen := le.Uint16(hdr[20:])
+		hasHeaders := rl&hbit != 0
+		rl &^= hbit
+		dlen := int(rl) - msgHdrSize
+		if dlen < checksumSize || int(slen) > dlen-checksumSize || index+rl > lbuf ||
+			(hasHeaders && int(slen)+4 > dlen-checksumSize) {
+			break
+		}
+		data := buf[index+msgHdrSize : index+rl]
+		hh.Reset()
+		hh.Write(hdr[4:20])
+		hh.Write(data[:slen])
+		if hasHeaders {
+			hh.Write(data[slen+4 : dlen-8])
+		} else {
+			hh.Write(data[slen : dlen-8])
+		}
+		lchk = hh.Sum(nil)
+		copy(data[dlen-8:], lchk)
+		index += rl
+	}
+	return lchk
+}
+
+// Compressed message blocks start with this magic followed by the compression used.
+// This can never be the start of a valid record since the record length would be
+// larger than any message block we allow.
+var compressedBlkMagic = []byte{0xff, 0xff, 0xff, 0xff}
+
+const compressedBlkHdrSize = 5
+
+// Check if buf holds a compressed message block and if so which compression was used.
+func compressedBlockType(buf []byte) (StoreCompression, bool) {
+	if len(buf) < compressedBlkHdrSize || !bytes.Equal(buf[:len(compressedBlkMagic)], compressedBlkMagic) {
+		return NoCompression, false
+	}
+	return StoreCompression(buf[len(compressedBlkMagic)]), true
+}
+
+// Decompress buf if it holds a compressed message block. Will also track our compression state.
+// Lock should be held.
+func (mb *msgBlock) decompressIfNeeded(buf []byte) ([]byte, error) {
+	cmp, ok := compressedBlockType(buf)
+	if !ok {
+		mb.cmp = NoCompression
+		return buf, nil
+	}
+	if cmp != S2Compression {
+		return nil, errUnknownCompress
+	}
+	rbuf, err := s2.Decode(nil, buf[compressedBlkHdrSize:])
+	if err != nil {
+		return nil, errCorruptState
+	}
+	mb.cmp = cmp
+	return rbuf, nil
+}
+
+// Read in our whole message block, decrypting and decompressing as needed.
+// Lock should be held.
+func (mb *msgBlock) loadBlock() ([]byte, error) {
+	buf, err := mb.readBlockFile()
+	if err != nil {
+		return nil, err
+	}
+	// Decrypt if needed. If our last frame is incomplete we return what we could open.
+	if mb.aek != nil {
+		if buf, err = openBlockFrames(mb.aek, buf, 0); err != nil {
+			return buf, err
+		}
+	}
+	return mb.decompressIfNeeded(buf)
+}
+
+// Replace our message block on disk with buf, which holds our records in the clear, using cmp
+// for compression. We write to a temporary file first so a failure will not lose the block.
+// If encrypted the block is sealed as a single frame with new keys.
+// Lock should be held.
+func (mb *msgBlock) writeBlock(buf []byte, cmp StoreCompression) error {
+	switch cmp {
+	case NoCompression:
+	case S2Compression:
+		cbuf := make([]byte, compressedBlkHdrSize+s2.MaxEncodedLen(len(buf)))
+		copy(cbuf, compressedBlkMagic)
+		cbuf[len(compressedBlkMagic)] = byte(cmp)
+		n := len(s2.Encode(cbuf[compressedBlkHdrSize:], buf))
+		buf = cbuf[:compressedBlkHdrSize+n]
+	default:
+		return errUnknownCompress
+	}
+	if err := mb.replaceBlockFile(buf); err != nil {
+		return err
+	}
+	mb.cmp = cmp
+	// We have a local copy now.
+	return mb.removeFromArchive()
+}
+
+// Compress our message block on disk if needed. This is called once we are
+// no longer the last message block, so we will not be appended to again.
+func (mb *msgBlock) compress(cmp StoreCompression) error {
+	// Make sure all of our messages are on disk.
+	if err := mb.flushPendingMsgsAndWait(); err != nil {
+		return err
+	}
+
+	// We may have been made the last message block again, e.g. by a truncate, since we
+	// were selected. Holding the store lock keeps it that way until we are done.
+	fs := mb.fs
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if fs.closed || mb == fs.lmb || mb.closed || mb.arch || mb.cmp == cmp || mb.isEmpty() {
+		return nil
+	}
+	buf, err := mb.loadBlock()
+	if err != nil || mb.cmp == cmp || len(buf) == 0 {
+		return err
+	}
+	if err := mb.writeBlock(buf, cmp); err != nil {
+		return err
+	}
+	// If we are encrypted our index needs to be sealed with our new keys.
+	// Our records did not change so our cache is still valid.
+	if mb.aek != nil {
+		return mb.writeIndexInfoLocked()
+	}
+	return nil
+}
+
+// Compress any of our message blocks that are not compressed and not the last block.
+// These can be left behind if we are stopped before we could compress them.
+func (fs *fileStore) compressMsgBlocks(blks []*msgBlock, cmp StoreCompression) {
+	for _, mb := range blks {
+		mb.compress(cmp)
+	}
+}
+
+// Read in the raw contents of our message block, which may be in the archive.
+// Lock should be held.
+func (mb *msgBlock) readBlockFile() ([]byte, error) {
+	if !mb.arch {
+		return ioutil.ReadFile(mb.mfn)
+	}
+	r, err := mb.fs.fcfg.Archive.Get(fmt.Sprintf(blkScan, mb.index))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Move our message block to the archive. Our index and key files stay local, so we
+// can recover and track our state without reading the block back from the archive.
+func (mb *msgBlock) archive() error {
+	// Make sure all of our messages are on disk.
+	if err := mb.flushPendingMsgsAndWait(); err != nil {
+		return err
+	}
+
+	// Same as compress, we can not archive if we are being written to.
+	// We do not hold any locks while we copy our block to the archive,
+	// so we check again once done that we can still be archived.
+	fs := mb.fs
+	canArchive := func() bool {
+		return !fs.closed && mb != fs.lmb && !mb.closed && !mb.arch
+	}
+
+	fs.mu.RLock()
+	mb.mu.RLock()
+	if !canArchive() {
+		mb.mu.RUnlock()
+		fs.mu.RUnlock()
+		return nil
+	}
+	buf, err := ioutil.ReadFile(mb.mfn)
+	mb.mu.RUnlock()
+	fs.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf(blkScan, mb.index)
+	if err := fs.fcfg.Archive.Put(name, bytes.NewReader(buf)); err != nil {
+		return err
+	}
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	// Make sure we were not changed while we were copying.
+	var unchanged bool
+	if canArchive() {
+		cbuf, err := ioutil.ReadFile(mb.mfn)
+		unchanged = err == nil && bytes.Equal(cbuf, buf)
+	}
+	if !unchanged {
+		// Our copy is stale, but if we were archived since then it is not ours to remove.
+		if !mb.arch {
+			fs.fcfg.Archive.Remove(name)
+		}
+		return nil
+	}
+	// Our index will be the only local record of our state.
+	if err := mb.writeIndexInfoLocked(); err != nil {
+		return err
+	}
+	mb.ifd.Truncate(mb.liwsz)
+	if err := mb.closeFDsLocked(); err != nil {
+		return err
+	}
+	// Mark that we are archived before removing our local copy.
+	if err := ioutil.WriteFile(mb.afn, nil, 0644); err != nil {
+		mb.fs.fcfg.Archive.Remove(name)
+		return err
+	}
+	os.Remove(mb.mfn)
+	mb.arch = true
+	return nil
+}
+
+// Bring our message block back from the archive. We need to do this before writing to it in place.
+// Lock should be held.
+func (mb *msgBlock) unarchive() error {
+	if !mb.arch {
+		return nil
+	}
+	buf, err := mb.readBlockFile()
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(mb.mfn), fmt.Sprintf(tmpScan, mb.index))
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, mb.mfn); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return mb.removeFromArchive()
+}
+
+// Remove our message block from the archive if it was archived.
+// The marker goes first so a failure can not bring back a removed block on restart.
+// Lock should be held.
+func (mb *msgBlock) removeFromArchive() error {
+	if !mb.arch {
+		return nil
+	}
+	mb.arch = false
+	if err := os.Remove(mb.afn); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%w %d: %v", errArchiveRemove, mb.index, err)
+	}
+	if err := mb.fs.fcfg.Archive.Remove(fmt.Sprintf(blkScan, mb.index)); err != nil {
+		return fmt.Errorf("%w %d: %v", errArchiveRemove, mb.index, err)
+	}
+	return nil
+}
+
+// How often we check for message blocks to archive.
+func (fs *fileStore) archiveCheckInterval() time.Duration {
+	if fs.fcfg.ArchiveAge < maxArchiveCheckInterval {
+		return fs.fcfg.ArchiveAge
+	}
+	return maxArchiveCheckInterval
+}
+
+// Archive any message blocks that are no longer being written to and old enough.
+// If we are compressing we wait for blocks to be compressed first.
+func (fs *fileStore) archiveMsgBlocks() {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return
+	}
+	var blks []*msgBlock
+	if len(fs.blks) > 1 {
+		blks = append(blks, fs.blks[:len(fs.blks)-1]...)
+	}
+	cmp, lmb := fs.cfg.Compression, fs.lmb
+	fs.mu.RUnlock()
+
+	cutoff := time.Now().Add(-fs.fcfg.ArchiveAge).UnixNano()
+	for _, mb := range blks {
+		mb.mu.RLock()
+		skip := mb == lmb || mb.arch || mb.closed || mb.cmp != cmp || mb.last.ts > cutoff
+		mb.mu.RUnlock()
+		if skip {
+			continue
+		}
+		if err := mb.archive(); err != nil {
+			break
+		}
+	}
+
+	fs.mu.Lock()
+	if !fs.closed {
+		fs.archTmr = time.AfterFunc(fs.archiveCheckInterval(), fs.archiveMsgBlocks)
+	}
+	fs.mu.Unlock()
+}
+
+func (fs *fileStore) lostData() *LostStreamData {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	if fs.ld == nil {
+		return nil
+	}
+	nld := *fs.ld
+	return &nld
+}
+
+func (fs *fileStore) rebuildState(ld *LostStreamData) {
+	if fs.ld != nil {
+		fs.ld.Msgs = append(fs.ld.Msgs, ld.Msgs...)
+		msgs := fs.ld.Msgs
+		sort.Slice(msgs, func(i, j int) bool { return msgs[i] < msgs[j] })
+		fs.ld.Bytes += ld.Bytes
+	} else {
+		fs.ld = ld
+	}
+	fs.state.Msgs, fs.state.Bytes = 0, 0
+	fs.state.FirstSeq, fs.state.LastSeq = 0, 0
+	// Per subject index will be rebuilt when needed.
+	fs.psim = nil
+	for _, seq := range ld.Msgs {
+		fs.ttls.removeSeq(seq)
+	}
+
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		fs.state.Msgs += mb.msgs
+		fs.state.Bytes += mb.bytes
+		if fs.state.FirstSeq == 0 || mb.first.seq < fs.state.FirstSeq {
+			fs.state.FirstSeq = mb.first.seq
+			fs.state.FirstTime = time.Unix(0, mb.first.ts).UTC()
+		}
+		fs.state.LastSeq = mb.last.seq
+		fs.state.LastTime = time.Unix(0, mb.last.ts).UTC()
+		mb.mu.RUnlock()
+	}
+}
+
+func (mb *msgBlock) rebuildState() (*LostStreamData, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	startLastSeq := mb.last.seq
+
+	// Clear state we need to rebuild.
+	mb.msgs, mb.bytes, mb.ttls = 0, 0, 0
+	mb.last.seq, mb.last.ts = 0, 0
+	// Per subject info will be regenerated on demand.
+	mb.fss = nil
+	firstNeedsSet := true
+
+	buf, err := mb.loadBlock()
+	// If our last encrypted frame is incomplete we keep what we could open.
+	torn := err == errBadFrame
+	if err != nil && !torn {
+		return nil, err
+	}
+
+	addToDmap := func(seq uint64) {
+		if seq == 0 {
 			return
 		}
 		if mb.dmap == nil {
@@ -484,6 +1473,13 @@ func (mb *msgBlock) rebuildState() (*LostStreamData, error) {
 	var le = binary.LittleEndian
 
 	truncate := func(index uint32) {
+		// We can not truncate compressed or encrypted blocks in place so rewrite what is still valid.
+		if mb.cmp != NoCompression || mb.aek != nil {
+			if err := mb.writeBlock(buf[:index], NoCompression); err == nil && index >= 8 {
+				copy(mb.lchk[0:], buf[index-8:index])
+			}
+			return
+		}
 		var fd *os.File
 		if mb.mfd != nil {
 			fd = mb.mfd
@@ -497,6 +1493,7 @@ func (mb *msgBlock) rebuildState() (*LostStreamData, error) {
 			return
 		}
 		if err := fd.Truncate(int64(index)); err == nil {
+			mb.rbytes = uint64(index)
 			// Update our checksum.
 			if index >= 8 {
 				var lchk [8]byte
@@ -597,11 +1594,29 @@ func (mb *msgBlock) rebuildState() (*LostStreamData, error) {
 
 			mb.msgs++
 			mb.bytes += uint64(rl)
+
+			if hasHeaders {
+				data := buf[index+msgHdrSize : index+rl]
+				hlen := le.Uint32(data[slen:])
+				if hs := int(slen) + 4; hs+int(hlen) <= dlen-8 {
+					if ttl, _ := getMessageTTL(data[hs : hs+int(hlen)]); ttl > 0 {
+						mb.ttls++
+					}
+				}
+			}
 		}
 
 		index += rl
 	}
 
+	// Drop an incomplete frame so we can be appended to again.
+	if torn {
+		truncate(uint32(len(buf)))
+		if ld := gatherLost(0); len(ld.Msgs) > 0 {
+			return ld, errBadMsg
+		}
+	}
+
 	return nil, nil
 }
 
@@ -625,27 +1640,58 @@ func (fs *fileStore) recoverMsgs() error {
 	// These can come in a random order, so account for that.
 	for _, fi := range fis {
 		var index uint64
-		if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
-			if mb := fs.recoverMsgBlock(fi, index); mb != nil {
-				if fs.state.FirstSeq == 0 || mb.first.seq < fs.state.FirstSeq {
-					fs.state.FirstSeq = mb.first.seq
-					fs.state.FirstTime = time.Unix(0, mb.first.ts).UTC()
-				}
-				if mb.last.seq > fs.state.LastSeq {
-					fs.state.LastSeq = mb.last.seq
-					fs.state.LastTime = time.Unix(0, mb.last.ts).UTC()
+		var mb *msgBlock
+		if n, err := fmt.Sscanf(fi.Name(), tmpScan, &index); err == nil && n == 1 {
+			// Left over from a message block rewrite that did not complete.
+			// Any new key file for it is not valid either, see loadEncryptionKeys.
+			os.Remove(path.Join(mdir, fmt.Sprintf(keyTmpScan, index)))
+			os.Remove(path.Join(mdir, fi.Name()))
+		} else if n, err := fmt.Sscanf(fi.Name(), archScan, &index); err == nil && n == 1 {
+			// If we still have the block locally we did not finish archiving it.
+			if _, err := os.Stat(path.Join(mdir, fmt.Sprintf(blkScan, index))); err == nil {
+				if fs.fcfg.Archive != nil {
+					fs.fcfg.Archive.Remove(fmt.Sprintf(blkScan, index))
 				}
-				fs.state.Msgs += mb.msgs
-				fs.state.Bytes += mb.bytes
+				os.Remove(path.Join(mdir, fi.Name()))
+				continue
+			}
+			if mb, err = fs.recoverArchivedMsgBlock(index); err != nil {
+				return err
+			}
+		} else if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
+			if mb, err = fs.recoverMsgBlock(fi, index); err != nil {
+				return err
 			}
 		}
+		if mb != nil {
+			if fs.state.FirstSeq == 0 || mb.first.seq < fs.state.FirstSeq {
+				fs.state.FirstSeq = mb.first.seq
+				fs.state.FirstTime = time.Unix(0, mb.first.ts).UTC()
+			}
+			if mb.last.seq > fs.state.LastSeq {
+				fs.state.LastSeq = mb.last.seq
+				fs.state.LastTime = time.Unix(0, mb.last.ts).UTC()
+			}
+			fs.state.Msgs += mb.msgs
+			fs.state.Bytes += mb.bytes
+		}
 	}
 
 	// Now make sure to sort blks for efficient lookup later with selectMsgBlock().
 	if len(fs.blks) > 0 {
 		sort.Slice(fs.blks, func(i, j int) bool { return fs.blks[i].index < fs.blks[j].index })
 		fs.lmb = fs.blks[len(fs.blks)-1]
-		err = fs.enableLastMsgBlockForWriting()
+		// Any blocks we did not get a chance to compress will be done in the background.
+		if fs.cfg.Compression != NoCompression && len(fs.blks) > 1 {
+			blks := append([]*msgBlock(nil), fs.blks[:len(fs.blks)-1]...)
+			go fs.compressMsgBlocks(blks, fs.cfg.Compression)
+		}
+		// We can not append to a compressed or archived block.
+		if fs.lmb.cmp != NoCompression || fs.lmb.arch {
+			_, err = fs.newMsgBlockForWrite()
+		} else {
+			err = fs.enableLastMsgBlockForWriting()
+		}
 	} else {
 		_, err = fs.newMsgBlockForWrite()
 	}
@@ -658,14 +1704,132 @@ func (fs *fileStore) recoverMsgs() error {
 	fs.enforceMsgLimit()
 	fs.enforceBytesLimit()
 
+	// Load our index of per message TTLs, or rebuild it if not valid.
+	if fs.cfg.AllowMsgTTL && fs.state.Msgs > 0 {
+		if err := fs.loadMsgTTLIndex(); err != nil {
+			fs.ttls.reset()
+			fs.recoverMsgTTLs()
+		}
+	}
+	// Only valid once, we will write it again when stopped.
+	os.Remove(path.Join(mdir, ttlIndexFile))
+
 	// Do age checks too, make sure to call in place.
-	if fs.cfg.MaxAge != 0 && fs.state.Msgs > 0 {
+	if (fs.cfg.MaxAge != 0 || fs.ttls.Len() > 0) && fs.state.Msgs > 0 {
 		fs.startAgeChk()
 		fs.expireMsgsLocked()
 	}
 	return nil
 }
 
+// Will scan our messages for any per message TTLs.
+// Only blocks that have stored messages with a TTL are scanned.
+// Lock should be held.
+func (fs *fileStore) recoverMsgTTLs() {
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		first, last, ttls := mb.first.seq, mb.last.seq, mb.ttls
+		mb.mu.RUnlock()
+		if ttls == 0 {
+			continue
+		}
+		for seq := first; seq > 0 && seq <= last; seq++ {
+			sm, _ := mb.fetchMsg(seq)
+			if sm == nil || len(sm.hdr) == 0 {
+				continue
+			}
+			if ttl, _ := getMessageTTL(sm.hdr); ttl > 0 {
+				fs.ttls.add(seq, sm.ts+ttl)
+			}
+		}
+	}
+}
+
+// Write out our index of per message TTLs so it does not need to be rebuilt on recovery.
+// Lock should be held.
+func (fs *fileStore) writeMsgTTLIndex() error {
+	// HEADER: magic version lseq count [seq expires]*
+	var tmp [binary.MaxVarintLen64]byte
+	buf := make([]byte, hdrLen, hdrLen+2*binary.MaxVarintLen64*(fs.ttls.Len()+1))
+	buf[0], buf[1] = magic, version
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], fs.state.LastSeq)]...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(fs.ttls.Len()))]...)
+	for _, mt := range fs.ttls.ttls {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], mt.seq)]...)
+		buf = append(buf, tmp[:binary.PutVarint(tmp[:], mt.expires)]...)
+	}
+	// Encrypt if needed.
+	if fs.aek != nil {
+		var err error
+		if buf, err = sealWithNonce(fs.aek, buf); err != nil {
+			return err
+		}
+	}
+	fn := path.Join(fs.fcfg.StoreDir, msgDir, ttlIndexFile)
+	tfn := fn + ".tmp"
+	if err := ioutil.WriteFile(tfn, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tfn, fn)
+}
+
+// Load our index of per message TTLs written when we were last stopped.
+// This is only valid if no messages were stored since.
+// Lock should be held.
+func (fs *fileStore) loadMsgTTLIndex() error {
+	buf, err := ioutil.ReadFile(path.Join(fs.fcfg.StoreDir, msgDir, ttlIndexFile))
+	if err != nil {
+		return err
+	}
+	// Decrypt if needed.
+	if fs.aek != nil {
+		if buf, err = openWithNonce(fs.aek, buf); err != nil {
+			return err
+		}
+	}
+	if err := checkHeader(buf); err != nil {
+		return err
+	}
+	bi := hdrLen
+	readSeq := func() uint64 {
+		if bi < 0 {
+			return 0
+		}
+		seq, n := binary.Uvarint(buf[bi:])
+		if n <= 0 {
+			bi = -1
+			return 0
+		}
+		bi += n
+		return seq
+	}
+	readExpires := func() int64 {
+		if bi < 0 {
+			return 0
+		}
+		expires, n := binary.Varint(buf[bi:])
+		if n <= 0 {
+			bi = -1
+			return 0
+		}
+		bi += n
+		return expires
+	}
+	if lseq := readSeq(); bi < 0 || lseq != fs.state.LastSeq {
+		return errCorruptState
+	}
+	for i, num := 0, readSeq(); i < int(num); i++ {
+		seq, expires := readSeq(), readExpires()
+		if bi < 0 {
+			return errCorruptState
+		}
+		if seq >= fs.state.FirstSeq && seq <= fs.state.LastSeq {
+			fs.ttls.add(seq, expires)
+		}
+	}
+	return nil
+}
+
 // GetSeqFromTime looks for the first sequence number that has
 // the message with >= timestamp.
 // FIXME(dlc) - inefficient, and dumb really. Make this better.
@@ -719,6 +1883,18 @@ func (fs *fileStore) hashKeyForBlock(index uint64) []byte {
 	return []byte(fmt.Sprintf("%s-%d", fs.cfg.Name, index))
 }
 
+// Create the hash used for record checksums in a message block. If secure is set and we
+// are encrypted we mix in our secret, which makes the checksums authenticate our records.
+// Lock should be held
+func (fs *fileStore) hashForBlock(index uint64, secure bool) (hash.Hash64, error) {
+	hk := fs.hashKeyForBlock(index)
+	if secure && fs.seed != nil {
+		hk = append(append([]byte(nil), fs.seed...), hk...)
+	}
+	key := sha256.Sum256(hk)
+	return highwayhash.New64(key[:])
+}
+
 func (mb *msgBlock) setupWriteCache(buf []byte) {
 	// Make sure we have a cache setup.
 	if mb.cache != nil {
@@ -735,6 +1911,15 @@ func (mb *msgBlock) setupWriteCache(buf []byte) {
 	if fi != nil {
 		mb.cache.off = int(fi.Size())
 	}
+	// If encrypted our offsets are in the clear, which our last frame tells us.
+	if mb.aek != nil && mb.cache.off > 0 {
+		if f, err := os.Open(mb.mfn); err == nil {
+			if _, end, err := readLastFrameTrailer(f, int64(mb.cache.off)); err == nil {
+				mb.cache.off = int(end)
+			}
+			f.Close()
+		}
+	}
 	mb.startCacheExpireTimer()
 }
 
@@ -755,14 +1940,19 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 			mbuf = lmb.expireCacheLocked()
 			lmb.mu.Unlock()
 		}
+		// Compress the block we are moving on from in the background if needed.
+		if fs.cfg.Compression != NoCompression {
+			go lmb.compress(fs.cfg.Compression)
+		}
 	}
 
 	mb := &msgBlock{fs: fs, index: index, cexp: fs.fcfg.CacheExpire}
 	mb.setupWriteCache(mbuf)
+	// New blocks can track per subject info from the start.
+	mb.fss = make(map[string]*SimpleState)
 
 	// Now do local hash.
-	key := sha256.Sum256(fs.hashKeyForBlock(index))
-	hh, err := highwayhash.New64(key[:])
+	hh, err := fs.hashForBlock(index, true)
 	if err != nil {
 		return nil, fmt.Errorf("could not create hash: %v", err)
 	}
@@ -770,6 +1960,15 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 
 	mdir := path.Join(fs.fcfg.StoreDir, msgDir)
 	mb.mfn = path.Join(mdir, fmt.Sprintf(blkScan, mb.index))
+	mb.kfn = path.Join(mdir, fmt.Sprintf(keyScan, mb.index))
+	mb.afn = path.Join(mdir, fmt.Sprintf(archScan, mb.index))
+
+	// Generate our encryption keys if needed.
+	if fs.aek != nil {
+		if err := mb.genEncryptionKeys(); err != nil {
+			return nil, err
+		}
+	}
 	mfd, err := os.OpenFile(mb.mfn, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		mb.dirtyCloseWithRemove(true)
@@ -818,6 +2017,12 @@ func (fs *fileStore) enableLastMsgBlockForWriting() error {
 	if mb.mfd != nil {
 		return nil
 	}
+	mb.mu.Lock()
+	err := mb.unarchive()
+	mb.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error restoring msg block file [%q] from archive: %v", mb.mfn, err)
+	}
 	mfd, err := os.OpenFile(mb.mfn, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return fmt.Errorf("error opening msg block file [%q]: %v", mb.mfn, err)
@@ -835,6 +2040,16 @@ func (fs *fileStore) enableLastMsgBlockForWriting() error {
 // Stores a raw message with expected sequence number and timestamp.
 // Lock should be held.
 func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error {
+	if err := fs.addMsg(subj, hdr, msg, seq, ts); err != nil {
+		return err
+	}
+	fs.enforceLimits(subj)
+	return nil
+}
+
+// Adds a raw message with expected sequence number and timestamp, without enforcing our limits.
+// Lock should be held.
+func (fs *fileStore) addMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error {
 	if fs.closed {
 		return ErrStoreClosed
 	}
@@ -862,6 +2077,7 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 	if err != nil {
 		return err
 	}
+	fs.addPerSubject(subj, seq)
 
 	// Adjust first if needed.
 	now := time.Unix(0, ts).UTC()
@@ -875,20 +2091,48 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 	fs.state.LastSeq = seq
 	fs.state.LastTime = now
 
-	// Limits checks and enforcement.
-	// If they do any deletions they will update the
-	// byte count on their own, so no need to compensate.
-	fs.enforceMsgLimit()
-	fs.enforceBytesLimit()
-
 	// Check if we have and need the age expiration timer running.
 	if fs.ageChk == nil && fs.cfg.MaxAge != 0 {
 		fs.startAgeChk()
 	}
 
+	// Track any per message TTL. If this is the next to expire make sure our timer reflects that.
+	if fs.cfg.AllowMsgTTL && len(hdr) > 0 {
+		if ttl, _ := getMessageTTL(hdr); ttl > 0 {
+			// Note that our last block holds a TTL so it will be scanned if we need to recover them.
+			if mb := fs.lmb; mb != nil {
+				mb.mu.Lock()
+				mb.ttls++
+				mb.mu.Unlock()
+			}
+			if fs.ttls.add(seq, ts+ttl) {
+				var fts int64
+				if fs.state.Msgs > 0 {
+					fts = fs.state.FirstTime.UnixNano()
+				}
+				fs.resetAgeChk(time.Now().UnixNano(), fts)
+			}
+		}
+	}
+
 	return nil
 }
 
+// Enforce our limits after adding a message on subj.
+// Lock should be held but will be released during any removals.
+func (fs *fileStore) enforceLimits(subj string) {
+	// Enforce per subject limits.
+	if fs.cfg.MaxMsgsPer > 0 && len(subj) > 0 {
+		fs.enforcePerSubjectLimit(subj)
+	}
+
+	// Limits checks and enforcement.
+	// If they do any deletions they will update the
+	// byte count on their own, so no need to compensate.
+	fs.enforceMsgLimit()
+	fs.enforceBytesLimit()
+}
+
 // StoreRawMsg stores a raw message with expected sequence number and timestamp.
 func (fs *fileStore) StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error {
 	fs.mu.Lock()
@@ -920,6 +2164,180 @@ func (fs *fileStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, erro
 	return seq, ts, err
 }
 
+// StoreMsgs stores a batch of messages as one unit, starting at seq with timestamp ts, or at the
+// next sequence with the current time if seq is zero. Either all of them are stored or none are.
+// We hold our lock until all of them are written, and only enforce our limits afterwards
+// since that may release it.
+func (fs *fileStore) StoreMsgs(batch []*BatchMsg, seq uint64, ts int64) (uint64, int64, error) {
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return 0, 0, ErrStoreClosed
+	}
+	if seq == 0 {
+		seq, ts = fs.state.LastSeq+1, time.Now().UnixNano()
+	} else if seq != fs.state.LastSeq+1 {
+		fs.mu.Unlock()
+		return 0, 0, ErrSequenceMismatch
+	}
+
+	// Check everything we can up front so we do not fail part way through.
+	msgs, bytes := fs.state.Msgs, fs.state.Bytes
+	for _, bm := range batch {
+		if bm.Skip {
+			continue
+		}
+		rl := fileStoreMsgSize(bm.Subject, bm.Hdr, bm.Msg)
+		if rl&hbit != 0 {
+			fs.mu.Unlock()
+			return 0, 0, ErrMsgTooLarge
+		}
+		if fs.cfg.Discard == DiscardNew {
+			if fs.cfg.MaxMsgs > 0 && msgs >= uint64(fs.cfg.MaxMsgs) {
+				fs.mu.Unlock()
+				return 0, 0, ErrMaxMsgs
+			}
+			if fs.cfg.MaxBytes > 0 && bytes+uint64(len(bm.Msg)+len(bm.Hdr)) >= uint64(fs.cfg.MaxBytes) {
+				fs.mu.Unlock()
+				return 0, 0, ErrMaxBytes
+			}
+		}
+		msgs, bytes = msgs+1, bytes+rl
+	}
+
+	sp, err := fs.batchSavepoint()
+	if err != nil {
+		fs.mu.Unlock()
+		return 0, 0, err
+	}
+	now := time.Unix(0, ts).UTC()
+	for i, bm := range batch {
+		if bm.Skip {
+			fs.skipMsg(now)
+			continue
+		}
+		if err := fs.addMsg(bm.Subject, bm.Hdr, bm.Msg, seq+uint64(i), ts); err != nil {
+			// We could not write to disk, so undo what we have written of the batch.
+			// No callbacks were made for those yet, so there is nothing to compensate.
+			if rerr := fs.rollbackBatch(sp); rerr != nil {
+				err = fmt.Errorf("%w, could not undo partial batch: %v", err, rerr)
+			}
+			fs.mu.Unlock()
+			return 0, 0, err
+		}
+	}
+	for _, bm := range batch {
+		if !bm.Skip {
+			fs.enforceLimits(bm.Subject)
+		}
+	}
+	cb := fs.scb
+	fs.mu.Unlock()
+
+	if cb != nil {
+		for i, bm := range batch {
+			if !bm.Skip {
+				cb(1, int64(fileStoreMsgSize(bm.Subject, bm.Hdr, bm.Msg)), seq+uint64(i), bm.Subject)
+			}
+		}
+	}
+	return seq, ts, nil
+}
+
+// Where we were before storing a batch, so a batch that fails part way through can be undone.
+type batchSavepoint struct {
+	state StreamState
+	lmb   *msgBlock
+	// Our last message block as it was.
+	eof   int64
+	first msgId
+	last  msgId
+	msgs  uint64
+	bytes uint64
+	lchk  [8]byte
+}
+
+// Lock should be held.
+func (fs *fileStore) batchSavepoint() (*batchSavepoint, error) {
+	sp := &batchSavepoint{state: fs.state, lmb: fs.lmb}
+	mb := fs.lmb
+	if mb == nil {
+		return sp, nil
+	}
+	if err := fs.enableLastMsgBlockForWriting(); err != nil {
+		return nil, err
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	// This is where the batch will be appended.
+	mb.setupWriteCache(nil)
+	sp.eof = int64(mb.cache.off + len(mb.cache.buf))
+	sp.first, sp.last = mb.first, mb.last
+	sp.msgs, sp.bytes = mb.msgs, mb.bytes
+	sp.lchk = mb.lchk
+	return sp, nil
+}
+
+// Undo everything stored since sp. Sequences used by the batch will be used again.
+// Lock should be held.
+func (fs *fileStore) rollbackBatch(sp *batchSavepoint) error {
+	// Remove any blocks the batch added, we do not want a new one created as these are removed.
+	fs.lmb = sp.lmb
+	var err error
+	for len(fs.blks) > 0 {
+		mb := fs.blks[len(fs.blks)-1]
+		if mb == sp.lmb {
+			break
+		}
+		mb.mu.Lock()
+		if rerr := fs.removeMsgBlock(mb); rerr != nil && err == nil {
+			err = rerr
+		}
+		mb.mu.Unlock()
+	}
+
+	fs.state = sp.state
+	// Per subject index will be rebuilt when needed.
+	fs.psim = nil
+	fs.ttls.removeOutside(fs.state.FirstSeq, fs.state.LastSeq)
+
+	mb := sp.lmb
+	if mb == nil {
+		if _, nerr := fs.newMsgBlockForWrite(); nerr != nil && err == nil {
+			err = nerr
+		}
+		return err
+	}
+	// We may have closed our last block when moving on from it.
+	if eerr := fs.enableLastMsgBlockForWriting(); eerr != nil {
+		return eerr
+	}
+	// Make sure what we had before the batch is on disk before we truncate.
+	if ferr := mb.flushPendingMsgsAndWait(); ferr != nil {
+		return ferr
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if terr := mb.truncateFile(sp.eof); terr != nil {
+		return terr
+	}
+	mb.first, mb.last = sp.first, sp.last
+	mb.msgs, mb.bytes = sp.msgs, sp.bytes
+	mb.lchk = sp.lchk
+	for seq := range mb.dmap {
+		if seq > sp.state.LastSeq {
+			delete(mb.dmap, seq)
+		}
+	}
+	mb.clearCacheAndOffset()
+	mb.fss = nil
+	if ierr := mb.writeIndexInfoLocked(); ierr != nil && err == nil {
+		err = ierr
+	}
+	return err
+}
+
 // skipMsg will update this message block for a skipped message.
 // If we do not have any messages, just update the metadata, otherwise
 // we will place and empty record marking the sequence as used. The
@@ -961,8 +2379,65 @@ func (fs *fileStore) SkipMsg() uint64 {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	// Grab time.
+	return fs.skipMsg(time.Now().UTC())
+}
+
+// SkipMsgs will use the next num sequences starting at seq but not store anything.
+// The seq has to be our next sequence.
+func (fs *fileStore) SkipMsgs(seq uint64, num uint64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return ErrStoreClosed
+	}
+	if seq != fs.state.LastSeq+1 {
+		return ErrSequenceMismatch
+	}
+	if num == 0 {
+		return nil
+	}
+
+	// We do not write a record for each skipped sequence. If our last block has messages
+	// we start a new one after the skipped range, leaving a gap between the two just like
+	// when an interior block is removed. An empty block only needs its meta updated.
+	mb := fs.lmb
+	var hasMsgs bool
+	if mb != nil {
+		mb.mu.RLock()
+		hasMsgs = mb.msgs > 0
+		mb.mu.RUnlock()
+	}
+	if mb == nil || hasMsgs {
+		var err error
+		if mb, err = fs.newMsgBlockForWrite(); err != nil {
+			return err
+		}
+	}
+
 	// Grab time.
 	now := time.Now().UTC()
+	lseq := seq + num - 1
+	mb.mu.Lock()
+	mb.last.seq = lseq
+	mb.last.ts = now.UnixNano()
+	mb.first.seq = lseq + 1
+	mb.first.ts = now.UnixNano()
+	mb.mu.Unlock()
+	mb.kickFlusher()
+
+	fs.state.LastSeq = lseq
+	fs.state.LastTime = now
+	if fs.state.Msgs == 0 {
+		fs.state.FirstSeq = lseq + 1
+		fs.state.FirstTime = now
+	}
+	return nil
+}
+
+// Lock should be held.
+func (fs *fileStore) skipMsg(now time.Time) uint64 {
 	seq := fs.state.LastSeq + 1
 	fs.state.LastSeq = seq
 	fs.state.LastTime = now
@@ -974,49 +2449,243 @@ func (fs *fileStore) SkipMsg() uint64 {
 		fs.state.FirstSeq = seq + 1
 		fs.state.FirstTime = now
 	}
-	fs.lmb.skipMsg(seq, now)
+	fs.lmb.skipMsg(seq, now)
+
+	return seq
+}
+
+// Lock should be held.
+func (fs *fileStore) rebuildFirst() {
+	if len(fs.blks) == 0 {
+		return
+	}
+	if fmb := fs.blks[0]; fmb != nil {
+		fmb.removeIndexFile()
+		fmb.rebuildState()
+		fmb.writeIndexInfo()
+		fs.selectNextFirst()
+	}
+}
+
+// Will check the msg limit and drop firstSeq msg if needed.
+// Lock should be held.
+func (fs *fileStore) enforceMsgLimit() {
+	if fs.cfg.MaxMsgs <= 0 || fs.state.Msgs <= uint64(fs.cfg.MaxMsgs) {
+		return
+	}
+	for nmsgs := fs.state.Msgs; nmsgs > uint64(fs.cfg.MaxMsgs); nmsgs = fs.state.Msgs {
+		if removed, err := fs.deleteFirstMsgLocked(); err != nil || !removed {
+			fs.rebuildFirst()
+			return
+		}
+	}
+}
+
+// Will check the bytes limit and drop msgs if needed.
+// Lock should be held.
+func (fs *fileStore) enforceBytesLimit() {
+	if fs.cfg.MaxBytes <= 0 || fs.state.Bytes <= uint64(fs.cfg.MaxBytes) {
+		return
+	}
+	for bs := fs.state.Bytes; bs > uint64(fs.cfg.MaxBytes); bs = fs.state.Bytes {
+		if removed, err := fs.deleteFirstMsgLocked(); err != nil || !removed {
+			fs.rebuildFirst()
+			return
+		}
+	}
+}
+
+// Will check the per subject msg limit for subj and drop the oldest msgs for that subject if needed.
+// Lock should be held but will be released during any removals.
+func (fs *fileStore) enforcePerSubjectLimit(subj string) {
+	maxMsgsPer := uint64(fs.cfg.MaxMsgsPer)
+	for {
+		nmsgs, first := fs.perSubjectState(subj)
+		if nmsgs <= maxMsgsPer || first == 0 {
+			return
+		}
+		fs.mu.Unlock()
+		// An archive error still removes the message.
+		removed, _ := fs.removeMsg(first, false)
+		fs.mu.Lock()
+		if !removed {
+			return
+		}
+	}
+}
+
+// Will check all subjects against the per subject msg limit.
+// Used when the limit is lowered or set on an existing stream.
+// Lock should be held.
+func (fs *fileStore) enforcePerSubjectLimits() {
+	if fs.psim == nil {
+		fs.rebuildPerSubjectIndex()
+	}
+	subjs := make([]string, 0, len(fs.psim))
+	for subj := range fs.psim {
+		subjs = append(subjs, subj)
+	}
+	for _, subj := range subjs {
+		fs.enforcePerSubjectLimit(subj)
+	}
+}
+
+// Returns the number of msgs and the first sequence for the given subject across all blocks.
+// Lock should be held.
+func (fs *fileStore) perSubjectState(subj string) (nmsgs, first uint64) {
+	if fs.psim == nil {
+		fs.rebuildPerSubjectIndex()
+	}
+	info := fs.psim[subj]
+	if info == nil {
+		return 0, 0
+	}
+	if info.firstNeedsUpdate {
+		info.first, info.firstNeedsUpdate = fs.firstSeqForSubj(subj, info.first), false
+	}
+	return info.total, info.first
+}
+
+// LastSeqForSubject will return the last sequence stored for the literal subject, or 0 if none.
+func (fs *fileStore) LastSeqForSubject(subj string) uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return 0
+	}
+	if fs.psim == nil {
+		fs.rebuildPerSubjectIndex()
+	}
+	return fs.lastSeqForInfo(subj, fs.psim[subj])
+}
+
+// Returns the last sequence from the per subject info for subj, updating it if needed.
+// Lock should be held.
+func (fs *fileStore) lastSeqForInfo(subj string, info *psi) uint64 {
+	if info == nil {
+		return 0
+	}
+	if info.lastNeedsUpdate {
+		info.last, info.lastNeedsUpdate = fs.lastSeqForSubj(subj, info.last), false
+	}
+	return info.last
+}
+
+// Will find the last sequence for subj at or before start.
+// Only blocks that may hold it will have their per subject info loaded.
+// Lock should be held.
+func (fs *fileStore) lastSeqForSubj(subj string, start uint64) uint64 {
+	for i := len(fs.blks) - 1; i >= 0; i-- {
+		mb := fs.blks[i]
+		mb.mu.RLock()
+		after := mb.first.seq > start
+		mb.mu.RUnlock()
+		if after {
+			continue
+		}
+		if lseq := mb.lastSeqForSubj(subj); lseq > 0 {
+			return lseq
+		}
+	}
+	return 0
+}
 
-	return seq
+// Will find the first sequence for subj at or after start.
+// Only blocks that may hold it will have their per subject info loaded.
+// Lock should be held.
+func (fs *fileStore) firstSeqForSubj(subj string, start uint64) uint64 {
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		before := mb.last.seq < start
+		mb.mu.RUnlock()
+		if before {
+			continue
+		}
+		if err := mb.ensurePerSubjectInfoLoaded(); err != nil {
+			continue
+		}
+		mb.mu.RLock()
+		ss := mb.fss[subj]
+		var needsUpdate bool
+		if ss != nil {
+			needsUpdate = ss.firstNeedsUpdate || ss.lastNeedsUpdate
+		}
+		mb.mu.RUnlock()
+
+		if ss == nil {
+			continue
+		}
+		if needsUpdate {
+			mb.recalculateForSubj(subj, ss)
+		}
+		mb.mu.RLock()
+		first := ss.First
+		mb.mu.RUnlock()
+		return first
+	}
+	return 0
 }
 
+// Track a newly stored message in our per subject index.
 // Lock should be held.
-func (fs *fileStore) rebuildFirst() {
-	if len(fs.blks) == 0 {
+func (fs *fileStore) addPerSubject(subj string, seq uint64) {
+	// A nil index will be rebuilt when needed.
+	if fs.psim == nil || len(subj) == 0 {
 		return
 	}
-	if fmb := fs.blks[0]; fmb != nil {
-		fmb.removeIndexFile()
-		fmb.rebuildState()
-		fmb.writeIndexInfo()
-		fs.selectNextFirst()
+	if info := fs.psim[subj]; info != nil {
+		info.total++
+		info.last, info.lastNeedsUpdate = seq, false
+	} else {
+		fs.psim[subj] = &psi{total: 1, first: seq, last: seq}
 	}
 }
 
-// Will check the msg limit and drop firstSeq msg if needed.
+// Remove a message from our per subject index.
 // Lock should be held.
-func (fs *fileStore) enforceMsgLimit() {
-	if fs.cfg.MaxMsgs <= 0 || fs.state.Msgs <= uint64(fs.cfg.MaxMsgs) {
+func (fs *fileStore) removePerSubject(subj string, seq uint64) {
+	info := fs.psim[subj]
+	if info == nil {
 		return
 	}
-	for nmsgs := fs.state.Msgs; nmsgs > uint64(fs.cfg.MaxMsgs); nmsgs = fs.state.Msgs {
-		if removed, err := fs.deleteFirstMsgLocked(); err != nil || !removed {
-			fs.rebuildFirst()
-			return
-		}
+	if info.total--; info.total == 0 {
+		delete(fs.psim, subj)
+		return
+	}
+	// We will lazily look up the new first or last when needed.
+	if seq == info.first {
+		info.firstNeedsUpdate = true
+	}
+	if seq == info.last {
+		info.lastNeedsUpdate = true
 	}
 }
 
-// Will check the bytes limit and drop msgs if needed.
+// Rebuild our per subject index from the per subject info of our message blocks.
+// This is done once after recovery or after bulk removals like compact and truncate.
 // Lock should be held.
-func (fs *fileStore) enforceBytesLimit() {
-	if fs.cfg.MaxBytes <= 0 || fs.state.Bytes <= uint64(fs.cfg.MaxBytes) {
-		return
-	}
-	for bs := fs.state.Bytes; bs > uint64(fs.cfg.MaxBytes); bs = fs.state.Bytes {
-		if removed, err := fs.deleteFirstMsgLocked(); err != nil || !removed {
-			fs.rebuildFirst()
-			return
+func (fs *fileStore) rebuildPerSubjectIndex() {
+	fs.psim = make(map[string]*psi)
+	for _, mb := range fs.blks {
+		if err := mb.ensurePerSubjectInfoLoaded(); err != nil {
+			continue
 		}
+		mb.mu.RLock()
+		for subj, ss := range mb.fss {
+			if info := fs.psim[subj]; info != nil {
+				info.total += ss.Msgs
+				info.last, info.lastNeedsUpdate = ss.Last, ss.lastNeedsUpdate
+			} else {
+				fs.psim[subj] = &psi{
+					total:            ss.Msgs,
+					first:            ss.First,
+					last:             ss.Last,
+					firstNeedsUpdate: ss.firstNeedsUpdate,
+					lastNeedsUpdate:  ss.lastNeedsUpdate,
+				}
+			}
+		}
+		mb.mu.RUnlock()
 	}
 }
 
@@ -1068,15 +2737,11 @@ func (fs *fileStore) removeMsg(seq uint64, secure bool) (bool, error) {
 		return false, err
 	}
 
-	// If we have a callback grab the message since we need the subject.
+	// Grab the message since we need the subject for the callback and for
+	// our per subject tracking.
 	// TODO(dlc) - This will cause whole buffer to be loaded which I was trying
 	// to avoid. Maybe use side cache for subjects or understand when we really need them.
-	// Meaning if the stream above is only a single subject no need to store, this is just
-	// for updating stream pending for consumers.
-	var sm *fileStoredMsg
-	if fs.scb != nil {
-		sm, _ = mb.fetchMsg(seq)
-	}
+	sm, _ := mb.fetchMsg(seq)
 
 	mb.mu.Lock()
 
@@ -1123,7 +2788,15 @@ func (fs *fileStore) removeMsg(seq uint64, secure bool) (bool, error) {
 	mb.msgs--
 	mb.bytes -= msz
 
+	// Update our per subject tracking.
+	if sm != nil {
+		mb.removeSeqPerSubject(sm.subj, seq)
+		fs.removePerSubject(sm.subj, seq)
+	}
+	fs.ttls.removeSeq(seq)
+
 	var shouldWriteIndex, firstSeqNeedsUpdate bool
+	var aerr error
 
 	if secure {
 		mb.eraseMsg(seq, int(ri), int(rl))
@@ -1133,7 +2806,7 @@ func (fs *fileStore) removeMsg(seq uint64, secure bool) (bool, error) {
 	if seq == mb.first.seq {
 		mb.selectNextFirst()
 		if mb.isEmpty() {
-			fs.removeMsgBlock(mb)
+			aerr = fs.removeMsgBlock(mb)
 			firstSeqNeedsUpdate = seq == fs.state.FirstSeq
 		} else {
 			shouldWriteIndex = true
@@ -1183,6 +2856,10 @@ func (fs *fileStore) removeMsg(seq uint64, secure bool) (bool, error) {
 	if firstSeqNeedsUpdate {
 		fs.selectNextFirst()
 	}
+	// The message is gone even if its block was left in the archive.
+	if aerr != nil {
+		fs.warn("Error removing message block: %v", aerr)
+	}
 	fs.mu.Unlock()
 
 	// Storage updates.
@@ -1198,6 +2875,14 @@ func (fs *fileStore) removeMsg(seq uint64, secure bool) (bool, error) {
 	return true, nil
 }
 
+// Log a warning if we have a server to log to.
+// Lock should be held.
+func (fs *fileStore) warn(format string, args ...interface{}) {
+	if srv := fs.fcfg.srv; srv != nil {
+		srv.Warnf(fmt.Sprintf("Filestore [%s] %s", fs.cfg.Name, format), args...)
+	}
+}
+
 // Grab info from a slot.
 // Lock should be held.
 func (mb *msgBlock) slotInfo(slot int) (uint32, uint32, bool, error) {
@@ -1375,8 +3060,35 @@ func (mb *msgBlock) eraseMsg(seq uint64, ri, rl int) error {
 		copy(buf, nbytes)
 	}
 
+	// Compressed blocks need to be rewritten.
+	if mb.cmp != NoCompression {
+		buf, err := mb.loadBlock()
+		if err != nil {
+			return err
+		}
+		if ri+rl > len(buf) {
+			return errBadMsg
+		}
+		copy(buf[ri:ri+rl], nbytes)
+		if err := mb.writeBlock(buf, mb.cmp); err != nil {
+			return err
+		}
+		// If we are encrypted our index needs to be sealed with our new keys.
+		if mb.aek != nil {
+			return mb.writeIndexInfoLocked()
+		}
+		return nil
+	}
+
 	// Disk
 	if mb.cache.off+mb.cache.wp > ri {
+		// We need our block locally to rewrite it in place.
+		if err := mb.unarchive(); err != nil {
+			return err
+		}
+		if mb.aek != nil {
+			return mb.rewriteFrameAt(nbytes, int64(ri))
+		}
 		mfd, err := os.OpenFile(mb.mfn, os.O_RDWR, 0644)
 		if err != nil {
 			return err
@@ -1430,16 +3142,9 @@ func (mb *msgBlock) truncate(sm *fileStoredMsg) (nmsgs, nbytes uint64, err error
 	}
 
 	// Truncate our msgs and close file.
-	if mb.mfd != nil {
-		mb.mfd.Truncate(eof)
-		mb.mfd.Sync()
-		// Update our checksum.
-		var lchk [8]byte
-		mb.mfd.ReadAt(lchk[:], eof-8)
-		copy(mb.lchk[0:], lchk[:])
-	} else {
+	if err := mb.truncateFile(eof); err != nil {
 		mb.mu.Unlock()
-		return 0, 0, fmt.Errorf("failed to truncate msg block %d, file not open", mb.index)
+		return 0, 0, err
 	}
 
 	// Do local mb stat updates.
@@ -1449,8 +3154,9 @@ func (mb *msgBlock) truncate(sm *fileStoredMsg) (nmsgs, nbytes uint64, err error
 	mb.last.seq = sm.seq
 	mb.last.ts = sm.ts
 
-	// Clear our cache.
+	// Clear our cache and per subject info.
 	mb.clearCacheAndOffset()
+	mb.fss = nil
 	mb.mu.Unlock()
 
 	// Write our index file.
@@ -1461,6 +3167,44 @@ func (mb *msgBlock) truncate(sm *fileStoredMsg) (nmsgs, nbytes uint64, err error
 	return purged, bytes, nil
 }
 
+// Truncate our block file to eof, which is an offset into our records in the clear.
+// Our last checksum will be updated to the one from the new last record.
+// Lock should be held.
+func (mb *msgBlock) truncateFile(eof int64) error {
+	var lchk [8]byte
+	if mb.cmp != NoCompression || mb.aek != nil {
+		// We will be written to again, so we store what is left uncompressed.
+		// Encrypted blocks are sealed again as a single frame.
+		buf, err := mb.loadBlock()
+		if err == nil && eof > int64(len(buf)) {
+			err = errBadMsg
+		}
+		if err == nil {
+			err = mb.writeBlock(buf[:eof], NoCompression)
+		}
+		if err != nil {
+			return err
+		}
+		if eof >= 8 {
+			copy(lchk[:], buf[eof-8:eof])
+		}
+	} else if mb.mfd != nil {
+		if err := mb.mfd.Truncate(eof); err != nil {
+			return err
+		}
+		mb.mfd.Sync()
+		mb.rbytes = uint64(eof)
+		// Update our checksum.
+		if eof >= 8 {
+			mb.mfd.ReadAt(lchk[:], eof-8)
+		}
+	} else {
+		return fmt.Errorf("failed to truncate msg block %d, file not open", mb.index)
+	}
+	copy(mb.lchk[0:], lchk[:])
+	return nil
+}
+
 // Lock should be held.
 func (mb *msgBlock) isEmpty() bool {
 	return mb.first.seq > mb.last.seq
@@ -1619,8 +3363,9 @@ func (mb *msgBlock) expireCacheLocked() []byte {
 	return buf[:0]
 }
 
+// Sealed streams do not expire messages.
 func (fs *fileStore) startAgeChk() {
-	if fs.ageChk == nil && fs.cfg.MaxAge != 0 {
+	if fs.ageChk == nil && fs.cfg.MaxAge != 0 && !fs.cfg.Sealed {
 		fs.ageChk = time.AfterFunc(fs.cfg.MaxAge, fs.expireMsgs)
 	}
 }
@@ -1632,11 +3377,37 @@ func (fs *fileStore) expireMsgsLocked() {
 	fs.mu.Lock()
 }
 
-// Will expire msgs that are too old.
+// Will reset the age check timer to fire for the next message to expire,
+// either from our max age based on the first message timestamp, or a per message TTL.
+// Lock should be held.
+func (fs *fileStore) resetAgeChk(now, fts int64) {
+	var next int64
+	if fs.cfg.MaxAge != 0 && fts > 0 {
+		next = fts + int64(fs.cfg.MaxAge)
+	}
+	if seq, expires := fs.ttls.next(); seq > 0 && (next == 0 || expires < next) {
+		next = expires
+	}
+	if next == 0 || fs.cfg.Sealed {
+		if fs.ageChk != nil {
+			fs.ageChk.Stop()
+			fs.ageChk = nil
+		}
+		return
+	}
+	fireIn := time.Duration(next - now)
+	if fs.ageChk != nil {
+		fs.ageChk.Reset(fireIn)
+	} else {
+		fs.ageChk = time.AfterFunc(fireIn, fs.expireMsgs)
+	}
+}
+
+// Will expire msgs that are too old or have reached their TTL.
 func (fs *fileStore) expireMsgs() {
 	// Make sure this is only running one at a time.
 	fs.mu.Lock()
-	if fs.expiring {
+	if fs.expiring || fs.cfg.Sealed {
 		fs.mu.Unlock()
 		return
 	}
@@ -1650,31 +3421,45 @@ func (fs *fileStore) expireMsgs() {
 	}()
 
 	now := time.Now().UnixNano()
-	minAge := now - int64(fs.cfg.MaxAge)
+	if maxAge := int64(fs.cfg.MaxAge); maxAge != 0 {
+		minAge := now - maxAge
+		for {
+			sm, _ := fs.msgForSeq(0)
+			if sm == nil || sm.ts > minAge {
+				break
+			}
+			fs.deleteFirstMsg()
+		}
+	}
 
+	// Per message TTLs are kept in expiration order.
 	for {
-		sm, _ := fs.msgForSeq(0)
-		if sm != nil && sm.ts <= minAge {
-			fs.deleteFirstMsg()
-		} else {
-			fs.mu.Lock()
-			if sm == nil {
-				if fs.ageChk != nil {
-					fs.ageChk.Stop()
-					fs.ageChk = nil
-				}
-			} else {
-				fireIn := time.Duration(sm.ts-now) + fs.cfg.MaxAge
-				if fs.ageChk != nil {
-					fs.ageChk.Reset(fireIn)
-				} else {
-					fs.ageChk = time.AfterFunc(fireIn, fs.expireMsgs)
-				}
-			}
+		fs.mu.Lock()
+		seq, expires := fs.ttls.next()
+		if seq == 0 || expires > now {
 			fs.mu.Unlock()
-			return
+			break
+		}
+		fs.ttls.remove()
+		fs.mu.Unlock()
+		// Make sure this is still the message that was indexed.
+		if sm, _ := fs.msgForSeq(seq); sm != nil {
+			if ttl, _ := getMessageTTL(sm.hdr); sm.ts+ttl == expires {
+				fs.removeMsg(seq, false)
+			}
+		}
+	}
+
+	// Grab the first message timestamp for our max age.
+	var fts int64
+	if fs.cfg.MaxAge != 0 {
+		if sm, _ := fs.msgForSeq(0); sm != nil {
+			fts = sm.ts
 		}
 	}
+	fs.mu.Lock()
+	fs.resetAgeChk(now, fts)
+	fs.mu.Unlock()
 }
 
 // Lock should be held.
@@ -1778,6 +3563,17 @@ func (mb *msgBlock) writeMsgRecord(rl, seq uint64, subj string, mhdr, msg []byte
 	// Accounting
 	mb.updateAccounting(seq, ts, rl)
 
+	// Per subject tracking if we are generating.
+	if mb.fss != nil && len(subj) > 0 {
+		if ss := mb.fss[subj]; ss != nil {
+			ss.Msgs++
+			ss.Last = seq
+			ss.lastNeedsUpdate = false
+		} else {
+			mb.fss[subj] = &SimpleState{Msgs: 1, First: seq, Last: seq}
+		}
+	}
+
 	fch, werr := mb.fch, mb.werr
 	mb.mu.Unlock()
 
@@ -1892,6 +3688,147 @@ func (mb *msgBlock) updateAccounting(seq uint64, ts int64, rl uint64) {
 	mb.msgs++
 }
 
+// Will remove the seq from the per subject tracking.
+// Lock should be held.
+func (mb *msgBlock) removeSeqPerSubject(subj string, seq uint64) {
+	ss := mb.fss[subj]
+	if ss == nil {
+		return
+	}
+	if ss.Msgs == 1 {
+		delete(mb.fss, subj)
+		return
+	}
+	ss.Msgs--
+	// We will lazily recalculate these when needed since we may not have the cache loaded.
+	if seq == ss.First {
+		ss.firstNeedsUpdate = true
+	}
+	if seq == ss.Last {
+		ss.lastNeedsUpdate = true
+	}
+}
+
+// Will recalculate the first and/or last sequence for this subject in this block.
+// Lock should NOT be held.
+func (mb *msgBlock) recalculateForSubj(subj string, ss *SimpleState) {
+	mb.mu.RLock()
+	first, last := ss.First, ss.Last
+	fnu, lnu := ss.firstNeedsUpdate, ss.lastNeedsUpdate
+	mb.mu.RUnlock()
+
+	if fnu {
+		for seq := first + 1; seq <= last; seq++ {
+			if sm, _ := mb.fetchMsg(seq); sm != nil && sm.subj == subj {
+				first = seq
+				break
+			}
+		}
+	}
+	if lnu {
+		for seq := last - 1; seq >= first; seq-- {
+			if sm, _ := mb.fetchMsg(seq); sm != nil && sm.subj == subj {
+				last = seq
+				break
+			}
+		}
+	}
+
+	mb.mu.Lock()
+	ss.First, ss.Last = first, last
+	ss.firstNeedsUpdate, ss.lastNeedsUpdate = false, false
+	mb.mu.Unlock()
+}
+
+// Will return the last sequence in this block for the given subject, or 0 if not present.
+// The subject can contain wildcards.
+// Lock should NOT be held.
+func (mb *msgBlock) lastSeqForSubj(subj string) uint64 {
+	if err := mb.ensurePerSubjectInfoLoaded(); err != nil {
+		return 0
+	}
+
+	wc := subjectHasWildcard(subj)
+	matched := make(map[string]*SimpleState)
+	mb.mu.RLock()
+	if !wc {
+		if ss := mb.fss[subj]; ss != nil {
+			matched[subj] = ss
+		}
+	} else {
+		for fsubj, ss := range mb.fss {
+			if subjectIsSubsetMatch(fsubj, subj) {
+				matched[fsubj] = ss
+			}
+		}
+	}
+	mb.mu.RUnlock()
+
+	var lseq uint64
+	for fsubj, ss := range matched {
+		mb.mu.RLock()
+		needsUpdate := ss.lastNeedsUpdate
+		mb.mu.RUnlock()
+		if needsUpdate {
+			mb.recalculateForSubj(fsubj, ss)
+		}
+		mb.mu.RLock()
+		if ss.Last > lseq {
+			lseq = ss.Last
+		}
+		mb.mu.RUnlock()
+	}
+	return lseq
+}
+
+// Will make sure we have the per subject info loaded for this block.
+// Lock should NOT be held.
+func (mb *msgBlock) ensurePerSubjectInfoLoaded() error {
+	mb.mu.RLock()
+	loaded := mb.fss != nil
+	mb.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+	return mb.generatePerSubjectInfo()
+}
+
+// Generate the per subject info for this block by scanning all of the messages.
+// Lock should NOT be held.
+func (mb *msgBlock) generatePerSubjectInfo() error {
+	if err := mb.loadMsgs(); err != nil {
+		return err
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	// Someone else may have beat us here.
+	if mb.fss != nil {
+		return nil
+	}
+	if mb.msgs > 0 && (mb.cache == nil || mb.cache.off > 0) {
+		return errPartialCache
+	}
+
+	fss := make(map[string]*SimpleState)
+	for seq := mb.first.seq; seq <= mb.last.seq && mb.msgs > 0; seq++ {
+		sm, _ := mb.cacheLookupWithLock(seq)
+		if sm == nil || len(sm.subj) == 0 {
+			continue
+		}
+		if ss := fss[sm.subj]; ss != nil {
+			ss.Msgs++
+			ss.Last = seq
+		} else {
+			fss[sm.subj] = &SimpleState{Msgs: 1, First: seq, Last: seq}
+		}
+	}
+	mb.fss = fss
+
+	return nil
+}
+
 // Lock should be held.
 func (fs *fileStore) writeMsgRecord(seq uint64, ts int64, subj string, hdr, msg []byte) (uint64, error) {
 	var err error
@@ -2106,16 +4043,32 @@ func (mb *msgBlock) flushPendingMsgs() error {
 
 	woff := int64(mb.cache.off + mb.cache.wp)
 	lob := len(buf)
+	loff := woff
+
+	// If we are encrypted we append our pending records as a sealed frame.
+	// Our cache offsets stay in the clear.
+	if mb.aek != nil {
+		var fi os.FileInfo
+		if buf, err = sealBlockFrame(mb.aek, buf, loff); err == nil {
+			if fi, err = mb.mfd.Stat(); err == nil {
+				woff = fi.Size()
+			}
+		}
+		if err != nil {
+			mb.mu.Unlock()
+			return err
+		}
+	}
 
 	// Only one can be flushing at a time.
 	mb.setFlushing()
 	mfd := mb.mfd
 	mb.mu.Unlock()
 
-	var n, tn int
+	var n int
 
 	// Append new data to the message block file.
-	for lbb := lob; lbb > 0; lbb = len(buf) {
+	for lbb := len(buf); lbb > 0; lbb = len(buf) {
 		n, err = mfd.WriteAt(buf, woff)
 		if err != nil {
 			mb.removeIndexFile()
@@ -2132,7 +4085,6 @@ func (mb *msgBlock) flushPendingMsgs() error {
 		}
 
 		woff += int64(n)
-		tn += n
 
 		// Success
 		if n == lbb {
@@ -2150,6 +4102,7 @@ func (mb *msgBlock) flushPendingMsgs() error {
 	defer mb.clearFlushing()
 	// set write err to any error.
 	mb.werr = err
+	mb.rbytes = uint64(woff)
 
 	// Cache may be gone.
 	if mb.cache == nil || mb.mfd == nil {
@@ -2162,7 +4115,7 @@ func (mb *msgBlock) flushPendingMsgs() error {
 	// Decide what we want to do with the buffer in hand. If we have load interest
 	// we will hold onto the whole thing, otherwise empty the buffer, possibly reusing it.
 	if ts := time.Now().UnixNano(); ts < mb.llts || (ts-mb.llts) <= int64(mb.cexp) {
-		mb.cache.wp += tn
+		mb.cache.wp += lob
 	} else {
 		if cap(buf) <= maxBufReuse {
 			buf = buf[:0]
@@ -2178,7 +4131,7 @@ func (mb *msgBlock) flushPendingMsgs() error {
 			}
 		}
 		// Update our cache offset.
-		mb.cache.off = int(woff)
+		mb.cache.off = int(loff) + lob
 		// Reset write pointer.
 		mb.cache.wp = 0
 		// Place buffer back in the cache structure.
@@ -2221,7 +4174,6 @@ checkCache:
 		return nil
 	}
 
-	mfn := mb.mfn
 	mb.llts = time.Now().UnixNano()
 
 	// FIXME(dlc) - We could be smarter here.
@@ -2237,7 +4189,7 @@ checkCache:
 
 	// Load in the whole block. We want to hold the mb lock here to avoid any changes to
 	// state.
-	buf, err := ioutil.ReadFile(mfn)
+	buf, err := mb.loadBlock()
 	if err != nil {
 		return err
 	}
@@ -2291,15 +4243,21 @@ func (mb *msgBlock) fetchMsg(seq uint64) (*fileStoredMsg, error) {
 }
 
 var (
-	errNoCache      = errors.New("no message cache")
-	errBadMsg       = errors.New("malformed or corrupt message")
-	errDeletedMsg   = errors.New("deleted message")
-	errPartialCache = errors.New("partial cache")
-	errNoPending    = errors.New("message block does not have pending data")
-	errNotReadable  = errors.New("storage directory not readable")
-	errFlushRunning = errors.New("flush is already running")
-	errCorruptState = errors.New("corrupt state file")
-	errPendingData  = errors.New("pending data still present")
+	errNoCache         = errors.New("no message cache")
+	errBadMsg          = errors.New("malformed or corrupt message")
+	errDeletedMsg      = errors.New("deleted message")
+	errPartialCache    = errors.New("partial cache")
+	errNoPending       = errors.New("message block does not have pending data")
+	errNotReadable     = errors.New("storage directory not readable")
+	errFlushRunning    = errors.New("flush is already running")
+	errCorruptState    = errors.New("corrupt state file")
+	errPendingData     = errors.New("pending data still present")
+	errBadKeyFile      = errors.New("malformed or corrupt key file")
+	errUnknownCipher   = errors.New("unknown store cipher")
+	errUnknownCompress = errors.New("unknown store compression")
+	errNoEncryptionKey = errors.New("store is encrypted but no encryption key is configured")
+	errArchiveRemove   = errors.New("could not remove msg block from archive")
+	errBadFrame        = errors.New("malformed or corrupt encrypted frame")
 )
 
 // Used for marking messages that have had their checksums checked.
@@ -2482,16 +4440,86 @@ func msgFromBuf(buf []byte, hh hash.Hash64) (string, []byte, []byte, uint64, int
 	} else {
 		msg = data[slen:end:end]
 	}
-	return string(data[:slen]), mhdr, msg, seq, ts, nil
+	return string(data[:slen]), mhdr, msg, seq, ts, nil
+}
+
+// LoadMsg will lookup the message by sequence number and return it if found.
+func (fs *fileStore) LoadMsg(seq uint64) (string, []byte, []byte, int64, error) {
+	sm, err := fs.msgForSeq(seq)
+	if sm != nil {
+		return sm.subj, sm.hdr, sm.msg, sm.ts, nil
+	}
+	return "", nil, nil, 0, err
+}
+
+// LoadLastMsg will return the last message we have that matches the given subject.
+// The subject can contain wildcards. An empty subject will return the last message in the store.
+func (fs *fileStore) LoadLastMsg(subject string) (subj string, seq uint64, hdr, msg []byte, ts int64, err error) {
+	sm, err := fs.loadLast(subject)
+	if sm == nil || err != nil {
+		if err == nil || err == ErrStoreEOF || err == errDeletedMsg {
+			err = ErrStoreMsgNotFound
+		}
+		return _EMPTY_, 0, nil, nil, 0, err
+	}
+	return sm.subj, sm.seq, sm.hdr, sm.msg, sm.ts, nil
+}
+
+// Will use the per subject index to find the last message that matches subj.
+func (fs *fileStore) loadLast(subj string) (*fileStoredMsg, error) {
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return nil, ErrStoreClosed
+	}
+	var lseq uint64
+	if subj == _EMPTY_ || subj == fwcs {
+		lseq = fs.lastMsgSeq()
+	} else {
+		if fs.psim == nil {
+			fs.rebuildPerSubjectIndex()
+		}
+		if !subjectHasWildcard(subj) {
+			lseq = fs.lastSeqForInfo(subj, fs.psim[subj])
+		} else {
+			for fsubj, info := range fs.psim {
+				if !subjectIsSubsetMatch(fsubj, subj) {
+					continue
+				}
+				if seq := fs.lastSeqForInfo(fsubj, info); seq > lseq {
+					lseq = seq
+				}
+			}
+		}
+	}
+	fs.mu.Unlock()
+
+	if lseq == 0 {
+		return nil, ErrStoreMsgNotFound
+	}
+	return fs.msgForSeq(lseq)
 }
 
-// LoadMsg will lookup the message by sequence number and return it if found.
-func (fs *fileStore) LoadMsg(seq uint64) (string, []byte, []byte, int64, error) {
-	sm, err := fs.msgForSeq(seq)
-	if sm != nil {
-		return sm.subj, sm.hdr, sm.msg, sm.ts, nil
+// Will walk back from our last sequence to the last message that has not been removed.
+// Lock should be held.
+func (fs *fileStore) lastMsgSeq() uint64 {
+	if fs.state.Msgs == 0 {
+		return 0
 	}
-	return "", nil, nil, 0, err
+	for i := len(fs.blks) - 1; i >= 0; i-- {
+		mb := fs.blks[i]
+		mb.mu.RLock()
+		if mb.msgs > 0 {
+			for seq := mb.last.seq; seq >= mb.first.seq && seq > 0; seq-- {
+				if _, ok := mb.dmap[seq]; !ok {
+					mb.mu.RUnlock()
+					return seq
+				}
+			}
+		}
+		mb.mu.RUnlock()
+	}
+	return 0
 }
 
 // Type returns the type of the underlying store.
@@ -2516,8 +4544,19 @@ func (fs *fileStore) State() StreamState {
 	state := fs.state
 	state.Consumers = len(fs.cfs)
 	state.Deleted = nil // make sure.
+	// Only report compressed bytes if we are or were compressing.
+	compressed := fs.cfg.Compression != NoCompression
+	var cbytes uint64
 	for _, mb := range fs.blks {
 		mb.mu.Lock()
+		if mb.cmp != NoCompression {
+			compressed = true
+		}
+		// What we actually store includes framing and any deleted records not yet removed.
+		cbytes += mb.rbytes
+		if mb.arch {
+			state.ArchivedBytes += mb.bytes
+		}
 		fseq := mb.first.seq
 		for seq := range mb.dmap {
 			if seq <= fseq {
@@ -2528,6 +4567,9 @@ func (fs *fileStore) State() StreamState {
 		}
 		mb.mu.Unlock()
 	}
+	if compressed {
+		state.CompressedBytes = cbytes
+	}
 	fs.mu.RUnlock()
 
 	state.Lost = fs.lostData()
@@ -2558,31 +4600,22 @@ func fileStoreMsgSizeEstimate(slen, maxPayload int) uint64 {
 
 // Write index info to the appropriate file.
 func (mb *msgBlock) writeIndexInfo() error {
-	// HEADER: magic version msgs bytes fseq fts lseq lts checksum
-	var hdr [indexHdrSize]byte
-
-	// Write header
-	hdr[0] = magic
-	hdr[1] = version
-
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
+	return mb.writeIndexInfoLocked()
+}
 
-	n := hdrLen
-	n += binary.PutUvarint(hdr[n:], mb.msgs)
-	n += binary.PutUvarint(hdr[n:], mb.bytes)
-	n += binary.PutUvarint(hdr[n:], mb.first.seq)
-	n += binary.PutVarint(hdr[n:], mb.first.ts)
-	n += binary.PutUvarint(hdr[n:], mb.last.seq)
-	n += binary.PutVarint(hdr[n:], mb.last.ts)
-	n += binary.PutUvarint(hdr[n:], uint64(len(mb.dmap)))
-	buf := append(hdr[:n], mb.lchk[:]...)
-
-	// Append a delete map if needed
-	if len(mb.dmap) > 0 {
-		buf = append(buf, mb.genDeleteMap()...)
-	}
+// Lock should be held.
+func (mb *msgBlock) writeIndexInfoLocked() error {
 	var err error
+	buf := mb.encodeIndexInfo(mb.lchk[:])
+	// Encrypt if needed.
+	if mb.aek != nil {
+		if buf, err = sealWithNonce(mb.aek, buf); err != nil {
+			return err
+		}
+	}
+
 	if mb.ifd == nil {
 		ifd, err := os.OpenFile(mb.ifn, os.O_CREATE|os.O_RDWR, 0644)
 		if err != nil {
@@ -2593,7 +4626,12 @@ func (mb *msgBlock) writeIndexInfo() error {
 
 	mb.lwits = time.Now().UnixNano()
 
-	if n, err = mb.ifd.WriteAt(buf, 0); err == nil {
+	var n int
+	if n, err = mb.ifd.WriteAt(buf, 0); err == nil && mb.aek != nil {
+		// A sealed index will not open with any trailing bytes left from a longer one.
+		err = mb.ifd.Truncate(int64(n))
+	}
+	if err == nil {
 		mb.liwsz = int64(n)
 		mb.werr = nil
 	} else {
@@ -2603,6 +4641,40 @@ func (mb *msgBlock) writeIndexInfo() error {
 	return err
 }
 
+// Encode our index info with lchk as the last checksum.
+// Lock should be held.
+func (mb *msgBlock) encodeIndexInfo(lchk []byte) []byte {
+	// HEADER: magic version msgs bytes fseq fts lseq lts ndel checksum [dmap] ttls rbytes
+	var hdr [indexHdrSize]byte
+
+	// Generate the delete map first since this will drop stale entries.
+	dmap := mb.genDeleteMap()
+
+	// Write header
+	hdr[0] = magic
+	hdr[1] = version
+
+	n := hdrLen
+	n += binary.PutUvarint(hdr[n:], mb.msgs)
+	n += binary.PutUvarint(hdr[n:], mb.bytes)
+	n += binary.PutUvarint(hdr[n:], mb.first.seq)
+	n += binary.PutVarint(hdr[n:], mb.first.ts)
+	n += binary.PutUvarint(hdr[n:], mb.last.seq)
+	n += binary.PutVarint(hdr[n:], mb.last.ts)
+	n += binary.PutUvarint(hdr[n:], uint64(len(mb.dmap)))
+	buf := append(hdr[:n], lchk...)
+
+	// Append a delete map if needed
+	if len(dmap) > 0 {
+		buf = append(buf, dmap...)
+	}
+	// Number of messages with a TTL, so only these blocks need scanning on recovery.
+	var tmp [binary.MaxVarintLen64]byte
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], mb.ttls)]...)
+	// Size of our block file, which we can not check once we are archived.
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], mb.rbytes)]...)
+}
+
 // readIndexInfo will read in the index information for the message block.
 func (mb *msgBlock) readIndexInfo() error {
 	buf, err := ioutil.ReadFile(mb.ifn)
@@ -2610,6 +4682,14 @@ func (mb *msgBlock) readIndexInfo() error {
 		return err
 	}
 
+	// Decrypt if needed.
+	if mb.aek != nil {
+		if buf, err = openWithNonce(mb.aek, buf); err != nil {
+			defer os.Remove(mb.ifn)
+			return fmt.Errorf("bad index file")
+		}
+	}
+
 	if err := checkHeader(buf); err != nil {
 		defer os.Remove(mb.ifn)
 		return fmt.Errorf("bad index file")
@@ -2673,6 +4753,21 @@ func (mb *msgBlock) readIndexInfo() error {
 		}
 	}
 
+	// Older index files do not track messages with a TTL, so assume we have some.
+	mb.ttls = 1
+	if bi >= 0 && bi < len(buf) {
+		if ttls := readCount(); bi >= 0 {
+			mb.ttls = ttls
+		}
+	}
+	// Older index files do not have our file size either, so use our message bytes.
+	mb.rbytes = mb.bytes
+	if bi >= 0 && bi < len(buf) {
+		if rbytes := readCount(); bi >= 0 {
+			mb.rbytes = rbytes
+		}
+	}
+
 	return nil
 }
 
@@ -2763,9 +4858,18 @@ func (fs *fileStore) purge(fseq uint64) (uint64, error) {
 
 	fs.state.Bytes = 0
 	fs.state.Msgs = 0
+	fs.ttls.reset()
+	fs.psim = nil
 
+	var aerr error
 	for _, mb := range fs.blks {
 		mb.dirtyClose()
+		// Archived blocks are not in our msgs directory.
+		mb.mu.Lock()
+		if err := mb.removeFromArchive(); err != nil && aerr == nil {
+			aerr = err
+		}
+		mb.mu.Unlock()
 	}
 
 	fs.blks = nil
@@ -2807,6 +4911,112 @@ func (fs *fileStore) purge(fseq uint64) (uint64, error) {
 		cb(-int64(purged), -rbytes, 0, _EMPTY_)
 	}
 
+	return purged, aerr
+}
+
+// PurgeEx will remove messages based on subject filters, sequence and number of messages to keep.
+// Messages with a sequence at or above seq are kept, as are the last keep messages for each subject.
+// Will return the number of purged messages.
+func (fs *fileStore) PurgeEx(subject string, sequence, keep uint64) (purged uint64, err error) {
+	all := subject == _EMPTY_ || subject == fwcs
+	if all && keep == 0 && (sequence == 0 || sequence > fs.lastSeq()) {
+		return fs.Purge()
+	}
+
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return 0, ErrStoreClosed
+	}
+	blks := append(fs.blks[:0:0], fs.blks...)
+	last := fs.state.LastSeq
+	fs.mu.RUnlock()
+
+	if sequence > 0 && sequence <= last {
+		last = sequence - 1
+	}
+
+	// If we need to keep some messages grab the per subject counts.
+	// Only messages below the sequence cutoff are counted.
+	var counts map[string]uint64
+	if keep > 0 {
+		counts = make(map[string]uint64)
+		for _, mb := range blks {
+			if err := mb.ensurePerSubjectInfoLoaded(); err != nil {
+				continue
+			}
+			mb.mu.RLock()
+			mfirst, mlast := mb.first.seq, mb.last.seq
+			if mlast <= last {
+				for subj, ss := range mb.fss {
+					if all || subjectIsSubsetMatch(subj, subject) {
+						counts[subj] += ss.Msgs
+					}
+				}
+			}
+			mb.mu.RUnlock()
+			if mlast <= last {
+				continue
+			}
+			// This block straddles the cutoff, so count what is below it.
+			for seq := mfirst; seq <= last; seq++ {
+				if sm, _ := mb.fetchMsg(seq); sm != nil && (all || subjectIsSubsetMatch(sm.subj, subject)) {
+					counts[sm.subj]++
+				}
+			}
+			break
+		}
+	}
+
+	for _, mb := range blks {
+		if err := mb.ensurePerSubjectInfoLoaded(); err != nil {
+			continue
+		}
+		// Only walk the range of this block that holds matching subjects, if any.
+		// These may be stale after removals, but will still bound the range.
+		var first, mlast uint64
+		mb.mu.RLock()
+		for subj, ss := range mb.fss {
+			if all || subjectIsSubsetMatch(subj, subject) {
+				if first == 0 || ss.First < first {
+					first = ss.First
+				}
+				if ss.Last > mlast {
+					mlast = ss.Last
+				}
+			}
+		}
+		mb.mu.RUnlock()
+
+		if first == 0 {
+			continue
+		}
+		if first > last {
+			break
+		}
+		if mlast > last {
+			mlast = last
+		}
+		for seq := first; seq <= mlast; seq++ {
+			sm, _ := mb.fetchMsg(seq)
+			if sm == nil || (!all && !subjectIsSubsetMatch(sm.subj, subject)) {
+				continue
+			}
+			if keep > 0 {
+				if counts[sm.subj] <= keep {
+					continue
+				}
+				counts[sm.subj]--
+			}
+			removed, err := fs.removeMsg(seq, false)
+			if removed {
+				purged++
+			}
+			if err != nil {
+				return purged, err
+			}
+		}
+	}
 	return purged, nil
 }
 
@@ -2829,6 +5039,7 @@ func (fs *fileStore) Compact(seq uint64) (uint64, error) {
 		return 0, nil
 	}
 	// All msgblocks up to this one can be thrown away.
+	var aerr error
 	for i, mb := range fs.blks {
 		if mb == smb {
 			fs.blks = append(fs.blks[:0:0], fs.blks[i:]...)
@@ -2837,7 +5048,9 @@ func (fs *fileStore) Compact(seq uint64) (uint64, error) {
 		mb.mu.Lock()
 		purged += mb.msgs
 		bytes += mb.bytes
-		mb.dirtyCloseWithRemove(true)
+		if err := mb.dirtyCloseWithRemove(true); err != nil && aerr == nil {
+			aerr = err
+		}
 		mb.mu.Unlock()
 	}
 	fs.mu.Unlock()
@@ -2848,8 +5061,14 @@ func (fs *fileStore) Compact(seq uint64) (uint64, error) {
 
 	smb.mu.Lock()
 	for mseq := smb.first.seq; mseq < seq; mseq++ {
-		if _, rl, _, err := smb.slotInfo(int(mseq - smb.cache.fseq)); err != nil {
+		// Skip messages that have already been removed.
+		if _, ok := smb.dmap[mseq]; ok {
+			delete(smb.dmap, mseq)
+			continue
+		}
+		if _, rl, _, err := smb.slotInfo(int(mseq - smb.cache.fseq)); err == nil {
 			smb.bytes -= uint64(rl)
+			bytes += uint64(rl)
 		}
 		smb.msgs--
 		purged++
@@ -2859,9 +5078,13 @@ func (fs *fileStore) Compact(seq uint64) (uint64, error) {
 	if sm != nil {
 		smb.first.seq = sm.seq
 		smb.first.ts = sm.ts
+		smb.writeIndexInfoLocked()
 	}
+	// Per subject info will be regenerated on demand.
+	smb.fss = nil
 	smb.mu.Unlock()
 
+	var cb StorageUpdateHandler
 	if sm != nil {
 		// Reset our version of first.
 		fs.mu.Lock()
@@ -2869,10 +5092,18 @@ func (fs *fileStore) Compact(seq uint64) (uint64, error) {
 		fs.state.FirstTime = time.Unix(0, sm.ts).UTC()
 		fs.state.Msgs -= purged
 		fs.state.Bytes -= bytes
+		// Per subject index will be rebuilt when needed.
+		fs.psim = nil
+		fs.ttls.removeOutside(sm.seq, fs.state.LastSeq)
+		cb = fs.scb
 		fs.mu.Unlock()
 	}
 
-	return purged, nil
+	if cb != nil {
+		cb(-int64(purged), -int64(bytes), 0, _EMPTY_)
+	}
+
+	return purged, aerr
 }
 
 // Truncate will truncate a stream store up to and including seq. Sequence needs to be valid.
@@ -2888,15 +5119,32 @@ func (fs *fileStore) Truncate(seq uint64) error {
 		return ErrStoreSnapshotInProgress
 	}
 
+	purged, bytes, err := fs.truncate(seq)
+	if purged == 0 && err != nil {
+		fs.mu.Unlock()
+		return err
+	}
+	cb := fs.scb
+	fs.mu.Unlock()
+
+	if cb != nil {
+		cb(-int64(purged), -int64(bytes), 0, _EMPTY_)
+	}
+
+	return err
+}
+
+// Truncate up to and including seq, returning the number of msgs and bytes removed.
+// Any error removing left over blocks from the archive is returned along with them.
+// Lock should be held.
+func (fs *fileStore) truncate(seq uint64) (uint64, uint64, error) {
 	nlmb := fs.selectMsgBlock(seq)
 	if nlmb == nil {
-		fs.mu.Unlock()
-		return ErrInvalidSequence
+		return 0, 0, ErrInvalidSequence
 	}
 	lsm, _ := nlmb.fetchMsg(seq)
 	if lsm == nil {
-		fs.mu.Unlock()
-		return ErrInvalidSequence
+		return 0, 0, ErrInvalidSequence
 	}
 
 	// Set lmb to nlmb and make sure writeable.
@@ -2908,8 +5156,7 @@ func (fs *fileStore) Truncate(seq uint64) error {
 	// Truncate our new last message block.
 	nmsgs, nbytes, err := nlmb.truncate(lsm)
 	if err != nil {
-		fs.mu.Unlock()
-		return err
+		return 0, 0, err
 	}
 	// Account for the truncated msgs and bytes.
 	purged += nmsgs
@@ -2917,11 +5164,14 @@ func (fs *fileStore) Truncate(seq uint64) error {
 
 	// Remove any left over msg blocks.
 	getLastMsgBlock := func() *msgBlock { return fs.blks[len(fs.blks)-1] }
+	var aerr error
 	for mb := getLastMsgBlock(); mb != nlmb; mb = getLastMsgBlock() {
 		mb.mu.Lock()
 		purged += mb.msgs
 		bytes += mb.bytes
-		fs.removeMsgBlock(mb)
+		if err := fs.removeMsgBlock(mb); err != nil && aerr == nil {
+			aerr = err
+		}
 		mb.mu.Unlock()
 	}
 
@@ -2931,15 +5181,11 @@ func (fs *fileStore) Truncate(seq uint64) error {
 	// Update msgs and bytes.
 	fs.state.Msgs -= purged
 	fs.state.Bytes -= bytes
+	// Per subject index will be rebuilt when needed.
+	fs.psim = nil
+	fs.ttls.removeOutside(fs.state.FirstSeq, lsm.seq)
 
-	cb := fs.scb
-	fs.mu.Unlock()
-
-	if cb != nil {
-		cb(-int64(purged), -int64(bytes), 0, _EMPTY_)
-	}
-
-	return nil
+	return purged, bytes, aerr
 }
 
 func (fs *fileStore) lastSeq() uint64 {
@@ -2969,10 +5215,11 @@ func (mb *msgBlock) removeIndexFile() {
 	}
 }
 
-// Removes the msgBlock
+// Removes the msgBlock. The block is always removed, but we will return
+// any error from removing it from the archive.
 // Both locks should be held.
-func (fs *fileStore) removeMsgBlock(mb *msgBlock) {
-	mb.dirtyCloseWithRemove(true)
+func (fs *fileStore) removeMsgBlock(mb *msgBlock) error {
+	err := mb.dirtyCloseWithRemove(true)
 
 	// Remove from list.
 	for i, omb := range fs.blks {
@@ -2989,6 +5236,7 @@ func (fs *fileStore) removeMsgBlock(mb *msgBlock) {
 		fs.newMsgBlockForWrite()
 		mb.mu.Lock()
 	}
+	return err
 }
 
 // Called by purge to simply get rid of the cache and close our fds.
@@ -3000,10 +5248,11 @@ func (mb *msgBlock) dirtyClose() {
 }
 
 // Should be called with lock held.
-func (mb *msgBlock) dirtyCloseWithRemove(remove bool) {
+func (mb *msgBlock) dirtyCloseWithRemove(remove bool) error {
 	if mb == nil {
-		return
+		return nil
 	}
+	mb.closed = true
 	// Close cache
 	mb.clearCacheAndOffset()
 	// Quit our loops.
@@ -3028,7 +5277,13 @@ func (mb *msgBlock) dirtyCloseWithRemove(remove bool) {
 			os.Remove(mb.mfn)
 			mb.mfn = _EMPTY_
 		}
+		if mb.kfn != _EMPTY_ {
+			os.Remove(mb.kfn)
+			mb.kfn = _EMPTY_
+		}
+		return mb.removeFromArchive()
 	}
+	return nil
 }
 
 func (mb *msgBlock) close(sync bool) {
@@ -3038,6 +5293,7 @@ func (mb *msgBlock) close(sync bool) {
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
+	mb.closed = true
 	if mb.qch == nil {
 		return
 	}
@@ -3086,11 +5342,18 @@ func (fs *fileStore) Stop() error {
 
 	fs.checkAndFlushAllBlocks()
 	fs.closeAllMsgBlocks(false)
+	if fs.cfg.AllowMsgTTL {
+		fs.writeMsgTTLIndex()
+	}
 
 	if fs.syncTmr != nil {
 		fs.syncTmr.Stop()
 		fs.syncTmr = nil
 	}
+	if fs.archTmr != nil {
+		fs.archTmr.Stop()
+		fs.archTmr = nil
+	}
 	if fs.ageChk != nil {
 		fs.ageChk.Stop()
 		fs.ageChk = nil
@@ -3171,6 +5434,17 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, state *StreamState, includ
 		writeErr(fmt.Sprintf("Could not read stream checksum file: %v", err))
 		return
 	}
+	// Snapshots are always in the clear so they can be restored with or without encryption.
+	if fs.aek != nil {
+		if meta, err = openWithNonce(fs.aek, meta); err != nil {
+			fs.mu.Unlock()
+			writeErr(fmt.Sprintf("Could not decrypt stream meta file: %v", err))
+			return
+		}
+		fs.hh.Reset()
+		fs.hh.Write(meta)
+		sum = []byte(hex.EncodeToString(fs.hh.Sum(nil)))
+	}
 	fs.mu.Unlock()
 
 	// Meta first.
@@ -3191,26 +5465,41 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, state *StreamState, includ
 			mb.writeIndexInfo()
 		}
 		mb.mu.Lock()
-		buf, err := ioutil.ReadFile(mb.ifn)
+		ibuf, err := ioutil.ReadFile(mb.ifn)
 		if err != nil {
 			mb.mu.Unlock()
 			writeErr(fmt.Sprintf("Could not read message block [%d] meta file: %v", mb.index, err))
 			return
 		}
-		if writeFile(msgPre+fmt.Sprintf(indexScan, mb.index), buf) != nil {
-			mb.mu.Unlock()
-			return
-		}
 		// We could stream but don't want to hold the lock and prevent changes, so just read in and
 		// release the lock for now.
 		// TODO(dlc) - Maybe reuse buffer?
-		buf, err = ioutil.ReadFile(mb.mfn)
+		buf, err := mb.readBlockFile()
 		if err != nil {
 			mb.mu.Unlock()
 			writeErr(fmt.Sprintf("Could not read message block [%d]: %v", mb.index, err))
 			return
 		}
+		// If encrypted, decrypt and recalculate our checksums without our secret.
+		// We need to be uncompressed for that, but the snapshot itself is compressed.
+		if mb.aek != nil {
+			if buf, err = openBlockFrames(mb.aek, buf, 0); err != nil {
+				mb.mu.Unlock()
+				writeErr(fmt.Sprintf("Could not decrypt message block [%d]: %v", mb.index, err))
+				return
+			}
+			if buf, err = mb.decompressIfNeeded(buf); err != nil {
+				mb.mu.Unlock()
+				writeErr(fmt.Sprintf("Could not decompress message block [%d]: %v", mb.index, err))
+				return
+			}
+			hh, _ := fs.hashForBlock(mb.index, false)
+			ibuf = mb.encodeIndexInfo(rehashMsgBlock(buf, hh))
+		}
 		mb.mu.Unlock()
+		if writeFile(msgPre+fmt.Sprintf(indexScan, mb.index), ibuf) != nil {
+			return
+		}
 		// Do this one unlocked.
 		if writeFile(msgPre+fmt.Sprintf(blkScan, mb.index), buf) != nil {
 			return
@@ -3241,6 +5530,16 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, state *StreamState, includ
 			writeErr(fmt.Sprintf("Could not read consumer checksum file for %q: %v", o.name, err))
 			return
 		}
+		if o.aek != nil {
+			if meta, err = openWithNonce(o.aek, meta); err != nil {
+				o.mu.Unlock()
+				writeErr(fmt.Sprintf("Could not decrypt consumer meta file for %q: %v", o.name, err))
+				return
+			}
+			o.hh.Reset()
+			o.hh.Write(meta)
+			sum = []byte(hex.EncodeToString(o.hh.Sum(nil)))
+		}
 
 		// We can have the running state directly encoded now.
 		state, err := o.encodeState()
@@ -3322,6 +5621,7 @@ type consumerFileStore struct {
 	ifd     *os.File
 	lwsz    int64
 	hh      hash.Hash64
+	aek     cipher.AEAD
 	state   ConsumerState
 	fch     chan struct{}
 	qch     chan struct{}
@@ -3359,6 +5659,13 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 	}
 	o.hh = hh
 
+	// Setup our encryption keys if needed. Existing state will be converted.
+	if fs.prf != nil {
+		if err := o.setupEncryption(); err != nil {
+			return nil, err
+		}
+	}
+
 	// Write our meta data iff does not exist.
 	meta := path.Join(odir, JetStreamMetaFile)
 	if _, err := os.Stat(meta); err != nil && os.IsNotExist(err) {
@@ -3380,6 +5687,61 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 	return o, nil
 }
 
+// Setup our encryption keys. If we do not have any yet any existing meta
+// and state was written in the clear and will be converted.
+func (o *consumerFileStore) setupEncryption() error {
+	fs := o.fs
+	context := fs.cfg.Name + "/" + o.name
+	kfn := path.Join(o.odir, JetStreamMetaFileKey)
+	ekey, err := ioutil.ReadFile(kfn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sc, seed := fs.fcfg.Cipher, []byte(nil)
+	if err == nil {
+		if sc, seed, err = decryptEncryptionKeys(fs.prf, context, ekey); err != nil {
+			return err
+		}
+	} else {
+		if seed, ekey, err = genEncryptionKeys(fs.prf, sc, context, seedSize); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(kfn, ekey); err != nil {
+			return err
+		}
+	}
+	if o.aek, err = genEncryptionKey(sc, seed); err != nil {
+		return err
+	}
+
+	// Convert anything still in the clear. Our key file is written first, so we may
+	// have stopped part way through a conversion, so we check each file on its own.
+	if buf, err := ioutil.ReadFile(o.ifn); err == nil && len(buf) > 0 {
+		if _, err := openWithNonce(o.aek, buf); err != nil {
+			if buf, err = sealWithNonce(o.aek, buf); err == nil {
+				err = writeFileAtomic(o.ifn, buf)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Convert our meta, keeping our original created time.
+	meta := path.Join(o.odir, JetStreamMetaFile)
+	buf, err := ioutil.ReadFile(meta)
+	if err != nil {
+		return nil
+	}
+	if _, err := openWithNonce(o.aek, buf); err == nil {
+		return nil
+	}
+	var cfg FileConsumerInfo
+	if err := json.Unmarshal(buf, &cfg); err == nil {
+		o.cfg.Created = cfg.Created
+	}
+	return o.writeConsumerMetaFile()
+}
+
 // Kick flusher for this consumer.
 // Lock should be held.
 func (o *consumerFileStore) kickFlusher() {
@@ -3672,10 +6034,23 @@ func (o *consumerFileStore) writeState(buf []byte) error {
 		return err
 	}
 	o.writing = true
-	ifd := o.ifd
+	ifd, aek := o.ifd, o.aek
 	o.mu.Unlock()
 
-	n, err := ifd.WriteAt(buf, 0)
+	// Encrypt if needed.
+	var err error
+	if aek != nil {
+		buf, err = sealWithNonce(aek, buf)
+	}
+
+	var n int
+	if err == nil {
+		n, err = ifd.WriteAt(buf, 0)
+	}
+	// A sealed state will not open with any trailing bytes left from a longer one.
+	if err == nil && aek != nil {
+		err = ifd.Truncate(int64(n))
+	}
 
 	o.mu.Lock()
 	if err == nil {
@@ -3687,12 +6062,14 @@ func (o *consumerFileStore) writeState(buf []byte) error {
 	return err
 }
 
-// Will upodate the config. Only used when recovering ephemerals.
+// Will update the config. Used when recovering ephemerals and on consumer updates.
 func (o *consumerFileStore) updateConfig(cfg ConsumerConfig) error {
 	o.mu.Lock()
 	defer o.mu.Unlock()
-	o.cfg = &FileConsumerInfo{ConsumerConfig: cfg}
-	return o.writeConsumerMeta()
+	// Keep our created time and name.
+	o.cfg = &FileConsumerInfo{Created: o.cfg.Created, Name: o.cfg.Name, ConsumerConfig: cfg}
+	// Replace the existing meta file in place.
+	return o.writeConsumerMetaFile()
 }
 
 // Write out the consumer meta data, i.e. state.
@@ -3702,21 +6079,42 @@ func (cfs *consumerFileStore) writeConsumerMeta() error {
 	if _, err := os.Stat(meta); (err != nil && !os.IsNotExist(err)) || err == nil {
 		return err
 	}
+	return cfs.writeConsumerMetaFile()
+}
+
+// Write out the consumer meta data and its checksum, replacing any existing
+// files atomically so a crash never leaves us without a config.
+// Lock should be held.
+func (cfs *consumerFileStore) writeConsumerMetaFile() error {
+	meta := path.Join(cfs.odir, JetStreamMetaFile)
 	b, err := json.Marshal(cfs.cfg)
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(meta, b, 0644); err != nil {
+	// Encrypt if needed.
+	if cfs.aek != nil {
+		if b, err = sealWithNonce(cfs.aek, b); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(meta, b); err != nil {
 		return err
 	}
 	cfs.hh.Reset()
 	cfs.hh.Write(b)
 	checksum := hex.EncodeToString(cfs.hh.Sum(nil))
 	sum := path.Join(cfs.odir, JetStreamMetaFileSum)
-	if err := ioutil.WriteFile(sum, []byte(checksum), 0644); err != nil {
+	return writeFileAtomic(sum, []byte(checksum))
+}
+
+// writeFileAtomic writes to a temporary file and renames it over fn.
+func writeFileAtomic(fn string, b []byte) error {
+	tfn := fn + ".tmp"
+	if err := ioutil.WriteFile(tfn, b, 0644); err != nil {
+		os.Remove(tfn)
 		return err
 	}
-	return nil
+	return os.Rename(tfn, fn)
 }
 
 func (o *consumerFileStore) syncStateFile() {
@@ -3809,6 +6207,13 @@ func (o *consumerFileStore) State() (*ConsumerState, error) {
 		return state, nil
 	}
 
+	// Decrypt if needed.
+	if o.aek != nil {
+		if buf, err = openWithNonce(o.aek, buf); err != nil {
+			return nil, err
+		}
+	}
+
 	state, err = decodeConsumerState(buf)
 	if err != nil {
 		return nil, err
@@ -3949,7 +6354,16 @@ func (o *consumerFileStore) Stop() error {
 			var buf []byte
 			// Make sure to write this out..
 			if buf, err = o.encodeState(); err == nil && len(buf) > 0 {
-				_, err = o.ifd.WriteAt(buf, 0)
+				if o.aek != nil {
+					buf, err = sealWithNonce(o.aek, buf)
+				}
+				var n int
+				if err == nil {
+					n, err = o.ifd.WriteAt(buf, 0)
+				}
+				if err == nil {
+					err = o.ifd.Truncate(int64(n))
+				}
 			}
 		}
 	}
@@ -16,6 +16,8 @@ package server
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -1369,7 +1371,7 @@ func TestFileStoreMeta(t *testing.T) {
 	if err := json.Unmarshal(buf, &oconfig2); err != nil {
 		t.Fatalf("Error unmarshalling: %v", err)
 	}
-	if oconfig2 != oconfig {
+	if !reflect.DeepEqual(oconfig2, oconfig) {
 		t.Fatalf("Consumer configs not equal, got %+v vs %+v", oconfig2, oconfig)
 	}
 	checksum, err = ioutil.ReadFile(ometasum)
@@ -2393,6 +2395,44 @@ func TestFileStoreConsumerRedeliveredLost(t *testing.T) {
 	}
 }
 
+func TestFileStoreConsumerUpdateConfig(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fs, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, StreamConfig{Name: "zzz", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	o, err := fs.ConsumerStore("o22", &ConsumerConfig{Durable: "o22", AckPolicy: AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexepected error: %v", err)
+	}
+	defer o.Stop()
+	cfs := o.(*consumerFileStore)
+
+	if err := cfs.updateConfig(ConsumerConfig{Durable: "o22", AckPolicy: AckExplicit, MaxDeliver: 22}); err != nil {
+		t.Fatalf("Unexepected error: %v", err)
+	}
+	// The meta file should have been replaced, with nothing left behind.
+	buf, err := ioutil.ReadFile(path.Join(cfs.odir, JetStreamMetaFile))
+	if err != nil {
+		t.Fatalf("Unexepected error: %v", err)
+	}
+	var cfg FileConsumerInfo
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		t.Fatalf("Unexepected error: %v", err)
+	}
+	if cfg.MaxDeliver != 22 {
+		t.Fatalf("Expected updated config, got %+v", cfg.ConsumerConfig)
+	}
+	if _, err := os.Stat(path.Join(cfs.odir, JetStreamMetaFile+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no temporary meta file, got %v", err)
+	}
+}
+
 func TestFileStoreConsumerFlusher(t *testing.T) {
 	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
 	os.MkdirAll(storeDir, 0755)
@@ -2763,3 +2803,1948 @@ func TestFileStoreStreamDeleteCacheBug(t *testing.T) {
 		t.Fatalf("Unexpected error looking up msg: %v", err)
 	}
 }
+
+func TestFileStorePerSubjectMsgLimit(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 256}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, MaxMsgsPer: 3}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("Hello World")
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg("foo", nil, msg)
+		fs.StoreMsg("bar", nil, msg)
+	}
+
+	checkState := func(msgs, first uint64) {
+		t.Helper()
+		state := fs.State()
+		if state.Msgs != msgs {
+			t.Fatalf("Expected %d msgs, got %d", msgs, state.Msgs)
+		}
+		if state.FirstSeq != first {
+			t.Fatalf("Expected the first sequence to be %d, got %d", first, state.FirstSeq)
+		}
+	}
+	checkState(6, 15)
+
+	// Make sure we span multiple blocks here.
+	if fs.numMsgBlocks() < 2 {
+		t.Fatalf("Expected multiple msg blocks, got %d", fs.numMsgBlocks())
+	}
+
+	// Remove an interior message and make sure we still enforce correctly.
+	fs.RemoveMsg(17)
+	fs.StoreMsg("foo", nil, msg)
+	fs.StoreMsg("foo", nil, msg)
+	checkState(6, 16)
+
+	fs.mu.Lock()
+	nmsgs, first := fs.perSubjectState("foo")
+	fs.mu.Unlock()
+	if nmsgs != 3 || first != 19 {
+		t.Fatalf("Expected 3 foo msgs with first of 19, got %d and %d", nmsgs, first)
+	}
+
+	// Restart and make sure we regenerate our per subject state and continue to enforce.
+	fs.Stop()
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	fs.StoreMsg("bar", nil, msg)
+	checkState(6, 18)
+
+	// Our per subject index should be kept up to date from here on.
+	fs.RemoveMsg(18)
+	fs.mu.Lock()
+	nmsgs, first = fs.perSubjectState("bar")
+	fs.mu.Unlock()
+	if nmsgs != 2 || first != 20 {
+		t.Fatalf("Expected 2 bar msgs with first of 20, got %d and %d", nmsgs, first)
+	}
+	fs.StoreMsg("bar", nil, msg)
+	checkState(6, 19)
+
+	// Lowering the limit should be applied to existing subjects.
+	cfg.MaxMsgsPer = 1
+	if err := fs.UpdateConfig(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkState(2, 22)
+	if subj, _, _, _, err := fs.LoadMsg(24); err != nil || subj != "bar" {
+		t.Fatalf("Expected last bar msg at seq 24, got %q, %v", subj, err)
+	}
+}
+
+func TestFileStoreLoadLastMsg(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	// Small blocks so subjects span multiple blocks.
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 256}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("Hello World")
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg("foo.A", nil, msg)
+		fs.StoreMsg("foo.B", nil, msg)
+		fs.StoreMsg("bar", nil, msg)
+	}
+	// Push the foo subjects into older blocks.
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg("bar", nil, msg)
+	}
+
+	expectLast := func(filter string, lseq uint64) {
+		t.Helper()
+		_, seq, _, _, _, err := fs.LoadLastMsg(filter)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if seq != lseq {
+			t.Fatalf("Expected last seq of %d for %q, got %d", lseq, filter, seq)
+		}
+		if filter != _EMPTY_ && !subjectHasWildcard(filter) {
+			if seq := fs.LastSeqForSubject(filter); seq != lseq {
+				t.Fatalf("Expected indexed last seq of %d for %q, got %d", lseq, filter, seq)
+			}
+		}
+	}
+	checkAll := func() {
+		t.Helper()
+		expectLast("foo.A", 28)
+		expectLast("foo.B", 29)
+		expectLast("bar", 40)
+		expectLast("foo.*", 29)
+		expectLast(_EMPTY_, 40)
+	}
+	checkAll()
+
+	// Restart and make sure we regenerate the per subject info.
+	fs.Stop()
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	checkAll()
+
+	// Removing the last should select the prior one.
+	fs.RemoveMsg(29)
+	expectLast("foo.B", 26)
+	expectLast("foo.*", 28)
+	fs.RemoveMsg(40)
+	fs.RemoveMsg(39)
+	expectLast(_EMPTY_, 38)
+	expectLast(">", 38)
+	expectLast("bar", 38)
+
+	// Looking for a subject we do not have should not need to load any blocks.
+	// Drop our caches and the per subject info for the blocks, the index is kept.
+	fs.mu.RLock()
+	for _, mb := range fs.blks {
+		mb.mu.Lock()
+		mb.clearCache()
+		mb.fss = nil
+		mb.mu.Unlock()
+	}
+	fs.mu.RUnlock()
+	cloads := fs.cacheLoads()
+	if _, _, _, _, _, err := fs.LoadLastMsg("baz"); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected a not found error, got %v", err)
+	}
+	if seq := fs.LastSeqForSubject("baz"); seq != 0 {
+		t.Fatalf("Expected no last seq, got %d", seq)
+	}
+	if n := fs.cacheLoads() - cloads; n != 0 {
+		t.Fatalf("Expected no cache loads, got %d", n)
+	}
+}
+
+func testFileStorePRF(key string) keyGen {
+	return func(context []byte) ([]byte, error) {
+		h := hmac.New(sha256.New, []byte(key))
+		if _, err := h.Write(context); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+}
+
+// Make sure that none of the files in dir contain data in the clear.
+func checkFileStoreEncrypted(t *testing.T, dir string, plain []byte) {
+	t.Helper()
+	err := filepath.Walk(dir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		buf, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(buf, plain) {
+			return fmt.Errorf("found %q in the clear in %q", plain, fpath)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestFileStoreEncrypted(t *testing.T) {
+	for _, sc := range []StoreCipher{ChaCha, AES} {
+		t.Run(sc.String(), func(t *testing.T) {
+			storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+			defer os.RemoveAll(storeDir)
+
+			fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 1024, Cipher: sc}
+			cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+			prf := testFileStorePRF("dlc22")
+
+			fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+
+			subj, msg := "secret.subject", []byte("ENCRYPTED PAYLOAD")
+			hdr := []byte("NATS/1.0\r\nSecret-Header: 22\r\n\r\n")
+			for i := 0; i < 100; i++ {
+				if _, _, err := fs.StoreMsg(subj, hdr, msg); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			if fs.numMsgBlocks() < 2 {
+				t.Fatalf("Expected multiple message blocks, got %d", fs.numMsgBlocks())
+			}
+			fs.RemoveMsg(10)
+			fs.EraseMsg(20)
+
+			o, err := fs.ConsumerStore("secret-consumer", &ConsumerConfig{Durable: "secret-consumer", AckPolicy: AckExplicit})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			ostate := &ConsumerState{}
+			ostate.Delivered.Consumer, ostate.Delivered.Stream = 50, 50
+			ostate.AckFloor.Consumer, ostate.AckFloor.Stream = 40, 40
+			if err := o.Update(ostate); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			// Consumers are recovered by the upper layers.
+			state := fs.State()
+			state.Consumers = 0
+			o.Stop()
+			fs.Stop()
+
+			checkFileStoreEncrypted(t, storeDir, msg)
+			checkFileStoreEncrypted(t, storeDir, []byte(subj))
+			checkFileStoreEncrypted(t, storeDir, []byte("Secret-Header"))
+			checkFileStoreEncrypted(t, storeDir, []byte("secret-consumer"))
+
+			// Can not open without our key, or with the wrong one.
+			if _, err := newFileStore(fcfg, cfg); err == nil {
+				t.Fatalf("Expected an error opening an encrypted store without a key")
+			}
+			if _, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), testFileStorePRF("bad")); err == nil {
+				t.Fatalf("Expected an error opening an encrypted store with the wrong key")
+			}
+
+			// Changing our configured cipher should not matter for existing stores.
+			fcfg.Cipher = ChaCha + AES - sc
+			fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+
+			if rstate := fs.State(); !reflect.DeepEqual(rstate, state) {
+				t.Fatalf("Restored state does not match:\n%+v\n\n%+v", rstate, state)
+			}
+			for _, seq := range []uint64{1, 50, 100} {
+				_, rhdr, rmsg, _, err := fs.LoadMsg(seq)
+				if err != nil {
+					t.Fatalf("Unexpected error loading %d: %v", seq, err)
+				}
+				if !bytes.Equal(rhdr, hdr) || !bytes.Equal(rmsg, msg) {
+					t.Fatalf("Message %d does not match", seq)
+				}
+			}
+			for _, seq := range []uint64{10, 20} {
+				if _, _, _, _, err := fs.LoadMsg(seq); err == nil {
+					t.Fatalf("Expected an error loading removed message %d", seq)
+				}
+			}
+
+			o, err = fs.ConsumerStore("secret-consumer", &ConsumerConfig{Durable: "secret-consumer", AckPolicy: AckExplicit})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if rostate, err := o.State(); err != nil || !reflect.DeepEqual(rostate, ostate) {
+				t.Fatalf("Restored consumer state does not match: %+v vs %+v, %v", rostate, ostate, err)
+			}
+
+			// Truncate and write over the same offsets again.
+			if err := fs.Truncate(90); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for i := 0; i < 10; i++ {
+				fs.StoreMsg(subj, nil, []byte("NEW PAYLOAD"))
+			}
+			o.Stop()
+			state = fs.State()
+			fs.Stop()
+			checkFileStoreEncrypted(t, storeDir, []byte("NEW PAYLOAD"))
+
+			fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+			if rstate := fs.State(); !reflect.DeepEqual(rstate, state) {
+				t.Fatalf("Restored state does not match:\n%+v\n\n%+v", rstate, state)
+			}
+			if _, _, rmsg, _, err := fs.LoadMsg(91); err != nil || string(rmsg) != "NEW PAYLOAD" {
+				t.Fatalf("Unexpected message: %q, %v", rmsg, err)
+			}
+		})
+	}
+}
+
+func TestFileStoreEncryptedKeyRotationRecovery(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, Cipher: ChaCha}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	prf := testFileStorePRF("dlc22")
+
+	fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("ENCRYPTED PAYLOAD")
+	for i := 0; i < 20; i++ {
+		fs.StoreMsg("foo", nil, msg)
+	}
+
+	mdir := path.Join(storeDir, msgDir)
+	kfn := path.Join(mdir, fmt.Sprintf(keyScan, 1))
+	tkfn := path.Join(mdir, fmt.Sprintf(keyTmpScan, 1))
+	tmp := path.Join(mdir, fmt.Sprintf(tmpScan, 1))
+
+	okey, err := ioutil.ReadFile(kfn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fs.mu.RLock()
+	mb := fs.blks[0]
+	fs.mu.RUnlock()
+	mb.mu.Lock()
+	buf, err := mb.loadBlock()
+	if err == nil {
+		err = mb.writeBlock(buf, NoCompression)
+	}
+	mb.mu.Unlock()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fs.Stop()
+
+	checkMsgs := func() {
+		t.Helper()
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer fs.Stop()
+		if state := fs.State(); state.Msgs != 20 {
+			t.Fatalf("Expected 20 msgs, got %d", state.Msgs)
+		}
+		for seq := uint64(1); seq <= 20; seq++ {
+			if _, _, rmsg, _, err := fs.LoadMsg(seq); err != nil || !bytes.Equal(rmsg, msg) {
+				t.Fatalf("Unexpected message %d: %q, %v", seq, rmsg, err)
+			}
+		}
+		for _, fn := range []string{tkfn, tmp} {
+			if _, err := os.Stat(fn); err == nil {
+				t.Fatalf("Expected %q to be removed", fn)
+			}
+		}
+	}
+
+	// Simulate a crash after the new block was renamed in place but before its key file.
+	nkey, err := ioutil.ReadFile(kfn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if bytes.Equal(nkey, okey) {
+		t.Fatalf("Expected new keys after rotating")
+	}
+	ioutil.WriteFile(tkfn, nkey, 0644)
+	ioutil.WriteFile(kfn, okey, 0644)
+	checkMsgs()
+
+	// Simulate a crash before the new block was renamed in place.
+	ioutil.WriteFile(tmp, []byte("partial block"), 0644)
+	ioutil.WriteFile(tkfn, okey, 0644)
+	checkMsgs()
+}
+
+func TestFileStoreEncryptedBlockIntegrity(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, Cipher: AES}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	prf := testFileStorePRF("dlc22")
+
+	fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("ENCRYPTED PAYLOAD")
+	for i := 0; i < 20; i++ {
+		fs.StoreMsg("foo", nil, msg)
+	}
+	fs.Stop()
+
+	mfn := path.Join(storeDir, msgDir, fmt.Sprintf(blkScan, 1))
+	buf, err := ioutil.ReadFile(mfn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Simulate a crash while appending a frame. We should keep everything before it.
+	ioutil.WriteFile(mfn, append(append([]byte(nil), buf...), buf[:40]...), 0644)
+	fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if state := fs.State(); state.Msgs != 20 {
+		t.Fatalf("Expected 20 msgs, got %d", state.Msgs)
+	}
+	fs.StoreMsg("foo", nil, msg)
+	fs.Stop()
+
+	fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	for seq := uint64(1); seq <= 21; seq++ {
+		if _, _, rmsg, _, err := fs.LoadMsg(seq); err != nil || !bytes.Equal(rmsg, msg) {
+			t.Fatalf("Unexpected message %d: %q, %v", seq, rmsg, err)
+		}
+	}
+	fs.Stop()
+
+	// Any change to our records should be detected, not returned.
+	buf, err = ioutil.ReadFile(mfn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buf[len(buf)/2] ^= 0xff
+	ioutil.WriteFile(mfn, buf, 0644)
+
+	fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	for seq := uint64(1); seq <= 21; seq++ {
+		if _, _, rmsg, _, err := fs.LoadMsg(seq); err == nil && !bytes.Equal(rmsg, msg) {
+			t.Fatalf("Unexpected message %d: %q", seq, rmsg)
+		}
+	}
+}
+
+func TestFileStoreEncryptedStateShrinks(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, Cipher: ChaCha}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	prf := testFileStorePRF("dlc22")
+
+	fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("ENCRYPTED PAYLOAD")
+	for i := 0; i < 100; i++ {
+		fs.StoreMsg("foo", nil, msg)
+	}
+	ocfg := &ConsumerConfig{Durable: "o22", AckPolicy: AckExplicit}
+	o, err := fs.ConsumerStore("o22", ocfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ts := time.Now().UnixNano()
+	for i := uint64(1); i <= 100; i++ {
+		if err := o.UpdateDelivered(i, i, 1, ts); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// Make sure the state with all pending is written out.
+	ofs := o.(*consumerFileStore)
+	buf, err := ofs.encodeState()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := ofs.writeState(buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := uint64(1); i <= 100; i++ {
+		if err := o.UpdateAcks(i, i); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Our block index will shrink once the interior deletes are below our first sequence.
+	for seq := uint64(2); seq <= 50; seq++ {
+		fs.RemoveMsg(seq)
+	}
+	fs.lmb.writeIndexInfo()
+	fs.RemoveMsg(1)
+	o.Stop()
+	fs.Stop()
+
+	fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if cls := fs.cacheLoads(); cls != 0 {
+		t.Fatalf("Expected our index to be used without loading the block, got %d loads", cls)
+	}
+	if state := fs.State(); state.Msgs != 50 || state.FirstSeq != 51 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	o, err = fs.ConsumerStore("o22", ocfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer o.Stop()
+	state, err := o.State()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(state.Pending) != 0 || state.AckFloor.Stream != 100 {
+		t.Fatalf("Unexpected consumer state: %+v", state)
+	}
+}
+
+func TestFileStoreEncryptedConversionInterrupted(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	created := time.Now().UTC().Add(-time.Hour)
+
+	fs, err := newFileStoreWithCreated(fcfg, cfg, created, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	msg := []byte("PLAIN PAYLOAD")
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg("foo", nil, msg)
+	}
+	o, err := fs.ConsumerStore("dlc", &ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ostate := &ConsumerState{}
+	ostate.Delivered.Consumer, ostate.Delivered.Stream = 5, 5
+	ostate.AckFloor.Consumer, ostate.AckFloor.Stream = 2, 2
+	o.Update(ostate)
+	o.Stop()
+	fs.Stop()
+
+	// Hold onto our meta files in the clear.
+	odir := path.Join(storeDir, consumerDir, "dlc")
+	var plain []string
+	for _, dir := range []string{storeDir, odir} {
+		plain = append(plain, path.Join(dir, JetStreamMetaFile), path.Join(dir, JetStreamMetaFileSum))
+	}
+	plain = append(plain, path.Join(odir, consumerState))
+	pbufs := make(map[string][]byte)
+	for _, fn := range plain {
+		buf, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		pbufs[fn] = buf
+	}
+
+	prf := testFileStorePRF("dlc22")
+	fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	o, err = fs.ConsumerStore("dlc", &ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	o.Stop()
+	fs.Stop()
+
+	// Simulate stopping after our key files were written but before our meta files were converted.
+	for fn, buf := range pbufs {
+		ioutil.WriteFile(fn, buf, 0644)
+	}
+	fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if !fs.cfg.Created.Equal(created) {
+		t.Fatalf("Expected created time to be preserved, got %v vs %v", fs.cfg.Created, created)
+	}
+	o, err = fs.ConsumerStore("dlc", &ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if rostate, err := o.State(); err != nil || !reflect.DeepEqual(rostate, ostate) {
+		t.Fatalf("Converted consumer state does not match: %+v vs %+v, %v", rostate, ostate, err)
+	}
+	o.Stop()
+	fs.Stop()
+	checkFileStoreEncrypted(t, storeDir, []byte("zzz"))
+	checkFileStoreEncrypted(t, storeDir, []byte("dlc"))
+}
+
+func TestFileStoreEncryptedConversion(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 1024}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	created := time.Now().UTC().Add(-time.Hour)
+
+	fs, err := newFileStoreWithCreated(fcfg, cfg, created, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("PLAIN PAYLOAD")
+	for i := 0; i < 100; i++ {
+		fs.StoreMsg("foo", nil, msg)
+	}
+	// These are only tracked in the index files.
+	for seq := uint64(20); seq <= 30; seq++ {
+		fs.RemoveMsg(seq)
+	}
+	o, err := fs.ConsumerStore("dlc", &ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ostate := &ConsumerState{}
+	ostate.Delivered.Consumer, ostate.Delivered.Stream = 10, 10
+	ostate.AckFloor.Consumer, ostate.AckFloor.Stream = 5, 5
+	o.Update(ostate)
+	o.Stop()
+	state := fs.State()
+	fs.Stop()
+
+	prf := testFileStorePRF("dlc22")
+	for i := 0; i < 2; i++ {
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer fs.Stop()
+		if rstate := fs.State(); !reflect.DeepEqual(rstate, state) {
+			t.Fatalf("Converted state does not match:\n%+v\n\n%+v", rstate, state)
+		}
+		if _, _, rmsg, _, err := fs.LoadMsg(100); err != nil || !bytes.Equal(rmsg, msg) {
+			t.Fatalf("Unexpected message: %q, %v", rmsg, err)
+		}
+		// Converting rewrites our meta, so make sure we kept our created time.
+		if i == 0 && !fs.cfg.Created.Equal(created) {
+			t.Fatalf("Expected created time to be preserved, got %v vs %v", fs.cfg.Created, created)
+		}
+		o, err = fs.ConsumerStore("dlc", &ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if rostate, err := o.State(); err != nil || !reflect.DeepEqual(rostate, ostate) {
+			t.Fatalf("Converted consumer state does not match: %+v vs %+v, %v", rostate, ostate, err)
+		}
+		o.Stop()
+		fs.Stop()
+		checkFileStoreEncrypted(t, storeDir, msg)
+	}
+}
+
+func TestFileStoreEncryptedSnapshot(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	prf := testFileStorePRF("dlc22")
+	fs, err := newFileStoreWithCreated(FileStoreConfig{StoreDir: storeDir, BlockSize: 1024}, cfg, time.Now(), prf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("SNAPSHOT PAYLOAD")
+	for i := 0; i < 100; i++ {
+		fs.StoreMsg("foo", nil, msg)
+	}
+	fs.RemoveMsg(22)
+	if _, err := fs.ConsumerStore("dlc", &ConsumerConfig{Durable: "dlc"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	state := fs.State()
+	state.Consumers = 0
+
+	r, err := fs.Snapshot(5*time.Second, true, true)
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+	snap, err := ioutil.ReadAll(r.Reader)
+	if err != nil {
+		t.Fatalf("Error reading snapshot: %v", err)
+	}
+
+	// Snapshots are in the clear, so they can be restored with or without encryption.
+	for _, rprf := range []keyGen{nil, testFileStorePRF("other")} {
+		rstoreDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+		defer os.RemoveAll(rstoreDir)
+
+		tr := tar.NewReader(s2.NewReader(bytes.NewReader(snap)))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Error getting next entry from snapshot: %v", err)
+			}
+			fpath := path.Join(rstoreDir, filepath.Clean(hdr.Name))
+			os.MkdirAll(filepath.Dir(fpath), 0755)
+			buf, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("Error reading snapshot entry: %v", err)
+			}
+			if strings.HasSuffix(hdr.Name, ".blk") && !bytes.Contains(buf, msg) {
+				t.Fatalf("Expected message block %q to be in the clear", hdr.Name)
+			}
+			if err := ioutil.WriteFile(fpath, buf, 0644); err != nil {
+				t.Fatalf("Error writing file[%s]: %v", fpath, err)
+			}
+		}
+
+		fsr, err := newFileStoreWithCreated(FileStoreConfig{StoreDir: rstoreDir}, cfg, time.Now(), rprf)
+		if err != nil {
+			t.Fatalf("Error restoring from snapshot: %v", err)
+		}
+		if rstate := fsr.State(); !reflect.DeepEqual(rstate, state) {
+			t.Fatalf("Restored state does not match:\n%+v\n\n%+v", rstate, state)
+		}
+		if _, _, rmsg, _, err := fsr.LoadMsg(100); err != nil || !bytes.Equal(rmsg, msg) {
+			t.Fatalf("Unexpected message: %q, %v", rmsg, err)
+		}
+		fsr.Stop()
+	}
+}
+
+func TestFileStoreCompression(t *testing.T) {
+	for _, prf := range []keyGen{nil, testFileStorePRF("dlc22")} {
+		name := "Plain"
+		if prf != nil {
+			name = "Encrypted"
+		}
+		t.Run(name, func(t *testing.T) {
+			storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+			defer os.RemoveAll(storeDir)
+
+			fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 4096}
+			cfg := StreamConfig{Name: "zzz", Storage: FileStorage, Compression: S2Compression}
+			fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+
+			subj, msg := "telemetry", bytes.Repeat([]byte(`{"sensor":"abc","temp":22.4,"unit":"C"}`), 10)
+			for i := 0; i < 100; i++ {
+				if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			if fs.numMsgBlocks() < 4 {
+				t.Fatalf("Expected multiple message blocks, got %d", fs.numMsgBlocks())
+			}
+
+			// All blocks but the last should be compressed in the background.
+			checkCompressed := func() {
+				t.Helper()
+				checkFor(t, 2*time.Second, 10*time.Millisecond, func() error {
+					fs.mu.RLock()
+					defer fs.mu.RUnlock()
+					for _, mb := range fs.blks {
+						mb.mu.RLock()
+						compressed := mb.cmp == S2Compression
+						mb.mu.RUnlock()
+						if mb == fs.lmb && compressed {
+							return fmt.Errorf("last message block should not be compressed")
+						} else if mb != fs.lmb && !compressed {
+							return fmt.Errorf("message block %d not compressed", mb.index)
+						}
+					}
+					return nil
+				})
+			}
+			checkCompressed()
+
+			state := fs.State()
+			if state.CompressedBytes == 0 || state.CompressedBytes >= state.Bytes/2 {
+				t.Fatalf("Expected compressed bytes to be much smaller than %d, got %d", state.Bytes, state.CompressedBytes)
+			}
+			if state.Bytes != 100*fileStoreMsgSize(subj, nil, msg) {
+				t.Fatalf("Expected bytes to be uncompressed, got %d", state.Bytes)
+			}
+
+			checkMsgs := func(fs *fileStore, seqs ...uint64) {
+				t.Helper()
+				for _, seq := range seqs {
+					rsubj, _, rmsg, _, err := fs.LoadMsg(seq)
+					if err != nil {
+						t.Fatalf("Unexpected error loading %d: %v", seq, err)
+					}
+					if rsubj != subj || !bytes.Equal(rmsg, msg) {
+						t.Fatalf("Message %d does not match", seq)
+					}
+				}
+			}
+			checkMsgs(fs, 1, 2, 10, 20, 50, 99, 100)
+
+			// Removes and erases from compressed blocks.
+			fs.RemoveMsg(10)
+			if ok, err := fs.EraseMsg(20); !ok || err != nil {
+				t.Fatalf("Unexpected erase result: %v, %v", ok, err)
+			}
+			for _, seq := range []uint64{10, 20} {
+				if _, _, _, _, err := fs.LoadMsg(seq); err == nil {
+					t.Fatalf("Expected an error loading removed message %d", seq)
+				}
+			}
+			checkMsgs(fs, 9, 11, 19, 21)
+
+			state = fs.State()
+			fs.Stop()
+
+			fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+			if rstate := fs.State(); !reflect.DeepEqual(rstate, state) {
+				t.Fatalf("Restored state does not match:\n%+v\n\n%+v", rstate, state)
+			}
+			// Compressed bytes should be what our block files take on disk.
+			blks, _ := filepath.Glob(path.Join(storeDir, msgDir, "*.blk"))
+			var dbytes uint64
+			for _, fn := range blks {
+				if fi, err := os.Stat(fn); err == nil {
+					dbytes += uint64(fi.Size())
+				}
+			}
+			if cbytes := fs.State().CompressedBytes; cbytes != dbytes {
+				t.Fatalf("Expected compressed bytes of %d, got %d", dbytes, cbytes)
+			}
+			checkMsgs(fs, 1, 19, 21, 100)
+			if _, _, _, _, err := fs.LoadMsg(20); err == nil {
+				t.Fatalf("Expected an error loading erased message")
+			}
+
+			// Snapshots should restore without the need for our keys.
+			r, err := fs.Snapshot(5*time.Second, false, false)
+			if err != nil {
+				t.Fatalf("Error creating snapshot: %v", err)
+			}
+			snap, err := ioutil.ReadAll(r.Reader)
+			if err != nil {
+				t.Fatalf("Error reading snapshot: %v", err)
+			}
+			rstoreDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+			defer os.RemoveAll(rstoreDir)
+			tr := tar.NewReader(s2.NewReader(bytes.NewReader(snap)))
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Error getting next entry from snapshot: %v", err)
+				}
+				fpath := path.Join(rstoreDir, filepath.Clean(hdr.Name))
+				os.MkdirAll(filepath.Dir(fpath), 0755)
+				buf, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatalf("Error reading snapshot entry: %v", err)
+				}
+				if err := ioutil.WriteFile(fpath, buf, 0644); err != nil {
+					t.Fatalf("Error writing file[%s]: %v", fpath, err)
+				}
+			}
+			fsr, err := newFileStore(FileStoreConfig{StoreDir: rstoreDir}, cfg)
+			if err != nil {
+				t.Fatalf("Error restoring from snapshot: %v", err)
+			}
+			if rstate := fsr.State(); rstate.Msgs != state.Msgs || rstate.Bytes != state.Bytes || rstate.FirstSeq != state.FirstSeq {
+				t.Fatalf("Restored state does not match:\n%+v\n\n%+v", rstate, state)
+			}
+			checkMsgs(fsr, 1, 19, 21, 100)
+			fsr.Stop()
+
+			// Truncate into a compressed block and write to it again.
+			if err := fs.Truncate(30); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			newMsg := []byte("NEW PAYLOAD")
+			for i := 0; i < 50; i++ {
+				fs.StoreMsg(subj, nil, newMsg)
+			}
+			checkCompressed()
+			checkMsgs(fs, 1, 29, 30)
+			if _, _, rmsg, _, err := fs.LoadMsg(31); err != nil || !bytes.Equal(rmsg, newMsg) {
+				t.Fatalf("Unexpected message: %q, %v", rmsg, err)
+			}
+			state = fs.State()
+			fs.Stop()
+
+			fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+			if rstate := fs.State(); !reflect.DeepEqual(rstate, state) {
+				t.Fatalf("Restored state does not match:\n%+v\n\n%+v", rstate, state)
+			}
+			if _, _, rmsg, _, err := fs.LoadMsg(80); err != nil || !bytes.Equal(rmsg, newMsg) {
+				t.Fatalf("Unexpected message: %q, %v", rmsg, err)
+			}
+		})
+	}
+}
+
+func TestFileStoreCompressAfterTruncate(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 4096}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, Compression: S2Compression}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	subj, msg := "telemetry", bytes.Repeat([]byte(`{"sensor":"abc","temp":22.4,"unit":"C"}`), 10)
+	for i := 0; i < 100; i++ {
+		if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// Grab the blocks as a pending compression would have before the truncate.
+	fs.mu.RLock()
+	blks := append([]*msgBlock(nil), fs.blks...)
+	fs.mu.RUnlock()
+
+	if err := fs.Truncate(30); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fs.compressMsgBlocks(blks, S2Compression)
+
+	fs.mu.RLock()
+	lmb := fs.lmb
+	fs.mu.RUnlock()
+	lmb.mu.RLock()
+	cmp := lmb.cmp
+	lmb.mu.RUnlock()
+	if cmp != NoCompression {
+		t.Fatalf("Expected the last message block to not be compressed")
+	}
+
+	newMsg := []byte("NEW PAYLOAD")
+	for i := 0; i < 50; i++ {
+		if _, _, err := fs.StoreMsg(subj, nil, newMsg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	checkMsgs := func() {
+		t.Helper()
+		for seq := uint64(1); seq <= 80; seq++ {
+			expected := msg
+			if seq > 30 {
+				expected = newMsg
+			}
+			if _, _, rmsg, _, err := fs.LoadMsg(seq); err != nil || !bytes.Equal(rmsg, expected) {
+				t.Fatalf("Unexpected message %d: %q, %v", seq, rmsg, err)
+			}
+		}
+	}
+	checkMsgs()
+
+	fs.Stop()
+	if fs, err = newFileStore(fcfg, cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if state := fs.State(); state.Msgs != 80 || state.LastSeq != 80 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	checkMsgs()
+}
+
+func TestFileStoreArchive(t *testing.T) {
+	for _, prf := range []keyGen{nil, testFileStorePRF("dlc22")} {
+		name := "Plain"
+		if prf != nil {
+			name = "Encrypted"
+		}
+		t.Run(name, func(t *testing.T) {
+			storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+			defer os.RemoveAll(storeDir)
+			archDir, _ := ioutil.TempDir("", "js-archive-")
+			defer os.RemoveAll(archDir)
+
+			fcfg := FileStoreConfig{
+				StoreDir:   storeDir,
+				BlockSize:  4096,
+				Archive:    NewDirBlockArchive(archDir),
+				ArchiveAge: 50 * time.Millisecond,
+			}
+			cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+			fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+
+			subj, msg := "telemetry", bytes.Repeat([]byte("Z"), 256)
+			for i := 0; i < 100; i++ {
+				if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			if fs.numMsgBlocks() < 4 {
+				t.Fatalf("Expected multiple message blocks, got %d", fs.numMsgBlocks())
+			}
+
+			// All blocks but the last should be moved to the archive.
+			checkArchived := func() {
+				t.Helper()
+				checkFor(t, 2*time.Second, 10*time.Millisecond, func() error {
+					fs.mu.RLock()
+					defer fs.mu.RUnlock()
+					for _, mb := range fs.blks {
+						mb.mu.RLock()
+						archived, mfn := mb.arch, mb.mfn
+						mb.mu.RUnlock()
+						if mb == fs.lmb && archived {
+							return fmt.Errorf("last message block should not be archived")
+						} else if mb != fs.lmb && !archived {
+							return fmt.Errorf("message block %d not archived", mb.index)
+						}
+						_, err := os.Stat(mfn)
+						if archived && err == nil {
+							return fmt.Errorf("message block %d still stored locally", mb.index)
+						}
+						_, err = os.Stat(path.Join(archDir, fmt.Sprintf(blkScan, mb.index)))
+						if archived != (err == nil) {
+							return fmt.Errorf("message block %d archive copy does not match", mb.index)
+						}
+					}
+					return nil
+				})
+			}
+			checkArchived()
+
+			state := fs.State()
+			if state.ArchivedBytes == 0 || state.ArchivedBytes >= state.Bytes {
+				t.Fatalf("Expected some but not all bytes to be archived, got %d of %d", state.ArchivedBytes, state.Bytes)
+			}
+			if state.Bytes != 100*fileStoreMsgSize(subj, nil, msg) {
+				t.Fatalf("Expected bytes to include archived blocks, got %d", state.Bytes)
+			}
+
+			checkMsgs := func(fs *fileStore, seqs ...uint64) {
+				t.Helper()
+				for _, seq := range seqs {
+					rsubj, _, rmsg, _, err := fs.LoadMsg(seq)
+					if err != nil {
+						t.Fatalf("Unexpected error loading %d: %v", seq, err)
+					}
+					if rsubj != subj || !bytes.Equal(rmsg, msg) {
+						t.Fatalf("Message %d does not match", seq)
+					}
+				}
+			}
+			checkMsgs(fs, 1, 2, 10, 20, 50, 99, 100)
+
+			// Removes and erases from archived blocks.
+			fs.RemoveMsg(10)
+			if ok, err := fs.EraseMsg(20); !ok || err != nil {
+				t.Fatalf("Unexpected erase result: %v, %v", ok, err)
+			}
+			for _, seq := range []uint64{10, 20} {
+				if _, _, _, _, err := fs.LoadMsg(seq); err == nil {
+					t.Fatalf("Expected an error loading removed message %d", seq)
+				}
+			}
+			checkMsgs(fs, 9, 11, 19, 21)
+			// The erased block was brought back to be rewritten and will be archived again.
+			checkArchived()
+			fs.Stop()
+
+			// We can not recover archived blocks without the archive.
+			ncfg := fcfg
+			ncfg.Archive = nil
+			if fs, err := newFileStoreWithCreated(ncfg, cfg, time.Now(), prf); err == nil {
+				fs.Stop()
+				t.Fatalf("Expected an error recovering without an archive")
+			}
+
+			fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+			if rstate := fs.State(); rstate.Msgs != state.Msgs-2 || rstate.FirstSeq != 1 || rstate.LastSeq != 100 || rstate.ArchivedBytes == 0 {
+				t.Fatalf("Restored state does not match: %+v", rstate)
+			}
+			checkMsgs(fs, 1, 19, 21, 100)
+
+			// Truncate into an archived block and write to it again.
+			if err := fs.Truncate(30); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			newMsg := []byte("NEW PAYLOAD")
+			for i := 0; i < 50; i++ {
+				fs.StoreMsg(subj, nil, newMsg)
+			}
+			checkMsgs(fs, 1, 29, 30)
+			if _, _, rmsg, _, err := fs.LoadMsg(31); err != nil || !bytes.Equal(rmsg, newMsg) {
+				t.Fatalf("Unexpected message: %q, %v", rmsg, err)
+			}
+
+			// Purging should clean up the archive.
+			if _, err := fs.Purge(); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if fis, _ := ioutil.ReadDir(archDir); len(fis) != 0 {
+				t.Fatalf("Expected the archive to be empty, got %d entries", len(fis))
+			}
+		})
+	}
+}
+
+func TestFileStoreArchiveAfterTruncate(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+	archDir, _ := ioutil.TempDir("", "js-archive-")
+	defer os.RemoveAll(archDir)
+
+	// Archive age is long enough we will only archive when we ask.
+	fcfg := FileStoreConfig{
+		StoreDir:   storeDir,
+		BlockSize:  4096,
+		Archive:    NewDirBlockArchive(archDir),
+		ArchiveAge: time.Hour,
+	}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	subj, msg := "telemetry", bytes.Repeat([]byte("Z"), 256)
+	for i := 0; i < 100; i++ {
+		if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// Grab the blocks as archiveMsgBlocks would have before the truncate.
+	fs.mu.RLock()
+	blks := append([]*msgBlock(nil), fs.blks[:len(fs.blks)-1]...)
+	fs.mu.RUnlock()
+
+	if err := fs.Truncate(30); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, mb := range blks {
+		if err := mb.archive(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	fs.mu.RLock()
+	lmb := fs.lmb
+	fs.mu.RUnlock()
+	lmb.mu.RLock()
+	archived, mfn := lmb.arch, lmb.mfn
+	lmb.mu.RUnlock()
+	if archived {
+		t.Fatalf("Expected the last message block to not be archived")
+	}
+	if _, err := os.Stat(mfn); err != nil {
+		t.Fatalf("Expected the last message block to be stored locally: %v", err)
+	}
+
+	newMsg := []byte("NEW PAYLOAD")
+	for i := 0; i < 50; i++ {
+		if _, _, err := fs.StoreMsg(subj, nil, newMsg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	checkMsgs := func() {
+		t.Helper()
+		for seq := uint64(1); seq <= 80; seq++ {
+			expected := msg
+			if seq > 30 {
+				expected = newMsg
+			}
+			if _, _, rmsg, _, err := fs.LoadMsg(seq); err != nil || !bytes.Equal(rmsg, expected) {
+				t.Fatalf("Unexpected message %d: %q, %v", seq, rmsg, err)
+			}
+		}
+	}
+	checkMsgs()
+
+	fs.Stop()
+	if fs, err = newFileStore(fcfg, cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if state := fs.State(); state.Msgs != 80 || state.LastSeq != 80 || state.ArchivedBytes == 0 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	checkMsgs()
+}
+
+// Archive that can not remove anything, e.g. when it is not reachable.
+type noRemoveBlockArchive struct {
+	BlockArchive
+}
+
+func (a *noRemoveBlockArchive) Remove(name string) error {
+	return fmt.Errorf("archive not available")
+}
+
+func TestFileStoreArchiveRemoveError(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+	archDir, _ := ioutil.TempDir("", "js-archive-")
+	defer os.RemoveAll(archDir)
+
+	fcfg := FileStoreConfig{
+		StoreDir:   storeDir,
+		BlockSize:  4096,
+		Archive:    &noRemoveBlockArchive{NewDirBlockArchive(archDir)},
+		ArchiveAge: 50 * time.Millisecond,
+	}
+	fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	subj, msg := "telemetry", bytes.Repeat([]byte("Z"), 256)
+	for i := 0; i < 100; i++ {
+		if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// Wait for all but the last block to be archived.
+	checkFor(t, 2*time.Second, 10*time.Millisecond, func() error {
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+		for _, mb := range fs.blks {
+			mb.mu.RLock()
+			archived := mb.arch
+			mb.mu.RUnlock()
+			if mb != fs.lmb && !archived {
+				return fmt.Errorf("message block %d not archived", mb.index)
+			}
+		}
+		return nil
+	})
+
+	// Removing a single message is not affected if its block is left in the archive.
+	fs.mu.RLock()
+	mb := fs.blks[0]
+	fs.mu.RUnlock()
+	mb.mu.RLock()
+	first, last := mb.first.seq, mb.last.seq
+	mb.mu.RUnlock()
+	for seq := first; seq <= last; seq++ {
+		if removed, err := fs.RemoveMsg(seq); !removed || err != nil {
+			t.Fatalf("Unexpected remove result for %d: %v, %v", seq, removed, err)
+		}
+	}
+
+	// The messages are removed, but we should hear about the blocks left in the archive.
+	if purged, err := fs.Compact(50); err == nil || purged != 49-(last-first+1) {
+		t.Fatalf("Expected an archive error compacting, got %d, %v", purged, err)
+	}
+	if state := fs.State(); state.FirstSeq != 50 {
+		t.Fatalf("Expected first seq of 50, got %d", state.FirstSeq)
+	}
+	if purged, err := fs.Purge(); err == nil || purged != 51 {
+		t.Fatalf("Expected an archive error purging, got %d, %v", purged, err)
+	}
+	if state := fs.State(); state.Msgs != 0 {
+		t.Fatalf("Expected no msgs, got %d", state.Msgs)
+	}
+}
+
+// Archive that waits to be released before storing anything.
+type blockingBlockArchive struct {
+	BlockArchive
+	putting chan struct{}
+	release chan struct{}
+}
+
+func (a *blockingBlockArchive) Put(name string, r io.Reader) error {
+	a.putting <- struct{}{}
+	<-a.release
+	return a.BlockArchive.Put(name, r)
+}
+
+func TestFileStoreArchiveChangedWhileCopying(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+	archDir, _ := ioutil.TempDir("", "js-archive-")
+	defer os.RemoveAll(archDir)
+
+	arch := &blockingBlockArchive{NewDirBlockArchive(archDir), make(chan struct{}), make(chan struct{})}
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 4096, Archive: arch, ArchiveAge: time.Hour}
+	fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	subj, msg := "telemetry", bytes.Repeat([]byte("Z"), 256)
+	for i := 0; i < 100; i++ {
+		fs.StoreMsg(subj, nil, msg)
+	}
+	fs.mu.RLock()
+	mb := fs.blks[0]
+	fs.mu.RUnlock()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- mb.archive() }()
+	<-arch.putting
+
+	// We should not be holding any locks while copying, and our change should not be lost.
+	if ok, err := fs.EraseMsg(2); !ok || err != nil {
+		t.Fatalf("Unexpected erase result: %v, %v", ok, err)
+	}
+	close(arch.release)
+	if err := <-errCh; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mb.mu.RLock()
+	archived := mb.arch
+	mb.mu.RUnlock()
+	if archived {
+		t.Fatalf("Expected the changed message block to not be archived")
+	}
+	if fis, _ := ioutil.ReadDir(archDir); len(fis) != 0 {
+		t.Fatalf("Expected the stale copy to be removed from the archive, got %d entries", len(fis))
+	}
+
+	// Next time around we are archived.
+	go func() { errCh <- mb.archive() }()
+	<-arch.putting
+	if err := <-errCh; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mb.mu.RLock()
+	archived = mb.arch
+	mb.mu.RUnlock()
+	if !archived {
+		t.Fatalf("Expected the message block to be archived")
+	}
+	if _, _, _, _, err := fs.LoadMsg(2); err == nil {
+		t.Fatalf("Expected an error loading erased message")
+	}
+	if _, _, rmsg, _, err := fs.LoadMsg(3); err != nil || !bytes.Equal(rmsg, msg) {
+		t.Fatalf("Unexpected message: %q, %v", rmsg, err)
+	}
+}
+
+func TestFileStorePurgeEx(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	// Small blocks so subjects span multiple blocks.
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 256}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("Hello World")
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg("foo.A", nil, msg)
+		fs.StoreMsg("foo.B", nil, msg)
+		fs.StoreMsg("bar", nil, msg)
+	}
+
+	// Only purge foo.A before seq 10.
+	if purged, err := fs.PurgeEx("foo.A", 10, 0); err != nil || purged != 3 {
+		t.Fatalf("Expected 3 purged, got %d, %v", purged, err)
+	}
+	// Keep the last 2 for each foo subject.
+	if purged, err := fs.PurgeEx("foo.*", 0, 2); err != nil || purged != 13 {
+		t.Fatalf("Expected 13 purged, got %d, %v", purged, err)
+	}
+	for _, subj := range []string{"foo.A", "foo.B"} {
+		if nmsgs, _ := fs.perSubjectState(subj); nmsgs != 2 {
+			t.Fatalf("Expected 2 msgs for %q, got %d", subj, nmsgs)
+		}
+	}
+	if _, seq, _, _, _, err := fs.LoadLastMsg("foo.A"); err != nil || seq != 28 {
+		t.Fatalf("Expected last foo.A at 28, got %d, %v", seq, err)
+	}
+	if state := fs.State(); state.Msgs != 14 {
+		t.Fatalf("Expected 14 msgs, got %d", state.Msgs)
+	}
+
+	// Make sure this survives a restart.
+	fs.Stop()
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if state := fs.State(); state.Msgs != 14 {
+		t.Fatalf("Expected 14 msgs, got %d", state.Msgs)
+	}
+
+	// Keep only counts messages below the sequence cutoff.
+	fs.StoreMsg("foo.A", nil, msg)
+	if purged, err := fs.PurgeEx("foo.A", 31, 1); err != nil || purged != 1 {
+		t.Fatalf("Expected 1 purged, got %d, %v", purged, err)
+	}
+	if _, _, _, _, err := fs.LoadMsg(28); err != nil {
+		t.Fatalf("Expected foo.A at 28 to be kept, got %v", err)
+	}
+
+	// No filter and no keep is the same as a purge.
+	if purged, err := fs.PurgeEx(_EMPTY_, 0, 0); err != nil || purged != 14 {
+		t.Fatalf("Expected 14 purged, got %d, %v", purged, err)
+	}
+	if state := fs.State(); state.Msgs != 0 || state.FirstSeq != 32 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+}
+
+func TestFileStorePurgeExSkipsBlocks(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fs, err := newFileStore(FileStoreConfig{StoreDir: storeDir, BlockSize: 256}, StreamConfig{Name: "zzz", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("Hello World")
+	for i := 0; i < 50; i++ {
+		fs.StoreMsg("foo", nil, msg)
+	}
+	fs.StoreMsg("bar", nil, msg)
+	fs.StoreMsg("bar", nil, msg)
+	if fs.numMsgBlocks() < 5 {
+		t.Fatalf("Expected multiple msg blocks, got %d", fs.numMsgBlocks())
+	}
+
+	// Drop our caches, the per subject info is kept.
+	fs.mu.RLock()
+	for _, mb := range fs.blks {
+		mb.mu.Lock()
+		mb.clearCache()
+		mb.mu.Unlock()
+	}
+	fs.mu.RUnlock()
+
+	cloads := fs.cacheLoads()
+	if purged, err := fs.PurgeEx("bar", 0, 1); err != nil || purged != 1 {
+		t.Fatalf("Expected 1 purged, got %d, %v", purged, err)
+	}
+	// Only the block holding our subject should have been loaded.
+	if n := fs.cacheLoads() - cloads; n > 1 {
+		t.Fatalf("Expected only one block to be loaded, got %d", n)
+	}
+	if state := fs.State(); state.Msgs != 51 {
+		t.Fatalf("Expected 51 msgs, got %d", state.Msgs)
+	}
+}
+
+func TestFileStoreCompactWithInteriorDeletes(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	var removed int64
+	fs.RegisterStorageUpdates(func(md, bd int64, seq uint64, subj string) {
+		removed -= md
+	})
+
+	msg := []byte("Hello World")
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg("foo", nil, msg)
+	}
+	fs.RemoveMsg(3)
+	fs.RemoveMsg(5)
+	removed = 0
+
+	if purged, err := fs.Compact(8); err != nil || purged != 5 {
+		t.Fatalf("Expected 5 purged, got %d, %v", purged, err)
+	}
+	if removed != 5 {
+		t.Fatalf("Expected storage updates for 5 msgs, got %d", removed)
+	}
+	expected := fs.State()
+	if expected.Msgs != 3 || expected.FirstSeq != 8 || expected.Bytes != 3*fileStoreMsgSize("foo", nil, msg) {
+		t.Fatalf("Unexpected state: %+v", expected)
+	}
+
+	fs.Stop()
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if state := fs.State(); state.Msgs != expected.Msgs || state.FirstSeq != expected.FirstSeq || state.Bytes != expected.Bytes {
+		t.Fatalf("Expected state %+v after restart, got %+v", expected, state)
+	}
+}
+
+func TestFileStoreMsgTTL(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, AllowMsgTTL: true}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("Hello World")
+	fs.StoreMsg("foo", nil, msg)
+	fs.StoreMsg("foo", genHeader(nil, JSMessageTTL, "1s"), msg)
+	fs.StoreMsg("foo", nil, msg)
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := fs.State(); state.Msgs != 2 || len(state.Deleted) != 1 || state.Deleted[0] != 2 {
+			return fmt.Errorf("Unexpected state: %+v", state)
+		}
+		return nil
+	})
+
+	// Make sure we rebuild our TTLs on restart.
+	fs.StoreMsg("foo", genHeader(nil, JSMessageTTL, "1s"), msg)
+	fs.Stop()
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if state := fs.State(); state.Msgs != 3 {
+		t.Fatalf("Expected 3 msgs, got %d", state.Msgs)
+	}
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := fs.State(); state.Msgs != 2 || state.LastSeq != 4 {
+			return fmt.Errorf("Unexpected state: %+v", state)
+		}
+		return nil
+	})
+}
+
+func TestFileStoreMsgTTLIndex(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, AllowMsgTTL: true}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	numTTLs := func() int {
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+		return fs.ttls.Len()
+	}
+
+	msg := []byte("Hello World")
+	fs.StoreMsg("foo", nil, msg)
+	fs.StoreMsg("foo", genHeader(nil, JSMessageTTL, "1s"), msg)
+	fs.StoreMsg("foo", genHeader(nil, JSMessageTTL, "1h"), msg)
+
+	// Removing a message removes its TTL.
+	fs.RemoveMsg(3)
+	if n := numTTLs(); n != 1 {
+		t.Fatalf("Expected 1 TTL, got %d", n)
+	}
+	// A truncated message should not expire the message that reuses its sequence.
+	if err := fs.Truncate(1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := numTTLs(); n != 0 {
+		t.Fatalf("Expected no TTLs, got %d", n)
+	}
+	if seq, _, err := fs.StoreMsg("foo", nil, msg); err != nil || seq != 2 {
+		t.Fatalf("Expected seq 2, got %d, %v", seq, err)
+	}
+	time.Sleep(1200 * time.Millisecond)
+	if _, _, _, _, err := fs.LoadMsg(2); err != nil {
+		t.Fatalf("Expected msg 2 to still be present, got %v", err)
+	}
+
+	// The TTL index should be written when stopped and loaded without scanning the messages.
+	fs.StoreMsg("foo", genHeader(nil, JSMessageTTL, "1h"), msg)
+	fs.Stop()
+	ttlIndex := path.Join(storeDir, msgDir, ttlIndexFile)
+	if _, err := os.Stat(ttlIndex); err != nil {
+		t.Fatalf("Expected TTL index to exist: %v", err)
+	}
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if n := numTTLs(); n != 1 {
+		t.Fatalf("Expected 1 TTL, got %d", n)
+	}
+	if cls := fs.cacheLoads(); cls != 0 {
+		t.Fatalf("Expected no cache loads, got %d", cls)
+	}
+	if _, err := os.Stat(ttlIndex); err == nil {
+		t.Fatalf("Expected TTL index to be removed after recovery")
+	}
+
+	// Without the index we rebuild it from the messages.
+	fs.Stop()
+	os.Remove(ttlIndex)
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if n := numTTLs(); n != 1 {
+		t.Fatalf("Expected 1 TTL, got %d", n)
+	}
+}
+
+func TestFileStoreMsgTTLRecoverOnlyBlocksWithTTLs(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	// Small blocks so we have many without TTLs.
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 256}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, AllowMsgTTL: true}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("Hello World")
+	for i := 0; i < 50; i++ {
+		fs.StoreMsg("foo", nil, msg)
+	}
+	fs.StoreMsg("foo", genHeader(nil, JSMessageTTL, "1h"), msg)
+	for i := 0; i < 50; i++ {
+		fs.StoreMsg("foo", nil, msg)
+	}
+	if nb := fs.numMsgBlocks(); nb < 10 {
+		t.Fatalf("Expected at least 10 blocks, got %d", nb)
+	}
+
+	restart := func() {
+		t.Helper()
+		fs.Stop()
+		os.Remove(path.Join(storeDir, msgDir, ttlIndexFile))
+		fs, err = newFileStore(fcfg, cfg)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		fs.mu.RLock()
+		n := fs.ttls.Len()
+		fs.mu.RUnlock()
+		if n != 1 {
+			t.Fatalf("Expected 1 TTL, got %d", n)
+		}
+	}
+
+	// Only the block holding the TTL should be loaded.
+	restart()
+	if cls := fs.cacheLoads(); cls != 1 {
+		t.Fatalf("Expected 1 cache load, got %d", cls)
+	}
+
+	// Same when the block index files are lost and the blocks are rebuilt.
+	fs.Stop()
+	idxs, _ := filepath.Glob(path.Join(storeDir, msgDir, "*.idx"))
+	for _, fn := range idxs {
+		os.Remove(fn)
+	}
+	restart()
+	defer fs.Stop()
+	if cls := fs.cacheLoads(); cls != 1 {
+		t.Fatalf("Expected 1 cache load, got %d", cls)
+	}
+}
+
+func TestFileStoreStoreMsgs(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, MaxMsgs: 4}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("Hello World")
+	fs.StoreMsg("foo", nil, msg)
+	batch := []*BatchMsg{{Subject: "foo", Msg: msg}, {Subject: "bar", Skip: true}, {Subject: "baz", Msg: msg}}
+	seq, _, err := fs.StoreMsgs(batch, 0, 0)
+	if err != nil || seq != 2 {
+		t.Fatalf("Expected first seq of 2, got %d, %v", seq, err)
+	}
+	if state := fs.State(); state.Msgs != 3 || state.LastSeq != 4 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if _, _, _, _, err := fs.LoadMsg(3); err == nil {
+		t.Fatalf("Expected skipped msg to not be found")
+	}
+
+	// Limits are enforced once the whole batch is stored.
+	if _, _, err := fs.StoreMsgs(batch, 0, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state := fs.State(); state.Msgs != 4 || state.FirstSeq != 2 || state.LastSeq != 7 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+
+	// With discard new none of the batch is stored if it does not fit.
+	cfg.Discard = DiscardNew
+	if err := fs.UpdateConfig(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fs.RemoveMsg(4)
+	if _, _, err := fs.StoreMsgs(batch, 0, 0); err != ErrMaxMsgs {
+		t.Fatalf("Expected %v, got %v", ErrMaxMsgs, err)
+	}
+	if _, _, err := fs.StoreMsgs(batch, 9, time.Now().UnixNano()); err != ErrSequenceMismatch {
+		t.Fatalf("Expected %v, got %v", ErrSequenceMismatch, err)
+	}
+
+	// Make sure the batch is recovered as stored.
+	fs.Stop()
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if state := fs.State(); state.Msgs != 3 || state.LastSeq != 7 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+}
+
+func TestFileStoreStoreMsgsRollback(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 256}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("Hello World")
+	var batch []*BatchMsg
+	for i := 0; i < 20; i++ {
+		batch = append(batch, &BatchMsg{Subject: "foo", Msg: msg})
+	}
+	// We will fail to create the next block part way through the batch.
+	failNextBlock := func() {
+		t.Helper()
+		mfn := path.Join(storeDir, msgDir, fmt.Sprintf(blkScan, fs.numMsgBlocks()+1))
+		if err := os.MkdirAll(mfn, 0755); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	checkNotStored := func(first, last uint64) {
+		t.Helper()
+		for seq := first; seq <= last; seq++ {
+			if _, _, _, _, err := fs.LoadMsg(seq); err == nil {
+				t.Fatalf("Expected msg %d of the failed batch to not be stored", seq)
+			}
+		}
+	}
+
+	// A batch at the start of our stream.
+	failNextBlock()
+	if _, _, err := fs.StoreMsgs(batch, 0, 0); err == nil {
+		t.Fatalf("Expected an error storing the batch")
+	}
+	if state := fs.State(); state.Msgs != 0 || state.LastSeq != 0 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	checkNotStored(1, 20)
+	if seq, _, err := fs.StoreMsg("foo", nil, msg); err != nil || seq != 1 {
+		t.Fatalf("Expected seq 1, got %d, %v", seq, err)
+	}
+
+	// A batch after our last message was removed.
+	fs.StoreMsg("foo", nil, msg)
+	fs.RemoveMsg(2)
+	failNextBlock()
+	if _, _, err := fs.StoreMsgs(batch, 0, 0); err == nil {
+		t.Fatalf("Expected an error storing the batch")
+	}
+	if state := fs.State(); state.Msgs != 1 || state.LastSeq != 2 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	checkNotStored(3, 22)
+	if seq, _, err := fs.StoreMsg("foo", nil, msg); err != nil || seq != 3 {
+		t.Fatalf("Expected seq 3, got %d, %v", seq, err)
+	}
+
+	// Make sure we recover the same state.
+	fs.Stop()
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if state := fs.State(); state.Msgs != 2 || state.FirstSeq != 1 || state.LastSeq != 3 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	checkNotStored(4, 22)
+	if seq, _, err := fs.StoreMsg("foo", nil, msg); err != nil || seq != 4 {
+		t.Fatalf("Expected seq 4, got %d, %v", seq, err)
+	}
+}
+
+func TestFileStoreSkipMsgs(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	// On an empty store we just move our sequences.
+	if err := fs.SkipMsgs(1, 10); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state := fs.State(); state.Msgs != 0 || state.FirstSeq != 11 || state.LastSeq != 10 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+
+	msg := []byte("Hello World")
+	fs.StoreMsg("foo", nil, msg)
+	if err := fs.SkipMsgs(5, 10); err != ErrSequenceMismatch {
+		t.Fatalf("Expected %v, got %v", ErrSequenceMismatch, err)
+	}
+	// Skipping past messages should not write a record for each sequence.
+	nblks := fs.numMsgBlocks()
+	if err := fs.SkipMsgs(12, 100000); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := fs.numMsgBlocks(); n != nblks+1 {
+		t.Fatalf("Expected a new msg block, got %d vs %d", n, nblks)
+	}
+	if seq, _, err := fs.StoreMsg("foo", nil, msg); err != nil || seq != 100012 {
+		t.Fatalf("Expected seq 100012, got %d, %v", seq, err)
+	}
+	if _, _, _, _, err := fs.LoadMsg(500); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected %v, got %v", ErrStoreMsgNotFound, err)
+	}
+
+	// Make sure we recover the same state.
+	fs.Stop()
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if state := fs.State(); state.Msgs != 2 || state.FirstSeq != 11 || state.LastSeq != 100012 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if seq, _, err := fs.StoreMsg("foo", nil, msg); err != nil || seq != 100013 {
+		t.Fatalf("Expected seq 100013, got %d, %v", seq, err)
+	}
+}
@@ -14,6 +14,7 @@
 package server
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -819,6 +820,20 @@ func (a *Account) EnableJetStream(limits *JetStreamAccountLimits) error {
 			continue
 		}
 
+		// Check if we are encrypted.
+		if ekey, err := ioutil.ReadFile(path.Join(mdir, JetStreamMetaFileKey)); err == nil {
+			s.Debugf("  Stream metafile is encrypted, reading encrypted keyfile")
+			if dbuf, err := s.decryptMeta(ekey, buf, a.Name, fi.Name()); err == nil {
+				buf = dbuf
+			} else if !json.Valid(buf) {
+				s.Warnf("  Error decrypting Stream metafile %q: %v", metafile, err)
+				continue
+			} else {
+				// We stopped before the metafile was converted, the store will finish that.
+				s.Debugf("  Stream metafile is not encrypted yet")
+			}
+		}
+
 		var cfg FileStreamInfo
 		if err := json.Unmarshal(buf, &cfg); err != nil {
 			s.Warnf("  Error unmarshalling Stream metafile: %v", err)
@@ -864,6 +879,17 @@ func (a *Account) EnableJetStream(limits *JetStreamAccountLimits) error {
 				s.Warnf("    Missing Consumer checksum for %q", metasum)
 				continue
 			}
+			// Check if we are encrypted.
+			if ekey, err := ioutil.ReadFile(path.Join(odir, ofi.Name(), JetStreamMetaFileKey)); err == nil {
+				s.Debugf("  Consumer metafile is encrypted, reading encrypted keyfile")
+				// Consumer keys are derived using the stream and consumer name.
+				if dbuf, err := s.decryptMeta(ekey, buf, a.Name, fi.Name()+"/"+ofi.Name()); err == nil {
+					buf = dbuf
+				} else if !json.Valid(buf) {
+					s.Warnf("    Error decrypting Consumer metafile %q: %v", metafile, err)
+					continue
+				}
+			}
 			var cfg FileConsumerInfo
 			if err := json.Unmarshal(buf, &cfg); err != nil {
 				s.Warnf("    Error unmarshalling Consumer metafile: %v", err)
@@ -903,6 +929,42 @@ func (a *Account) EnableJetStream(limits *JetStreamAccountLimits) error {
 	return nil
 }
 
+// Return a key generator for encrypting stores at rest, or nil if we do not have a key configured.
+// Keys are derived from our configured key, info, which is usually the account, and the context.
+func (s *Server) jsKeyGen(info string) keyGen {
+	ek := s.getOpts().JetStreamKey
+	if ek == _EMPTY_ {
+		return nil
+	}
+	return func(context []byte) ([]byte, error) {
+		h := hmac.New(sha256.New, []byte(ek))
+		if _, err := h.Write([]byte(info)); err != nil {
+			return nil, err
+		}
+		if _, err := h.Write(context); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+}
+
+// Decrypt a stream or consumer meta file with the contents of its key file.
+func (s *Server) decryptMeta(ekey, buf []byte, acc, context string) ([]byte, error) {
+	prf := s.jsKeyGen(acc)
+	if prf == nil {
+		return nil, errNoEncryptionKey
+	}
+	sc, seed, err := decryptEncryptionKeys(prf, context, ekey)
+	if err != nil {
+		return nil, err
+	}
+	aek, err := genEncryptionKey(sc, seed)
+	if err != nil {
+		return nil, err
+	}
+	return openWithNonce(aek, buf)
+}
+
 // NumStreams will return how many streams we have.
 func (a *Account) numStreams() int {
 	a.mu.RLock()
@@ -17,12 +17,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unicode"
@@ -104,6 +106,17 @@ const (
 	JSApiStreamRestore  = "$JS.API.STREAM.RESTORE.*"
 	JSApiStreamRestoreT = "$JS.API.STREAM.RESTORE.%s"
 
+	// JSApiStreamExport is the endpoint to export messages from a stream.
+	// Will return a stream of chunks in the stream export format with a
+	// nil chunk as EOF to the deliver subject, with the same ack flow as snapshots.
+	JSApiStreamExport  = "$JS.API.STREAM.EXPORT.*"
+	JSApiStreamExportT = "$JS.API.STREAM.EXPORT.%s"
+
+	// JSApiStreamImport is the endpoint to import messages into a stream from an export.
+	// Caller should send chunks with a reply subject and a nil chunk as EOF, same as restores.
+	JSApiStreamImport  = "$JS.API.STREAM.IMPORT.*"
+	JSApiStreamImportT = "$JS.API.STREAM.IMPORT.%s"
+
 	// JSApiDeleteMsg is the endpoint to delete messages from a stream.
 	// Will return JSON response.
 	JSApiMsgDelete  = "$JS.API.STREAM.MSG.DELETE.*"
@@ -114,6 +127,12 @@ const (
 	JSApiMsgGet  = "$JS.API.STREAM.MSG.GET.*"
 	JSApiMsgGetT = "$JS.API.STREAM.MSG.GET.%s"
 
+	// JSDirectMsgGet is the template for direct requests for a message by its stream sequence number or
+	// last by subject. These are answered by any replica or mirror of a stream that allows direct gets.
+	// Will return the message with its headers, not a JSON response.
+	JSDirectMsgGet  = "$JS.API.DIRECT.GET.*"
+	JSDirectMsgGetT = "$JS.API.DIRECT.GET.%s"
+
 	// JSApiConsumerCreate is the endpoint to create ephemeral consumers for streams.
 	// Will return JSON response.
 	JSApiConsumerCreate  = "$JS.API.CONSUMER.CREATE.*"
@@ -149,6 +168,8 @@ const (
 	// For snapshots and restores. The ack will have additional tokens.
 	jsSnapshotAckT    = "$JS.SNAPSHOT.ACK.%s.%s"
 	jsRestoreDeliverT = "$JS.SNAPSHOT.RESTORE.%s.%s"
+	jsExportAckT      = "$JS.EXPORT.ACK.%s.%s"
+	jsImportDeliverT  = "$JS.IMPORT.%s.%s"
 
 	// JSApiStreamRemovePeer is the endpoint to remove a peer from a clustered stream and its consumers.
 	// Will return JSON response.
@@ -345,6 +366,16 @@ type JSApiStreamListResponse struct {
 
 const JSApiStreamListResponseType = "io.nats.jetstream.api.v1.stream_list_response"
 
+// JSApiStreamPurgeRequest is optional request information to the purge API.
+// Subject will filter the purge request to only messages that match the subject, which can have wildcards.
+// Sequence will purge up to but not including this sequence and can be combined with subject filtering.
+// Keep will specify how many messages to keep per subject. This can not be used with sequence.
+type JSApiStreamPurgeRequest struct {
+	Subject  string `json:"filter,omitempty"`
+	Sequence uint64 `json:"seq,omitempty"`
+	Keep     uint64 `json:"keep,omitempty"`
+}
+
 // JSApiStreamPurgeResponse.
 type JSApiStreamPurgeResponse struct {
 	ApiResponse
@@ -418,6 +449,61 @@ type JSApiStreamRestoreResponse struct {
 
 const JSApiStreamRestoreResponseType = "io.nats.jetstream.api.v1.stream_restore_response"
 
+// JSApiStreamExportRequest is the required export request.
+// All of the range options are optional and both ends of the range are inclusive.
+type JSApiStreamExportRequest struct {
+	// Subject to deliver the chunks to for the export.
+	DeliverSubject string `json:"deliver_subject"`
+	// Start of the range, by sequence or time.
+	StartSeq  uint64     `json:"start_seq,omitempty"`
+	StartTime *time.Time `json:"start_time,omitempty"`
+	// End of the range, by sequence or time.
+	EndSeq  uint64     `json:"end_seq,omitempty"`
+	EndTime *time.Time `json:"end_time,omitempty"`
+	// Only export messages that match this subject.
+	FilterSubject string `json:"filter_subject,omitempty"`
+	// Optional chunk size preference.
+	// Best to just let server select.
+	ChunkSize int `json:"chunk_size,omitempty"`
+}
+
+// JSApiStreamExportResponse is the direct response to the export request.
+type JSApiStreamExportResponse struct {
+	ApiResponse
+	// State for the given stream when the export started.
+	State *StreamState `json:"state,omitempty"`
+}
+
+const JSApiStreamExportResponseType = "io.nats.jetstream.api.v1.stream_export_response"
+
+// JSApiStreamImportRequest is the import request.
+type JSApiStreamImportRequest struct {
+	// Keep the original sequences, which need to be past the last sequence of the stream.
+	KeepSequences bool `json:"keep_sequences,omitempty"`
+	// Keep the original timestamps.
+	KeepTimestamps bool `json:"keep_timestamps,omitempty"`
+}
+
+// JSApiStreamImportResponse is the direct response to the import request.
+type JSApiStreamImportResponse struct {
+	ApiResponse
+	// Subject to deliver the chunks to for the import.
+	DeliverSubject string `json:"deliver_subject"`
+}
+
+const JSApiStreamImportResponseType = "io.nats.jetstream.api.v1.stream_import_response"
+
+// JSApiStreamImportCompleteResponse is the response to the last chunk of an import.
+type JSApiStreamImportCompleteResponse struct {
+	ApiResponse
+	// Number of messages imported.
+	Imported uint64 `json:"imported"`
+	// State for the given stream once the import completed.
+	State *StreamState `json:"state,omitempty"`
+}
+
+const JSApiStreamImportCompleteResponseType = "io.nats.jetstream.api.v1.stream_import_complete_response"
+
 // JSApiStreamRemovePeerRequest is the required remove peer request.
 type JSApiStreamRemovePeerRequest struct {
 	// Server name of the peer to be removed.
@@ -477,7 +563,9 @@ const JSApiMetaServerRemoveResponseType = "io.nats.jetstream.api.v1.meta_server_
 
 // JSApiMsgGetRequest get a message request.
 type JSApiMsgGetRequest struct {
-	Seq uint64 `json:"seq"`
+	Seq uint64 `json:"seq,omitempty"`
+	// LastFor will return the last message for the subject, which can contain wildcards.
+	LastFor string `json:"last_by_subj,omitempty"`
 }
 
 // JSApiMsgGetResponse.
@@ -540,9 +628,11 @@ const JSApiConsumerListResponseType = "io.nats.jetstream.api.v1.consumer_list_re
 
 // JSApiConsumerGetNextRequest is for getting next messages for pull based consumers.
 type JSApiConsumerGetNextRequest struct {
-	Expires time.Duration `json:"expires,omitempty"`
-	Batch   int           `json:"batch,omitempty"`
-	NoWait  bool          `json:"no_wait,omitempty"`
+	Expires   time.Duration `json:"expires,omitempty"`
+	Batch     int           `json:"batch,omitempty"`
+	MaxBytes  int           `json:"max_bytes,omitempty"`
+	NoWait    bool          `json:"no_wait,omitempty"`
+	Heartbeat time.Duration `json:"idle_heartbeat,omitempty"`
 }
 
 // JSApiStreamTemplateCreateResponse for creating templates.
@@ -600,6 +690,9 @@ var (
 	jsClusterNoPeersErr    = &ApiError{Code: 400, Description: "no suitable peers for placement"}
 	jsServerNotMemberErr   = &ApiError{Code: 400, Description: "server is not a member of the cluster"}
 	jsNoMessageFoundErr    = &ApiError{Code: 404, Description: "no message found"}
+	jsStreamSealedErr      = &ApiError{Code: 400, Description: "invalid operation on sealed stream"}
+	jsStreamDenyDeleteErr  = &ApiError{Code: 400, Description: "message delete not permitted"}
+	jsStreamDenyPurgeErr   = &ApiError{Code: 400, Description: "stream purge not permitted"}
 )
 
 // For easier handling of exports and imports.
@@ -618,6 +711,8 @@ var allJsExports = []string{
 	JSApiStreamPurge,
 	JSApiStreamSnapshot,
 	JSApiStreamRestore,
+	JSApiStreamExport,
+	JSApiStreamImport,
 	JSApiStreamRemovePeer,
 	JSApiStreamLeaderStepDown,
 	JSApiConsumerLeaderStepDown,
@@ -724,6 +819,8 @@ func (s *Server) setJetStreamExportSubs() error {
 		{JSApiStreamPurge, s.jsStreamPurgeRequest},
 		{JSApiStreamSnapshot, s.jsStreamSnapshotRequest},
 		{JSApiStreamRestore, s.jsStreamRestoreRequest},
+		{JSApiStreamExport, s.jsStreamExportRequest},
+		{JSApiStreamImport, s.jsStreamImportRequest},
 		{JSApiStreamRemovePeer, s.jsStreamRemovePeerRequest},
 		{JSApiStreamLeaderStepDown, s.jsStreamLeaderStepDownRequest},
 		{JSApiConsumerLeaderStepDown, s.jsConsumerLeaderStepDownRequest},
@@ -1095,6 +1192,14 @@ func jsNotFoundError(err error) *ApiError {
 	}
 }
 
+// Returned when the last sequence for a subject does not match the expected one.
+func jsWrongLastSubjSeqError(seq uint64) *ApiError {
+	return &ApiError{
+		Code:        400,
+		Description: fmt.Sprintf("wrong last sequence for subject: %d", seq),
+	}
+}
+
 // Request to create a stream.
 func (s *Server) jsStreamCreateRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
 	if c == nil || !s.JetStreamEnabled() {
@@ -1142,6 +1247,12 @@ func (s *Server) jsStreamCreateRequest(sub *subscription, c *client, subject, re
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	// Streams can only be sealed by an update.
+	if cfg.Sealed {
+		resp.Error = &ApiError{Code: 400, Description: "stream configuration for create can not be sealed"}
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
 
 	hasStream := func(streamName string) (bool, int32, []string) {
 		var exists bool
@@ -1643,10 +1754,7 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, subject, repl
 		resp.StreamInfo.Sources = mset.sourcesInfo()
 	}
 
-	// Check for out of band catchups.
-	if mset.hasCatchupPeers() {
-		mset.checkClusterInfo(resp.StreamInfo)
-	}
+	mset.checkClusterInfo(resp.StreamInfo)
 
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 }
@@ -2245,6 +2353,16 @@ func (s *Server) jsMsgDeleteRequest(sub *subscription, c *client, subject, reply
 		return
 	}
 
+	if cfg := mset.config(); cfg.Sealed {
+		resp.Error = jsStreamSealedErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	} else if cfg.DenyDelete {
+		resp.Error = jsStreamDenyDeleteErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
 	if s.JetStreamIsClustered() {
 		s.jsClusteredMsgDeleteRequest(ci, acc, mset, stream, subject, reply, &req, rmsg)
 		return
@@ -2342,6 +2460,12 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, subject, reply st
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	// Can not ask for both a sequence and the last message for a subject.
+	if req.Seq > 0 && req.LastFor != _EMPTY_ {
+		resp.Error = jsBadRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
 
 	mset, err := acc.lookupStream(stream)
 	if err != nil {
@@ -2350,7 +2474,16 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, subject, reply st
 		return
 	}
 
-	subj, hdr, msg, ts, err := mset.store.LoadMsg(req.Seq)
+	var subj string
+	var hdr, data []byte
+	var ts int64
+	seq := req.Seq
+
+	if req.LastFor != _EMPTY_ {
+		subj, seq, hdr, data, ts, err = mset.store.LoadLastMsg(req.LastFor)
+	} else {
+		subj, hdr, data, ts, err = mset.store.LoadMsg(seq)
+	}
 	if err != nil {
 		resp.Error = jsNoMessageFoundErr
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
@@ -2358,9 +2491,9 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, subject, reply st
 	}
 	resp.Message = &StoredMsg{
 		Subject:  subj,
-		Sequence: req.Seq,
+		Sequence: seq,
 		Header:   hdr,
-		Data:     msg,
+		Data:     data,
 		Time:     time.Unix(0, ts).UTC(),
 	}
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
@@ -2434,10 +2567,25 @@ func (s *Server) jsStreamPurgeRequest(sub *subscription, c *client, subject, rep
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	var purgeRequest *JSApiStreamPurgeRequest
 	if !isEmptyRequest(msg) {
-		resp.Error = jsNotEmptyRequestErr
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
-		return
+		var req JSApiStreamPurgeRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = jsInvalidJSONErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		if req.Sequence > 0 && req.Keep > 0 {
+			resp.Error = &ApiError{Code: 400, Description: "sequence and keep can not both be set"}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		if req.Subject != _EMPTY_ && !IsValidSubject(req.Subject) {
+			resp.Error = &ApiError{Code: 400, Description: "invalid purge filter subject"}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		purgeRequest = &req
 	}
 	mset, err := acc.lookupStream(stream)
 	if err != nil {
@@ -2446,12 +2594,22 @@ func (s *Server) jsStreamPurgeRequest(sub *subscription, c *client, subject, rep
 		return
 	}
 
+	if cfg := mset.config(); cfg.Sealed {
+		resp.Error = jsStreamSealedErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	} else if cfg.DenyPurge {
+		resp.Error = jsStreamDenyPurgeErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
 	if s.JetStreamIsClustered() {
-		s.jsClusteredStreamPurgeRequest(ci, acc, mset, stream, subject, reply, rmsg)
+		s.jsClusteredStreamPurgeRequest(ci, acc, mset, stream, subject, reply, rmsg, purgeRequest)
 		return
 	}
 
-	purged, err := mset.purge()
+	purged, err := mset.purge(purgeRequest)
 	if err != nil {
 		resp.Error = jsError(err)
 	} else {
@@ -2816,19 +2974,21 @@ const defaultSnapshotWindowSize = 32 * 1024 * 1024 // 32MB
 
 // streamSnapshot will stream out our snapshot to the reply subject.
 func (s *Server) streamSnapshot(ci *ClientInfo, acc *Account, mset *stream, sr *SnapshotResult, req *JSApiStreamSnapshotRequest) {
-	chunkSize := req.ChunkSize
+	s.streamChunks(acc, mset, sr.Reader, req.DeliverSubject, req.ChunkSize, jsSnapshotAckT)
+}
+
+// streamChunks will stream out the contents of r to the reply subject.
+// The ackT is used to create the subject for flow control acks.
+func (s *Server) streamChunks(acc *Account, mset *stream, r io.ReadCloser, reply string, chunkSize int, ackT string) {
 	if chunkSize == 0 {
 		chunkSize = defaultSnapshotChunkSize
 	}
-	// Setup for the chunk stream.
-	reply := req.DeliverSubject
-	r := sr.Reader
 	defer r.Close()
 
-	// Check interest for the snapshot deliver subject.
+	// Check interest for the deliver subject.
 	inch := make(chan bool, 1)
-	acc.sl.RegisterNotification(req.DeliverSubject, inch)
-	defer acc.sl.ClearNotification(req.DeliverSubject, inch)
+	acc.sl.RegisterNotification(reply, inch)
+	defer acc.sl.ClearNotification(reply, inch)
 	hasInterest := <-inch
 	if !hasInterest {
 		// Allow 2 seconds or so for interest to show up.
@@ -2847,7 +3007,7 @@ func (s *Server) streamSnapshot(ci *ClientInfo, acc *Account, mset *stream, sr *
 	var out int32
 
 	// We will place sequence number and size of chunk sent in the reply.
-	ackSubj := fmt.Sprintf(jsSnapshotAckT, mset.name(), nuid.Next())
+	ackSubj := fmt.Sprintf(ackT, mset.name(), nuid.Next())
 	ackSub, _ := mset.subscribeInternalUnlocked(ackSubj+".>", func(_ *subscription, _ *client, subject, _ string, _ []byte) {
 		cs, _ := strconv.Atoi(tokenAt(subject, 6))
 		// This is very crude and simple, but ok for now.
@@ -2894,6 +3054,246 @@ done:
 	mset.outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, nil, nil, 0, nil})
 }
 
+// Process an export request.
+func (s *Server) jsStreamExportRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	smsg := string(msg)
+	stream := streamNameFromSubject(subject)
+
+	// If we are in clustered mode we need to be the stream leader to proceed.
+	if s.JetStreamIsClustered() && !acc.JetStreamIsStreamLeader(stream) {
+		return
+	}
+
+	var resp = JSApiStreamExportResponse{ApiResponse: ApiResponse{Type: JSApiStreamExportResponseType}}
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = jsBadRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+
+	mset, err := acc.lookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+
+	var req JSApiStreamExportRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+	if !IsValidSubject(req.DeliverSubject) {
+		resp.Error = &ApiError{Code: 400, Description: "deliver subject not valid"}
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+	if (req.StartSeq > 0 && req.StartTime != nil) || (req.EndSeq > 0 && req.EndTime != nil) {
+		resp.Error = &ApiError{Code: 400, Description: "range can not be set by both sequence and time"}
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+	if req.FilterSubject != _EMPTY_ && !IsValidSubject(req.FilterSubject) {
+		resp.Error = &ApiError{Code: 400, Description: "filter subject not valid"}
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+
+	state := mset.state()
+	resp.State = &state
+	s.sendAPIResponse(ci, acc, subject, reply, smsg, s.jsonResponse(resp))
+
+	// Write the export from its own Go routine and stream it out as it is produced.
+	pr, pw := io.Pipe()
+	go func() {
+		err := mset.exportMsgs(pw, &req)
+		if err != nil {
+			s.Warnf("Export of stream '%s > %s' failed: %v", acc.Name, mset.name(), err)
+		}
+		pw.CloseWithError(err)
+	}()
+	go s.streamChunks(acc, mset, pr, req.DeliverSubject, req.ChunkSize, jsExportAckT)
+}
+
+// Process an import request.
+func (s *Server) jsStreamImportRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	smsg := string(msg)
+	stream := streamNameFromSubject(subject)
+
+	// If we are in clustered mode we need to be the stream leader to proceed.
+	if s.JetStreamIsClustered() && !acc.JetStreamIsStreamLeader(stream) {
+		return
+	}
+
+	var resp = JSApiStreamImportResponse{ApiResponse: ApiResponse{Type: JSApiStreamImportResponseType}}
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+
+	mset, err := acc.lookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+
+	var req JSApiStreamImportRequest
+	if !isEmptyRequest(msg) {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = jsInvalidJSONErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+			return
+		}
+	}
+
+	si, err := mset.newStreamMsgImport(&req)
+	if err != nil {
+		resp.Error = &ApiError{Code: 400, Description: err.Error()}
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+
+	s.processStreamImport(ci, acc, mset, si, subject, reply, smsg)
+}
+
+// processStreamImport will accept the chunks of an export and store the messages as they arrive.
+func (s *Server) processStreamImport(ci *ClientInfo, acc *Account, mset *stream, si *streamMsgImport, subject, reply, msg string) {
+	var resp = JSApiStreamImportResponse{ApiResponse: ApiResponse{Type: JSApiStreamImportResponseType}}
+
+	streamName := mset.name()
+	s.Noticef("Starting import for stream '%s > %s'", acc.Name, streamName)
+
+	start := time.Now().UTC()
+
+	// Create our internal subscription to accept the export.
+	importSubj := fmt.Sprintf(jsImportDeliverT, streamName, nuid.Next())
+
+	const activityInterval = 5 * time.Second
+
+	var (
+		mu        sync.Mutex
+		sub       *subscription
+		done      bool
+		total     int
+		notActive *time.Timer
+	)
+
+	// Stop accepting chunks and respond with the result.
+	// Lock should be held.
+	finish := func(reply string, err error) {
+		done = true
+		notActive.Stop()
+		if sub != nil {
+			sub.client.processUnsub(sub.sid)
+		}
+		// Waiting on our messages to be applied may take a bit, so do this in a Go routine.
+		go func() {
+			if err == nil {
+				err = si.waitApplied(activityInterval)
+			}
+			end := time.Now().UTC()
+
+			var resp = JSApiStreamImportCompleteResponse{ApiResponse: ApiResponse{Type: JSApiStreamImportCompleteResponseType}}
+			resp.Imported = si.count
+			if err != nil {
+				resp.Error = jsError(err)
+				s.Warnf("Import failed for stream '%s > %s' after %d msgs: %v", acc.Name, streamName, si.count, err)
+			} else {
+				state := mset.state()
+				resp.State = &state
+				s.Noticef("Completed import of %d msgs and %s for stream '%s > %s' in %v",
+					si.count, friendlyBytes(int64(total)), acc.Name, streamName, end.Sub(start))
+			}
+			if reply != _EMPTY_ {
+				s.sendInternalAccountMsg(acc, reply, s.jsonResponse(&resp))
+			}
+		}()
+	}
+
+	notActive = time.AfterFunc(activityInterval, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !done {
+			finish(_EMPTY_, fmt.Errorf("import for stream '%s > %s' is stalled", acc.Name, streamName))
+		}
+	})
+
+	processChunk := func(_ *subscription, c *client, subject, reply string, msg []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if done {
+			return
+		}
+		// We require reply subjects to communicate back failures, flow etc.
+		if reply == _EMPTY_ {
+			finish(_EMPTY_, fmt.Errorf("import for stream '%s > %s' requires reply subject for each chunk", acc.Name, streamName))
+			return
+		}
+		// Account client messages have \r\n on end. This is an error.
+		if len(msg) < LEN_CR_LF {
+			finish(reply, fmt.Errorf("import for stream '%s > %s' received short chunk", acc.Name, streamName))
+			return
+		}
+		// Adjust.
+		msg = msg[:len(msg)-LEN_CR_LF]
+		notActive.Reset(activityInterval)
+
+		// This means we are complete with our transfer from the client.
+		if len(msg) == 0 {
+			finish(reply, si.finish())
+			return
+		}
+
+		total += len(msg)
+		if err := si.write(msg); err != nil {
+			finish(reply, err)
+			return
+		}
+		s.sendInternalAccountMsg(acc, reply, nil)
+	}
+
+	mu.Lock()
+	sub, err := acc.subscribeInternal(importSubj, processChunk)
+	mu.Unlock()
+	if err != nil {
+		notActive.Stop()
+		resp.Error = &ApiError{Code: 500, Description: "JetStream unable to subscribe to import"}
+		s.sendAPIErrResponse(ci, acc, subject, reply, msg, s.jsonResponse(&resp))
+		return
+	}
+
+	// Mark the subject so the end user knows where to send the export chunks.
+	resp.DeliverSubject = importSubj
+	s.sendAPIResponse(ci, acc, subject, reply, msg, s.jsonResponse(resp))
+}
+
 // Request to create a durable consumer.
 func (s *Server) jsDurableCreateRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
 	s.jsConsumerCreate(sub, c, subject, reply, msg, true)
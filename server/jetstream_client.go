@@ -0,0 +1,333 @@
+// Copyright 2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+const (
+	// Inbox prefix for internal requests and consumer deliveries.
+	jsInternalInboxPre = "$JSC_INBOX."
+	// How long we wait for responses from the JetStream layer.
+	jsInternalRequestTimeout = 5 * time.Second
+)
+
+// Internal client used by the layers built on top of JetStream, like key value and object stores.
+// Everything goes through the account's subject space so that requests and publishes are
+// handled by the stream and meta leaders, which makes this work for clustered setups as well.
+type jsInternalClient struct {
+	mu  sync.Mutex
+	c   *client
+	cih []byte
+	sid int64
+}
+
+func (a *Account) newJSInternalClient() (*jsInternalClient, error) {
+	if !a.JetStreamEnabled() {
+		return nil, ErrJetStreamNotEnabledForAccount
+	}
+	a.mu.RLock()
+	s := a.srv
+	a.mu.RUnlock()
+	if s == nil {
+		return nil, ErrServerNotRunning
+	}
+	c := s.createInternalAccountClient()
+	c.acc = a
+	ci, _ := json.Marshal(&ClientInfo{Account: a.Name})
+
+	return &jsInternalClient{c: c, cih: genHeader(nil, ClientInfoHdr, string(ci))}, nil
+}
+
+// Make a JetStream API request and decode the response into resp.
+// Requests from internal clients are dispatched without the account, so we attach it here.
+func (ic *jsInternalClient) apiRequest(subject string, req []byte, resp interface{}) error {
+	return ic.request(subject, ic.cih, req, resp)
+}
+
+// Send a request through the account subject space and wait for a single response.
+func (ic *jsInternalClient) request(subject string, hdr, msg []byte, resp interface{}) error {
+	ch := make(chan []byte, 1)
+	reply := jsInternalInboxPre + nuid.Next()
+	sub, err := ic.subscribe(reply, func(_ *subscription, c *client, _, _ string, rmsg []byte) {
+		_, msg := c.msgParts(rmsg)
+		select {
+		case ch <- append([]byte(nil), msg...):
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer ic.unsubscribe(sub)
+
+	ic.publish(subject, reply, hdr, msg)
+
+	select {
+	case rmsg := <-ch:
+		return json.Unmarshal(rmsg, resp)
+	case <-time.After(jsInternalRequestTimeout):
+		return fmt.Errorf("timeout waiting for response on %q", subject)
+	}
+}
+
+// Store a message into a stream and return the stream sequence.
+func (ic *jsInternalClient) storeMsg(subject string, hdr, msg []byte) (uint64, error) {
+	var resp JSPubAckResponse
+	if err := ic.request(subject, hdr, msg, &resp); err != nil {
+		return 0, err
+	}
+	if err := convertApiErrorToError(resp.Error); err != nil {
+		return 0, err
+	}
+	if resp.PubAck == nil {
+		return 0, fmt.Errorf("invalid publish response for %q", subject)
+	}
+	return resp.Sequence, nil
+}
+
+// Load a message from a stream.
+func (ic *jsInternalClient) loadMsg(stream string, mreq *JSApiMsgGetRequest) (*StoredMsg, *ApiError, error) {
+	req, err := json.Marshal(mreq)
+	if err != nil {
+		return nil, nil, err
+	}
+	var resp JSApiMsgGetResponse
+	if err := ic.apiRequest(fmt.Sprintf(JSApiMsgGetT, stream), req, &resp); err != nil {
+		return nil, nil, err
+	}
+	return resp.Message, resp.Error, nil
+}
+
+// Remove a message from a stream.
+func (ic *jsInternalClient) deleteMsg(stream string, seq uint64) error {
+	req, _ := json.Marshal(&JSApiMsgDeleteRequest{Seq: seq, NoErase: true})
+	var resp JSApiMsgDeleteResponse
+	if err := ic.apiRequest(fmt.Sprintf(JSApiMsgDeleteT, stream), req, &resp); err != nil {
+		return err
+	}
+	return convertApiErrorToError(resp.Error)
+}
+
+func (ic *jsInternalClient) subscribe(subject string, cb msgHandler) (*subscription, error) {
+	ic.mu.Lock()
+	ic.sid++
+	sid := strconv.FormatInt(ic.sid, 10)
+	ic.mu.Unlock()
+	return ic.c.processSub([]byte(subject), nil, []byte(sid), cb, false)
+}
+
+func (ic *jsInternalClient) unsubscribe(sub *subscription) {
+	ic.c.processUnsub(sub.sid)
+}
+
+// Publish through our internal client.
+// The pubArgs are shared so we serialize here.
+func (ic *jsInternalClient) publish(subject, reply string, hdr, msg []byte) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	c := ic.c
+	buf := make([]byte, 0, len(hdr)+len(msg)+LEN_CR_LF)
+	buf = append(buf, hdr...)
+	buf = append(buf, msg...)
+	if len(hdr) > 0 {
+		c.pa.hdr = len(hdr)
+		c.pa.hdb = []byte(strconv.Itoa(c.pa.hdr))
+	} else {
+		c.pa.hdr = -1
+		c.pa.hdb = nil
+	}
+	c.pa.subject = []byte(subject)
+	c.pa.reply = []byte(reply)
+	c.pa.size = len(buf)
+	c.pa.szb = []byte(strconv.Itoa(c.pa.size))
+	buf = append(buf, _CRLF_...)
+
+	c.processInboundClientMsg(buf)
+	c.flushClients(0)
+}
+
+// An ephemeral push consumer that delivers to an internal subscription.
+// Messages are queued on arrival so we never block the stream's delivery path,
+// and handed to the callback in order from our own Go routine.
+type jsInternalConsumer struct {
+	mu      sync.Mutex
+	ic      *jsInternalClient
+	stream  string
+	name    string
+	pending uint64
+	sub     *subscription
+	head    *jsInternalMsg
+	tail    *jsInternalMsg
+	mch     chan struct{}
+	qch     chan struct{}
+	stopped bool
+}
+
+// Message delivered to an internal consumer.
+type jsInternalMsg struct {
+	subj  string
+	reply string
+	hdr   []byte
+	msg   []byte
+	next  *jsInternalMsg
+}
+
+// Create an ephemeral consumer on stream and call cb for each delivered message.
+// The callback is passed our quit channel in case it needs to block.
+func (ic *jsInternalClient) createConsumer(stream string, cfg ConsumerConfig, cb func(m *jsInternalMsg, qch chan struct{})) (*jsInternalConsumer, error) {
+	o := &jsInternalConsumer{
+		ic:     ic,
+		stream: stream,
+		mch:    make(chan struct{}, 1),
+		qch:    make(chan struct{}),
+	}
+
+	// Subscribe to our delivery subject first so the consumer sees interest.
+	cfg.DeliverSubject = jsInternalInboxPre + nuid.Next()
+	sub, err := ic.subscribe(cfg.DeliverSubject, o.queueMsg)
+	if err != nil {
+		return nil, err
+	}
+	o.sub = sub
+
+	req, err := json.Marshal(&CreateConsumerRequest{Stream: stream, Config: cfg})
+	if err != nil {
+		o.stop()
+		return nil, err
+	}
+	var resp JSApiConsumerCreateResponse
+	if err := ic.apiRequest(fmt.Sprintf(JSApiConsumerCreateT, stream), req, &resp); err != nil {
+		o.stop()
+		return nil, err
+	}
+	if err := convertApiErrorToError(resp.Error); err != nil {
+		o.stop()
+		return nil, err
+	}
+	if resp.ConsumerInfo != nil {
+		o.mu.Lock()
+		o.name, o.pending = resp.Name, resp.NumPending
+		o.mu.Unlock()
+	}
+
+	go o.loop(cb)
+
+	return o, nil
+}
+
+// Number of messages pending for this consumer when it was created.
+func (o *jsInternalConsumer) numPending() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.pending
+}
+
+// Acknowledge a delivered message.
+func (o *jsInternalConsumer) ack(m *jsInternalMsg) {
+	if m.reply != _EMPTY_ {
+		o.ic.publish(m.reply, _EMPTY_, nil, nil)
+	}
+}
+
+// Stop will remove our subscription and the underlying consumer.
+func (o *jsInternalConsumer) stop() error {
+	o.mu.Lock()
+	if o.stopped {
+		o.mu.Unlock()
+		return nil
+	}
+	o.stopped = true
+	close(o.qch)
+	sub, name := o.sub, o.name
+	o.head, o.tail = nil, nil
+	o.mu.Unlock()
+
+	ic := o.ic
+	if sub != nil {
+		ic.unsubscribe(sub)
+	}
+	if name == _EMPTY_ {
+		return nil
+	}
+	var resp JSApiConsumerDeleteResponse
+	if err := ic.apiRequest(fmt.Sprintf(JSApiConsumerDeleteT, o.stream, name), nil, &resp); err != nil {
+		return err
+	}
+	return convertApiErrorToError(resp.Error)
+}
+
+// Called when the consumer delivers a message.
+// We can not block here so we queue and let our loop handle it.
+func (o *jsInternalConsumer) queueMsg(_ *subscription, c *client, subject, reply string, rmsg []byte) {
+	hdr, msg := c.msgParts(rmsg)
+	msg = bytes.TrimSuffix(msg, []byte(_CRLF_))
+	m := &jsInternalMsg{subj: subject, reply: reply}
+	if len(hdr) > 0 {
+		m.hdr = append([]byte(nil), hdr...)
+	}
+	if len(msg) > 0 {
+		m.msg = append([]byte(nil), msg...)
+	}
+
+	o.mu.Lock()
+	if o.stopped {
+		o.mu.Unlock()
+		return
+	}
+	if o.head == nil {
+		o.head = m
+	} else {
+		o.tail.next = m
+	}
+	o.tail = m
+	o.mu.Unlock()
+
+	select {
+	case o.mch <- struct{}{}:
+	default:
+	}
+}
+
+func (o *jsInternalConsumer) loop(cb func(m *jsInternalMsg, qch chan struct{})) {
+	for {
+		select {
+		case <-o.mch:
+		case <-o.qch:
+			return
+		}
+		o.mu.Lock()
+		m := o.head
+		o.head, o.tail = nil, nil
+		o.mu.Unlock()
+
+		for ; m != nil; m = m.next {
+			select {
+			case <-o.qch:
+				return
+			default:
+			}
+			cb(m, o.qch)
+		}
+	}
+}
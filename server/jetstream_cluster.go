@@ -79,6 +79,12 @@ const (
 	updateSkipOp
 	// Update Stream
 	updateStreamOp
+	// Atomic batch of stream msgs.
+	batchMsgOp
+	// Skip stream sequences, e.g. when importing msgs with their original sequences.
+	skipMsgsOp
+	// Imported stream msg, which is not checked for duplicates.
+	importMsgOp
 )
 
 // raftGroups are controlled by the metagroup controller.
@@ -88,6 +94,9 @@ type raftGroup struct {
 	Peers     []string    `json:"peers"`
 	Storage   StorageType `json:"store"`
 	Preferred string      `json:"preferred,omitempty"`
+	// Set when a single replica gets new peers. Only the preferred peer has any data,
+	// so the new peers will not campaign until they have caught up.
+	ScaleUp bool `json:"scale_up,omitempty"`
 	// Internal
 	node RaftNode
 }
@@ -127,11 +136,32 @@ type consumerAssignment struct {
 
 // streamPurge is what the stream leader will replicate when purging a stream.
 type streamPurge struct {
-	Client  *ClientInfo `json:"client,omitempty"`
-	Stream  string      `json:"stream"`
-	LastSeq uint64      `json:"last_seq"`
-	Subject string      `json:"subject"`
-	Reply   string      `json:"reply"`
+	Client  *ClientInfo              `json:"client,omitempty"`
+	Stream  string                   `json:"stream"`
+	LastSeq uint64                   `json:"last_seq"`
+	Subject string                   `json:"subject"`
+	Reply   string                   `json:"reply"`
+	Request *JSApiStreamPurgeRequest `json:"request,omitempty"`
+}
+
+// resolvedRequest returns the partial purge request bounded by the last sequence at the time of the purge.
+// Messages stored after the purge will never be considered, so a purge evaluates the same on every replica
+// and when replayed. A request with keep only counts the messages below that sequence.
+func (sp *streamPurge) resolvedRequest() *JSApiStreamPurgeRequest {
+	if sp.isFull() {
+		return nil
+	}
+	preq := *sp.Request
+	if preq.Sequence == 0 || preq.Sequence > sp.LastSeq+1 {
+		preq.Sequence = sp.LastSeq + 1
+	}
+	return &preq
+}
+
+// isFull returns if this purge removes all messages from the stream.
+func (sp *streamPurge) isFull() bool {
+	preq := sp.Request
+	return preq == nil || ((preq.Subject == _EMPTY_ || preq.Subject == fwcs) && preq.Sequence == 0 && preq.Keep == 0)
 }
 
 // streamMsgDelete is what the stream leader will replicate when deleting a message.
@@ -471,19 +501,21 @@ func (js *jetStream) setupMetaGroup() error {
 	sysAcc := s.SystemAccount()
 	storeDir := path.Join(js.config.StoreDir, sysAcc.Name, defaultStoreDirName, defaultMetaGroupName)
 
-	fs, err := newFileStore(
-		FileStoreConfig{StoreDir: storeDir, BlockSize: defaultMetaFSBlkSize, AsyncFlush: false},
+	fs, err := newFileStoreWithCreated(
+		FileStoreConfig{StoreDir: storeDir, BlockSize: defaultMetaFSBlkSize, AsyncFlush: false, Cipher: s.getOpts().JetStreamCipher},
 		StreamConfig{Name: defaultMetaGroupName, Storage: FileStorage},
+		time.Now().UTC(),
+		s.jsKeyGen(sysAcc.Name),
 	)
 	if err != nil {
 		s.Errorf("Error creating filestore: %v", err)
 		return err
 	}
 
-	cfg := &RaftConfig{Name: defaultMetaGroupName, Store: storeDir, Log: fs}
+	cfg := &RaftConfig{Name: defaultMetaGroupName, Store: storeDir, Log: fs, prf: s.jsKeyGen(sysAcc.Name), cipher: s.getOpts().JetStreamCipher}
 
 	var bootstrap bool
-	if _, err := readPeerState(storeDir); err != nil {
+	if _, err := readPeerState(cfg); err != nil {
 		s.Noticef("JetStream cluster bootstrapping")
 		bootstrap = true
 		peers := s.ActivePeers()
@@ -953,6 +985,13 @@ func (sa *streamAssignment) copyGroup() *streamAssignment {
 	return &csa
 }
 
+// Returns true if we are moving the stream to a new set of peers.
+// While moving, the new peers are appended to the existing ones.
+// Lock should be held.
+func (sa *streamAssignment) isMigrating() bool {
+	return sa.Group != nil && sa.Config != nil && len(sa.Group.Peers) > sa.Config.Replicas
+}
+
 func (js *jetStream) processRemovePeer(peer string) {
 	js.mu.Lock()
 	s, cc := js.srv, js.cluster
@@ -1153,9 +1192,11 @@ func (js *jetStream) createRaftGroup(rg *raftGroup, storage StorageType) error {
 	storeDir := path.Join(js.config.StoreDir, sysAcc.Name, defaultStoreDirName, rg.Name)
 	var store StreamStore
 	if storage == FileStorage {
-		fs, err := newFileStore(
-			FileStoreConfig{StoreDir: storeDir, BlockSize: 4_000_000, AsyncFlush: false, SyncInterval: 5 * time.Minute},
+		fs, err := newFileStoreWithCreated(
+			FileStoreConfig{StoreDir: storeDir, BlockSize: 4_000_000, AsyncFlush: false, SyncInterval: 5 * time.Minute, Cipher: s.getOpts().JetStreamCipher},
 			StreamConfig{Name: rg.Name, Storage: FileStorage},
+			time.Now().UTC(),
+			s.jsKeyGen(sysAcc.Name),
 		)
 		if err != nil {
 			s.Errorf("Error creating filestore WAL: %v", err)
@@ -1171,9 +1212,11 @@ func (js *jetStream) createRaftGroup(rg *raftGroup, storage StorageType) error {
 		store = ms
 	}
 
-	cfg := &RaftConfig{Name: rg.Name, Store: storeDir, Log: store, Track: true}
+	cfg := &RaftConfig{Name: rg.Name, Store: storeDir, Log: store, Track: true, prf: s.jsKeyGen(sysAcc.Name), cipher: s.getOpts().JetStreamCipher}
 
-	if _, err := readPeerState(storeDir); err != nil {
+	if _, err := readPeerState(cfg); err != nil {
+		// If we are new to a group that scaled up we can not lead until we have caught up.
+		cfg.Observer = rg.ScaleUp && cc.meta.ID() != rg.Preferred
 		s.bootstrapRaftNode(cfg, rg.Peers, true)
 	}
 
@@ -1267,6 +1310,39 @@ func (js *jetStream) monitorStream(mset *stream, sa *streamAssignment) {
 	restoreDoneCh := make(<-chan error)
 	isRecovering := true
 
+	// If we have messages but our log is empty we were scaled up from a single replica.
+	// Our new peers will need our snapshot to catch up once we are leader, even with no
+	// messages since they will not campaign until they have processed it.
+	var needCatchup bool
+	if index, _, _ := n.Progress(); index <= 1 && mset != nil && (mset.lastSeq() > 0 || sa.Group.ScaleUp) {
+		needCatchup = true
+	}
+
+	// When moving to new peers the leader will check periodically if they have caught up.
+	var uch <-chan struct{}
+	if mset != nil {
+		uch = mset.updateC()
+	}
+	var mt *time.Ticker
+	var mtc <-chan time.Time
+	var mcurrent int
+	checkMigration := func() {
+		if isLeader && mset != nil && len(js.streamMigrationPeers(mset)) > 0 {
+			if mt == nil {
+				mt, mcurrent = time.NewTicker(migrationCheckInterval), 0
+				mtc = mt.C
+			}
+		} else if mt != nil {
+			mt.Stop()
+			mt, mtc = nil, nil
+		}
+	}
+	defer func() {
+		if mt != nil {
+			mt.Stop()
+		}
+	}()
+
 	for {
 		select {
 		case <-s.quitCh:
@@ -1300,6 +1376,10 @@ func (js *jetStream) monitorStream(mset *stream, sa *streamAssignment) {
 				s.Warnf("Error applying entries to '%s > %s'", sa.Client.serviceAccount(), sa.Config.Name)
 			}
 		case isLeader = <-lch:
+			// We may have been stopped, e.g. scaled down to a single replica.
+			if n.State() == Closed {
+				return
+			}
 			if isLeader {
 				if isRestore {
 					acc, _ := s.LookupAccount(sa.Client.serviceAccount())
@@ -1312,6 +1392,24 @@ func (js *jetStream) monitorStream(mset *stream, sa *streamAssignment) {
 				js.setStreamAssignmentRecovering(sa)
 			}
 			js.processStreamLeaderChange(mset, isLeader)
+			if isLeader && needCatchup {
+				mset.sendSnapshot()
+				needCatchup = false
+			}
+			checkMigration()
+		case <-uch:
+			checkMigration()
+		case <-mtc:
+			// We need our new peers to be current for consecutive checks, since they
+			// may have just received our snapshot and not yet asked us to catch them up.
+			if js.isStreamMigrationCurrent(mset) {
+				mcurrent++
+			} else {
+				mcurrent = 0
+			}
+			if mcurrent >= 2 && js.completeStreamMigration(mset) {
+				checkMigration()
+			}
 		case <-t.C:
 			doSnapshot()
 		case err := <-restoreDoneCh:
@@ -1466,8 +1564,8 @@ func (js *jetStream) applyStreamEntries(mset *stream, ce *CommittedEntry, isReco
 	for _, e := range ce.Entries {
 		if e.Type == EntryNormal {
 			buf := e.Data
-			switch entryOp(buf[0]) {
-			case streamMsgOp:
+			switch op := entryOp(buf[0]); op {
+			case streamMsgOp, importMsgOp:
 				if mset == nil {
 					continue
 				}
@@ -1478,8 +1576,10 @@ func (js *jetStream) applyStreamEntries(mset *stream, ce *CommittedEntry, isReco
 				}
 
 				// We can skip if we know this is less than what we already have.
-				last := mset.lastSeq()
+				// Proposals that failed when applied took up a sequence here as well.
+				last := mset.appliedSeq()
 				if lseq < last {
+					mset.checkSkippedProposal(lseq, ts, 1)
 					continue
 				}
 				// Skip by hand here since first msg special case.
@@ -1493,7 +1593,7 @@ func (js *jetStream) applyStreamEntries(mset *stream, ce *CommittedEntry, isReco
 				mset.checkForFlowControl(lseq + 1)
 
 				s := js.srv
-				if err := mset.processJetStreamMsg(subject, reply, hdr, msg, lseq, ts); err != nil {
+				if err := mset.processJetStreamMsg(subject, reply, hdr, msg, lseq, ts, op == importMsgOp); err != nil {
 					if !isRecovering {
 						if err == errLastSeqMismatch {
 							return err
@@ -1506,6 +1606,55 @@ func (js *jetStream) applyStreamEntries(mset *stream, ce *CommittedEntry, isReco
 					}
 				}
 
+			case batchMsgOp:
+				if mset == nil {
+					continue
+				}
+
+				id, reply, msgs, lseq, ts, err := decodeStreamBatch(buf[1:])
+				if err != nil {
+					panic(err.Error())
+				}
+
+				// We can skip if we know this is less than what we already have.
+				last := mset.appliedSeq()
+				if lseq < last || (lseq == 0 && last != 0) {
+					mset.checkSkippedProposal(lseq, ts, uint64(len(msgs)))
+					continue
+				}
+
+				s := js.srv
+				if err := mset.processJetStreamBatch(id, reply, msgs, lseq, ts); err != nil {
+					if !isRecovering {
+						if err == errLastSeqMismatch {
+							return err
+						}
+						s.Debugf("Got error processing JetStream batch: %v", err)
+					}
+					if isOutOfSpaceErr(err) {
+						s.handleOutOfSpace(mset.name())
+						return err
+					}
+				}
+
+			case skipMsgsOp:
+				if mset == nil {
+					continue
+				}
+
+				lseq, last, err := decodeSkipMsgs(buf[1:])
+				if err != nil {
+					panic(err.Error())
+				}
+
+				// We can skip if we already have these.
+				if mset.lastSeq() >= last {
+					continue
+				}
+				if err := mset.skipMsgs(lseq, last); err == errLastSeqMismatch && !isRecovering {
+					return err
+				}
+
 			case deleteMsgOp:
 				md, err := decodeMsgDelete(buf[1:])
 				if err != nil {
@@ -1548,15 +1697,19 @@ func (js *jetStream) applyStreamEntries(mset *stream, ce *CommittedEntry, isReco
 				}
 				// Ignore if we are recovering and we have already processed.
 				if isRecovering {
-					if mset.state().FirstSeq <= sp.LastSeq {
-						// Make sure all messages from the purge are gone.
-						mset.store.Compact(sp.LastSeq + 1)
+					if sp.isFull() {
+						if mset.state().FirstSeq <= sp.LastSeq {
+							// Make sure all messages from the purge are gone.
+							mset.store.Compact(sp.LastSeq + 1)
+						}
+					} else {
+						mset.purge(sp.resolvedRequest())
 					}
 					continue
 				}
 
 				s := js.server()
-				purged, err := mset.purge()
+				purged, err := mset.purge(sp.resolvedRequest())
 				if err != nil {
 					s.Warnf("JetStream cluster failed to purge stream %q for account %q: %v", sp.Stream, sp.Client.serviceAccount(), err)
 				}
@@ -1580,12 +1733,21 @@ func (js *jetStream) applyStreamEntries(mset *stream, ce *CommittedEntry, isReco
 				panic("JetStream Cluster Unknown group entry op type!")
 			}
 		} else if e.Type == EntrySnapshot {
-			if !isRecovering && mset != nil {
+			if mset != nil {
 				var snap streamSnapshot
 				if err := json.Unmarshal(e.Data, &snap); err != nil {
 					return err
 				}
-				mset.processSnapshot(&snap)
+				// Failed proposals are not reflected in our store, so we need these
+				// even when recovering for the entries that follow to line up.
+				mset.setCLFS(snap.Failed)
+				if !isRecovering {
+					mset.processSnapshot(&snap)
+					// If we were waiting to catch up before taking part in elections we can now.
+					if n := mset.raftNode(); n != nil && n.IsObserver() && mset.lastSeq() >= snap.LastSeq {
+						n.SetObserver(false)
+					}
+				}
 			}
 		} else if e.Type == EntryRemovePeer {
 			js.mu.RLock()
@@ -1633,20 +1795,181 @@ func (s *Server) replicas(node RaftNode) []*PeerInfo {
 	return replicas
 }
 
-// Will check our node peers and see if we should remove a peer.
-func (js *jetStream) checkPeers(rg *raftGroup) {
+// How often leaders check on new peers when moving a stream.
+const migrationCheckInterval = 250 * time.Millisecond
+
+// Returns the peers the stream is moving to, or nil if the stream is not moving.
+func (js *jetStream) streamMigrationPeers(mset *stream) []string {
+	sa := mset.streamAssignment()
+	if sa == nil {
+		return nil
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	if !sa.isMigrating() {
+		return nil
+	}
+	return append([]string(nil), sa.Group.Peers[len(sa.Group.Peers)-sa.Config.Replicas:]...)
+}
+
+// Returns how far each of the new peers we are moving the stream to has caught up to lseq.
+func (js *jetStream) streamMigrationInfo(mset *stream, npeers []string, lseq uint64) []*MigrationInfo {
+	n := mset.raftNode()
+	if n == nil {
+		return nil
+	}
+	ourID := n.ID()
+	peers := make(map[string]*Peer)
+	for _, p := range n.Peers() {
+		peers[p.ID] = p
+	}
+	s := js.srv
+	var mis []*MigrationInfo
+	for _, peer := range npeers {
+		mi := &MigrationInfo{Name: peer, LastSeq: lseq}
+		if sir, ok := s.nodeToInfo.Load(peer); ok && sir != nil {
+			mi.Name = sir.(nodeInfo).name
+		}
+		if seq, ok := mset.catchupProgress(peer); ok {
+			// Being caught up out of band.
+			mi.Seq = seq
+		} else if peer == ourID {
+			mi.Seq, mi.Current = lseq, true
+		} else if p := peers[peer]; p != nil {
+			if p.Lag < lseq {
+				mi.Seq = lseq - p.Lag
+			}
+			mi.Current = p.Current && p.Lag == 0
+		}
+		mis = append(mis, mi)
+	}
+	return mis
+}
+
+// Returns true if all of the new peers we are moving the stream to are current.
+func (js *jetStream) isStreamMigrationCurrent(mset *stream) bool {
+	npeers, n := js.streamMigrationPeers(mset), mset.raftNode()
+	if len(npeers) == 0 || n == nil {
+		return false
+	}
+	ourID := n.ID()
+	peers := make(map[string]*Peer)
+	for _, p := range n.Peers() {
+		peers[p.ID] = p
+	}
+	for _, peer := range npeers {
+		if peer == ourID {
+			continue
+		}
+		if p := peers[peer]; p == nil || !p.Current || p.Lag > 0 || mset.lagForCatchupPeer(peer) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Called by the stream leader once the new peers of a stream being moved are current.
+// We need to be one of the new peers, and so do the leaders of our consumers. We then remove
+// the old peers from the raft groups while they are still running so we do not lose quorum.
+// Once that is done we propose the assignments without the old peers. Returns true if proposed.
+func (js *jetStream) completeStreamMigration(mset *stream) bool {
+	npeers, n := js.streamMigrationPeers(mset), mset.raftNode()
+	if len(npeers) == 0 || n == nil {
+		return false
+	}
+	npg := &raftGroup{Peers: npeers}
+	if !npg.isMember(n.ID()) {
+		stepDownToCurrentPeer(n, npeers)
+		return false
+	}
+
+	sa := mset.streamAssignment()
+	js.mu.RLock()
+	cc := js.cluster
+	if cc == nil || cc.meta == nil {
+		js.mu.RUnlock()
+		return false
+	}
+	nodes := []RaftNode{n}
+	for _, ca := range sa.consumers {
+		if cn := ca.Group.node; cn != nil {
+			if !npg.isMember(cn.GroupLeader()) {
+				js.mu.RUnlock()
+				return false
+			}
+			nodes = append(nodes, cn)
+		}
+	}
+	js.mu.RUnlock()
+
+	var removing bool
+	for _, node := range nodes {
+		for _, p := range node.Peers() {
+			if !npg.isMember(p.ID) {
+				node.ProposeRemovePeer(p.ID)
+				removing = true
+			}
+		}
+	}
+	if removing {
+		return false
+	}
+
+	js.mu.RLock()
+	csa := sa.copyGroup()
+	csa.Group.Peers, csa.Group.Preferred, csa.Group.ScaleUp = npeers, n.ID(), false
+	csa.Subject, csa.Reply = _EMPTY_, _EMPTY_
+	cas := sa.consumersForGroup(csa.Group)
+	meta := cc.meta
+	js.mu.RUnlock()
+
+	for _, ca := range cas {
+		meta.ForwardProposal(encodeAddConsumerAssignment(ca))
+	}
+	meta.ForwardProposal(encodeUpdateStreamAssignment(csa))
+	return true
+}
+
+// Will step down to the first of the peers that is current.
+func stepDownToCurrentPeer(n RaftNode, peers []string) {
+	current := make(map[string]bool)
+	for _, p := range n.Peers() {
+		if p.Current && p.Lag == 0 {
+			current[p.ID] = true
+		}
+	}
+	for _, peer := range peers {
+		if current[peer] && n.StepDown(peer) == nil {
+			return
+		}
+	}
+}
+
+// Will check our node peers and see if we should remove or add a peer.
+// Returns true if we added peers, which will need to be caught up.
+func (js *jetStream) checkPeers(rg *raftGroup) bool {
 	js.mu.Lock()
 	defer js.mu.Unlock()
 
 	// FIXME(dlc) - Single replicas?
 	if rg == nil || rg.node == nil {
-		return
+		return false
 	}
+	known := make(map[string]bool)
 	for _, peer := range rg.node.Peers() {
+		known[peer.ID] = true
 		if !rg.isMember(peer.ID) {
 			rg.node.ProposeRemovePeer(peer.ID)
 		}
 	}
+	var added bool
+	for _, peer := range rg.Peers {
+		if !known[peer] {
+			rg.node.ProposeAddPeer(peer)
+			added = true
+		}
+	}
+	return added
 }
 
 func (js *jetStream) processStreamLeaderChange(mset *stream, isLeader bool) {
@@ -1669,8 +1992,6 @@ func (js *jetStream) processStreamLeaderChange(mset *stream, isLeader bool) {
 	if isLeader {
 		s.Noticef("JetStream cluster new stream leader for '%s > %s'", sa.Client.serviceAccount(), streamName)
 		s.sendStreamLeaderElectAdvisory(mset)
-		// Check for peer removal and process here if needed.
-		js.checkPeers(sa.Group)
 	} else {
 		// We are stepping down.
 		// Make sure if we are doing so because we have lost quorum that we send the appropriate advisories.
@@ -1682,6 +2003,11 @@ func (js *jetStream) processStreamLeaderChange(mset *stream, isLeader bool) {
 	// Tell stream to switch leader status.
 	mset.setLeader(isLeader)
 
+	// Check for peer changes and process here if needed.
+	if isLeader && js.checkPeers(sa.Group) {
+		mset.sendSnapshot()
+	}
+
 	if !isLeader || hasResponded {
 		return
 	}
@@ -1705,6 +2031,7 @@ func (js *jetStream) processStreamLeaderChange(mset *stream, isLeader bool) {
 			Sources: mset.sourcesInfo(),
 			Mirror:  mset.mirrorInfo(),
 		}
+		mset.checkClusterInfo(resp.StreamInfo)
 		s.sendAPIResponse(client, acc, subject, reply, _EMPTY_, s.jsonResponse(&resp))
 		if node := mset.raftNode(); node != nil {
 			mset.sendCreateAdvisory()
@@ -1961,15 +2288,48 @@ func (js *jetStream) processClusterUpdateStream(acc *Account, sa *streamAssignme
 	js.mu.Unlock()
 
 	mset, err := acc.lookupStream(sa.Config.Name)
+	if err == ErrJetStreamStreamNotFound && len(rg.Peers) > 1 {
+		// We are a new peer for a stream being scaled up.
+		// We will be caught up by the leader once we are running.
+		js.processClusterCreateStream(acc, sa)
+		return
+	}
+
+	// The stream leader prior to this update will respond.
+	var wasLeader bool
+	if err == nil && mset != nil {
+		mset.mu.RLock()
+		wasLeader = mset.isLeader()
+		mset.mu.RUnlock()
+	}
+
 	if err == nil && mset != nil {
 		osa := mset.streamAssignment()
-		if !alreadyRunning {
-			s.startGoRoutine(func() { js.monitorStream(mset, sa) })
+		if !alreadyRunning && len(rg.Peers) > 1 {
+			// We are being scaled up from a single replica so need a raft group now.
+			err = js.createRaftGroup(rg, sa.Config.Storage)
+		} else if alreadyRunning && len(rg.Peers) == 1 {
+			// We are being scaled down to a single replica so no longer need our raft group.
+			js.mu.Lock()
+			node := rg.node
+			rg.node = nil
+			js.mu.Unlock()
+			node.Delete()
+		}
+		if err == nil {
+			// Set our assignment first so the monitor sees our raft node.
+			mset.setStreamAssignment(sa)
+			if !alreadyRunning && rg.node != nil {
+				s.startGoRoutine(func() { js.monitorStream(mset, sa) })
+			}
+			if err = mset.update(sa.Config); err != nil {
+				s.Warnf("JetStream cluster error updating stream %q for account %q: %v", sa.Config.Name, acc.Name, err)
+				mset.setStreamAssignment(osa)
+			}
 		}
-		mset.setStreamAssignment(sa)
-		if err = mset.update(sa.Config); err != nil {
-			s.Warnf("JetStream cluster error updating stream %q for account %q: %v", sa.Config.Name, acc.Name, err)
-			mset.setStreamAssignment(osa)
+		// If we are now running without a raft group we are the leader.
+		if err == nil && alreadyRunning && rg.node == nil {
+			js.processStreamLeaderChange(mset, true)
 		}
 	}
 
@@ -1994,7 +2354,12 @@ func (js *jetStream) processClusterUpdateStream(acc *Account, sa *streamAssignme
 	isLeader := mset.isLeader()
 	mset.mu.RUnlock()
 
-	if !isLeader || hasResponded {
+	// Check for peer changes if we are the leader and catch up any new peers.
+	if isLeader && js.checkPeers(rg) {
+		mset.sendSnapshot()
+	}
+
+	if !(isLeader || wasLeader) || hasResponded {
 		return
 	}
 
@@ -2008,6 +2373,7 @@ func (js *jetStream) processClusterUpdateStream(acc *Account, sa *streamAssignme
 		Mirror:  mset.mirrorInfo(),
 		Sources: mset.sourcesInfo(),
 	}
+	mset.checkClusterInfo(resp.StreamInfo)
 	s.sendAPIResponse(client, acc, subject, reply, _EMPTY_, s.jsonResponse(&resp))
 }
 
@@ -2416,10 +2782,20 @@ func (js *jetStream) processClusterCreateConsumer(ca *consumerAssignment) {
 		return
 	}
 
+	// If we are being scaled down to a single replica we no longer need our raft group.
+	if alreadyRunning && len(rg.Peers) == 1 {
+		js.mu.Lock()
+		node := rg.node
+		rg.node = nil
+		js.mu.Unlock()
+		node.Delete()
+	}
+
 	// Process the raft group and make sure its running if needed.
 	js.createRaftGroup(rg, mset.config().Storage)
 
 	// Check if we already have this consumer running.
+	var isUpdate bool
 	o := mset.lookupConsumer(ca.Name)
 	if o != nil {
 		if o.isDurable() && o.isPushMode() {
@@ -2430,6 +2806,14 @@ func (js *jetStream) processClusterCreateConsumer(ca *consumerAssignment) {
 		}
 		o.setConsumerAssignment(ca)
 		s.Debugf("JetStream cluster, consumer was already running")
+
+		// Check if this is an update to a durable's config.
+		ocfg, ncfg := o.config(), *ca.Config
+		setConsumerConfigDefaults(&ncfg)
+		if o.isDurable() && !configsEqualSansDelivery(ocfg, ncfg) {
+			isUpdate = true
+			_, err = mset.addConsumerWithAssignment(ca.Config, ca.Name, ca)
+		}
 	}
 
 	// Add in the consumer if needed.
@@ -2442,6 +2826,24 @@ func (js *jetStream) processClusterCreateConsumer(ca *consumerAssignment) {
 		err = o.setStoreState(ca.State)
 	}
 
+	// Updates keep running with the prior config on failure, and the leader responds directly.
+	if isUpdate {
+		if err != nil {
+			s.Warnf("Consumer update failed for '%s > %s > %s': %v", ca.Client.serviceAccount(), ca.Stream, ca.Name, err)
+		}
+		if rg.node == nil || rg.node.Leader() {
+			var resp = JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}}
+			if err != nil {
+				resp.Error = jsError(err)
+				s.sendAPIErrResponse(ca.Client, acc, ca.Subject, ca.Reply, _EMPTY_, s.jsonResponse(&resp))
+			} else {
+				resp.ConsumerInfo = o.info()
+				s.sendAPIResponse(ca.Client, acc, ca.Subject, ca.Reply, _EMPTY_, s.jsonResponse(&resp))
+			}
+		}
+		return
+	}
+
 	if err != nil {
 		s.Warnf("Consumer create failed for '%s > %s > %s': %v\n", ca.Client.serviceAccount(), ca.Stream, ca.Name, err)
 		js.mu.Lock()
@@ -2485,6 +2887,9 @@ func (js *jetStream) processClusterCreateConsumer(ca *consumerAssignment) {
 		if rg.node != nil {
 			if !alreadyRunning {
 				s.startGoRoutine(func() { js.monitorConsumer(o, ca) })
+			} else if rg.node.Leader() && js.checkPeers(rg) {
+				// Our peers changed, catch up any new ones.
+				o.sendSnapshot()
 			}
 		} else {
 			// Single replica consumer, process manually here.
@@ -2651,6 +3056,40 @@ func (js *jetStream) monitorConsumer(o *consumer, ca *consumerAssignment) {
 	// Track if we are leader.
 	var isLeader bool
 
+	// If we have state but our log is empty we were scaled up from a single replica.
+	// Our new peers will need our snapshot to catch up once we are leader, even with no
+	// state since they will not campaign until they have processed it.
+	var needCatchup bool
+	if index, _, _ := n.Progress(); index <= 1 {
+		if state, err := o.store.State(); err == nil && state != nil && (state.Delivered.Stream > 0 || ca.Group.ScaleUp) {
+			needCatchup = true
+		}
+	}
+
+	// When moving our stream to new peers the leader will hand off to one of them once they are current.
+	o.mu.RLock()
+	mset := o.mset
+	o.mu.RUnlock()
+	uch := o.updateC()
+	var mt *time.Ticker
+	var mtc <-chan time.Time
+	checkMigration := func() {
+		if isLeader && mset != nil && len(js.streamMigrationPeers(mset)) > 0 {
+			if mt == nil {
+				mt = time.NewTicker(migrationCheckInterval)
+				mtc = mt.C
+			}
+		} else if mt != nil {
+			mt.Stop()
+			mt, mtc = nil, nil
+		}
+	}
+	defer func() {
+		if mt != nil {
+			mt.Stop()
+		}
+	}()
+
 	for {
 		select {
 		case <-s.quitCh:
@@ -2675,16 +3114,40 @@ func (js *jetStream) monitorConsumer(o *consumer, ca *consumerAssignment) {
 				s.Warnf("Error applying consumer entries to '%s > %s'", ca.Client.serviceAccount(), ca.Name)
 			}
 		case isLeader = <-lch:
+			// We may have been stopped, e.g. scaled down to a single replica.
+			if n.State() == Closed {
+				return
+			}
 			if !isLeader && n.GroupLeader() != noLeader {
 				js.setConsumerAssignmentRecovering(ca)
 			}
 			js.processConsumerLeaderChange(o, isLeader)
+			if isLeader && needCatchup {
+				o.sendSnapshot()
+				needCatchup = false
+			}
+			checkMigration()
+		case <-uch:
+			checkMigration()
+		case <-mtc:
+			if npeers := js.streamMigrationPeers(mset); len(npeers) > 0 && !(&raftGroup{Peers: npeers}).isMember(n.ID()) {
+				stepDownToCurrentPeer(n, npeers)
+			}
 		case <-t.C:
 			doSnapshot()
 		}
 	}
 }
 
+// Send our state to our followers so new peers can catch up.
+func (o *consumer) sendSnapshot() {
+	if node := o.raftNode(); node != nil {
+		if state, err := o.store.State(); err == nil && state != nil {
+			node.SendSnapshot(encodeConsumerState(state))
+		}
+	}
+}
+
 func (js *jetStream) applyConsumerEntries(o *consumer, ce *CommittedEntry, isLeader bool) error {
 	for _, e := range ce.Entries {
 		if e.Type == EntrySnapshot {
@@ -2694,6 +3157,10 @@ func (js *jetStream) applyConsumerEntries(o *consumer, ce *CommittedEntry, isLea
 				panic(err.Error())
 			}
 			o.store.Update(state)
+			// If we were waiting to catch up before taking part in elections we can now.
+			if n := o.raftNode(); n != nil && n.IsObserver() {
+				n.SetObserver(false)
+			}
 		} else if e.Type == EntryRemovePeer {
 			js.mu.RLock()
 			var ourID string
@@ -2850,8 +3317,10 @@ func (js *jetStream) processConsumerLeaderChange(o *consumer, isLeader bool) {
 	if isLeader {
 		s.Noticef("JetStream cluster new consumer leader for '%s > %s > %s'", ca.Client.serviceAccount(), streamName, consumerName)
 		s.sendConsumerLeaderElectAdvisory(o)
-		// Check for peer removal and process here if needed.
-		js.checkPeers(ca.Group)
+		// Check for peer changes and process here if needed.
+		if js.checkPeers(ca.Group) {
+			o.sendSnapshot()
+		}
 	} else {
 		// We are stepping down.
 		// Make sure if we are doing so because we have lost quorum that we send the appropriate advisories.
@@ -3112,10 +3581,8 @@ func (js *jetStream) processLeaderChange(isLeader bool) {
 // Lock should be held.
 func (cc *jetStreamCluster) remapStreamAssignment(sa *streamAssignment, removePeer string) bool {
 	// Need to select a replacement peer
-	s, now, cluster := cc.s, time.Now(), sa.Client.Cluster
-	if sa.Config.Placement != nil && sa.Config.Placement.Cluster != _EMPTY_ {
-		cluster = sa.Config.Placement.Cluster
-	}
+	s, now := cc.s, time.Now()
+	cluster, tags := sa.Config.placement(sa.Client.Cluster)
 	ourID := cc.meta.ID()
 
 	for _, p := range cc.meta.Peers() {
@@ -3132,8 +3599,8 @@ func (cc *jetStreamCluster) remapStreamAssignment(sa *streamAssignment, removePe
 		if !current || lastSeen > lostQuorumInterval || sa.Group.isMember(p.ID) {
 			continue
 		}
-		// Make sure the correct cluster.
-		if s.clusterNameForNode(p.ID) != cluster {
+		// Make sure the correct cluster and tags.
+		if !s.nodeMatchesPlacement(p.ID, cluster, tags) {
 			continue
 		}
 		// If we are here we have our candidate replacement, swap out the old one.
@@ -3149,32 +3616,171 @@ func (cc *jetStreamCluster) remapStreamAssignment(sa *streamAssignment, removePe
 	return false
 }
 
+// resizeGroupForStream will return a new group for the stream with the requested number of replicas.
+// When scaling down we try to keep the current leader, and when scaling up we keep all existing peers.
+// Returns nil if we do not have enough peers.
+// Lock should be held.
+func (cc *jetStreamCluster) resizeGroupForStream(sa *streamAssignment, replicas int) *raftGroup {
+	if replicas <= 0 {
+		replicas = 1
+	}
+	og := sa.Group
+	rg := &raftGroup{Name: og.Name, Storage: og.Storage, Preferred: og.Preferred}
+
+	if replicas < len(og.Peers) {
+		var leader string
+		if og.node != nil {
+			leader = og.node.GroupLeader()
+		}
+		if og.isMember(leader) {
+			rg.Peers = append(rg.Peers, leader)
+		}
+		for _, peer := range og.Peers {
+			if len(rg.Peers) == replicas {
+				break
+			}
+			if peer != leader {
+				rg.Peers = append(rg.Peers, peer)
+			}
+		}
+		if !rg.isMember(rg.Preferred) {
+			rg.Preferred = _EMPTY_
+		}
+		return rg
+	}
+
+	// Need to select new peers.
+	s, now := cc.s, time.Now()
+	cluster, tags := sa.Config.placement(sa.Client.Cluster)
+	ourID := cc.meta.ID()
+	rg.Peers = append(rg.Peers, og.Peers...)
+
+	for _, p := range cc.meta.Peers() {
+		if len(rg.Peers) == replicas {
+			break
+		}
+		// If it is not in our list it's probably shutdown, so don't consider.
+		if si, ok := s.nodeToInfo.Load(p.ID); !ok || si.(nodeInfo).offline {
+			continue
+		}
+		// Make sure they are active and current and not already part of our group.
+		current, lastSeen := p.Current, now.Sub(p.Last)
+		// We do not track activity of ourselves so ignore.
+		if p.ID == ourID {
+			lastSeen = 0
+		}
+		if !current || lastSeen > lostQuorumInterval || rg.isMember(p.ID) {
+			continue
+		}
+		// Make sure the correct cluster and tags.
+		if !s.nodeMatchesPlacement(p.ID, cluster, tags) {
+			continue
+		}
+		rg.Peers = append(rg.Peers, p.ID)
+	}
+	if len(rg.Peers) < replicas {
+		return nil
+	}
+
+	// If we were a single replica we need a new raft group. The current peer has the
+	// messages so make sure it is the one that leads.
+	if len(og.Peers) == 1 {
+		rg.Name, rg.Preferred, rg.ScaleUp = groupNameForStream(rg.Peers, rg.Storage), og.Peers[0], true
+	}
+	return rg
+}
+
+// placement returns the cluster and tags the stream should be placed on.
+// The cluster defaults to the one passed in if not set in the config.
+func (cfg *StreamConfig) placement(cluster string) (string, []string) {
+	if cfg.Placement == nil {
+		return cluster, nil
+	}
+	if cfg.Placement.Cluster != _EMPTY_ {
+		cluster = cfg.Placement.Cluster
+	}
+	return cluster, cfg.Placement.Tags
+}
+
+// moveGroupForStream will return the group for the stream while it moves to peers that match its new placement.
+// Any new peers are appended to the current ones, and once they have caught up the stream leader
+// will propose the group with only the new peers. Returns nil if we do not have enough peers.
+// Lock should be held.
+func (cc *jetStreamCluster) moveGroupForStream(sa *streamAssignment, cfg *StreamConfig) *raftGroup {
+	cluster, tags := cfg.placement(sa.Client.Cluster)
+	og := sa.Group
+	peers := cc.selectPeerGroup(cfg.Replicas, cluster, tags, og.Peers)
+	if len(peers) == 0 {
+		return nil
+	}
+	rg := &raftGroup{Name: og.Name, Storage: og.Storage, Preferred: og.Preferred}
+	npg := &raftGroup{Peers: peers}
+	for _, peer := range og.Peers {
+		if !npg.isMember(peer) {
+			rg.Peers = append(rg.Peers, peer)
+		}
+	}
+	// If our current peers already match the new placement there is nothing to move.
+	if len(rg.Peers) == 0 {
+		return og
+	}
+	rg.Peers = append(rg.Peers, peers...)
+
+	// If we were a single replica we need a new raft group. The current peer has the
+	// messages so make sure it is the one that leads.
+	if len(og.Peers) == 1 {
+		rg.Name, rg.Preferred, rg.ScaleUp = groupNameForStream(rg.Peers, rg.Storage), og.Peers[0], true
+	}
+	return rg
+}
+
 // selectPeerGroup will select a group of peers to start a raft group.
 // TODO(dlc) - For now randomly select. Can be way smarter.
-func (cc *jetStreamCluster) selectPeerGroup(r int, cluster string) []string {
-	var nodes []string
+// Peers that match the cluster and tags will be considered, and any existing peers will be preferred.
+func (cc *jetStreamCluster) selectPeerGroup(r int, cluster string, tags []string, existing []string) []string {
+	var nodes, enodes []string
 	peers := cc.meta.Peers()
 	s := cc.s
+	eg := &raftGroup{Peers: existing}
 
 	for _, p := range peers {
 		// If we know its offline or it is not in our list it probably shutdown, so don't consider.
 		if si, ok := s.nodeToInfo.Load(p.ID); !ok || si.(nodeInfo).offline {
 			continue
 		}
-		if cluster != _EMPTY_ {
-			if s.clusterNameForNode(p.ID) == cluster {
-				nodes = append(nodes, p.ID)
-			}
+		if !s.nodeMatchesPlacement(p.ID, cluster, tags) {
+			continue
+		}
+		if eg.isMember(p.ID) {
+			enodes = append(enodes, p.ID)
 		} else {
 			nodes = append(nodes, p.ID)
 		}
 	}
-	if len(nodes) < r {
+	if len(enodes)+len(nodes) < r {
 		return nil
 	}
 	// Don't depend on range to randomize.
 	rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
-	return nodes[:r]
+	return append(enodes, nodes...)[:r]
+}
+
+// nodeMatchesPlacement returns true if the node is in the cluster, if one is given, and has all of the tags.
+func (s *Server) nodeMatchesPlacement(node, cluster string, tags []string) bool {
+	sir, ok := s.nodeToInfo.Load(node)
+	if !ok || sir == nil {
+		return false
+	}
+	si := sir.(nodeInfo)
+	if cluster != _EMPTY_ && si.cluster != cluster {
+		return false
+	}
+	for _, tag := range tags {
+		if !si.tags.Contains(tag) {
+			return false
+		}
+	}
+	return true
 }
 
 func groupNameForStream(peers []string, storage StorageType) string {
@@ -3202,13 +3808,10 @@ func (cc *jetStreamCluster) createGroupForStream(ci *ClientInfo, cfg *StreamConf
 	if replicas == 0 {
 		replicas = 1
 	}
-	cluster := ci.Cluster
-	if cfg.Placement != nil && cfg.Placement.Cluster != _EMPTY_ {
-		cluster = cfg.Placement.Cluster
-	}
+	cluster, tags := cfg.placement(ci.Cluster)
 	// Need to create a group here.
 	// TODO(dlc) - Can be way smarter here.
-	peers := cc.selectPeerGroup(replicas, cluster)
+	peers := cc.selectPeerGroup(replicas, cluster, tags, nil)
 	if len(peers) == 0 {
 		return nil
 	}
@@ -3333,19 +3936,68 @@ func (s *Server) jsClusteredStreamUpdateRequest(ci *ClientInfo, acc *Account, su
 		return
 	}
 	// Check for cluster changes that we want to error on.
-	if newCfg.Replicas != len(osa.Group.Peers) {
-		resp.Error = &ApiError{Code: 400, Description: "Replicas configuration can not be updated"}
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
-		return
-	}
 	if !reflect.DeepEqual(newCfg.Mirror, osa.Config.Mirror) {
 		resp.Error = &ApiError{Code: 400, Description: "Mirror configuration can not be updated"}
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
 		return
 	}
 
-	sa := &streamAssignment{Group: osa.Group, Config: newCfg, Subject: subject, Reply: reply, Client: ci}
+	// Check for placement or replica changes, in which case we need a new group for the stream.
+	rg := osa.Group
+	placementChanged := !reflect.DeepEqual(newCfg.Placement, osa.Config.Placement)
+	if placementChanged || newCfg.Replicas != osa.Config.Replicas {
+		if osa.isMigrating() {
+			resp.Error = &ApiError{Code: 400, Description: "stream move already in progress"}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+			return
+		}
+		if placementChanged && newCfg.Replicas != osa.Config.Replicas {
+			resp.Error = &ApiError{Code: 400, Description: "stream move can not change replicas"}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+			return
+		}
+		if placementChanged {
+			rg = cc.moveGroupForStream(osa, newCfg)
+		} else {
+			rg = cc.resizeGroupForStream(osa, newCfg.Replicas)
+		}
+		if rg == nil {
+			resp.Error = jsInsufficientErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+			return
+		}
+	}
+
+	sa := &streamAssignment{Group: rg, Sync: osa.Sync, Config: newCfg, Subject: subject, Reply: reply, Client: ci}
 	cc.meta.Propose(encodeUpdateStreamAssignment(sa))
+
+	// Consumers are placed on the same peers as their stream, so move them along with it.
+	if rg != osa.Group {
+		for _, ca := range osa.consumersForGroup(rg) {
+			cc.meta.Propose(encodeAddConsumerAssignment(ca))
+		}
+	}
+}
+
+// consumersForGroup will return assignments for our consumers placed on the peers of
+// the stream's new group. Consumers always follow the peers of their stream.
+// Lock should be held.
+func (sa *streamAssignment) consumersForGroup(rg *raftGroup) []*consumerAssignment {
+	var cas []*consumerAssignment
+	for _, ca := range sa.consumers {
+		cca, cg := *ca, *ca.Group
+		cg.Peers = rg.Peers
+		cg.ScaleUp = len(ca.Group.Peers) == 1 && len(rg.Peers) > 1
+		if cg.ScaleUp {
+			// We were a single replica, so we need a new raft group led by the current peer.
+			cg.Name, cg.Preferred = groupNameForConsumer(rg.Peers, cg.Storage), ca.Group.Peers[0]
+		} else if !rg.isMember(cg.Preferred) {
+			cg.Preferred = _EMPTY_
+		}
+		cca.Group, cca.Subject, cca.Reply, cca.State = &cg, _EMPTY_, _EMPTY_, nil
+		cas = append(cas, &cca)
+	}
+	return cas
 }
 
 func (s *Server) jsClusteredStreamDeleteRequest(ci *ClientInfo, acc *Account, stream, subject, reply string, rmsg []byte) {
@@ -3374,7 +4026,7 @@ func (s *Server) jsClusteredStreamDeleteRequest(ci *ClientInfo, acc *Account, st
 	cc.meta.Propose(encodeDeleteStreamAssignment(sa))
 }
 
-func (s *Server) jsClusteredStreamPurgeRequest(ci *ClientInfo, acc *Account, mset *stream, stream, subject, reply string, rmsg []byte) {
+func (s *Server) jsClusteredStreamPurgeRequest(ci *ClientInfo, acc *Account, mset *stream, stream, subject, reply string, rmsg []byte, preq *JSApiStreamPurgeRequest) {
 	js, cc := s.getJetStreamCluster()
 	if js == nil || cc == nil {
 		return
@@ -3392,11 +4044,13 @@ func (s *Server) jsClusteredStreamPurgeRequest(ci *ClientInfo, acc *Account, mse
 	}
 
 	if n := sa.Group.node; n != nil {
-		sp := &streamPurge{Stream: stream, LastSeq: mset.state().LastSeq, Subject: subject, Reply: reply, Client: ci}
+		sp := &streamPurge{Stream: stream, LastSeq: mset.state().LastSeq, Subject: subject, Reply: reply, Client: ci, Request: preq}
+		// Resolve the cutoff here so all replicas purge exactly the same messages.
+		sp.Request = sp.resolvedRequest()
 		n.Propose(encodeStreamPurge(sp))
 	} else if mset != nil {
 		var resp = JSApiStreamPurgeResponse{ApiResponse: ApiResponse{Type: JSApiStreamPurgeResponseType}}
-		purged, err := mset.purge()
+		purged, err := mset.purge(preq)
 		if err != nil {
 			resp.Error = jsError(err)
 		} else {
@@ -3872,6 +4526,7 @@ func (s *Server) jsClusteredConsumerRequest(ci *ClientInfo, acc *Account, subjec
 
 	// We need to set the ephemeral here before replicating.
 	var oname string
+	created := time.Now().UTC()
 	if !isDurableConsumer(cfg) {
 		// We chose to have ephemerals be R=1.
 		rg.Peers = []string{rg.Preferred}
@@ -3889,16 +4544,23 @@ func (s *Server) jsClusteredConsumerRequest(ci *ClientInfo, acc *Account, subjec
 	} else {
 		oname = cfg.Durable
 		if ca := sa.consumers[oname]; ca != nil && !ca.deleted {
-			// This can be ok if delivery subject update.
+			// This can be ok if delivery subject update or an update to the fields we allow to change.
 			if !reflect.DeepEqual(cfg, ca.Config) && !configsEqualSansDelivery(*cfg, *ca.Config) {
-				resp.Error = jsError(ErrJetStreamConsumerAlreadyUsed)
-				s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
-				return
+				ocfg, ncfg := *ca.Config, *cfg
+				setConsumerConfigDefaults(&ocfg)
+				setConsumerConfigDefaults(&ncfg)
+				if err := checkNewConsumerConfig(&ocfg, &ncfg); err != nil {
+					resp.Error = jsError(err)
+					s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+					return
+				}
 			}
+			// Stay on our existing peers so we keep our state.
+			rg, created = ca.Group, ca.Created
 		}
 	}
 
-	ca := &consumerAssignment{Group: rg, Stream: stream, Name: oname, Config: cfg, Subject: subject, Reply: reply, Client: ci, Created: time.Now().UTC()}
+	ca := &consumerAssignment{Group: rg, Stream: stream, Name: oname, Config: cfg, Subject: subject, Reply: reply, Client: ci, Created: created}
 	cc.meta.Propose(encodeAddConsumerAssignment(ca))
 }
 
@@ -4035,6 +4697,7 @@ type streamSnapshot struct {
 	Bytes    uint64   `json:"bytes"`
 	FirstSeq uint64   `json:"first_seq"`
 	LastSeq  uint64   `json:"last_seq"`
+	Failed   uint64   `json:"clfs,omitempty"`
 	Deleted  []uint64 `json:"deleted,omitempty"`
 }
 
@@ -4049,12 +4712,20 @@ func (mset *stream) stateSnapshot() []byte {
 		Bytes:    state.Bytes,
 		FirstSeq: state.FirstSeq,
 		LastSeq:  state.LastSeq,
+		Failed:   mset.clfs,
 		Deleted:  state.Deleted,
 	}
 	b, _ := json.Marshal(snap)
 	return b
 }
 
+// Send our state snapshot to our followers so new peers can catch up.
+func (mset *stream) sendSnapshot() {
+	if node := mset.raftNode(); node != nil {
+		node.SendSnapshot(mset.stateSnapshot())
+	}
+}
+
 // processClusteredMsg will propose the inbound message to the underlying raft group.
 func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg []byte) (uint64, error) {
 	// For possible error response.
@@ -4066,8 +4737,18 @@ func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg [
 	s, js, jsa, st, rf, outq := mset.srv, mset.js, mset.jsa, mset.cfg.Storage, mset.cfg.Replicas, mset.outq
 	maxMsgSize := int(mset.cfg.MaxMsgSize)
 	msetName := mset.cfg.Name
+	sealed := mset.cfg.Sealed
 	mset.mu.RUnlock()
 
+	// Sealed streams do not accept new messages.
+	if sealed {
+		if canRespond {
+			b, _ := json.Marshal(&JSPubAckResponse{PubAck: &PubAck{Stream: name}, Error: jsStreamSealedErr})
+			outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0, nil})
+		}
+		return 0, errors.New("invalid operation on sealed stream")
+	}
+
 	// Check here pre-emptively if we have exceeded this server limits.
 	if js.limitsExceeded(stype) {
 		s.resourcesExeededError()
@@ -4131,10 +4812,32 @@ func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg [
 	mset.clMu.Lock()
 	if mset.clseq == 0 {
 		mset.mu.RLock()
-		mset.clseq = mset.lseq
+		mset.clseq = mset.lseq + mset.clfs
 		mset.mu.RUnlock()
 	}
 
+	// Expected last sequence per subject. Our store only reflects what has been applied, so if
+	// we already have a proposal with this check in flight for the subject we can not tell and reject.
+	if eseq, exists := getExpectedLastSeqPerSubject(hdr); exists {
+		mset.mu.Lock()
+		_, lss, _, _, _, _ := mset.store.LoadLastMsg(subject)
+		if _, inflight := mset.lssip[subject]; inflight || eseq != lss {
+			mset.mu.Unlock()
+			mset.clMu.Unlock()
+			if canRespond {
+				var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: name}, Error: jsWrongLastSubjSeqError(lss)}
+				response, _ = json.Marshal(resp)
+				outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0, nil})
+			}
+			return 0, fmt.Errorf("last sequence by subject mismatch: %d vs %d", eseq, lss)
+		}
+		if mset.lssip == nil {
+			mset.lssip = make(map[string]uint64)
+		}
+		mset.lssip[subject] = mset.clseq
+		mset.mu.Unlock()
+	}
+
 	esm := encodeStreamMsg(subject, reply, hdr, msg, mset.clseq, time.Now().UnixNano())
 	mset.clseq++
 	seq := mset.clseq
@@ -4147,6 +4850,9 @@ func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg [
 		seq = 0
 		mset.mu.Lock()
 		mset.clseq--
+		if pseq, ok := mset.lssip[subject]; ok && pseq == mset.clseq {
+			delete(mset.lssip, subject)
+		}
 		mset.mu.Unlock()
 		if canRespond {
 			var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: mset.cfg.Name}}
@@ -4167,6 +4873,203 @@ func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg [
 	return seq, err
 }
 
+// processClusteredInboundBatch will check a committed batch and propose it as a single entry.
+func (mset *stream) processClusteredInboundBatch(id, reply string, msgs []*inMsg) error {
+	mset.mu.RLock()
+	s, js, st := mset.srv, mset.js, mset.cfg.Storage
+	msetName := mset.cfg.Name
+	mset.mu.RUnlock()
+
+	// Check here pre-emptively if we have exceeded this server limits.
+	if js.limitsExceeded(st) {
+		s.resourcesExeededError()
+		mset.sendBatchError(reply, jsInsufficientErr)
+		// Stepdown regardless.
+		if node := mset.raftNode(); node != nil {
+			node.StepDown()
+		}
+		return ErrJetStreamResourcesExceeded
+	}
+
+	// Check here pre-emptively if we have exceeded our account limits.
+	if err := mset.checkBatchAccountLimits(msgs); err != nil {
+		mset.sendBatchError(reply, &ApiError{Code: 400, Description: "resource limits exceeded for account"})
+		return err
+	}
+
+	mset.clMu.Lock()
+	mset.mu.Lock()
+	if mset.clseq == 0 {
+		mset.clseq = mset.lseq + mset.clfs
+	}
+	// Check the whole batch against where we will be once all in flight proposals are applied.
+	var apiErr *ApiError
+	if mset.cfg.Sealed {
+		apiErr = jsStreamSealedErr
+	} else {
+		apiErr = mset.checkBatch(msgs, mset.clseq-mset.clfs)
+	}
+	// Our store only reflects what has been applied, so reject if a subject we expect
+	// a last sequence for already has a proposal with this check in flight.
+	if apiErr == nil {
+		for _, m := range msgs {
+			if _, exists := getExpectedLastSeqPerSubject(m.hdr); exists {
+				if _, inflight := mset.lssip[m.subj]; inflight {
+					_, lss, _, _, _, _ := mset.store.LoadLastMsg(m.subj)
+					apiErr = jsWrongLastSubjSeqError(lss)
+					break
+				}
+			}
+		}
+	}
+	if apiErr != nil {
+		mset.mu.Unlock()
+		mset.clMu.Unlock()
+		mset.sendBatchError(reply, apiErr)
+		return errors.New(apiErr.Description)
+	}
+	lseq := mset.clseq
+	for i, m := range msgs {
+		if _, exists := getExpectedLastSeqPerSubject(m.hdr); exists {
+			if mset.lssip == nil {
+				mset.lssip = make(map[string]uint64)
+			}
+			mset.lssip[m.subj] = lseq + uint64(i)
+		}
+	}
+	mset.mu.Unlock()
+
+	esm := encodeStreamBatch(id, reply, msgs, lseq, time.Now().UnixNano())
+	mset.clseq += uint64(len(msgs))
+
+	// Do proposal.
+	err := mset.node.Propose(esm)
+	if err != nil {
+		mset.mu.Lock()
+		mset.clseq = lseq
+		for i, m := range msgs {
+			if pseq, ok := mset.lssip[m.subj]; ok && pseq == lseq+uint64(i) {
+				delete(mset.lssip, m.subj)
+			}
+		}
+		mset.mu.Unlock()
+	}
+	mset.clMu.Unlock()
+
+	if err != nil {
+		mset.sendBatchError(reply, &ApiError{Code: 503, Description: err.Error()})
+		if isOutOfSpaceErr(err) {
+			s.handleOutOfSpace(msetName)
+		}
+	}
+	return err
+}
+
+var errBadStreamBatch = errors.New("jetstream cluster bad replicated stream batch")
+
+func encodeStreamBatch(id, reply string, msgs []*inMsg, lseq uint64, ts int64) []byte {
+	elen := 1 + 2 + len(id) + 2 + len(reply) + 8 + 8 + 2
+	for _, m := range msgs {
+		elen += 2 + len(m.subj) + 2 + len(m.hdr) + 4 + len(m.msg)
+	}
+	buf := make([]byte, elen)
+	buf[0] = byte(batchMsgOp)
+	var le = binary.LittleEndian
+	wi := 1
+	le.PutUint16(buf[wi:], uint16(len(id)))
+	wi += 2
+	wi += copy(buf[wi:], id)
+	le.PutUint16(buf[wi:], uint16(len(reply)))
+	wi += 2
+	wi += copy(buf[wi:], reply)
+	le.PutUint64(buf[wi:], lseq)
+	wi += 8
+	le.PutUint64(buf[wi:], uint64(ts))
+	wi += 8
+	le.PutUint16(buf[wi:], uint16(len(msgs)))
+	wi += 2
+	for _, m := range msgs {
+		le.PutUint16(buf[wi:], uint16(len(m.subj)))
+		wi += 2
+		wi += copy(buf[wi:], m.subj)
+		le.PutUint16(buf[wi:], uint16(len(m.hdr)))
+		wi += 2
+		wi += copy(buf[wi:], m.hdr)
+		le.PutUint32(buf[wi:], uint32(len(m.msg)))
+		wi += 4
+		wi += copy(buf[wi:], m.msg)
+	}
+	return buf
+}
+
+func decodeStreamBatch(buf []byte) (id, reply string, msgs []*inMsg, lseq uint64, ts int64, err error) {
+	var le = binary.LittleEndian
+	// Read a length prefixed field.
+	next := func(n int) []byte {
+		if err != nil || len(buf) < n {
+			err = errBadStreamBatch
+			return nil
+		}
+		var l int
+		if n == 2 {
+			l = int(le.Uint16(buf))
+		} else {
+			l = int(le.Uint32(buf))
+		}
+		buf = buf[n:]
+		if len(buf) < l {
+			err = errBadStreamBatch
+			return nil
+		}
+		b := buf[:l]
+		buf = buf[l:]
+		return b
+	}
+	id, reply = string(next(2)), string(next(2))
+	if err != nil || len(buf) < 18 {
+		return _EMPTY_, _EMPTY_, nil, 0, 0, errBadStreamBatch
+	}
+	lseq = le.Uint64(buf)
+	ts = int64(le.Uint64(buf[8:]))
+	n := int(le.Uint16(buf[16:]))
+	buf = buf[18:]
+	msgs = make([]*inMsg, 0, n)
+	for i := 0; i < n; i++ {
+		m := &inMsg{subj: string(next(2)), hdr: next(2), msg: next(4)}
+		if err != nil {
+			return _EMPTY_, _EMPTY_, nil, 0, 0, err
+		}
+		msgs = append(msgs, m)
+	}
+	return id, reply, msgs, lseq, ts, nil
+}
+
+// Imported msgs are encoded like any other stream msg, only with their own op.
+func encodeImportMsg(subject string, hdr, msg []byte, lseq uint64, ts int64) []byte {
+	buf := encodeStreamMsg(subject, _EMPTY_, hdr, msg, lseq, ts)
+	buf[0] = byte(importMsgOp)
+	return buf
+}
+
+var errBadSkipMsgs = errors.New("jetstream cluster bad replicated skip msgs")
+
+func encodeSkipMsgs(lseq, last uint64) []byte {
+	var buf [17]byte
+	buf[0] = byte(skipMsgsOp)
+	var le = binary.LittleEndian
+	le.PutUint64(buf[1:], lseq)
+	le.PutUint64(buf[9:], last)
+	return buf[:]
+}
+
+func decodeSkipMsgs(buf []byte) (lseq, last uint64, err error) {
+	if len(buf) < 16 {
+		return 0, 0, errBadSkipMsgs
+	}
+	var le = binary.LittleEndian
+	return le.Uint64(buf), le.Uint64(buf[8:]), nil
+}
+
 // For requesting messages post raft snapshot to catch up streams post server restart.
 // Any deleted msgs etc will be handled inline on catchup.
 type streamSyncRequest struct {
@@ -4202,15 +5105,23 @@ func (mset *stream) processSnapshotDeletes(snap *streamSnapshot) {
 	}
 }
 
-func (mset *stream) setCatchupPeer(peer string, lag uint64) {
+// Tracks an out of band catchup for a peer.
+type catchupPeer struct {
+	// The last sequence we will send.
+	last uint64
+	// The number of messages the peer has not acknowledged yet.
+	lag uint64
+}
+
+func (mset *stream) setCatchupPeer(peer string, last, lag uint64) {
 	if peer == _EMPTY_ {
 		return
 	}
 	mset.mu.Lock()
 	if mset.catchups == nil {
-		mset.catchups = make(map[string]uint64)
+		mset.catchups = make(map[string]*catchupPeer)
 	}
-	mset.catchups[peer] = lag
+	mset.catchups[peer] = &catchupPeer{last: last, lag: lag}
 	mset.mu.Unlock()
 }
 
@@ -4220,8 +5131,8 @@ func (mset *stream) updateCatchupPeer(peer string) {
 		return
 	}
 	mset.mu.Lock()
-	if lag := mset.catchups[peer]; lag > 0 {
-		mset.catchups[peer] = lag - 1
+	if cp := mset.catchups[peer]; cp != nil && cp.lag > 0 {
+		cp.lag--
 	}
 	mset.mu.Unlock()
 }
@@ -4244,10 +5155,20 @@ func (mset *stream) clearAllCatchupPeers() {
 func (mset *stream) lagForCatchupPeer(peer string) uint64 {
 	mset.mu.RLock()
 	defer mset.mu.RUnlock()
-	if mset.catchups == nil {
-		return 0
+	if cp := mset.catchups[peer]; cp != nil {
+		return cp.lag
 	}
-	return mset.catchups[peer]
+	return 0
+}
+
+// Returns the last sequence a peer has acknowledged in its catchup.
+func (mset *stream) catchupProgress(peer string) (uint64, bool) {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	if cp := mset.catchups[peer]; cp != nil {
+		return cp.last - cp.lag, true
+	}
+	return 0, false
 }
 
 func (mset *stream) hasCatchupPeers() bool {
@@ -4525,6 +5446,19 @@ func (js *jetStream) clusterInfo(rg *raftGroup) *ClusterInfo {
 }
 
 func (mset *stream) checkClusterInfo(si *StreamInfo) {
+	if si.Cluster == nil {
+		return
+	}
+	if js := mset.srv.getJetStream(); js != nil {
+		if npeers := js.streamMigrationPeers(mset); len(npeers) > 0 {
+			si.Cluster.Migrating = true
+			si.Cluster.Migration = js.streamMigrationInfo(mset, npeers, si.State.LastSeq)
+		}
+	}
+	// Check for out of band catchups.
+	if !mset.hasCatchupPeers() {
+		return
+	}
 	for _, r := range si.Cluster.Replicas {
 		peer := string(getHash(r.Name))
 		if lag := mset.lagForCatchupPeer(peer); lag > 0 {
@@ -4561,10 +5495,7 @@ func (mset *stream) handleClusterStreamInfoRequest(sub *subscription, c *client,
 		Mirror:  mset.mirrorInfo(),
 	}
 
-	// Check for out of band catchups.
-	if mset.hasCatchupPeers() {
-		mset.checkClusterInfo(si)
-	}
+	mset.checkClusterInfo(si)
 
 	sysc.sendInternalMsg(reply, _EMPTY_, nil, si)
 }
@@ -4613,7 +5544,7 @@ func (mset *stream) runCatchup(sendSubject string, sreq *streamSyncRequest) {
 
 	// Setup sequences to walk through.
 	seq, last := sreq.FirstSeq, sreq.LastSeq
-	mset.setCatchupPeer(sreq.Peer, last-seq)
+	mset.setCatchupPeer(sreq.Peer, last, last-seq)
 	defer mset.clearCatchupPeer(sreq.Peer)
 
 	sendNextBatch := func() {
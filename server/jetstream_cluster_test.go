@@ -22,7 +22,9 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -1340,12 +1342,13 @@ func TestJetStreamClusterStreamExtendedUpdates(t *testing.T) {
 	if si := updateStream(); !reflect.DeepEqual(si.Config.Subjects, cfg.Subjects) {
 		t.Fatalf("Did not get expected stream info: %+v", si)
 	}
-	// Make sure these error for now.
 	// R factor changes
 	cfg.Replicas = 1
-	expectError()
+	if si := updateStream(); si.Config.Replicas != 1 {
+		t.Fatalf("Did not get expected stream info: %+v", si)
+	}
+	// Make sure these error for now.
 	// Mirror changes
-	cfg.Replicas = 3
 	cfg.Mirror = &nats.StreamSource{Name: "ORDERS"}
 	expectError()
 }
@@ -3998,6 +4001,89 @@ func TestJetStreamClusterSuperClusterBasics(t *testing.T) {
 	}
 }
 
+func TestJetStreamClusterSuperClusterStreamMove(t *testing.T) {
+	sc := createJetStreamSuperCluster(t, 3, 2)
+	defer sc.shutdown()
+
+	nc, js := jsClientConnect(t, sc.clusterForName("C1").randomServer())
+	defer nc.Close()
+
+	cfg := &nats.StreamConfig{
+		Name:      "TEST",
+		Subjects:  []string{"foo"},
+		Replicas:  3,
+		Placement: &nats.Placement{Cluster: "C1"},
+	}
+	if _, err := js.AddStream(cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	sub, err := js.PullSubscribe("foo", "dlc")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		fetchMsgs(t, sub, 1, 5*time.Second)[0].Ack()
+	}
+
+	cfg.Placement = &nats.Placement{Cluster: "C2"}
+	if _, err := js.UpdateStream(cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// A second move while the first is in progress should fail.
+	cfg.Placement = &nats.Placement{Cluster: "C1"}
+	if _, err := js.UpdateStream(cfg); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	// Wait for the stream to be led and replicated only by servers in the new cluster.
+	c2 := sc.clusterForName("C2")
+	checkFor(t, 20*time.Second, 250*time.Millisecond, func() error {
+		si, err := js.StreamInfo("TEST")
+		if err != nil {
+			return err
+		}
+		if si.Cluster == nil || si.Cluster.Name != "C2" || len(si.Cluster.Replicas) != 2 {
+			return fmt.Errorf("Stream not moved yet: %+v", si.Cluster)
+		}
+		for _, pi := range si.Cluster.Replicas {
+			if c2.serverByName(pi.Name) == nil || !pi.Current {
+				return fmt.Errorf("Unexpected replica: %+v", pi)
+			}
+		}
+		if si.State.Msgs != 20 {
+			return fmt.Errorf("Expected 20 msgs, got %d", si.State.Msgs)
+		}
+		for _, s := range sc.clusterForName("C1").servers {
+			if _, err := s.GlobalAccount().lookupStream("TEST"); err == nil {
+				return fmt.Errorf("Expected stream to be removed from %q", s)
+			}
+		}
+		return nil
+	})
+
+	// Our consumer should have moved with the stream.
+	c2.waitOnConsumerLeader("$G", "TEST", "dlc")
+	nc2, js2 := jsClientConnect(t, c2.randomServer())
+	defer nc2.Close()
+	sub, err = js2.PullSubscribe("foo", "dlc")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 15; i++ {
+		fetchMsgs(t, sub, 1, 5*time.Second)[0].Ack()
+	}
+}
+
 // Test that consumer interest across gateways and superclusters is properly identitifed in a remote cluster.
 func TestJetStreamClusterSuperClusterCrossClusterConsumerInterest(t *testing.T) {
 	sc := createJetStreamSuperCluster(t, 3, 3)
@@ -4043,7 +4129,7 @@ func TestJetStreamClusterSuperClusterCrossClusterConsumerInterest(t *testing.T)
 
 func TestJetStreamNextReqFromMsg(t *testing.T) {
 	bef := time.Now()
-	expires, _, _, err := nextReqFromMsg([]byte(`{"expires":5000000000}`)) // nanoseconds
+	expires, _, _, _, _, err := nextReqFromMsg([]byte(`{"expires":5000000000}`)) // nanoseconds
 	require_NoError(t, err)
 	now := time.Now()
 	if expires.Before(bef.Add(5*time.Second)) || expires.After(now.Add(5*time.Second)) {
@@ -5284,135 +5370,1646 @@ func TestJetStreamClusterServerLimits(t *testing.T) {
 	}
 }
 
-// Support functions
+func TestJetStreamClusterMaxMsgsPerSubject(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
 
-// Used to setup superclusters for tests.
-type supercluster struct {
-	t        *testing.T
-	clusters []*cluster
-}
+	nc := clientConnectToServer(t, c.randomServer())
+	defer nc.Close()
 
-func (sc *supercluster) shutdown() {
-	if sc == nil {
-		return
+	// The client does not know about this config field yet so use the raw API.
+	cfg := StreamConfig{
+		Name:       "KV",
+		Subjects:   []string{"kv.>"},
+		Storage:    FileStorage,
+		Replicas:   3,
+		MaxMsgsPer: 1,
 	}
-	for _, c := range sc.clusters {
-		shutdownCluster(c)
+	req, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var scResp JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if scResp.StreamInfo == nil || scResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+	}
+	if scResp.Config.MaxMsgsPer != 1 {
+		t.Fatalf("Expected max msgs per subject of 1, got %d", scResp.Config.MaxMsgsPer)
 	}
-}
-
-var jsClusterTempl = `
-	listen: 127.0.0.1:-1
-	server_name: %s
-	jetstream: {max_mem_store: 256MB, max_file_store: 2GB, store_dir: "%s"}
 
-	cluster {
-		name: %s
-		listen: 127.0.0.1:%d
-		routes = [%s]
+	for i := 0; i < 10; i++ {
+		for _, subj := range []string{"kv.a", "kv.b"} {
+			if _, err := nc.Request(subj, []byte("OK"), time.Second); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
 	}
 
-	# For access to system account.
-	accounts { $SYS { users = [ { user: "admin", pass: "s3cr3t!" } ] } }
-`
+	// Every replica should have applied the limit.
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("KV")
+			if err != nil {
+				return err
+			}
+			if state := mset.state(); state.Msgs != 2 || state.FirstSeq != 19 || state.LastSeq != 20 {
+				return fmt.Errorf("Unexpected state on %q: %+v", s, state)
+			}
+		}
+		return nil
+	})
+}
 
-var jsSuperClusterTempl = `
-	%s
-	gateway {
-		name: %s
-		listen: 127.0.0.1:%d
-		gateways = [%s
-		]
-	}
-`
+func TestJetStreamClusterRePublish(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
 
-var jsClusterLimitsTempl = `
-	listen: 127.0.0.1:-1
-	server_name: %s
-	jetstream: {max_mem_store: 2MB, max_file_store: 8MB, store_dir: "%s"}
+	nc := clientConnectToServer(t, c.randomServer())
+	defer nc.Close()
 
-	cluster {
-		name: %s
-		listen: 127.0.0.1:%d
-		routes = [%s]
+	// The client does not know about this config field yet so use the raw API.
+	cfg := StreamConfig{
+		Name:      "RP",
+		Subjects:  []string{"foo"},
+		Storage:   FileStorage,
+		Replicas:  3,
+		RePublish: &RePublish{Destination: "RP.foo"},
+	}
+	req, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var scResp JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if scResp.StreamInfo == nil || scResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+	}
+	if rp := scResp.Config.RePublish; rp == nil || rp.Source != ">" || rp.Destination != "RP.foo" {
+		t.Fatalf("Unexpected republish config: %+v", rp)
 	}
 
-	no_auth_user: u
+	sub, _ := nc.SubscribeSync("RP.foo")
+	defer sub.Unsubscribe()
+	nc.Flush()
 
-	accounts {
-		ONE {
-			users = [ { user: "u", pass: "s3cr3t!" } ]
-			jetstream: enabled
+	toSend := 10
+	for i := 0; i < toSend; i++ {
+		if _, err := nc.Request("foo", []byte("OK"), time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
 		}
-		$SYS { users = [ { user: "admin", pass: "s3cr3t!" } ] }
 	}
-`
-
-var jsGWTempl = `%s{name: %s, urls: [%s]}`
 
-func createJetStreamSuperCluster(t *testing.T, numServersPer, numClusters int) *supercluster {
-	t.Helper()
-	if numServersPer < 1 {
-		t.Fatalf("Number of servers must be >= 1")
+	// Only the leader should republish, so we should see each message once and in order.
+	for i := 1; i <= toSend; i++ {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if seq := m.Header.Get(JSSequence); seq != strconv.Itoa(i) {
+			t.Fatalf("Expected sequence %d, got %q", i, seq)
+		}
+		if lseq := m.Header.Get(JSLastSequence); lseq != strconv.Itoa(i-1) {
+			t.Fatalf("Expected last sequence %d, got %q", i-1, lseq)
+		}
 	}
-	if numClusters <= 1 {
-		t.Fatalf("Number of clusters must be > 1")
+	if m, err := sub.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Did not expect another message, got sequence %q", m.Header.Get(JSSequence))
 	}
+}
 
-	const (
-		startClusterPort = 33222
-		startGWPort      = 11222
-	)
-
-	// Make the GWs form faster for the tests.
-	SetGatewaysSolicitDelay(10 * time.Millisecond)
-	defer ResetGatewaysSolicitDelay()
+func TestJetStreamClusterRollups(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
 
-	cp, gp := startClusterPort, startGWPort
-	var clusters []*cluster
+	nc := clientConnectToServer(t, c.randomServer())
+	defer nc.Close()
 
-	var gws []string
-	// Build GWs first, will be same for all servers.
-	for i, port := 1, gp; i <= numClusters; i++ {
-		cn := fmt.Sprintf("C%d", i)
-		var urls []string
-		for n := 0; n < numServersPer; n++ {
-			urls = append(urls, fmt.Sprintf("nats-route://127.0.0.1:%d", port))
-			port++
-		}
-		gws = append(gws, fmt.Sprintf(jsGWTempl, "\n\t\t\t", cn, strings.Join(urls, ",")))
+	// The client does not know about this config field yet so use the raw API.
+	cfg := StreamConfig{
+		Name:        "ORDERS",
+		Subjects:    []string{"orders.*"},
+		Storage:     FileStorage,
+		Replicas:    3,
+		AllowRollup: true,
+	}
+	req, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var scResp JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if scResp.StreamInfo == nil || scResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
 	}
-	gwconf := strings.Join(gws, "")
-
-	for i := 1; i <= numClusters; i++ {
-		cn := fmt.Sprintf("C%d", i)
-		// Go ahead and build configurations.
-		c := &cluster{servers: make([]*Server, 0, numServersPer), opts: make([]*Options, 0, numServersPer), name: cn}
 
-		// Build out the routes that will be shared with all configs.
-		var routes []string
-		for port := cp; port < cp+numServersPer; port++ {
-			routes = append(routes, fmt.Sprintf("nats-route://127.0.0.1:%d", port))
+	sendRollup := func(subj, rollup string) uint64 {
+		t.Helper()
+		m := nats.NewMsg(subj)
+		m.Header.Set(JSMsgRollup, rollup)
+		m.Data = []byte("SNAPSHOT")
+		resp, err := nc.RequestMsg(m, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
 		}
-		routeConfig := strings.Join(routes, ",")
-
-		for si := 0; si < numServersPer; si++ {
-			storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
-			sn := fmt.Sprintf("%s-S%d", cn, si+1)
-			bconf := fmt.Sprintf(jsClusterTempl, sn, storeDir, cn, cp+si, routeConfig)
-			conf := fmt.Sprintf(jsSuperClusterTempl, bconf, cn, gp, gwconf)
-			gp++
-			s, o := RunServerWithConfig(createConfFile(t, []byte(conf)))
-			c.servers = append(c.servers, s)
-			c.opts = append(c.opts, o)
+		var pa JSPubAckResponse
+		if err := json.Unmarshal(resp.Data, &pa); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
 		}
-		checkClusterFormed(t, c.servers...)
-		clusters = append(clusters, c)
-		cp += numServersPer
-		c.t = t
+		if pa.Error != nil {
+			t.Fatalf("Unexpected error: %+v", pa.Error)
+		}
+		return pa.Sequence
 	}
 
-	// Wait for the supercluster to be formed.
+	// All replicas need to agree on the state after applying the rollup.
+	checkState := func(msgs, first uint64) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+			for _, s := range c.servers {
+				mset, err := s.GlobalAccount().lookupStream("ORDERS")
+				if err != nil {
+					return err
+				}
+				if state := mset.state(); state.Msgs != msgs || state.FirstSeq != first {
+					return fmt.Errorf("Unexpected state on %s: %+v", s, state)
+				}
+			}
+			return nil
+		})
+	}
+
+	for i := 0; i < 5; i++ {
+		sendStreamMsg(t, nc, "orders.1", "UPDATED")
+		sendStreamMsg(t, nc, "orders.2", "UPDATED")
+	}
+	sendRollup("orders.1", JSMsgRollupSubject)
+	checkState(6, 2)
+
+	seq := sendRollup("orders.3", JSMsgRollupAll)
+	checkState(1, seq)
+}
+
+func TestJetStreamClusterStreamPurgeEx(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "KV", Subjects: []string{"kv.>"}, Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		js.Publish("kv.a", []byte("OK"))
+		js.Publish("kv.b", []byte("OK"))
+	}
+
+	// The client does not know about the purge request options yet so use the raw API.
+	req, _ := json.Marshal(&JSApiStreamPurgeRequest{Subject: "kv.a", Keep: 1})
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamPurgeT, "KV"), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var pResp JSApiStreamPurgeResponse
+	if err := json.Unmarshal(resp.Data, &pResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !pResp.Success || pResp.Purged != 9 {
+		t.Fatalf("Unexpected response: %+v", pResp)
+	}
+
+	checkState := func() {
+		t.Helper()
+		checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+			for _, s := range c.servers {
+				mset, err := s.GlobalAccount().lookupStream("KV")
+				if err != nil {
+					return err
+				}
+				if state := mset.state(); state.Msgs != 11 || state.FirstSeq != 2 {
+					return fmt.Errorf("Unexpected state on %s: %+v", s, state)
+				}
+			}
+			return nil
+		})
+	}
+	checkState()
+
+	// Make sure replaying the purge on restart does not remove anything else.
+	sl := c.randomNonStreamLeader("$G", "KV")
+	sl.Shutdown()
+	c.waitOnLeader()
+	nc, js = jsClientConnect(t, c.streamLeader("$G", "KV"))
+	defer nc.Close()
+	if _, err := js.Publish("kv.a", []byte("OK")); err != nil {
+		t.Fatalf("Unexpected publish error: %v", err)
+	}
+	sl = c.restartServer(sl)
+	c.waitOnStreamCurrent(sl, "$G", "KV")
+
+	mset, err := sl.GlobalAccount().lookupStream("KV")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := mset.state(); state.Msgs != 12 || state.FirstSeq != 2 {
+			return fmt.Errorf("Unexpected state after restart: %+v", state)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterExpectedLastSubjSeq(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo", "bar"}, Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	js.Publish("bar", []byte("OK"))
+
+	// Send a burst of messages that all expect foo to be empty.
+	// Only one should make it in, the rest will be rejected whether in flight or already applied.
+	inbox := nats.NewInbox()
+	sub, _ := nc.SubscribeSync(inbox)
+	defer sub.Unsubscribe()
+
+	toSend := 10
+	for i := 0; i < toSend; i++ {
+		m := nats.NewMsg("foo")
+		m.Reply = inbox
+		m.Header.Set(JSExpectedLastSubjSeq, "0")
+		m.Data = []byte(strconv.Itoa(i))
+		nc.PublishMsg(m)
+	}
+
+	var ok, bad int
+	for i := 0; i < toSend; i++ {
+		m, err := sub.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var pa JSPubAckResponse
+		if err := json.Unmarshal(m.Data, &pa); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if pa.Error == nil {
+			ok++
+		} else if pa.Error.Code == 400 && strings.HasPrefix(pa.Error.Description, "wrong last sequence for subject") {
+			bad++
+		} else {
+			t.Fatalf("Unexpected error: %+v", pa.Error)
+		}
+	}
+	if ok != 1 || bad != toSend-1 {
+		t.Fatalf("Expected 1 success and %d failures, got %d and %d", toSend-1, ok, bad)
+	}
+
+	// Now that nothing is in flight we should be able to publish with the correct sequence.
+	m := nats.NewMsg("foo")
+	m.Header.Set(JSExpectedLastSubjSeq, "2")
+	if _, err := js.PublishMsg(m); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if state := mset.state(); state.Msgs != 3 || state.LastSeq != 3 {
+				return fmt.Errorf("Unexpected state on %s: %+v", s, state)
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterMsgTTL(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc := clientConnectToServer(t, c.randomServer())
+	defer nc.Close()
+
+	// The client does not know about this config field yet so use the raw API.
+	cfg := StreamConfig{
+		Name:        "SESSIONS",
+		Subjects:    []string{"session.*"},
+		Storage:     FileStorage,
+		Replicas:    3,
+		AllowMsgTTL: true,
+	}
+	req, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var scResp JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if scResp.StreamInfo == nil || scResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+	}
+
+	for i := 0; i < 5; i++ {
+		m := nats.NewMsg("session.1")
+		// Set directly since the header name is not in canonical form.
+		m.Header[JSMessageTTL] = []string{"1s"}
+		if _, err := nc.RequestMsg(m, time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		sendStreamMsg(t, nc, "session.2", "RECORD")
+	}
+
+	// All replicas should expire the same messages.
+	checkFor(t, 3*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("SESSIONS")
+			if err != nil {
+				return err
+			}
+			state := mset.state()
+			if state.Msgs != 5 || state.FirstSeq != 2 {
+				return fmt.Errorf("Unexpected state on %s: %+v", s, state)
+			}
+			for _, seq := range state.Deleted {
+				if seq%2 == 0 {
+					return fmt.Errorf("Unexpected deleted sequence %d on %s", seq, s)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterDirectGet(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc := clientConnectToServer(t, c.randomServer())
+	defer nc.Close()
+
+	// The client does not know about this config field yet so use the raw API.
+	createStream := func(cfg *StreamConfig) {
+		t.Helper()
+		req, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var scResp JSApiStreamCreateResponse
+		if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if scResp.StreamInfo == nil || scResp.Error != nil {
+			t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+		}
+	}
+	createStream(&StreamConfig{Name: "DG", Subjects: []string{"dg.*"}, Storage: FileStorage, Replicas: 3, AllowDirect: true})
+	createStream(&StreamConfig{Name: "M", Mirror: &StreamSource{Name: "DG"}, Storage: FileStorage, AllowDirect: true})
+
+	for i := 0; i < 5; i++ {
+		sendStreamMsg(t, nc, "dg.1", "HELLO")
+	}
+	c.waitOnStreamLeader("$G", "M")
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			for _, name := range []string{"DG", "M"} {
+				mset, err := s.GlobalAccount().lookupStream(name)
+				if err != nil {
+					continue
+				}
+				if state := mset.state(); state.Msgs != 5 {
+					return fmt.Errorf("Expected 5 msgs for %q on %s, got %d", name, s, state.Msgs)
+				}
+			}
+		}
+		return nil
+	})
+
+	stopDirect := func(s *Server, stream string) {
+		t.Helper()
+		mset, err := s.GlobalAccount().lookupStream(stream)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		mset.mu.Lock()
+		mset.unsubscribeToDirect()
+		mset.mu.Unlock()
+	}
+	directGet := func(stream string) *nats.Msg {
+		t.Helper()
+		m, err := nc.Request(fmt.Sprintf(JSDirectMsgGetT, stream), []byte(`{"last_by_subj":"dg.1"}`), time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if string(m.Data) != "HELLO" || m.Header.Get(JSSequence) != "5" {
+			t.Fatalf("Unexpected response: %q %+v", m.Data, m.Header)
+		}
+		return m
+	}
+
+	// With the leader not answering the followers should.
+	sl := c.streamLeader("$G", "DG")
+	stopDirect(sl, "DG")
+	for i := 0; i < 10; i++ {
+		directGet("DG")
+	}
+
+	// Now stop all the replicas and the mirror should answer for its origin.
+	for _, s := range c.servers {
+		if s != sl {
+			stopDirect(s, "DG")
+		}
+	}
+	if m := directGet("DG"); m.Header.Get(JSStream) != "M" {
+		t.Fatalf("Expected the mirror to answer, got %+v", m.Header)
+	}
+	directGet("M")
+}
+
+func TestJetStreamClusterAtomicBatch(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc := clientConnectToServer(t, c.randomServer())
+	defer nc.Close()
+
+	// The client does not know about this config field yet so use the raw API.
+	cfg := StreamConfig{
+		Name:        "ORDERS",
+		Subjects:    []string{"orders.*"},
+		Storage:     FileStorage,
+		Replicas:    3,
+		AllowAtomic: true,
+	}
+	req, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var scResp JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if scResp.StreamInfo == nil || scResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+	}
+
+	// Make sure we go through a server that is not the leader.
+	nc.Close()
+	nc = clientConnectToServer(t, c.randomNonStreamLeader("$G", "ORDERS"))
+	defer nc.Close()
+
+	sendBatch := func(id string, n int, ehdr, eval string) *JSPubAckResponse {
+		t.Helper()
+		var resp *nats.Msg
+		for i := 1; i <= n; i++ {
+			m := nats.NewMsg(fmt.Sprintf("orders.%d", i))
+			m.Header.Set(JSBatchId, id)
+			m.Header.Set(JSBatchSeq, strconv.Itoa(i))
+			m.Data = []byte("ORDER")
+			if i < n {
+				nc.PublishMsg(m)
+				continue
+			}
+			m.Header.Set(JSBatchCommit, "1")
+			if ehdr != _EMPTY_ {
+				m.Header.Set(ehdr, eval)
+			}
+			if resp, err = nc.RequestMsg(m, 2*time.Second); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		var pa JSPubAckResponse
+		if err := json.Unmarshal(resp.Data, &pa); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &pa
+	}
+	checkState := func(msgs, lseq uint64) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+			for _, s := range c.servers {
+				mset, err := s.GlobalAccount().lookupStream("ORDERS")
+				if err != nil {
+					return err
+				}
+				if state := mset.state(); state.Msgs != msgs || state.LastSeq != lseq {
+					return fmt.Errorf("Unexpected state on %s: %+v", s, state)
+				}
+			}
+			return nil
+		})
+	}
+
+	pa := sendBatch("A", 5, _EMPTY_, _EMPTY_)
+	if pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	if pa.Sequence != 5 || pa.BatchId != "A" || pa.BatchSize != 5 {
+		t.Fatalf("Unexpected ack: %+v", pa.PubAck)
+	}
+	checkState(5, 5)
+
+	// A failed expectation on the last message rejects the whole batch.
+	if pa = sendBatch("B", 5, JSExpectedLastSeq, "5"); pa.Error == nil {
+		t.Fatalf("Expected an error for a wrong last sequence")
+	}
+	checkState(5, 5)
+	if pa = sendBatch("B", 5, JSExpectedLastSeq, "9"); pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	checkState(10, 10)
+
+	// Single publishes still line up after batches.
+	sendStreamMsg(t, nc, "orders.1", "ORDER")
+	checkState(11, 11)
+
+	// Replicas recovering their log should end up in the same place.
+	sr := c.randomNonStreamLeader("$G", "ORDERS")
+	sr.Shutdown()
+	sr = c.restartServer(sr)
+	c.waitOnStreamCurrent(sr, "$G", "ORDERS")
+	checkState(11, 11)
+}
+
+func TestJetStreamClusterStoreAfterRejectedProposals(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc := clientConnectToServer(t, c.randomServer())
+	defer nc.Close()
+
+	// The client does not know about this config field yet so use the raw API.
+	cfg := StreamConfig{
+		Name:        "TEST",
+		Subjects:    []string{"foo.*"},
+		Storage:     FileStorage,
+		Replicas:    3,
+		AllowAtomic: true,
+	}
+	req, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var scResp JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if scResp.StreamInfo == nil || scResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+	}
+
+	checkState := func(msgs, lseq uint64) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+			for _, s := range c.servers {
+				mset, err := s.GlobalAccount().lookupStream("TEST")
+				if err != nil {
+					return err
+				}
+				if state := mset.state(); state.Msgs != msgs || state.LastSeq != lseq {
+					return fmt.Errorf("Unexpected state on %s: %+v", s, state)
+				}
+			}
+			return nil
+		})
+	}
+
+	if pa := sendStreamMsg(t, nc, "foo.1", "OK"); pa.Sequence != 1 {
+		t.Fatalf("Expected sequence 1, got %d", pa.Sequence)
+	}
+
+	// These are only rejected when applied, so every replica has to account for them.
+	for i := 0; i < 3; i++ {
+		m := nats.NewMsg("foo.1")
+		m.Header.Set(JSExpectedLastSeq, "22")
+		resp, err := nc.RequestMsg(m, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if pa := getPubAckResponse(resp.Data); pa == nil || pa.Error == nil {
+			t.Fatalf("Expected an error for a wrong last sequence, got %q", resp.Data)
+		}
+	}
+
+	// The next message has to be stored right after the last one we accepted.
+	if pa := sendStreamMsg(t, nc, "foo.2", "OK"); pa.Sequence != 2 {
+		t.Fatalf("Expected sequence 2, got %d", pa.Sequence)
+	}
+	checkState(2, 2)
+
+	// Same for an atomic batch.
+	var pa JSPubAckResponse
+	for i := 1; i <= 3; i++ {
+		m := nats.NewMsg(fmt.Sprintf("foo.%d", i))
+		m.Header.Set(JSBatchId, "A")
+		m.Header.Set(JSBatchSeq, strconv.Itoa(i))
+		if i < 3 {
+			nc.PublishMsg(m)
+			continue
+		}
+		m.Header.Set(JSBatchCommit, "1")
+		resp, err := nc.RequestMsg(m, 2*time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := json.Unmarshal(resp.Data, &pa); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if pa.Error != nil || pa.Sequence != 5 {
+		t.Fatalf("Unexpected ack: %+v, %+v", pa.PubAck, pa.Error)
+	}
+	checkState(5, 5)
+
+	// Replicas recovering their log should end up in the same place.
+	sr := c.randomNonStreamLeader("$G", "TEST")
+	sr.Shutdown()
+	sr = c.restartServer(sr)
+	c.waitOnStreamCurrent(sr, "$G", "TEST")
+	checkState(5, 5)
+
+	// A new leader has to start proposing where the old one left off.
+	resp, err = nc.Request(fmt.Sprintf(JSApiStreamLeaderStepDownT, "TEST"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var sdResp JSApiStreamLeaderStepDownResponse
+	if err := json.Unmarshal(resp.Data, &sdResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sdResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", sdResp.Error)
+	}
+	c.waitOnStreamLeader("$G", "TEST")
+	if pa := sendStreamMsg(t, nc, "foo.3", "OK"); pa.Sequence != 6 {
+		t.Fatalf("Expected sequence 6, got %d", pa.Sequence)
+	}
+	checkState(6, 6)
+}
+
+func TestJetStreamClusterStreamReplicasUpdate(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R5S", 5)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	cfg := &nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 1}
+	if _, err := js.AddStream(cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	sub, err := js.PullSubscribe("foo", "dlc")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		fetchMsgs(t, sub, 1, 5*time.Second)[0].Ack()
+	}
+
+	// Make sure all peers of the stream and the consumer have the full state.
+	checkReplicas := func(replicas int, msgs uint64) {
+		t.Helper()
+		checkFor(t, 20*time.Second, 100*time.Millisecond, func() error {
+			var assigned int
+			for _, s := range c.servers {
+				if !s.JetStreamIsStreamAssigned("$G", "TEST") {
+					continue
+				}
+				assigned++
+				mset, err := s.GlobalAccount().lookupStream("TEST")
+				if err != nil {
+					return err
+				}
+				if state := mset.state(); state.Msgs != msgs {
+					return fmt.Errorf("Expected %d msgs on %q, got %d", msgs, s, state.Msgs)
+				}
+				o := mset.lookupConsumer("dlc")
+				if o == nil {
+					return fmt.Errorf("Expected consumer on %q", s)
+				}
+				if state, _ := o.store.State(); state == nil || state.AckFloor.Stream != 5 {
+					return fmt.Errorf("Expected ack floor of 5 on %q, got %+v", s, state)
+				}
+			}
+			if assigned != replicas {
+				return fmt.Errorf("Expected %d assigned peers, got %d", replicas, assigned)
+			}
+			return nil
+		})
+	}
+
+	// Scale up.
+	cfg.Replicas = 3
+	si, err := js.UpdateStream(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si.Config.Replicas != 3 {
+		t.Fatalf("Expected 3 replicas, got %d", si.Config.Replicas)
+	}
+	c.waitOnStreamLeader("$G", "TEST")
+	checkReplicas(3, 10)
+
+	// Make sure we can still publish and that new messages are replicated.
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	checkReplicas(3, 20)
+
+	cfg.Replicas = 5
+	if _, err := js.UpdateStream(cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkReplicas(5, 20)
+
+	// Asking for more peers than we have should fail.
+	cfg.Replicas = 7
+	if _, err := js.UpdateStream(cfg); err == nil {
+		t.Fatalf("Expected an error")
+	}
+
+	// Scale back down.
+	cfg.Replicas = 1
+	if _, err := js.UpdateStream(cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c.waitOnStreamLeader("$G", "TEST")
+	checkReplicas(1, 20)
+
+	if _, err := js.Publish("foo", []byte("OK")); err != nil {
+		t.Fatalf("Unexpected publish error: %v", err)
+	}
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+	for i := 0; i < 16; i++ {
+		fetchMsgs(t, sub, 1, 5*time.Second)[0].Ack()
+	}
+}
+
+func TestJetStreamClusterStreamScaleUpWithOldPeerDown(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R5S", 5)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	cfg := &nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 1}
+	if _, err := js.AddStream(cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	// Take down the only replica, making sure it is not the meta leader.
+	sl := c.streamLeader("$G", "TEST")
+	for c.leader() == sl {
+		sl.getJetStream().getMetaGroup().StepDown()
+		c.waitOnLeader()
+	}
+	sl.Shutdown()
+	c.waitOnLeader()
+
+	nc.Close()
+	nc, js = jsClientConnect(t, c.leader())
+	defer nc.Close()
+
+	// Scale up while the old replica is down. The new peers are empty, so
+	// none of them may become leader and truncate the stream.
+	cfg.Replicas = 3
+	js.UpdateStream(cfg, nats.MaxWait(2*time.Second))
+	checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			if s.isRunning() && s.JetStreamIsStreamAssigned("$G", "TEST") {
+				return nil
+			}
+		}
+		return fmt.Errorf("New peers not assigned yet")
+	})
+	// Give the new peers time to run past their election timeouts.
+	time.Sleep(maxElectionTimeout + time.Second)
+	if sl := c.streamLeader("$G", "TEST"); sl != nil {
+		t.Fatalf("Expected no stream leader while the old replica is down, got %q", sl)
+	}
+
+	// The new peers should still be waiting to catch up after a restart.
+	var npeers []*Server
+	for _, s := range c.servers {
+		if s.isRunning() && s.JetStreamIsStreamAssigned("$G", "TEST") {
+			npeers = append(npeers, s)
+		}
+	}
+	for _, s := range npeers {
+		s.Shutdown()
+		s = c.restartServer(s)
+		c.waitOnLeader()
+		checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if n := mset.raftNode(); n == nil || !n.IsObserver() {
+				return fmt.Errorf("Expected %q to be an observer", s)
+			}
+			return nil
+		})
+	}
+	time.Sleep(maxElectionTimeout + time.Second)
+	if sl := c.streamLeader("$G", "TEST"); sl != nil {
+		t.Fatalf("Expected no stream leader after restarting the new peers, got %q", sl)
+	}
+
+	sl = c.restartServer(sl)
+	c.waitOnStreamLeader("$G", "TEST")
+	checkFor(t, 20*time.Second, 100*time.Millisecond, func() error {
+		var assigned int
+		for _, s := range c.servers {
+			if !s.JetStreamIsStreamAssigned("$G", "TEST") {
+				continue
+			}
+			assigned++
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if state := mset.state(); state.Msgs != 10 {
+				return fmt.Errorf("Expected 10 msgs on %q, got %d", s, state.Msgs)
+			}
+		}
+		if assigned != 3 {
+			return fmt.Errorf("Expected 3 assigned peers, got %d", assigned)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterConsumerUpdate(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	sub, err := js.PullSubscribe("foo", "dlc")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		fetchMsgs(t, sub, 1, 5*time.Second)[0].Ack()
+	}
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+
+	ci, err := sub.ConsumerInfo()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cfg := ci.Config
+	cfg.AckWait = 10 * time.Second
+	cfg.MaxAckPending = 22
+	cfg.MaxDeliver = 3
+	if ci, err = js.AddConsumer("TEST", &cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ci.Config.MaxAckPending != 22 || ci.Config.AckWait != 10*time.Second || ci.Config.MaxDeliver != 3 {
+		t.Fatalf("Config was not updated: %+v", ci.Config)
+	}
+	if ci.AckFloor.Stream != 5 {
+		t.Fatalf("Expected state to be kept, got %+v", ci.AckFloor)
+	}
+
+	// All peers should have the new config.
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			o := mset.lookupConsumer("dlc")
+			if o == nil {
+				return fmt.Errorf("Expected consumer on %q", s)
+			}
+			if ocfg := o.config(); ocfg.MaxAckPending != 22 {
+				return fmt.Errorf("Expected updated config on %q, got %+v", s, ocfg)
+			}
+		}
+		return nil
+	})
+
+	// Changes to immutable fields should fail.
+	bcfg := cfg
+	bcfg.FilterSubject = "bar"
+	if _, err := js.AddConsumer("TEST", &bcfg); err == nil || !strings.Contains(err.Error(), "filter subject can not be updated") {
+		t.Fatalf("Expected a filter subject error, got %v", err)
+	}
+
+	// Make sure it survives a leader change and we can still consume.
+	if _, err := nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "dlc"), nil, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+	if ci, err = sub.ConsumerInfo(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ci.Config.MaxAckPending != 22 || ci.AckFloor.Stream != 5 {
+		t.Fatalf("Unexpected consumer info after leader change: %+v", ci)
+	}
+	for i := 0; i < 5; i++ {
+		fetchMsgs(t, sub, 1, 5*time.Second)[0].Ack()
+	}
+}
+
+func TestJetStreamClusterStreamMove(t *testing.T) {
+	// S-1 through S-3 are tagged as one cloud and S-4 through S-6 as another.
+	c := createJetStreamClusterWithTemplateAndModHook(t, jsClusterTempl, "R6S", 6, func(serverName, conf string) string {
+		cloud := "aws"
+		if serverName > "S-3" {
+			cloud = "gcp"
+		}
+		return fmt.Sprintf("%s\n\tserver_tags: [\"cloud:%s\"]\n", conf, cloud)
+	})
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	cfg := &nats.StreamConfig{
+		Name:      "TEST",
+		Subjects:  []string{"foo"},
+		Replicas:  3,
+		Placement: &nats.Placement{Tags: []string{"cloud:aws"}},
+	}
+	// Server tags may take a bit to be known by the meta leader.
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		_, err := js.AddStream(cfg)
+		return err
+	})
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	sub, err := js.PullSubscribe("foo", "dlc")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		fetchMsgs(t, sub, 1, 5*time.Second)[0].Ack()
+	}
+
+	// Make sure the stream and consumer are only on the tagged servers and have the full state.
+	checkPlacement := func(cloud string, msgs uint64) {
+		t.Helper()
+		checkFor(t, 20*time.Second, 100*time.Millisecond, func() error {
+			var assigned int
+			for _, s := range c.servers {
+				mset, err := s.GlobalAccount().lookupStream("TEST")
+				if !s.JetStreamIsStreamAssigned("$G", "TEST") {
+					if err == nil {
+						return fmt.Errorf("Expected stream to be removed from %q", s)
+					}
+					continue
+				}
+				assigned++
+				if !s.getOpts().Tags.Contains(cloud) {
+					return fmt.Errorf("Expected stream to not be assigned to %q", s)
+				}
+				if err != nil {
+					return err
+				}
+				if state := mset.state(); state.Msgs != msgs {
+					return fmt.Errorf("Expected %d msgs on %q, got %d", msgs, s, state.Msgs)
+				}
+				o := mset.lookupConsumer("dlc")
+				if o == nil {
+					return fmt.Errorf("Expected consumer on %q", s)
+				}
+				if state, _ := o.store.State(); state == nil || state.AckFloor.Stream != 5 {
+					return fmt.Errorf("Expected ack floor of 5 on %q, got %+v", s, state)
+				}
+			}
+			if assigned != 3 {
+				return fmt.Errorf("Expected 3 assigned peers, got %d", assigned)
+			}
+			return nil
+		})
+	}
+	checkPlacement("cloud:aws", 10)
+
+	// Can not move and change replicas at the same time.
+	cfg.Placement = &nats.Placement{Tags: []string{"cloud:gcp"}}
+	cfg.Replicas = 1
+	if _, err := js.UpdateStream(cfg); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	// No servers with this tag.
+	cfg.Placement, cfg.Replicas = &nats.Placement{Tags: []string{"cloud:azure"}}, 3
+	if _, err := js.UpdateStream(cfg); err == nil {
+		t.Fatalf("Expected an error")
+	}
+
+	// The update should report that we are moving.
+	cfg.Placement = &nats.Placement{Tags: []string{"cloud:gcp"}}
+	req, _ := json.Marshal(cfg)
+	var usResp JSApiStreamUpdateResponse
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		resp, err := nc.Request(fmt.Sprintf(JSApiStreamUpdateT, "TEST"), req, 2*time.Second)
+		if err != nil {
+			return err
+		}
+		usResp = JSApiStreamUpdateResponse{}
+		if err := json.Unmarshal(resp.Data, &usResp); err != nil {
+			return err
+		}
+		if usResp.Error != nil {
+			return fmt.Errorf("Unexpected error: %+v", usResp.Error)
+		}
+		return nil
+	})
+	if si := usResp.StreamInfo; si.Config.Placement == nil || len(si.Config.Placement.Tags) != 1 || si.Config.Placement.Tags[0] != "cloud:gcp" {
+		t.Fatalf("Unexpected placement: %+v", si.Config.Placement)
+	}
+	if si := usResp.StreamInfo; si.Cluster == nil || !si.Cluster.Migrating {
+		t.Fatalf("Expected to be migrating, got %+v", si.Cluster)
+	}
+	// We should report progress for each of the new peers.
+	checkMigration := func(ci *ClusterInfo, lseq uint64) {
+		t.Helper()
+		if len(ci.Migration) != 3 {
+			t.Fatalf("Expected progress for 3 new peers, got %+v", ci.Migration)
+		}
+		for _, mi := range ci.Migration {
+			if s := c.serverByName(mi.Name); s == nil || !s.getOpts().Tags.Contains("cloud:gcp") {
+				t.Fatalf("Unexpected new peer %q", mi.Name)
+			}
+			if mi.LastSeq != lseq || mi.Seq > mi.LastSeq || (mi.Current && mi.Seq != mi.LastSeq) {
+				t.Fatalf("Unexpected progress for %q: %+v", mi.Name, mi)
+			}
+		}
+	}
+	checkMigration(usResp.StreamInfo.Cluster, 10)
+
+	// We should stay available while moving.
+	c.waitOnStreamLeader("$G", "TEST")
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	// While moving, the new peers should be catching up to our last sequence.
+	for start := time.Now(); time.Since(start) < 10*time.Second; {
+		resp, err := nc.Request(fmt.Sprintf(JSApiStreamInfoT, "TEST"), nil, time.Second)
+		if err != nil {
+			continue
+		}
+		var siResp JSApiStreamInfoResponse
+		if err := json.Unmarshal(resp.Data, &siResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if siResp.Error != nil {
+			continue
+		}
+		if siResp.Cluster == nil || !siResp.Cluster.Migrating {
+			break
+		}
+		checkMigration(siResp.Cluster, siResp.State.LastSeq)
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkPlacement("cloud:gcp", 20)
+
+	// Once moved our cluster info should only report the new peers.
+	c.waitOnStreamLeader("$G", "TEST")
+	checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+		si, err := js.StreamInfo("TEST")
+		if err != nil {
+			return err
+		}
+		if si.Cluster == nil || len(si.Cluster.Replicas) != 2 {
+			return fmt.Errorf("Expected 2 replicas, got %+v", si.Cluster)
+		}
+		for _, pi := range append(si.Cluster.Replicas, &nats.PeerInfo{Name: si.Cluster.Leader}) {
+			if s := c.serverByName(pi.Name); s == nil || !s.getOpts().Tags.Contains("cloud:gcp") {
+				return fmt.Errorf("Unexpected peer %q", pi.Name)
+			}
+		}
+		return nil
+	})
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamInfoT, "TEST"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var siResp JSApiStreamInfoResponse
+	if err := json.Unmarshal(resp.Data, &siResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if siResp.StreamInfo == nil || siResp.Cluster == nil || siResp.Cluster.Migrating {
+		t.Fatalf("Expected to be done migrating, got %+v", siResp.StreamInfo)
+	}
+
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+	for i := 0; i < 15; i++ {
+		fetchMsgs(t, sub, 1, 5*time.Second)[0].Ack()
+	}
+}
+
+func TestJetStreamClusterStreamExportImport(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "SRC", Subjects: []string{"orders.*"}, Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 1; i <= 20; i++ {
+		subj := "orders.new"
+		if i%2 == 0 {
+			subj = "orders.paid"
+		}
+		if _, err := js.Publish(subj, []byte(fmt.Sprintf("ORDER-%d", i))); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	// Every other sequence will need to be skipped by all of the replicas.
+	export := exportStreamMsgs(t, nc, "SRC", &JSApiStreamExportRequest{FilterSubject: "orders.paid"})
+	if err := js.DeleteStream("SRC"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "DST", Subjects: []string{"orders.*"}, Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// A rejected message still takes up a proposal, but not a sequence.
+	if _, err := js.Publish("orders.new", nil, nats.ExpectLastSequence(22)); err == nil {
+		t.Fatalf("Expected an error for a wrong last sequence")
+	}
+	iresp := importStreamMsgs(t, nc, "DST", &JSApiStreamImportRequest{KeepSequences: true, KeepTimestamps: true}, export)
+	if iresp.Error != nil || iresp.Imported != 10 {
+		t.Fatalf("Unexpected import response: %+v, %+v", iresp, iresp.Error)
+	}
+	if iresp.State == nil || iresp.State.Msgs != 10 || iresp.State.FirstSeq != 2 || iresp.State.LastSeq != 20 {
+		t.Fatalf("Unexpected state: %+v", iresp.State)
+	}
+
+	// New messages continue after the imported ones.
+	pa, err := js.Publish("orders.new", []byte("NEW"))
+	if err != nil {
+		t.Fatalf("Unexpected publish error: %v", err)
+	}
+	if pa.Sequence != 21 {
+		t.Fatalf("Expected sequence 21, got %d", pa.Sequence)
+	}
+
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("DST")
+			if err != nil {
+				return err
+			}
+			if state := mset.state(); state.Msgs != 11 || state.FirstSeq != 2 || state.LastSeq != 21 {
+				return fmt.Errorf("Unexpected state on %s: %+v", s, state)
+			}
+			subj, _, msg, _, err := mset.store.LoadMsg(8)
+			if err != nil || subj != "orders.paid" || string(msg) != "ORDER-8" {
+				return fmt.Errorf("Unexpected msg on %s: %q %q %v", s, subj, msg, err)
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterConsumerBackOff(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	delivery := nats.NewInbox()
+	sub, _ := nc.SubscribeSync(delivery)
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	req, _ := json.Marshal(&CreateConsumerRequest{
+		Stream: "TEST",
+		Config: ConsumerConfig{
+			Durable:        "d",
+			DeliverSubject: delivery,
+			AckPolicy:      AckExplicit,
+			MaxDeliver:     5,
+			BackOff:        []time.Duration{250 * time.Millisecond, 1500 * time.Millisecond},
+		},
+	})
+	resp, err := nc.Request(fmt.Sprintf(JSApiDurableCreateT, "TEST", "d"), req, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ccResp JSApiConsumerCreateResponse
+	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.ConsumerInfo == nil || ccResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", ccResp.Error)
+	}
+	c.waitOnConsumerLeader("$G", "TEST", "d")
+
+	if _, err := js.Publish("foo", []byte("OK")); err != nil {
+		t.Fatalf("Unexpected publish error: %v", err)
+	}
+	// First delivery and the first redelivery.
+	for i := 0; i < 2; i++ {
+		if _, err := sub.NextMsg(2 * time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	redelivered := time.Now()
+
+	// All peers should have the backoff and the redelivery count.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			o := mset.lookupConsumer("d")
+			if o == nil {
+				return fmt.Errorf("Expected consumer on %q", s)
+			}
+			if cfg := o.config(); len(cfg.BackOff) != 2 {
+				return fmt.Errorf("Expected backoff on %q, got %+v", s, cfg)
+			}
+			state, err := o.store.State()
+			if err != nil {
+				return err
+			}
+			if state.Redelivered[1] != 1 {
+				return fmt.Errorf("Expected redelivered count on %q, got %+v", s, state.Redelivered)
+			}
+		}
+		return nil
+	})
+
+	// A new leader should pick up where the old one left off.
+	resp, err = nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "d"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var sdResp JSApiConsumerLeaderStepDownResponse
+	if err := json.Unmarshal(resp.Data, &sdResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sdResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", sdResp.Error)
+	}
+	c.waitOnConsumerLeader("$G", "TEST", "d")
+
+	if _, err := sub.NextMsg(3 * time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if elapsed := time.Since(redelivered); elapsed < 1250*time.Millisecond {
+		t.Fatalf("Expected the second backoff value to be used, redelivered after %v", elapsed)
+	}
+}
+
+func TestJetStreamClusterNakDelayLeaderChange(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.Publish("foo", []byte("OK")); err != nil {
+		t.Fatalf("Unexpected publish error: %v", err)
+	}
+	// A new leader only checks restored pending after the ack wait, so keep it short.
+	ackWait := 5 * time.Second
+	sub, err := js.PullSubscribe("foo", "d", nats.AckWait(ackWait))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c.waitOnConsumerLeader("$G", "TEST", "d")
+
+	m := fetchMsgs(t, sub, 1, 5*time.Second)[0]
+	m.Respond([]byte(`-NAK {"delay": "1500ms"}`))
+	nakd := time.Now()
+	nc.Flush()
+
+	// Let the new pending timestamp reach the followers before we move the leader.
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			o := mset.lookupConsumer("d")
+			if o == nil {
+				return fmt.Errorf("Expected consumer on %q", s)
+			}
+			state := o.readStoreState()
+			if state == nil {
+				return fmt.Errorf("Expected consumer state on %q", s)
+			}
+			// The delay is applied by moving the pending timestamp back, relative to our ack wait.
+			if p := state.Pending[1]; p == nil || p.Timestamp > nakd.Add(2*time.Second-ackWait).UnixNano() {
+				return fmt.Errorf("Expected delayed pending on %q, got %+v", s, p)
+			}
+		}
+		return nil
+	})
+
+	resp, err := nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "d"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var sdResp JSApiConsumerLeaderStepDownResponse
+	if err := json.Unmarshal(resp.Data, &sdResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sdResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", sdResp.Error)
+	}
+	c.waitOnConsumerLeader("$G", "TEST", "d")
+
+	m = fetchMsgs(t, sub, 1, 2*ackWait)[0]
+	if elapsed := time.Since(nakd); elapsed < 1500*time.Millisecond {
+		t.Fatalf("Expected redelivery after the delay, got %v", elapsed)
+	}
+	if md, _ := m.MetaData(); md == nil || md.Delivered != 2 {
+		t.Fatalf("Expected a redelivery, got %+v", md)
+	}
+}
+
+func TestJetStreamClusterEncryptedRaftFiles(t *testing.T) {
+	tmpl := strings.Replace(jsClusterTempl, "store_dir:", `key: "s3cr3t", store_dir:`, 1)
+	c := createJetStreamClusterWithTemplate(t, tmpl, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msg := []byte("ENCRYPTED PAYLOAD!!")
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	c.waitOnStreamLeader("$G", "TEST")
+	if err := c.streamLeader("$G", "TEST").JetStreamSnapshotStream("$G", "TEST"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := c.leader().JetStreamSnapshotMeta(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nc.Close()
+	c.stopAll()
+
+	// Our snapshots, peer state and term and vote hold our peers, none should be in the clear.
+	var plain [][]byte
+	for _, s := range c.servers {
+		plain = append(plain, getHash(s.Name()))
+	}
+	for _, s := range c.servers {
+		var snaps int
+		err := filepath.Walk(s.getOpts().StoreDir, func(fpath string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			if strings.Contains(fpath, snapshotsDir) {
+				snaps++
+			}
+			buf, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				return err
+			}
+			for _, p := range append(plain, msg) {
+				if bytes.Contains(buf, p) {
+					return fmt.Errorf("found %q in the clear in %q", p, fpath)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if snaps == 0 {
+			t.Fatalf("Expected snapshots for %q", s)
+		}
+	}
+
+	c.restartAll()
+	c.waitOnLeader()
+	c.waitOnStreamLeader("$G", "TEST")
+
+	nc, js = jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		si, err := js.StreamInfo("TEST")
+		if err != nil {
+			return err
+		}
+		if si.State.Msgs != 10 || len(si.Cluster.Replicas) != 2 {
+			return fmt.Errorf("Unexpected stream info: %+v %+v", si.State, si.Cluster)
+		}
+		return nil
+	})
+}
+
+// Support functions
+
+// Used to setup superclusters for tests.
+type supercluster struct {
+	t        *testing.T
+	clusters []*cluster
+}
+
+func (sc *supercluster) shutdown() {
+	if sc == nil {
+		return
+	}
+	for _, c := range sc.clusters {
+		shutdownCluster(c)
+	}
+}
+
+var jsClusterTempl = `
+	listen: 127.0.0.1:-1
+	server_name: %s
+	jetstream: {max_mem_store: 256MB, max_file_store: 2GB, store_dir: "%s"}
+
+	cluster {
+		name: %s
+		listen: 127.0.0.1:%d
+		routes = [%s]
+	}
+
+	# For access to system account.
+	accounts { $SYS { users = [ { user: "admin", pass: "s3cr3t!" } ] } }
+`
+
+var jsSuperClusterTempl = `
+	%s
+	gateway {
+		name: %s
+		listen: 127.0.0.1:%d
+		gateways = [%s
+		]
+	}
+`
+
+var jsClusterLimitsTempl = `
+	listen: 127.0.0.1:-1
+	server_name: %s
+	jetstream: {max_mem_store: 2MB, max_file_store: 8MB, store_dir: "%s"}
+
+	cluster {
+		name: %s
+		listen: 127.0.0.1:%d
+		routes = [%s]
+	}
+
+	no_auth_user: u
+
+	accounts {
+		ONE {
+			users = [ { user: "u", pass: "s3cr3t!" } ]
+			jetstream: enabled
+		}
+		$SYS { users = [ { user: "admin", pass: "s3cr3t!" } ] }
+	}
+`
+
+var jsGWTempl = `%s{name: %s, urls: [%s]}`
+
+func createJetStreamSuperCluster(t *testing.T, numServersPer, numClusters int) *supercluster {
+	t.Helper()
+	if numServersPer < 1 {
+		t.Fatalf("Number of servers must be >= 1")
+	}
+	if numClusters <= 1 {
+		t.Fatalf("Number of clusters must be > 1")
+	}
+
+	const (
+		startClusterPort = 33222
+		startGWPort      = 11222
+	)
+
+	// Make the GWs form faster for the tests.
+	SetGatewaysSolicitDelay(10 * time.Millisecond)
+	defer ResetGatewaysSolicitDelay()
+
+	cp, gp := startClusterPort, startGWPort
+	var clusters []*cluster
+
+	var gws []string
+	// Build GWs first, will be same for all servers.
+	for i, port := 1, gp; i <= numClusters; i++ {
+		cn := fmt.Sprintf("C%d", i)
+		var urls []string
+		for n := 0; n < numServersPer; n++ {
+			urls = append(urls, fmt.Sprintf("nats-route://127.0.0.1:%d", port))
+			port++
+		}
+		gws = append(gws, fmt.Sprintf(jsGWTempl, "\n\t\t\t", cn, strings.Join(urls, ",")))
+	}
+	gwconf := strings.Join(gws, "")
+
+	for i := 1; i <= numClusters; i++ {
+		cn := fmt.Sprintf("C%d", i)
+		// Go ahead and build configurations.
+		c := &cluster{servers: make([]*Server, 0, numServersPer), opts: make([]*Options, 0, numServersPer), name: cn}
+
+		// Build out the routes that will be shared with all configs.
+		var routes []string
+		for port := cp; port < cp+numServersPer; port++ {
+			routes = append(routes, fmt.Sprintf("nats-route://127.0.0.1:%d", port))
+		}
+		routeConfig := strings.Join(routes, ",")
+
+		for si := 0; si < numServersPer; si++ {
+			storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+			sn := fmt.Sprintf("%s-S%d", cn, si+1)
+			bconf := fmt.Sprintf(jsClusterTempl, sn, storeDir, cn, cp+si, routeConfig)
+			conf := fmt.Sprintf(jsSuperClusterTempl, bconf, cn, gp, gwconf)
+			gp++
+			s, o := RunServerWithConfig(createConfFile(t, []byte(conf)))
+			c.servers = append(c.servers, s)
+			c.opts = append(c.opts, o)
+		}
+		checkClusterFormed(t, c.servers...)
+		clusters = append(clusters, c)
+		cp += numServersPer
+		c.t = t
+	}
+
+	// Wait for the supercluster to be formed.
 	egws := numClusters - 1
 	for _, c := range clusters {
 		for _, s := range c.servers {
@@ -5565,6 +7162,12 @@ func createJetStreamClusterExplicit(t *testing.T, clusterName string, numServers
 }
 
 func createJetStreamClusterWithTemplate(t *testing.T, tmpl string, clusterName string, numServers int) *cluster {
+	t.Helper()
+	return createJetStreamClusterWithTemplateAndModHook(t, tmpl, clusterName, numServers, nil)
+}
+
+// Same as createJetStreamClusterWithTemplate but allows the config of each server to be modified.
+func createJetStreamClusterWithTemplateAndModHook(t *testing.T, tmpl string, clusterName string, numServers int, modify func(serverName, conf string) string) *cluster {
 	t.Helper()
 	if clusterName == "" || numServers < 1 {
 		t.Fatalf("Bad params")
@@ -5585,6 +7188,9 @@ func createJetStreamClusterWithTemplate(t *testing.T, tmpl string, clusterName s
 		storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
 		sn := fmt.Sprintf("S-%d", cp-startClusterPort+1)
 		conf := fmt.Sprintf(tmpl, sn, storeDir, clusterName, cp, routeConfig)
+		if modify != nil {
+			conf = modify(sn, conf)
+		}
 		s, o := RunServerWithConfig(createConfFile(t, []byte(conf)))
 		c.servers = append(c.servers, s)
 		c.opts = append(c.opts, o)
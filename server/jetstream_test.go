@@ -293,7 +293,7 @@ func TestJetStreamAddStreamDiscardNew(t *testing.T) {
 			}
 
 			// Now do bytes.
-			mset.purge()
+			mset.purge(nil)
 
 			big := make([]byte, 8192)
 			resp, _ = nc.Request(subj, big, 100*time.Millisecond)
@@ -818,6 +818,72 @@ func TestJetStreamAddStreamMaxMsgSize(t *testing.T) {
 	}
 }
 
+func TestJetStreamAddStreamMaxMsgsPerSubject(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *StreamConfig
+	}{
+		{name: "MemoryStore",
+			mconfig: &StreamConfig{
+				Name:       "kv",
+				Subjects:   []string{"kv.>"},
+				Storage:    MemoryStorage,
+				MaxMsgsPer: 2,
+			}},
+		{name: "FileStore",
+			mconfig: &StreamConfig{
+				Name:       "kv",
+				Subjects:   []string{"kv.>"},
+				Storage:    FileStorage,
+				MaxMsgsPer: 2,
+			}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			mset, err := s.GlobalAccount().addStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			for i := 0; i < 10; i++ {
+				for _, subj := range []string{"kv.a", "kv.b", "kv.c"} {
+					if _, err := nc.Request(subj, []byte("OK"), time.Second); err != nil {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+				}
+			}
+			state := mset.state()
+			if state.Msgs != 6 {
+				t.Fatalf("Expected 6 msgs, got %d", state.Msgs)
+			}
+			if state.FirstSeq != 25 || state.LastSeq != 30 {
+				t.Fatalf("Expected first and last of 25 and 30, got %d and %d", state.FirstSeq, state.LastSeq)
+			}
+
+			// Lower the limit and make sure we trim existing subjects.
+			cfg := mset.config()
+			cfg.MaxMsgsPer = 1
+			if err := mset.update(&cfg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if state := mset.state(); state.Msgs != 3 || state.FirstSeq != 28 {
+				t.Fatalf("Expected 3 msgs starting at 28, got %+v", state)
+			}
+		})
+	}
+}
+
 func TestJetStreamAddStreamCanonicalNames(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
@@ -1779,7 +1845,7 @@ func TestJetStreamWorkQueueRequest(t *testing.T) {
 				sub.NextMsg(time.Millisecond)
 			}
 			checkSubPending(0)
-			mset.purge()
+			mset.purge(nil)
 
 			// Now do expiration
 			req.Batch = 1
@@ -2212,7 +2278,7 @@ func TestJetStreamWorkQueueRequestBatch(t *testing.T) {
 			// Now queue up the request without messages and add them after.
 			sub, _ = nc.SubscribeSync(nats.NewInbox())
 			defer sub.Unsubscribe()
-			mset.purge()
+			mset.purge(nil)
 
 			nc.PublishRequest(o.requestNextMsgSubject(), sub.Subject, []byte(strconv.Itoa(batchSize)))
 			nc.Flush() // Make sure its registered.
@@ -2522,7 +2588,7 @@ func TestJetStreamAckReplyStreamPending(t *testing.T) {
 
 			expectPending(toSend*2 - 2)
 			// Purge and send a new one.
-			mset.purge()
+			mset.purge(nil)
 			nc.Flush()
 
 			sendStreamMsg(t, nc, "foo.1", "Hello World!")
@@ -2539,7 +2605,7 @@ func TestJetStreamAckReplyStreamPending(t *testing.T) {
 			expectPending(toSend - 4) // 203
 
 			// Test Expiration.
-			mset.purge()
+			mset.purge(nil)
 			for i := 0; i < toSend; i++ {
 				sendStreamMsg(t, nc, "foo.1", "Hello World!")
 			}
@@ -2586,7 +2652,7 @@ func TestJetStreamAckReplyStreamPending(t *testing.T) {
 			}
 			nc.Flush()
 			expectPending(100)
-			mset.purge()
+			mset.purge(nil)
 			sendStreamMsg(t, nc, "foo.22", "Hello World!")
 			expectPending(0)
 		})
@@ -3300,7 +3366,7 @@ func TestJetStreamPublishDeDupe(t *testing.T) {
 	if err := mset.update(&cfg); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	mset.purge()
+	mset.purge(nil)
 
 	// Send 5 new messages.
 	sendMsg(10, "AAAA", "Hello DeDupe!")
@@ -3345,7 +3411,7 @@ func TestJetStreamPublishDeDupe(t *testing.T) {
 	}
 
 	// Purge should wipe the msgIds as well.
-	mset.purge()
+	mset.purge(nil)
 	nmids(0)
 }
 
@@ -5303,6 +5369,99 @@ func TestJetStreamMetadata(t *testing.T) {
 		})
 	}
 }
+func TestJetStreamMsgGetLastBySubject(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *StreamConfig
+	}{
+		{"MemoryStore", &StreamConfig{Name: "KV", Subjects: []string{"kv.>"}, Storage: MemoryStorage}},
+		{"FileStore", &StreamConfig{Name: "KV", Subjects: []string{"kv.>"}, Storage: FileStorage}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			mset, err := s.GlobalAccount().addStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			for i := 0; i < 5; i++ {
+				for _, subj := range []string{"kv.a.1", "kv.b.1", "kv.a.2"} {
+					if _, err := nc.Request(subj, []byte(fmt.Sprintf("%s-%d", subj, i)), time.Second); err != nil {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+				}
+			}
+
+			getLast := func(mreq *JSApiMsgGetRequest) *JSApiMsgGetResponse {
+				t.Helper()
+				req, err := json.Marshal(mreq)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				rmsg, err := nc.Request(fmt.Sprintf(JSApiMsgGetT, c.mconfig.Name), req, time.Second)
+				if err != nil {
+					t.Fatalf("Could not retrieve stream message: %v", err)
+				}
+				var resp JSApiMsgGetResponse
+				if err := json.Unmarshal(rmsg.Data, &resp); err != nil {
+					t.Fatalf("Could not parse stream message: %v", err)
+				}
+				return &resp
+			}
+
+			expectLast := func(filter, subj string, seq uint64) {
+				t.Helper()
+				resp := getLast(&JSApiMsgGetRequest{LastFor: filter})
+				if resp.Message == nil || resp.Error != nil {
+					t.Fatalf("Did not receive correct response: %+v", resp.Error)
+				}
+				if resp.Message.Subject != subj || resp.Message.Sequence != seq {
+					t.Fatalf("Expected %q at seq %d, got %q at seq %d", subj, seq, resp.Message.Subject, resp.Message.Sequence)
+				}
+				if data := string(resp.Message.Data); data != fmt.Sprintf("%s-4", subj) {
+					t.Fatalf("Unexpected data: %q", data)
+				}
+			}
+
+			expectLast("kv.a.1", "kv.a.1", 13)
+			expectLast("kv.b.1", "kv.b.1", 14)
+			expectLast("kv.*.1", "kv.b.1", 14)
+			expectLast("kv.a.*", "kv.a.2", 15)
+			expectLast("kv.>", "kv.a.2", 15)
+
+			// Remove the last one for kv.a.2 and make sure we pick up the prior one.
+			if removed, err := mset.removeMsg(15); err != nil || !removed {
+				t.Fatalf("Expected to remove msg: %v", err)
+			}
+			if resp := getLast(&JSApiMsgGetRequest{LastFor: "kv.a.2"}); resp.Message == nil || resp.Message.Sequence != 12 {
+				t.Fatalf("Expected seq 12, got %+v", resp.Message)
+			}
+			expectLast("kv.a.*", "kv.a.1", 13)
+
+			// No match should be a not found.
+			if resp := getLast(&JSApiMsgGetRequest{LastFor: "kv.c.*"}); resp.Error == nil || resp.Error.Code != 404 {
+				t.Fatalf("Did not get correct error response: %+v", resp.Error)
+			}
+			// Can not ask for both.
+			if resp := getLast(&JSApiMsgGetRequest{Seq: 1, LastFor: "kv.a.1"}); resp.Error == nil || resp.Error.Code != 400 {
+				t.Fatalf("Did not get correct error response: %+v", resp.Error)
+			}
+		})
+	}
+}
+
 func TestJetStreamRedeliverCount(t *testing.T) {
 	cases := []struct {
 		name    string
@@ -5579,7 +5738,7 @@ func TestJetStreamStreamPurge(t *testing.T) {
 			if state := mset.state(); state.Msgs != 100 {
 				t.Fatalf("Expected %d messages, got %d", 100, state.Msgs)
 			}
-			mset.purge()
+			mset.purge(nil)
 			state := mset.state()
 			if state.Msgs != 0 {
 				t.Fatalf("Expected %d messages, got %d", 0, state.Msgs)
@@ -5670,7 +5829,7 @@ func TestJetStreamStreamPurgeWithConsumer(t *testing.T) {
 				t.Fatalf("Expected len(pending) to be 25, got %d", state.NumAckPending)
 			}
 			// Now do purge.
-			mset.purge()
+			mset.purge(nil)
 			if state := mset.state(); state.Msgs != 0 {
 				t.Fatalf("Expected %d messages, got %d", 0, state.Msgs)
 			}
@@ -5758,7 +5917,7 @@ func TestJetStreamStreamPurgeWithConsumerAndRedelivery(t *testing.T) {
 			// Now wait to make sure we are in a redelivered state.
 			time.Sleep(wcfg.AckWait * 2)
 			// Now do purge.
-			mset.purge()
+			mset.purge(nil)
 			if state := mset.state(); state.Msgs != 0 {
 				t.Fatalf("Expected %d messages, got %d", 0, state.Msgs)
 			}
@@ -8295,7 +8454,7 @@ func TestJetStreamDeleteMsg(t *testing.T) {
 			deleteAndCheck(3, 2)
 			deleteAndCheck(2, 4)
 
-			mset.purge()
+			mset.purge(nil)
 			// Put ten more one.
 			pubTen()
 			deleteAndCheck(11, 12)
@@ -10038,7 +10197,7 @@ func TestJetStreamConsumerMaxAckPending(t *testing.T) {
 			checkSubPending(maxAckPending)
 
 			o.stop()
-			mset.purge()
+			mset.purge(nil)
 
 			// Now test a consumer that is live while we publish messages to the stream.
 			o, err = mset.addConsumer(&ConsumerConfig{
@@ -11204,6 +11363,2188 @@ func TestJetStreamOperatorAccounts(t *testing.T) {
 	}
 }
 
+func TestJetStreamServerEncryption(t *testing.T) {
+	for _, cipher := range []string{"chacha", "aes"} {
+		t.Run(cipher, func(t *testing.T) {
+			sd := createDir(t, JetStreamStoreDir)
+			defer os.RemoveAll(sd)
+
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				listen: 127.0.0.1:-1
+				jetstream: {key: "s3cr3t", cipher: %s, store_dir: %q}
+			`, cipher, sd)))
+			defer os.Remove(conf)
+
+			s, _ := RunServerWithConfig(conf)
+			defer s.Shutdown()
+
+			nc, js := jsClientConnect(t, s)
+			defer nc.Close()
+
+			if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			msg := []byte("ENCRYPTED PAYLOAD!!")
+			for i := 0; i < 100; i++ {
+				if _, err := js.Publish("foo", msg); err != nil {
+					t.Fatalf("Unexpected publish error: %v", err)
+				}
+			}
+			if _, err := js.SubscribeSync("foo", nats.Durable("dlc")); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			nc.Close()
+			s.Shutdown()
+
+			// Nothing we stored should be readable on disk.
+			err := filepath.Walk(sd, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				buf, err := ioutil.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				for _, plain := range [][]byte{msg, []byte("TEST"), []byte("dlc")} {
+					if bytes.Contains(buf, plain) {
+						return fmt.Errorf("found plaintext %q in %q", plain, path)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			// Make sure we recover everything on restart.
+			s, _ = RunServerWithConfig(conf)
+			defer s.Shutdown()
+
+			nc, js = jsClientConnect(t, s)
+			defer nc.Close()
+
+			si, err := js.StreamInfo("TEST")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if si.State.Msgs != 100 {
+				t.Fatalf("Expected 100 msgs, got %d", si.State.Msgs)
+			}
+			if _, err := js.ConsumerInfo("TEST", "dlc"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			m, err := js.GetMsg("TEST", 22)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !bytes.Equal(m.Data, msg) {
+				t.Fatalf("Expected %q, got %q", msg, m.Data)
+			}
+		})
+	}
+}
+
+func TestJetStreamStreamCompression(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	createStream := func(cfg *StreamConfig) *JSApiStreamCreateResponse {
+		t.Helper()
+		req, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var scResp JSApiStreamCreateResponse
+		if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &scResp
+	}
+
+	if resp := createStream(&StreamConfig{Name: "MEM", Storage: MemoryStorage, Compression: S2Compression}); resp.Error == nil {
+		t.Fatalf("Expected an error for compression with memory storage")
+	}
+	// Keep our blocks small so they will be sealed and compressed.
+	resp := createStream(&StreamConfig{Name: "TELEMETRY", Storage: FileStorage, MaxBytes: 100_000, Compression: S2Compression})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	if resp.Config.Compression != S2Compression {
+		t.Fatalf("Expected compression to be set, got %v", resp.Config.Compression)
+	}
+
+	msg := bytes.Repeat([]byte(`{"sensor":"abc","temp":22.4,"unit":"C"}`), 10)
+	for i := 0; i < 200; i++ {
+		sendStreamMsg(t, nc, "TELEMETRY", string(msg))
+	}
+
+	mset, err := s.GlobalAccount().lookupStream("TELEMETRY")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkFor(t, 2*time.Second, 10*time.Millisecond, func() error {
+		if state := mset.state(); state.CompressedBytes == 0 || state.CompressedBytes >= state.Bytes/2 {
+			return fmt.Errorf("Expected compressed bytes to be much smaller than %d, got %d", state.Bytes, state.CompressedBytes)
+		}
+		return nil
+	})
+	if _, _, rmsg, _, err := mset.store.LoadMsg(1); err != nil || !bytes.Equal(rmsg, msg) {
+		t.Fatalf("Unexpected message: %q, %v", rmsg, err)
+	}
+}
+
+func TestJetStreamStreamArchiveDir(t *testing.T) {
+	archDir, _ := ioutil.TempDir("", "js-archive-")
+	defer os.RemoveAll(archDir)
+
+	opts := DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir, _ = ioutil.TempDir("", JetStreamStoreDir)
+	opts.JetStreamArchiveDir = archDir
+	s := RunServer(&opts)
+	defer s.Shutdown()
+	defer os.RemoveAll(opts.StoreDir)
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	// Servers may share an archive, so each one needs its own location.
+	fs := mset.store.(*fileStore)
+	expected := filepath.Join(archDir, s.Name(), globalAccountName, streamsDir, "TEST")
+	if a, ok := fs.fcfg.Archive.(*dirBlockArchive); !ok || a.dir != expected {
+		t.Fatalf("Expected archive in %q, got %+v", expected, fs.fcfg.Archive)
+	}
+}
+
+func TestJetStreamRePublish(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	for _, rp := range []*RePublish{
+		{Source: "foo.*", Destination: "foo.$1"},
+		{Source: "foo.*", Destination: "RP.$2"},
+		{Source: "bar.>", Destination: "RP.>"},
+		{Source: "bar", Destination: "RP"},
+	} {
+		if _, err := acc.addStream(&StreamConfig{Name: "BAD", Subjects: []string{"foo.>"}, RePublish: rp}); err == nil {
+			t.Fatalf("Expected an error for republish config %+v", rp)
+		}
+	}
+
+	mset, err := acc.addStream(&StreamConfig{
+		Name:      "RP",
+		Subjects:  []string{"foo.>"},
+		RePublish: &RePublish{Source: "foo.*", Destination: "RP.$1"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer mset.delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	sub, _ := nc.SubscribeSync("RP.>")
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	for _, subj := range []string{"foo.a", "foo.b", "foo.a", "foo.b.c", "foo.a"} {
+		sendStreamMsg(t, nc, subj, "HELLO")
+	}
+
+	expect := func(subj, seq, lseq string, hdrsOnly bool) {
+		t.Helper()
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if m.Subject != subj {
+			t.Fatalf("Expected subject %q, got %q", subj, m.Subject)
+		}
+		if stream := m.Header.Get(JSStream); stream != "RP" {
+			t.Fatalf("Expected stream header of %q, got %q", "RP", stream)
+		}
+		if s := m.Header.Get(JSSequence); s != seq {
+			t.Fatalf("Expected sequence of %q, got %q", seq, s)
+		}
+		if s := m.Header.Get(JSLastSequence); s != lseq {
+			t.Fatalf("Expected last sequence of %q, got %q", lseq, s)
+		}
+		if m.Header.Get(JSSubject) == _EMPTY_ || m.Header.Get(JSTimeStamp) == _EMPTY_ {
+			t.Fatalf("Expected subject and timestamp headers, got %+v", m.Header)
+		}
+		if hdrsOnly {
+			if len(m.Data) != 0 || m.Header.Get(JSMsgSize) != "5" {
+				t.Fatalf("Expected headers only with a msg size, got %q and %+v", m.Data, m.Header)
+			}
+		} else if string(m.Data) != "HELLO" {
+			t.Fatalf("Expected %q, got %q", "HELLO", m.Data)
+		}
+	}
+
+	// foo.b.c does not match our source so should not be republished.
+	expect("RP.a", "1", "0", false)
+	expect("RP.b", "2", "0", false)
+	expect("RP.a", "3", "1", false)
+	expect("RP.a", "5", "3", false)
+	if m, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Did not expect another message, got %q", m.Subject)
+	}
+
+	// Now switch to headers only.
+	cfg := mset.config()
+	cfg.RePublish = &RePublish{Source: "foo.>", Destination: "RP.>", HeadersOnly: true}
+	if err := mset.update(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendStreamMsg(t, nc, "foo.b.c", "HELLO")
+	expect("RP.b.c", "6", "4", true)
+
+	// Removing the config should stop republishing.
+	cfg.RePublish = nil
+	if err := mset.update(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendStreamMsg(t, nc, "foo.a", "HELLO")
+	if m, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Did not expect another message, got %q", m.Subject)
+	}
+}
+
+func TestJetStreamSubjectTransforms(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	for _, cfg := range []*StreamConfig{
+		{Name: "BAD", Subjects: []string{"foo.*"}, SubjectTransform: &SubjectTransformConfig{Source: "foo.*", Destination: "bar.$2"}},
+		{Name: "BAD", Mirror: &StreamSource{Name: "ORDERS", SubjectTransform: &SubjectTransformConfig{Destination: "bar"}}},
+		{Name: "BAD", Sources: []*StreamSource{{Name: "ORDERS", FilterSubject: "foo.*", SubjectTransform: &SubjectTransformConfig{Source: "bar.*", Destination: "baz.$1"}}}},
+	} {
+		if _, err := acc.addStream(cfg); err == nil {
+			t.Fatalf("Expected an error for config %+v", cfg)
+		}
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	// Transform on ingest.
+	orders, err := acc.addStream(&StreamConfig{
+		Name:             "ORDERS",
+		Subjects:         []string{"region.*.orders"},
+		SubjectTransform: &SubjectTransformConfig{Destination: "orders.$1"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tr := orders.config().SubjectTransform; tr.Source != "region.*.orders" {
+		t.Fatalf("Expected the transform source to default to our subject, got %q", tr.Source)
+	}
+	sendStreamMsg(t, nc, "region.east.orders", "ORDER")
+	if subj, _, _, _, err := orders.store.LoadMsg(1); err != nil || subj != "orders.east" {
+		t.Fatalf("Expected stored subject of %q, got %q, %v", "orders.east", subj, err)
+	}
+	orders.delete()
+
+	// Aggregate two regional streams through sources.
+	for _, region := range []string{"east", "west"} {
+		mset, err := acc.addStream(&StreamConfig{Name: strings.ToUpper(region), Subjects: []string{"region." + region + ".>"}})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer mset.delete()
+		sendStreamMsg(t, nc, "region."+region+".orders", "ORDER")
+		sendStreamMsg(t, nc, "region."+region+".returns", "RETURN")
+	}
+	all, err := acc.addStream(&StreamConfig{
+		Name: "ALL",
+		Sources: []*StreamSource{
+			{Name: "EAST", FilterSubject: "region.east.orders", SubjectTransform: &SubjectTransformConfig{Source: "region.*.orders", Destination: "orders.$1"}},
+			{Name: "WEST", FilterSubject: "region.west.orders", SubjectTransform: &SubjectTransformConfig{Destination: "orders.west"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer all.delete()
+	if tr := all.config().Sources[1].SubjectTransform; tr.Source != "region.west.orders" {
+		t.Fatalf("Expected the transform source to default to the filter subject, got %q", tr.Source)
+	}
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := all.state(); state.Msgs != 2 {
+			return fmt.Errorf("Expected 2 msgs, got state: %+v", state)
+		}
+		return nil
+	})
+	subjects := make(map[string]bool)
+	for seq := uint64(1); seq <= 2; seq++ {
+		subj, _, _, _, err := all.store.LoadMsg(seq)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		subjects[subj] = true
+	}
+	if !subjects["orders.east"] || !subjects["orders.west"] {
+		t.Fatalf("Unexpected stored subjects: %+v", subjects)
+	}
+}
+
+func TestJetStreamSealedAndDenyFlags(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	// The client does not know about these config fields yet so use the raw API.
+	request := func(subj string, req interface{}, resp interface{}) {
+		t.Helper()
+		var b []byte
+		if req != nil {
+			b, _ = json.Marshal(req)
+		}
+		rmsg, err := nc.Request(subj, b, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := json.Unmarshal(rmsg.Data, resp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	updateStream := func(cfg *StreamConfig) *ApiError {
+		t.Helper()
+		var resp JSApiStreamUpdateResponse
+		request(fmt.Sprintf(JSApiStreamUpdateT, cfg.Name), cfg, &resp)
+		return resp.Error
+	}
+
+	cfg := &StreamConfig{Name: "AUDIT", Subjects: []string{"audit.>"}, Storage: FileStorage, Sealed: true}
+	var scResp JSApiStreamCreateResponse
+	if request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), cfg, &scResp); scResp.Error == nil {
+		t.Fatalf("Expected an error creating a sealed stream")
+	}
+	cfg.Sealed, cfg.DenyDelete, cfg.DenyPurge, cfg.MaxAge = false, true, true, time.Second
+	scResp = JSApiStreamCreateResponse{}
+	if request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), cfg, &scResp); scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+	if !scResp.Config.DenyDelete || !scResp.Config.DenyPurge {
+		t.Fatalf("Expected deny flags to be set, got %+v", scResp.Config)
+	}
+
+	for i := 0; i < 5; i++ {
+		sendStreamMsg(t, nc, "audit.login", "OK")
+	}
+
+	var dResp JSApiMsgDeleteResponse
+	if request(fmt.Sprintf(JSApiMsgDeleteT, "AUDIT"), &JSApiMsgDeleteRequest{Seq: 1}, &dResp); dResp.Error == nil || dResp.Success {
+		t.Fatalf("Expected an error deleting a message")
+	}
+	var pResp JSApiStreamPurgeResponse
+	if request(fmt.Sprintf(JSApiStreamPurgeT, "AUDIT"), nil, &pResp); pResp.Error == nil || pResp.Success {
+		t.Fatalf("Expected an error purging the stream")
+	}
+
+	// Flags can not be removed once set.
+	cfg.DenyDelete = false
+	if err := updateStream(cfg); err == nil {
+		t.Fatalf("Expected an error removing deny delete")
+	}
+	cfg.DenyDelete, cfg.DenyPurge = true, false
+	if err := updateStream(cfg); err == nil {
+		t.Fatalf("Expected an error removing deny purge")
+	}
+
+	// Now seal the stream.
+	cfg.DenyPurge, cfg.Sealed = true, true
+	if err := updateStream(cfg); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	cfg.Sealed = false
+	if err := updateStream(cfg); err == nil {
+		t.Fatalf("Expected an error unsealing the stream")
+	}
+
+	// No new messages.
+	resp, err := nc.Request("audit.login", []byte("OK"), time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var pubAck JSPubAckResponse
+	if err := json.Unmarshal(resp.Data, &pubAck); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if pubAck.Error == nil || pubAck.Error.Description != jsStreamSealedErr.Description {
+		t.Fatalf("Expected a sealed stream error, got %+v", pubAck.Error)
+	}
+
+	// Messages should no longer expire.
+	time.Sleep(cfg.MaxAge + 250*time.Millisecond)
+	mset, err := s.GlobalAccount().lookupStream("AUDIT")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state := mset.state(); state.Msgs != 5 {
+		t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
+	}
+	// Make sure we keep our state after a restart.
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	time.Sleep(cfg.MaxAge + 250*time.Millisecond)
+	if mset, err = s.GlobalAccount().lookupStream("AUDIT"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg := mset.config(); !cfg.Sealed {
+		t.Fatalf("Expected the stream to still be sealed")
+	}
+	if state := mset.state(); state.Msgs != 5 {
+		t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
+	}
+}
+
+func TestJetStreamRollups(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	if _, err := acc.addStream(&StreamConfig{Name: "BAD", AllowRollup: true, DenyPurge: true}); err == nil {
+		t.Fatalf("Expected an error allowing rollups with deny purge")
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	sendRollup := func(subj, rollup string) *JSPubAckResponse {
+		t.Helper()
+		m := nats.NewMsg(subj)
+		m.Header.Set(JSMsgRollup, rollup)
+		m.Data = []byte("SNAPSHOT")
+		resp, err := nc.RequestMsg(m, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var pa JSPubAckResponse
+		if err := json.Unmarshal(resp.Data, &pa); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &pa
+	}
+
+	for _, storage := range []StorageType{MemoryStorage, FileStorage} {
+		t.Run(storage.String(), func(t *testing.T) {
+			mset, err := acc.addStream(&StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}, Storage: storage})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer mset.delete()
+
+			sendStreamMsg(t, nc, "orders.1", "CREATED")
+			if pa := sendRollup("orders.1", JSMsgRollupSubject); pa.Error == nil {
+				t.Fatalf("Expected an error when rollups are not allowed")
+			}
+
+			cfg := mset.config()
+			cfg.AllowRollup = true
+			if err := mset.update(&cfg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if pa := sendRollup("orders.1", "bad"); pa.Error == nil {
+				t.Fatalf("Expected an error for an invalid rollup value")
+			}
+
+			for i := 0; i < 5; i++ {
+				sendStreamMsg(t, nc, "orders.1", "UPDATED")
+				sendStreamMsg(t, nc, "orders.2", "UPDATED")
+			}
+			// Roll up orders.1 only.
+			pa := sendRollup("orders.1", JSMsgRollupSubject)
+			if pa.Error != nil {
+				t.Fatalf("Unexpected error: %+v", pa.Error)
+			}
+			if state := mset.state(); state.Msgs != 6 || state.LastSeq != pa.Sequence {
+				t.Fatalf("Unexpected state: %+v", state)
+			}
+			if _, seq, _, msg, _, err := mset.store.LoadLastMsg("orders.1"); err != nil || seq != pa.Sequence || string(msg) != "SNAPSHOT" {
+				t.Fatalf("Unexpected last msg for orders.1: %d %q %v", seq, msg, err)
+			}
+
+			// Now roll up everything.
+			sendStreamMsg(t, nc, "orders.2", "UPDATED")
+			if pa = sendRollup("orders.3", JSMsgRollupAll); pa.Error != nil {
+				t.Fatalf("Unexpected error: %+v", pa.Error)
+			}
+			if state := mset.state(); state.Msgs != 1 || state.FirstSeq != pa.Sequence {
+				t.Fatalf("Unexpected state: %+v", state)
+			}
+		})
+	}
+}
+
+func TestJetStreamPurgeEx(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	purge := func(req *JSApiStreamPurgeRequest) *JSApiStreamPurgeResponse {
+		t.Helper()
+		var body []byte
+		if req != nil {
+			body, _ = json.Marshal(req)
+		}
+		resp, err := nc.Request(fmt.Sprintf(JSApiStreamPurgeT, "ORDERS"), body, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var pResp JSApiStreamPurgeResponse
+		if err := json.Unmarshal(resp.Data, &pResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &pResp
+	}
+
+	for _, storage := range []StorageType{MemoryStorage, FileStorage} {
+		t.Run(storage.String(), func(t *testing.T) {
+			mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}, Storage: storage})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer mset.delete()
+
+			// Create a consumer that has seen everything so far.
+			o, err := mset.addConsumer(&ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer o.delete()
+
+			// 10 msgs each for orders.new, orders.paid and orders.eu.new.
+			for i := 0; i < 10; i++ {
+				sendStreamMsg(t, nc, "orders.new", "OK")
+				sendStreamMsg(t, nc, "orders.paid", "OK")
+				sendStreamMsg(t, nc, "orders.eu.new", "OK")
+			}
+
+			if pResp := purge(&JSApiStreamPurgeRequest{Sequence: 10, Keep: 1}); pResp.Error == nil {
+				t.Fatalf("Expected an error with both sequence and keep set")
+			}
+			if pResp := purge(&JSApiStreamPurgeRequest{Subject: "orders..bad"}); pResp.Error == nil {
+				t.Fatalf("Expected an error with an invalid filter")
+			}
+
+			// Filtered by subject.
+			pResp := purge(&JSApiStreamPurgeRequest{Subject: "orders.paid"})
+			if !pResp.Success || pResp.Purged != 10 {
+				t.Fatalf("Unexpected response: %+v", pResp)
+			}
+			if state := mset.state(); state.Msgs != 20 {
+				t.Fatalf("Expected 20 msgs, got %d", state.Msgs)
+			}
+
+			// Keep the newest 2 per subject that matches the wildcard.
+			if pResp = purge(&JSApiStreamPurgeRequest{Subject: "orders.>", Keep: 2}); !pResp.Success || pResp.Purged != 16 {
+				t.Fatalf("Unexpected response: %+v", pResp)
+			}
+			if state := mset.state(); state.Msgs != 4 || state.FirstSeq != 25 {
+				t.Fatalf("Unexpected state: %+v", state)
+			}
+			// Consumer should not have been moved.
+			if ci := o.info(); ci.Delivered.Stream != 0 {
+				t.Fatalf("Expected the consumer to not be moved, got %+v", ci.Delivered)
+			}
+
+			// Up to but not including a sequence.
+			if pResp = purge(&JSApiStreamPurgeRequest{Sequence: 28}); !pResp.Success || pResp.Purged != 2 {
+				t.Fatalf("Unexpected response: %+v", pResp)
+			}
+			if state := mset.state(); state.Msgs != 2 || state.FirstSeq != 28 {
+				t.Fatalf("Unexpected state: %+v", state)
+			}
+			if ci := o.info(); ci.NumPending != 2 {
+				t.Fatalf("Expected 2 pending for the consumer, got %d", ci.NumPending)
+			}
+
+			// Empty request still purges everything.
+			if pResp = purge(nil); !pResp.Success || pResp.Purged != 2 {
+				t.Fatalf("Unexpected response: %+v", pResp)
+			}
+		})
+	}
+}
+
+func TestJetStreamExpectedLastSubjSeq(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo", "bar", "baz"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer mset.delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	sendExpected := func(subj string, seq uint64) *JSPubAckResponse {
+		t.Helper()
+		m := nats.NewMsg(subj)
+		m.Header.Set(JSExpectedLastSubjSeq, strconv.FormatUint(seq, 10))
+		m.Data = []byte("OK")
+		resp, err := nc.RequestMsg(m, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var pa JSPubAckResponse
+		if err := json.Unmarshal(resp.Data, &pa); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &pa
+	}
+
+	sendStreamMsg(t, nc, "foo", "1")
+	sendStreamMsg(t, nc, "bar", "2")
+
+	// The last message for foo is 1 even though the stream has moved on.
+	if pa := sendExpected("foo", 1); pa.Error != nil || pa.Sequence != 3 {
+		t.Fatalf("Unexpected response: %+v %+v", pa.PubAck, pa.Error)
+	}
+	pa := sendExpected("foo", 1)
+	if pa.Error == nil {
+		t.Fatalf("Expected an error with the wrong last subject sequence")
+	}
+	if expected := jsWrongLastSubjSeqError(3); *pa.Error != *expected {
+		t.Fatalf("Expected error %+v, got %+v", expected, pa.Error)
+	}
+	// Zero means no messages for the subject.
+	if pa = sendExpected("baz", 0); pa.Error != nil || pa.Sequence != 4 {
+		t.Fatalf("Unexpected response: %+v %+v", pa.PubAck, pa.Error)
+	}
+	if pa = sendExpected("bar", 0); pa.Error == nil {
+		t.Fatalf("Expected an error with the wrong last subject sequence")
+	}
+	if state := mset.state(); state.Msgs != 4 {
+		t.Fatalf("Expected 4 msgs, got %d", state.Msgs)
+	}
+}
+
+func TestJetStreamMsgTTL(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	sendTTL := func(subj, ttl string) *JSPubAckResponse {
+		t.Helper()
+		m := nats.NewMsg(subj)
+		// Set directly since the header name is not in canonical form.
+		m.Header[JSMessageTTL] = []string{ttl}
+		m.Data = []byte("TOKEN")
+		resp, err := nc.RequestMsg(m, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var pa JSPubAckResponse
+		if err := json.Unmarshal(resp.Data, &pa); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &pa
+	}
+
+	for _, storage := range []StorageType{MemoryStorage, FileStorage} {
+		t.Run(storage.String(), func(t *testing.T) {
+			mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "SESSIONS", Subjects: []string{"session.*"}, Storage: storage})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer mset.delete()
+
+			if pa := sendTTL("session.1", "1s"); pa.Error == nil {
+				t.Fatalf("Expected an error when message TTLs are not enabled")
+			}
+
+			cfg := mset.config()
+			cfg.AllowMsgTTL = true
+			if err := mset.update(&cfg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for _, ttl := range []string{"bad", "10ms", "0"} {
+				if pa := sendTTL("session.1", ttl); pa.Error == nil {
+					t.Fatalf("Expected an error for TTL %q", ttl)
+				}
+			}
+
+			sendStreamMsg(t, nc, "session.1", "RECORD")
+			if pa := sendTTL("session.2", "1s"); pa.Error != nil {
+				t.Fatalf("Unexpected error: %+v", pa.Error)
+			}
+			sendStreamMsg(t, nc, "session.3", "RECORD")
+			if state := mset.state(); state.Msgs != 3 {
+				t.Fatalf("Expected 3 msgs, got %d", state.Msgs)
+			}
+			checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+				if state := mset.state(); state.Msgs != 2 {
+					return fmt.Errorf("Expected 2 msgs, got %d", state.Msgs)
+				}
+				return nil
+			})
+
+			// Can not be disabled once enabled.
+			cfg.AllowMsgTTL = false
+			if err := mset.update(&cfg); err == nil {
+				t.Fatalf("Expected an error disabling message TTLs")
+			}
+		})
+	}
+}
+
+func TestJetStreamDirectGet(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	directGet := func(stream string, req string) *nats.Msg {
+		t.Helper()
+		m, err := nc.Request(fmt.Sprintf(JSDirectMsgGetT, stream), []byte(req), time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return m
+	}
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "DG", Subjects: []string{"dg.*"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer mset.delete()
+
+	m := nats.NewMsg("dg.1")
+	m.Header.Set("X-Color", "blue")
+	m.Data = []byte("ONE")
+	if _, err := nc.RequestMsg(m, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendStreamMsg(t, nc, "dg.2", "TWO")
+	sendStreamMsg(t, nc, "dg.1", "THREE")
+
+	// Not enabled so no one should be listening.
+	if _, err := nc.Request(fmt.Sprintf(JSDirectMsgGetT, "DG"), []byte(`{"seq":1}`), 100*time.Millisecond); err == nil {
+		t.Fatalf("Expected an error when direct gets are not enabled")
+	}
+
+	cfg := mset.config()
+	cfg.AllowDirect = true
+	if err := mset.update(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	m = directGet("DG", `{"seq":1}`)
+	if string(m.Data) != "ONE" || m.Header.Get("X-Color") != "blue" {
+		t.Fatalf("Unexpected response: %q %+v", m.Data, m.Header)
+	}
+	if m.Header.Get(JSStream) != "DG" || m.Header.Get(JSSubject) != "dg.1" || m.Header.Get(JSSequence) != "1" {
+		t.Fatalf("Unexpected headers: %+v", m.Header)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, m.Header.Get(JSTimeStamp)); err != nil {
+		t.Fatalf("Unexpected timestamp header: %v", err)
+	}
+
+	m = directGet("DG", `{"last_by_subj":"dg.1"}`)
+	if string(m.Data) != "THREE" || m.Header.Get(JSSequence) != "3" {
+		t.Fatalf("Unexpected response: %q %+v", m.Data, m.Header)
+	}
+
+	if m = directGet("DG", `{"seq":22}`); m.Header.Get("Status") != "404" {
+		t.Fatalf("Expected a 404 status, got %+v", m.Header)
+	}
+	if m = directGet("DG", `{"last_by_subj":"dg.3"}`); m.Header.Get("Status") != "404" {
+		t.Fatalf("Expected a 404 status, got %+v", m.Header)
+	}
+	for _, req := range []string{`{}`, `{"seq":1,"last_by_subj":"dg.1"}`, `bad`} {
+		if m = directGet("DG", req); m.Header.Get("Status") != "400" {
+			t.Fatalf("Expected a 400 status for %q, got %+v", req, m.Header)
+		}
+	}
+
+	// Disable and make sure we stop answering.
+	cfg.AllowDirect = false
+	if err := mset.update(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := nc.Request(fmt.Sprintf(JSDirectMsgGetT, "DG"), []byte(`{"seq":1}`), 100*time.Millisecond); err == nil {
+		t.Fatalf("Expected an error when direct gets are disabled")
+	}
+}
+
+func TestJetStreamAtomicBatch(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer mset.delete()
+
+	batchMsg := func(id string, seq int, subj string, hdrs map[string]string) *nats.Msg {
+		m := nats.NewMsg(subj)
+		m.Header.Set(JSBatchId, id)
+		m.Header.Set(JSBatchSeq, strconv.Itoa(seq))
+		for k, v := range hdrs {
+			m.Header.Set(k, v)
+		}
+		m.Data = []byte("ORDER")
+		return m
+	}
+	commit := func(m *nats.Msg) *JSPubAckResponse {
+		t.Helper()
+		m.Header.Set(JSBatchCommit, "1")
+		resp, err := nc.RequestMsg(m, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var pa JSPubAckResponse
+		if err := json.Unmarshal(resp.Data, &pa); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &pa
+	}
+	expectMsgs := func(n uint64) {
+		t.Helper()
+		if state := mset.state(); state.Msgs != n {
+			t.Fatalf("Expected %d msgs, got %d", n, state.Msgs)
+		}
+	}
+
+	if pa := commit(batchMsg("A", 1, "orders.1", nil)); pa.Error == nil {
+		t.Fatalf("Expected an error when atomic publish is disabled")
+	}
+
+	cfg := mset.config()
+	cfg.AllowAtomic = true
+	if err := mset.update(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Nothing is stored until the batch is committed.
+	nc.PublishMsg(batchMsg("A", 1, "orders.1", nil))
+	nc.PublishMsg(batchMsg("A", 2, "orders.2", nil))
+	nc.Flush()
+	expectMsgs(0)
+	pa := commit(batchMsg("A", 3, "orders.3", nil))
+	if pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	if pa.Sequence != 3 || pa.BatchId != "A" || pa.BatchSize != 3 {
+		t.Fatalf("Unexpected ack: %+v", pa.PubAck)
+	}
+	expectMsgs(3)
+
+	// Expectations are checked in order within the batch.
+	nc.PublishMsg(batchMsg("B", 1, "orders.1", map[string]string{JSExpectedLastSeq: "3", JSMsgId: "b1"}))
+	nc.PublishMsg(batchMsg("B", 2, "orders.1", map[string]string{JSExpectedLastSubjSeq: "4"}))
+	if pa = commit(batchMsg("B", 3, "orders.2", map[string]string{JSExpectedLastSeq: "5"})); pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	if pa.Sequence != 6 || pa.BatchSize != 3 {
+		t.Fatalf("Unexpected ack: %+v", pa.PubAck)
+	}
+	expectMsgs(6)
+
+	// Any failed expectation rejects the whole batch.
+	for _, hdrs := range []map[string]string{
+		{JSExpectedLastSeq: "22"},
+		{JSExpectedLastSubjSeq: "1"},
+		{JSMsgId: "b1"},
+		{JSMsgRollup: JSMsgRollupSubject},
+	} {
+		nc.PublishMsg(batchMsg("C", 1, "orders.1", nil))
+		if pa = commit(batchMsg("C", 2, "orders.1", hdrs)); pa.Error == nil {
+			t.Fatalf("Expected an error for %+v", hdrs)
+		}
+		expectMsgs(6)
+	}
+
+	// Gaps abandon the batch.
+	nc.PublishMsg(batchMsg("D", 1, "orders.1", nil))
+	if pa = commit(batchMsg("D", 3, "orders.1", nil)); pa.Error == nil || pa.Error.Description != "batch is incomplete" {
+		t.Fatalf("Expected an incomplete batch error, got %+v", pa.Error)
+	}
+	if pa = commit(batchMsg("D", 2, "orders.1", nil)); pa.Error == nil {
+		t.Fatalf("Expected an error for an abandoned batch")
+	}
+	expectMsgs(6)
+
+	// The whole batch has to fit in our limits.
+	for _, update := range []func(cfg *StreamConfig){
+		func(cfg *StreamConfig) { cfg.Discard, cfg.MaxMsgs = DiscardNew, 8 },
+		func(cfg *StreamConfig) { cfg.Discard, cfg.MaxBytes = DiscardNew, int64(mset.state().Bytes+100) },
+		func(cfg *StreamConfig) { cfg.MaxMsgsPer = 2 },
+		func(cfg *StreamConfig) { cfg.MaxMsgs = 2 },
+	} {
+		cfg := mset.config()
+		update(&cfg)
+		if err := mset.update(&cfg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		nmsgs := mset.state().Msgs
+		nc.PublishMsg(batchMsg("E", 1, "orders.9", nil))
+		nc.PublishMsg(batchMsg("E", 2, "orders.9", nil))
+		if pa = commit(batchMsg("E", 3, "orders.9", nil)); pa.Error == nil {
+			t.Fatalf("Expected an error for a batch exceeding our limits")
+		}
+		expectMsgs(nmsgs)
+
+		cfg = mset.config()
+		cfg.Discard, cfg.MaxMsgs, cfg.MaxBytes, cfg.MaxMsgsPer = DiscardOld, -1, -1, -1
+		if err := mset.update(&cfg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// The total size of batches being staged is limited.
+	nmsgs := mset.state().Msgs
+	big := make([]byte, 1024*1024-1024)
+	var berr *ApiError
+	for i := 1; i <= maxBatchBytesInflight/len(big)+1; i++ {
+		m := batchMsg("F", i, "orders.1", nil)
+		m.Data = big
+		m.Reply = nats.NewInbox()
+		resp, err := nc.RequestMsg(m, 50*time.Millisecond)
+		if err == nats.ErrTimeout {
+			continue
+		} else if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var pa JSPubAckResponse
+		json.Unmarshal(resp.Data, &pa)
+		berr = pa.Error
+		break
+	}
+	if berr == nil || berr.Description != "too many batch bytes in flight" {
+		t.Fatalf("Expected a staged bytes error, got %+v", berr)
+	}
+	// The rejected batch no longer counts against the limit.
+	nc.PublishMsg(batchMsg("G", 1, "orders.1", nil))
+	if pa = commit(batchMsg("G", 2, "orders.1", nil)); pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	expectMsgs(nmsgs + 2)
+}
+
+func TestJetStreamConsumerUpdate(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "UPD", Subjects: []string{"upd.*"}, Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		sendStreamMsg(t, nc, "upd.1", "OK")
+	}
+
+	cfg := ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit, FilterSubject: "upd.*"}
+	o, err := mset.addConsumer(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		m, err := nc.Request(o.requestNextMsgSubject(), nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		m.Respond(nil)
+	}
+	nc.Flush()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if info := o.info(); info.AckFloor.Stream != 5 {
+			return fmt.Errorf("Expected ack floor of 5, got %+v", info.AckFloor)
+		}
+		return nil
+	})
+
+	// Update the mutable fields.
+	ncfg := ConsumerConfig{
+		Durable:         "dlc",
+		AckPolicy:       AckExplicit,
+		FilterSubject:   "upd.*",
+		AckWait:         2 * time.Second,
+		MaxDeliver:      5,
+		MaxAckPending:   10,
+		SampleFrequency: "50%",
+	}
+	no, err := mset.addConsumer(&ncfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if no != o {
+		t.Fatalf("Expected the running consumer to be updated")
+	}
+	info := o.info()
+	if info.Config.AckWait != 2*time.Second || info.Config.MaxDeliver != 5 || info.Config.MaxAckPending != 10 || info.Config.SampleFrequency != "50%" {
+		t.Fatalf("Config was not updated: %+v", info.Config)
+	}
+	if info.AckFloor.Stream != 5 || info.Delivered.Stream != 5 {
+		t.Fatalf("Expected state to be kept, got %+v", info)
+	}
+
+	// Immutable fields should error.
+	for _, test := range []struct {
+		name  string
+		apply func(cfg *ConsumerConfig)
+		err   string
+	}{
+		{"replay policy", func(cfg *ConsumerConfig) { cfg.ReplayPolicy = ReplayOriginal }, "consumer replay policy can not be updated"},
+		{"filter subject", func(cfg *ConsumerConfig) { cfg.FilterSubject = "upd.2" }, "consumer filter subject can not be updated"},
+		{"deliver policy", func(cfg *ConsumerConfig) { cfg.DeliverPolicy = DeliverNew }, "consumer deliver policy can not be updated"},
+		{"pull to push", func(cfg *ConsumerConfig) { cfg.DeliverSubject, cfg.MaxWaiting = "d", 0 }, "consumer can not be updated from pull to push based"},
+	} {
+		bcfg := ncfg
+		test.apply(&bcfg)
+		if _, err := mset.addConsumer(&bcfg); err == nil || err.Error() != test.err {
+			t.Fatalf("Expected %q error for %s, got %v", test.err, test.name, err)
+		}
+	}
+
+	// Idle heartbeats can be added to a running push consumer.
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	pcfg := ConsumerConfig{Durable: "push", DeliverSubject: sub.Subject, DeliverPolicy: DeliverNew, AckPolicy: AckExplicit}
+	if _, err := mset.addConsumer(&pcfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pcfg.Heartbeat = 100 * time.Millisecond
+	if _, err := mset.addConsumer(&pcfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Expected an idle heartbeat: %v", err)
+	}
+	if m.Header.Get("Status") != "100" {
+		t.Fatalf("Expected an idle heartbeat, got %+v", m)
+	}
+
+	// The deliver subject can not be moved while there is interest, even with other updates.
+	pcfg.DeliverSubject, pcfg.MaxDeliver = "d.new", 10
+	if _, err := mset.addConsumer(&pcfg); err == nil || err.Error() != "consumer deliver subject can not be updated while active" {
+		t.Fatalf("Expected an error moving an active push consumer, got %v", err)
+	}
+	sub.Unsubscribe()
+	nc.Flush()
+	if _, err := mset.addConsumer(&pcfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if po := mset.lookupConsumer("push"); po == nil || po.info().Config.DeliverSubject != "d.new" {
+		t.Fatalf("Expected the deliver subject to be updated")
+	}
+
+	// Make sure the update persists.
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	mset, err = s.GlobalAccount().lookupStream("UPD")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if o = mset.lookupConsumer("dlc"); o == nil {
+		t.Fatalf("Expected to find consumer")
+	}
+	if info := o.info(); info.Config.MaxAckPending != 10 || info.AckFloor.Stream != 5 {
+		t.Fatalf("Expected the update and state to be restored, got %+v", info)
+	}
+}
+
+func TestJetStreamStreamExportImport(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	acc := s.GlobalAccount()
+	mset, err := acc.addStream(&StreamConfig{Name: "SRC", Subjects: []string{"orders.*"}, Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 1; i <= 20; i++ {
+		m := nats.NewMsg("orders.new")
+		if i%2 == 0 {
+			m.Subject = "orders.paid"
+			m.Header.Set("Order-Id", strconv.Itoa(i))
+		}
+		m.Data = []byte(fmt.Sprintf("ORDER-%d", i))
+		if _, err := nc.RequestMsg(m, time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	mset.removeMsg(4)
+
+	// Make sure we get proper errors for bad requests.
+	var eresp JSApiStreamExportResponse
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamExportT, "SRC"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	json.Unmarshal(rmsg.Data, &eresp)
+	if eresp.Error == nil || eresp.Error.Code != 400 {
+		t.Fatalf("Did not get correct error response: %+v", eresp.Error)
+	}
+	now := time.Now()
+	req, _ := json.Marshal(&JSApiStreamExportRequest{DeliverSubject: "d", StartSeq: 1, StartTime: &now})
+	if rmsg, err = nc.Request(fmt.Sprintf(JSApiStreamExportT, "SRC"), req, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	eresp.Error = nil
+	json.Unmarshal(rmsg.Data, &eresp)
+	if eresp.Error == nil || eresp.Error.Description != "range can not be set by both sequence and time" {
+		t.Fatalf("Did not get correct error response: %+v", eresp.Error)
+	}
+
+	// Check the format itself.
+	export := exportStreamMsgs(t, nc, "SRC", &JSApiStreamExportRequest{})
+	lines := bytes.Split(bytes.TrimSpace(export), []byte("\n"))
+	if len(lines) != 20 {
+		t.Fatalf("Expected a header and 19 msgs, got %d lines", len(lines))
+	}
+	var hdr StreamExportHeader
+	if err := json.Unmarshal(lines[0], &hdr); err != nil || hdr.Version != JSStreamExportVersion || hdr.Stream != "SRC" {
+		t.Fatalf("Unexpected header: %+v, %v", hdr, err)
+	}
+	var sm StoredMsg
+	if err := json.Unmarshal(lines[4], &sm); err != nil || sm.Sequence != 5 || string(sm.Data) != "ORDER-5" {
+		t.Fatalf("Unexpected msg: %+v, %v", sm, err)
+	}
+
+	// Ranges and filters.
+	export = exportStreamMsgs(t, nc, "SRC", &JSApiStreamExportRequest{StartSeq: 5, EndSeq: 15, FilterSubject: "orders.paid"})
+	if lines = bytes.Split(bytes.TrimSpace(export), []byte("\n")); len(lines) != 6 {
+		t.Fatalf("Expected a header and 5 msgs, got %d lines", len(lines))
+	}
+	for _, line := range lines[1:] {
+		var sm StoredMsg
+		json.Unmarshal(line, &sm)
+		if sm.Subject != "orders.paid" || sm.Sequence < 6 || sm.Sequence > 14 || len(sm.Header) == 0 {
+			t.Fatalf("Unexpected msg: %+v", sm)
+		}
+	}
+
+	// Imported messages need to match the stream subjects.
+	export = exportStreamMsgs(t, nc, "SRC", &JSApiStreamExportRequest{StartSeq: 3})
+	other, err := acc.addStream(&StreamConfig{Name: "OTHER", Subjects: []string{"other"}, Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	iresp := importStreamMsgs(t, nc, "OTHER", &JSApiStreamImportRequest{}, export)
+	if iresp.Error == nil || !strings.Contains(iresp.Error.Description, "does not match the stream subjects") {
+		t.Fatalf("Expected a subject error, got %+v", iresp.Error)
+	}
+	if state := other.state(); state.Msgs != 0 {
+		t.Fatalf("Expected no msgs, got %d", state.Msgs)
+	}
+
+	// Keep the original sequences and timestamps. We need the subjects of the source,
+	// so hold on to the messages we will compare and remove it.
+	type storedMsg struct {
+		subj     string
+		hdr, msg []byte
+		ts       int64
+	}
+	smsgs := make(map[uint64]storedMsg)
+	for _, seq := range []uint64{3, 5, 10, 20} {
+		subj, hdr, msg, ts, err := mset.store.LoadMsg(seq)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		smsgs[seq] = storedMsg{subj, hdr, msg, ts}
+	}
+	if err := mset.delete(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dst, err := acc.addStream(&StreamConfig{Name: "DST", Subjects: []string{"orders.*"}, Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	iresp = importStreamMsgs(t, nc, "DST", &JSApiStreamImportRequest{KeepSequences: true, KeepTimestamps: true}, export)
+	if iresp.Error != nil || iresp.Imported != 17 {
+		t.Fatalf("Unexpected import response: %+v, %+v", iresp, iresp.Error)
+	}
+	if state := dst.state(); state.Msgs != 17 || state.FirstSeq != 3 || state.LastSeq != 20 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	for seq, sm := range smsgs {
+		dsubj, dhdr, dmsg, dts, err := dst.store.LoadMsg(seq)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sm.subj != dsubj || !bytes.Equal(sm.hdr, dhdr) || !bytes.Equal(sm.msg, dmsg) || sm.ts != dts {
+			t.Fatalf("Imported msg %d does not match", seq)
+		}
+	}
+	if _, _, _, _, err := dst.store.LoadMsg(4); err == nil {
+		t.Fatalf("Expected sequence 4 to be skipped")
+	}
+	// Can not go backwards when keeping sequences.
+	iresp = importStreamMsgs(t, nc, "DST", &JSApiStreamImportRequest{KeepSequences: true}, export)
+	if iresp.Error == nil || !strings.Contains(iresp.Error.Description, "not past the last sequence") {
+		t.Fatalf("Expected a sequence error, got %+v", iresp.Error)
+	}
+
+	// New sequences and timestamps.
+	start := time.Now()
+	iresp = importStreamMsgs(t, nc, "DST", &JSApiStreamImportRequest{}, export)
+	if iresp.Error != nil || iresp.Imported != 17 {
+		t.Fatalf("Unexpected import response: %+v, %+v", iresp, iresp.Error)
+	}
+	if iresp.State == nil || iresp.State.Msgs != 34 || iresp.State.LastSeq != 37 {
+		t.Fatalf("Unexpected state: %+v", iresp.State)
+	}
+	subj, _, msg, ts, err := dst.store.LoadMsg(21)
+	if err != nil || subj != "orders.new" || string(msg) != "ORDER-3" || ts < start.UnixNano() {
+		t.Fatalf("Unexpected msg: %q %q %v", subj, msg, err)
+	}
+
+	// Bad exports should fail.
+	iresp = importStreamMsgs(t, nc, "DST", &JSApiStreamImportRequest{}, []byte(`{"stream":"SRC"}`+"\n"))
+	if iresp.Error == nil || iresp.Error.Description != errStreamExportHeader.Error() {
+		t.Fatalf("Expected a header error, got %+v", iresp.Error)
+	}
+	iresp = importStreamMsgs(t, nc, "DST", &JSApiStreamImportRequest{}, []byte(`{"version":2}`+"\n"))
+	if iresp.Error == nil || !strings.Contains(iresp.Error.Description, "not supported") {
+		t.Fatalf("Expected a version error, got %+v", iresp.Error)
+	}
+
+	// Msg ids are kept for duplicate detection, but are not checked on import.
+	m := nats.NewMsg("orders.new")
+	m.Header.Set(JSMsgId, "dup")
+	if _, err := nc.RequestMsg(m, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	export = exportStreamMsgs(t, nc, "DST", &JSApiStreamExportRequest{StartSeq: 38})
+	iresp = importStreamMsgs(t, nc, "DST", &JSApiStreamImportRequest{}, export)
+	if iresp.Error != nil || iresp.Imported != 1 {
+		t.Fatalf("Unexpected import response: %+v, %+v", iresp, iresp.Error)
+	}
+	if _, hdr, _, _, err := dst.store.LoadMsg(39); err != nil || getMsgId(hdr) != "dup" {
+		t.Fatalf("Expected imported msg to keep its msg id, got %q, %v", hdr, err)
+	}
+	resp, err := nc.RequestMsg(m, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var pa JSPubAckResponse
+	if err := json.Unmarshal(resp.Data, &pa); err != nil || pa.PubAck == nil || !pa.Duplicate {
+		t.Fatalf("Expected a duplicate ack, got %q", resp.Data)
+	}
+
+	// Per message TTLs need to be allowed by the stream.
+	tsm, _ := json.Marshal(&StoredMsg{Subject: "orders.new", Sequence: 1, Header: genHeader(nil, JSMessageTTL, "1h"), Data: []byte("TTL"), Time: time.Now().UTC()})
+	export = append([]byte(`{"version":1,"stream":"SRC"}`+"\n"), tsm...)
+	iresp = importStreamMsgs(t, nc, "DST", &JSApiStreamImportRequest{}, export)
+	if iresp.Error == nil || !strings.Contains(iresp.Error.Description, "does not allow them") {
+		t.Fatalf("Expected a TTL error, got %+v", iresp.Error)
+	}
+}
+
+func TestJetStreamStreamExportImportKeyValue(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	acc := s.GlobalAccount()
+	kv, err := acc.CreateKeyValue(&KeyValueConfig{Bucket: "TEST", History: 5})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// A rollup of everything, which would remove anything we had imported before it.
+	m := nats.NewMsg("$KV.TEST.z")
+	m.Header.Set(JSMsgRollup, JSMsgRollupAll)
+	if _, err := nc.RequestMsg(m, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// These all send publish time headers, expected subject sequences, rollups and msg ids.
+	if _, err := kv.Create("a", []byte("1")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := kv.Update("a", []byte("2"), 2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m = nats.NewMsg("$KV.TEST.b")
+	m.Header.Set(JSMsgId, "b")
+	if _, err := nc.RequestMsg(m, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := kv.Purge("a"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := kv.Create("a", []byte("3")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	export := exportStreamMsgs(t, nc, "KV_TEST", &JSApiStreamExportRequest{})
+	if err := acc.DeleteKeyValue("TEST"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if kv, err = acc.CreateKeyValue(&KeyValueConfig{Bucket: "TEST", History: 5}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Import twice with new sequences. None of the headers should be checked or acted on again.
+	for i := 1; i <= 2; i++ {
+		iresp := importStreamMsgs(t, nc, "KV_TEST", &JSApiStreamImportRequest{}, export)
+		if iresp.Error != nil || iresp.Imported != 4 {
+			t.Fatalf("Unexpected import response: %+v, %+v", iresp, iresp.Error)
+		}
+		if iresp.State == nil || iresp.State.Msgs != uint64(4*i) || iresp.State.FirstSeq != 1 {
+			t.Fatalf("Unexpected state: %+v", iresp.State)
+		}
+	}
+	if e, err := kv.Get("a"); err != nil || string(e.Value) != "3" || e.Revision != 8 {
+		t.Fatalf("Unexpected entry: %+v, %v", e, err)
+	}
+	h, err := kv.History("a")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ops []KeyValueOp
+	for _, e := range h {
+		ops = append(ops, e.Operation)
+	}
+	if !reflect.DeepEqual(ops, []KeyValueOp{KeyValuePurge, KeyValuePut, KeyValuePurge, KeyValuePut}) {
+		t.Fatalf("Unexpected history: %v", ops)
+	}
+
+	// The publish time headers should be gone, but not anything else.
+	mset, err := acc.lookupStream("KV_TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for seq := uint64(1); seq <= 8; seq++ {
+		_, hdr, _, _, err := mset.store.LoadMsg(seq)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for _, key := range importStrippedHeaders {
+			if v := getHeader(key, hdr); v != nil {
+				t.Fatalf("Expected %q to be removed from msg %d, got %q", key, seq, v)
+			}
+		}
+	}
+	if _, hdr, _, _, _ := mset.store.LoadMsg(3); string(getHeader(KeyValueOperationHdr, hdr)) != string(KeyValuePurge) {
+		t.Fatalf("Expected the purge marker to be kept, got %q", hdr)
+	}
+}
+
+func TestJetStreamStreamImportAfterRejectedPublish(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	acc := s.GlobalAccount()
+	mset, err := acc.addStream(&StreamConfig{Name: "SRC", Subjects: []string{"orders.*"}, Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 1; i <= 5; i++ {
+		sendStreamMsg(t, nc, "orders.new", fmt.Sprintf("ORDER-%d", i))
+	}
+	mset.removeMsg(2)
+	export := exportStreamMsgs(t, nc, "SRC", &JSApiStreamExportRequest{})
+	if err := mset.delete(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	dst, err := acc.addStream(&StreamConfig{Name: "DST", Subjects: []string{"orders.*"}, Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reject := func() {
+		t.Helper()
+		m := nats.NewMsg("orders.new")
+		m.Header.Set(JSExpectedLastSeq, "22")
+		resp, err := nc.RequestMsg(m, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if pa := getPubAckResponse(resp.Data); pa == nil || pa.Error == nil {
+			t.Fatalf("Expected an error for a wrong last sequence, got %q", resp.Data)
+		}
+	}
+	checkMsg := func(seq uint64, data string) {
+		t.Helper()
+		if _, _, msg, _, err := dst.store.LoadMsg(seq); err != nil || string(msg) != data {
+			t.Fatalf("Expected %q at %d, got %q, %v", data, seq, msg, err)
+		}
+	}
+
+	// Into an empty stream, keeping the gap.
+	reject()
+	iresp := importStreamMsgs(t, nc, "DST", &JSApiStreamImportRequest{KeepSequences: true}, export)
+	if iresp.Error != nil || iresp.Imported != 4 {
+		t.Fatalf("Unexpected import response: %+v, %+v", iresp, iresp.Error)
+	}
+	if state := dst.state(); state.Msgs != 4 || state.FirstSeq != 1 || state.LastSeq != 5 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	checkMsg(1, "ORDER-1")
+	checkMsg(5, "ORDER-5")
+
+	// With new sequences after what we have.
+	reject()
+	iresp = importStreamMsgs(t, nc, "DST", &JSApiStreamImportRequest{}, export)
+	if iresp.Error != nil || iresp.Imported != 4 {
+		t.Fatalf("Unexpected import response: %+v, %+v", iresp, iresp.Error)
+	}
+	if state := dst.state(); state.Msgs != 8 || state.LastSeq != 9 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	checkMsg(6, "ORDER-1")
+	checkMsg(9, "ORDER-5")
+
+	if pa := sendStreamMsg(t, nc, "orders.new", "ORDER-6"); pa.Sequence != 10 {
+		t.Fatalf("Expected sequence 10, got %d", pa.Sequence)
+	}
+}
+
+// Export the stream and return the complete export.
+func exportStreamMsgs(t *testing.T, nc *nats.Conn, stream string, ereq *JSApiStreamExportRequest) []byte {
+	t.Helper()
+	ereq.DeliverSubject = nats.NewInbox()
+	// Just for test, usually left alone.
+	ereq.ChunkSize = 512
+
+	var export []byte
+	done := make(chan bool, 1)
+	sub, _ := nc.Subscribe(ereq.DeliverSubject, func(m *nats.Msg) {
+		// EOF
+		if len(m.Data) == 0 {
+			done <- true
+			return
+		}
+		export = append(export, m.Data...)
+		// Flow ack
+		m.Respond(nil)
+	})
+	defer sub.Unsubscribe()
+
+	req, _ := json.Marshal(ereq)
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamExportT, stream), req, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error on export request: %v", err)
+	}
+	var resp JSApiStreamExportResponse
+	json.Unmarshal(rmsg.Data, &resp)
+	if resp.Error != nil || resp.State == nil {
+		t.Fatalf("Unexpected export response: %+v, %+v", resp, resp.Error)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Did not receive our export in time")
+	}
+	return export
+}
+
+// Import an export into the stream and return the final response.
+func importStreamMsgs(t *testing.T, nc *nats.Conn, stream string, ireq *JSApiStreamImportRequest, export []byte) *JSApiStreamImportCompleteResponse {
+	t.Helper()
+	req, _ := json.Marshal(ireq)
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamImportT, stream), req, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error on import request: %v", err)
+	}
+	var resp JSApiStreamImportResponse
+	json.Unmarshal(rmsg.Data, &resp)
+	if resp.Error != nil {
+		t.Fatalf("Unexpected import response: %+v", resp.Error)
+	}
+	var cresp JSApiStreamImportCompleteResponse
+	// Chunks do not need to line up with messages.
+	var chunk [100]byte
+	for r := bytes.NewReader(export); ; {
+		n, err := r.Read(chunk[:])
+		if err != nil {
+			break
+		}
+		rmsg, err := nc.Request(resp.DeliverSubject, chunk[:n], 2*time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error sending chunk: %v", err)
+		}
+		// Errors are returned early.
+		if len(rmsg.Data) > 0 {
+			json.Unmarshal(rmsg.Data, &cresp)
+			return &cresp
+		}
+	}
+	if rmsg, err = nc.Request(resp.DeliverSubject, nil, 5*time.Second); err != nil {
+		t.Fatalf("Unexpected error completing import: %v", err)
+	}
+	json.Unmarshal(rmsg.Data, &cresp)
+	return &cresp
+}
+
+func TestJetStreamConsumerMultipleFilterSubjects(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	for i := 1; i <= 10; i++ {
+		sendStreamMsg(t, nc, fmt.Sprintf("orders.%d.new", i), "new")
+		sendStreamMsg(t, nc, fmt.Sprintf("orders.%d.paid", i), "paid")
+		sendStreamMsg(t, nc, fmt.Sprintf("orders.%d.shipped", i), "shipped")
+	}
+
+	// Bad configs.
+	for _, cfg := range []*ConsumerConfig{
+		{FilterSubject: "orders.*.new", FilterSubjects: []string{"orders.*.paid"}},
+		{FilterSubjects: []string{"orders.*.new", "orders.1.*"}},
+		{FilterSubjects: []string{"orders.*.new", "orders.>"}},
+		{FilterSubjects: []string{"orders.*.new", "foo"}},
+		{FilterSubjects: []string{"orders.*.new", ""}},
+	} {
+		if _, err := mset.addConsumer(cfg); err == nil {
+			t.Fatalf("Expected an error for filter subjects %+v", cfg)
+		}
+	}
+
+	delivery := nats.NewInbox()
+	sub, _ := nc.SubscribeSync(delivery)
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	o, err := mset.addConsumer(&ConsumerConfig{
+		Durable:        "d",
+		DeliverSubject: delivery,
+		AckPolicy:      AckExplicit,
+		FilterSubjects: []string{"orders.*.shipped", "orders.1.new"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.delete()
+
+	if info := o.info(); info.NumPending+uint64(info.NumAckPending) != 11 {
+		t.Fatalf("Expected 11 pending, got %d and %d ack pending", info.NumPending, info.NumAckPending)
+	}
+	checkSubsPending(t, sub, 11)
+
+	// Should be delivered in stream order regardless of the filter order.
+	var last uint64
+	for i := 0; i < 11; i++ {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if i == 0 && m.Subject != "orders.1.new" {
+			t.Fatalf("Expected first message to be orders.1.new, got %q", m.Subject)
+		} else if i > 0 && !strings.HasSuffix(m.Subject, ".shipped") {
+			t.Fatalf("Unexpected subject %q", m.Subject)
+		}
+		sseq, _, _, _, _ := replyInfo(m.Reply)
+		if sseq <= last {
+			t.Fatalf("Expected stream sequence to increase, got %d after %d", sseq, last)
+		}
+		last = sseq
+		m.Respond(nil)
+	}
+
+	// New messages should only count when they match one of the filters.
+	sendStreamMsg(t, nc, "orders.1.paid", "paid")
+	sendStreamMsg(t, nc, "orders.2.new", "new")
+	sendStreamMsg(t, nc, "orders.1.new", "new")
+	sendStreamMsg(t, nc, "orders.11.shipped", "shipped")
+	checkSubsPending(t, sub, 2)
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if info := o.info(); info.NumPending != 0 || info.Delivered.Stream != 34 {
+			return fmt.Errorf("Unexpected info: %+v", info)
+		}
+		return nil
+	})
+
+	// Filters can not be changed on a durable.
+	_, err = mset.addConsumer(&ConsumerConfig{
+		Durable:        "d",
+		DeliverSubject: delivery,
+		AckPolicy:      AckExplicit,
+		FilterSubjects: []string{"orders.*.shipped", "orders.2.new"},
+	})
+	if err == nil {
+		t.Fatalf("Expected an error updating filter subjects")
+	}
+	// But the same config is fine.
+	_, err = mset.addConsumer(&ConsumerConfig{
+		Durable:        "d",
+		DeliverSubject: delivery,
+		AckPolicy:      AckExplicit,
+		FilterSubjects: []string{"orders.*.shipped", "orders.1.new"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestJetStreamWorkQueueMultipleFilterSubjects(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "WQ", Subjects: []string{"wq.>"}, Retention: WorkQueuePolicy})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.delete()
+
+	o, err := mset.addConsumer(&ConsumerConfig{Durable: "A", AckPolicy: AckExplicit, FilterSubjects: []string{"wq.a", "wq.b.*"}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.delete()
+
+	if _, err := mset.addConsumer(&ConsumerConfig{Durable: "B", AckPolicy: AckExplicit, FilterSubjects: []string{"wq.c", "wq.b.1"}}); err == nil {
+		t.Fatalf("Expected an error with overlapping workqueue partitions")
+	}
+	o2, err := mset.addConsumer(&ConsumerConfig{Durable: "B", AckPolicy: AckExplicit, FilterSubjects: []string{"wq.c", "wq.d"}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o2.delete()
+}
+
+func TestJetStreamConsumerBackOff(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	delivery := nats.NewInbox()
+
+	// Bad configs.
+	for _, cfg := range []*ConsumerConfig{
+		{DeliverSubject: delivery, AckPolicy: AckNone, BackOff: []time.Duration{time.Second}},
+		{DeliverSubject: delivery, AckPolicy: AckExplicit, BackOff: []time.Duration{time.Second, 0}},
+		{DeliverSubject: delivery, AckPolicy: AckExplicit, MaxDeliver: 1, BackOff: []time.Duration{time.Second, 2 * time.Second}},
+		{DeliverSubject: delivery, AckPolicy: AckExplicit, AckWait: time.Hour, BackOff: []time.Duration{time.Second}},
+	} {
+		if _, err := mset.addConsumer(cfg); err == nil {
+			t.Fatalf("Expected an error for backoff config %+v", cfg)
+		}
+	}
+
+	sub, _ := nc.SubscribeSync(delivery)
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	o, err := mset.addConsumer(&ConsumerConfig{
+		Durable:        "d",
+		DeliverSubject: delivery,
+		AckPolicy:      AckExplicit,
+		MaxDeliver:     3,
+		BackOff:        []time.Duration{100 * time.Millisecond, 400 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.delete()
+
+	// The first backoff value is the ack wait.
+	if cfg := o.config(); cfg.AckWait != 100*time.Millisecond {
+		t.Fatalf("Expected ack wait to be the first backoff value, got %v", cfg.AckWait)
+	}
+
+	sendStreamMsg(t, nc, "foo", "Hello World!")
+
+	var last time.Time
+	for i, expected := range []time.Duration{0, 100 * time.Millisecond, 400 * time.Millisecond} {
+		if _, err := sub.NextMsg(time.Second); err != nil {
+			t.Fatalf("Unexpected error on delivery %d: %v", i+1, err)
+		}
+		now := time.Now()
+		if i > 0 {
+			if elapsed := now.Sub(last); elapsed < expected || elapsed > expected+200*time.Millisecond {
+				t.Fatalf("Expected delivery %d after %v, got %v", i+1, expected, elapsed)
+			}
+		}
+		last = now
+	}
+	// Should not see it again since we hit max deliver.
+	if m, err := sub.NextMsg(600 * time.Millisecond); err == nil {
+		t.Fatalf("Expected no more deliveries, got %+v", m)
+	}
+}
+
+func TestJetStreamNakDelayAndTermReason(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	sendStreamMsg(t, nc, "foo", "1")
+	sendStreamMsg(t, nc, "foo", "2")
+
+	o, err := mset.addConsumer(&ConsumerConfig{Durable: "d", AckPolicy: AckExplicit, AckWait: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.delete()
+
+	getMsg := func(sseq, dseq int) *nats.Msg {
+		t.Helper()
+		m, err := nc.Request(o.requestNextMsgSubject(), nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		rsseq, rdseq, _, _, _ := replyInfo(m.Reply)
+		if rsseq != uint64(sseq) || rdseq != uint64(dseq) {
+			t.Fatalf("Expected sequences of %d and %d, got %d and %d", sseq, dseq, rsseq, rdseq)
+		}
+		return m
+	}
+
+	m := getMsg(1, 1)
+	m.Respond([]byte(`-NAK {"delay": "250ms"}`))
+	nakd := time.Now()
+	getMsg(2, 2).Respond(AckAck)
+
+	// Should not be redelivered until the delay has passed.
+	if m, err := nc.Request(o.requestNextMsgSubject(), nil, 100*time.Millisecond); err == nil {
+		t.Fatalf("Expected no redelivery before the delay, got %q", m.Reply)
+	}
+	m = getMsg(1, 3)
+	if elapsed := time.Since(nakd); elapsed < 250*time.Millisecond {
+		t.Fatalf("Expected redelivery after the delay, got %v", elapsed)
+	}
+
+	// Durations in nanoseconds work as well.
+	m.Respond([]byte(fmt.Sprintf(`-NAK {"delay": %d}`, 100*time.Millisecond)))
+	nakd = time.Now()
+	m = getMsg(1, 4)
+	if elapsed := time.Since(nakd); elapsed < 100*time.Millisecond {
+		t.Fatalf("Expected redelivery after the delay, got %v", elapsed)
+	}
+
+	// Terminate with a reason.
+	sub, _ := nc.SubscribeSync(JSAdvisoryConsumerMsgTerminatedPre + ".>")
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	m.Respond([]byte("+TERM invalid payload"))
+	am, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var adv JSConsumerDeliveryTerminatedAdvisory
+	json.Unmarshal(am.Data, &adv)
+	if adv.StreamSeq != 1 || adv.Deliveries != 3 || adv.Reason != "invalid payload" {
+		t.Fatalf("Unexpected advisory: %+v", adv)
+	}
+	if info := o.info(); info.NumAckPending != 0 {
+		t.Fatalf("Expected no pending acks, got %d", info.NumAckPending)
+	}
+}
+
+func TestJetStreamPullMaxBytesAndIdleHeartbeats(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	// Each message is 103 bytes for max bytes, subject and payload.
+	payload := strings.Repeat("Z", 100)
+	for i := 0; i < 6; i++ {
+		sendStreamMsg(t, nc, "foo", payload)
+	}
+
+	o, err := mset.addConsumer(&ConsumerConfig{Durable: "d", AckPolicy: AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.delete()
+
+	inbox := nats.NewInbox()
+	sub, _ := nc.SubscribeSync(inbox)
+	defer sub.Unsubscribe()
+
+	pull := func(req string) {
+		t.Helper()
+		if err := nc.PublishRequest(o.requestNextMsgSubject(), inbox, []byte(req)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	expectMsg := func(sseq uint64) {
+		t.Helper()
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if rsseq, _, _, _, _ := replyInfo(m.Reply); rsseq != sseq {
+			t.Fatalf("Expected stream sequence %d, got %d, %+v", sseq, rsseq, m.Header)
+		}
+		m.Respond(nil)
+	}
+	expectStatus := func(status string) {
+		t.Helper()
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if m.Header.Get("Status") != status {
+			t.Fatalf("Expected a %s status code, got %q", status, m.Header.Get("Status"))
+		}
+	}
+
+	// Bad requests.
+	pull(`{"batch": 1, "max_bytes": -1}`)
+	expectStatus("400")
+	pull(fmt.Sprintf(`{"batch": 1, "expires": %d, "idle_heartbeat": %d}`, time.Second, time.Second))
+	expectStatus("400")
+
+	// Fits 3 messages, but not the 4th.
+	pull(`{"batch": 10, "max_bytes": 350}`)
+	expectMsg(1)
+	expectMsg(2)
+	expectMsg(3)
+	expectStatus("409")
+
+	// The first message does not fit.
+	pull(`{"batch": 10, "max_bytes": 50}`)
+	expectStatus("409")
+
+	// Exactly 2 messages.
+	pull(`{"batch": 10, "max_bytes": 206}`)
+	expectMsg(4)
+	expectMsg(5)
+	expectStatus("409")
+
+	// Not ended early if we get the whole batch.
+	pull(`{"batch": 1, "max_bytes": 103}`)
+	expectMsg(6)
+	if m, err := sub.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Expected no status, got %+v", m.Header)
+	}
+
+	// Now make sure this works when the request is waiting for messages.
+	pull(fmt.Sprintf(`{"batch": 10, "max_bytes": 250, "expires": %d}`, 5*time.Second))
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if n := o.info().NumWaiting; n != 1 {
+			return fmt.Errorf("Expected a waiting request, got %d", n)
+		}
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		sendStreamMsg(t, nc, "foo", payload)
+	}
+	expectMsg(7)
+	expectMsg(8)
+	expectStatus("409")
+	pull(`{"batch": 1}`)
+	expectMsg(9)
+
+	// Idle heartbeats while we wait.
+	pull(fmt.Sprintf(`{"batch": 1, "expires": %d, "idle_heartbeat": %d}`, 2*time.Second, 200*time.Millisecond))
+	start := time.Now()
+	expectStatus("100")
+	expectStatus("100")
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Unexpected time for heartbeats: %v", elapsed)
+	}
+	sendStreamMsg(t, nc, "foo", payload)
+	expectMsg(10)
+	// No more heartbeats once the request is done.
+	if m, err := sub.NextMsg(500 * time.Millisecond); err == nil {
+		t.Fatalf("Expected no more heartbeats, got %+v", m.Header)
+	}
+}
+
+func TestJetStreamPullMaxRequestLimits(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	// Bad configs.
+	for _, cfg := range []*ConsumerConfig{
+		{DeliverSubject: "d", MaxRequestBatch: 10},
+		{Durable: "d", AckPolicy: AckExplicit, MaxRequestBatch: -1},
+		{Durable: "d", AckPolicy: AckExplicit, MaxRequestExpires: time.Microsecond},
+		{Durable: "d", AckPolicy: AckExplicit, MaxRequestMaxBytes: -1},
+	} {
+		if _, err := mset.addConsumer(cfg); err == nil {
+			t.Fatalf("Expected an error for config %+v", cfg)
+		}
+	}
+
+	o, err := mset.addConsumer(&ConsumerConfig{
+		Durable:            "d",
+		AckPolicy:          AckExplicit,
+		MaxRequestBatch:    5,
+		MaxRequestExpires:  250 * time.Millisecond,
+		MaxRequestMaxBytes: 250,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.delete()
+
+	// The limits should be shown in the consumer info.
+	if cfg := o.info().Config; cfg.MaxRequestBatch != 5 || cfg.MaxRequestExpires != 250*time.Millisecond || cfg.MaxRequestMaxBytes != 250 {
+		t.Fatalf("Expected limits in consumer info, got %+v", cfg)
+	}
+
+	inbox := nats.NewInbox()
+	sub, _ := nc.SubscribeSync(inbox)
+	defer sub.Unsubscribe()
+
+	pull := func(req string) {
+		t.Helper()
+		if err := nc.PublishRequest(o.requestNextMsgSubject(), inbox, []byte(req)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	expectStatus := func(status, description string) {
+		t.Helper()
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if m.Header.Get("Status") != status || m.Header.Get("Description") != description {
+			t.Fatalf("Expected %s %q, got %+v", status, description, m.Header)
+		}
+	}
+
+	pull(`{"batch": 10}`)
+	expectStatus("409", "Exceeded MaxRequestBatch of 5")
+	pull(fmt.Sprintf(`{"batch": 1, "expires": %d}`, time.Second))
+	expectStatus("409", "Exceeded MaxRequestExpires of 250ms")
+	pull(`{"batch": 1, "max_bytes": 1024}`)
+	expectStatus("409", "Exceeded MaxRequestMaxBytes of 250")
+
+	// A request without an expiration gets the max.
+	pull(`{"batch": 1}`)
+	expectStatus("408", "Request Timeout")
+
+	// A request without max bytes gets the max, so only 2 of these fit.
+	payload := strings.Repeat("Z", 100)
+	for i := 0; i < 3; i++ {
+		sendStreamMsg(t, nc, "foo", payload)
+	}
+	pull(`{"batch": 5, "no_wait": true}`)
+	for i := 0; i < 2; i++ {
+		if m, err := sub.NextMsg(time.Second); err != nil || len(m.Data) != 100 {
+			t.Fatalf("Expected a message, got %v", err)
+		}
+	}
+	expectStatus("409", "Exceeded MaxBytes")
+
+	// The limits can be updated.
+	cfg := o.config()
+	cfg.MaxRequestBatch = 20
+	if _, err := mset.addConsumer(&cfg); err != nil {
+		t.Fatalf("Unexpected error updating consumer: %v", err)
+	}
+	pull(`{"batch": 10, "no_wait": true}`)
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Expected a message, got %v", err)
+	}
+}
+
+func TestJetStreamPullExpiredBatchRequest(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.delete()
+
+	o, err := mset.addConsumer(&ConsumerConfig{Durable: "d", AckPolicy: AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	inbox := nats.NewInbox()
+	sub, _ := nc.SubscribeSync(inbox)
+	defer sub.Unsubscribe()
+
+	// Expiring a request should remove it entirely, not just one of its batch.
+	req := fmt.Sprintf(`{"batch": 10, "expires": %d}`, 100*time.Millisecond)
+	if err := nc.PublishRequest(o.requestNextMsgSubject(), inbox, []byte(req)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.Header.Get("Status") != "408" {
+		t.Fatalf("Expected a 408 status, got %+v", m.Header)
+	}
+	if m, err := sub.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Expected only one timeout status, got %+v", m.Header)
+	}
+
+	// Nothing should be delivered to the expired request.
+	sendStreamMsg(t, nc, "foo", "Hello")
+	if _, err := sub.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Expected no message for the expired request")
+	}
+}
+
 ///////////////////////////////////////////////////////////////////////////
 // Simple JetStream Benchmarks
 ///////////////////////////////////////////////////////////////////////////
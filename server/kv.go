@@ -0,0 +1,401 @@
+// Copyright 2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyValueConfig is the configuration for a key value bucket.
+type KeyValueConfig struct {
+	Bucket       string        `json:"bucket"`
+	History      int64         `json:"history,omitempty"`
+	TTL          time.Duration `json:"ttl,omitempty"`
+	MaxValueSize int32         `json:"max_value_size,omitempty"`
+	MaxBytes     int64         `json:"max_bytes,omitempty"`
+	Storage      StorageType   `json:"storage,omitempty"`
+	Replicas     int           `json:"num_replicas,omitempty"`
+}
+
+// KeyValueOp is the operation that produced a key value entry.
+type KeyValueOp string
+
+const (
+	KeyValuePut   KeyValueOp = "PUT"
+	KeyValueDel   KeyValueOp = "DEL"
+	KeyValuePurge KeyValueOp = "PURGE"
+)
+
+// KeyValueEntry is a single revision of a key.
+type KeyValueEntry struct {
+	Bucket    string     `json:"bucket"`
+	Key       string     `json:"key"`
+	Value     []byte     `json:"value,omitempty"`
+	Revision  uint64     `json:"revision"`
+	Created   time.Time  `json:"created"`
+	Operation KeyValueOp `json:"operation"`
+}
+
+const (
+	// KeyValueOperationHdr is the header used to mark deletes and purges.
+	KeyValueOperationHdr = "KV-Operation"
+
+	// Buckets are streams with this name prefix.
+	kvBucketNamePre = "KV_"
+	// Keys are subjects with this prefix followed by the bucket name.
+	kvSubjectsPreTmpl = "$KV.%s."
+
+	// Maximum number of revisions kept per key.
+	kvMaxHistory = 64
+)
+
+var (
+	// ErrKeyValueInvalidBucket is returned when the bucket name is not valid.
+	ErrKeyValueInvalidBucket = errors.New("invalid bucket name")
+	// ErrKeyValueInvalidKey is returned when a key is not valid.
+	ErrKeyValueInvalidKey = errors.New("invalid key")
+	// ErrKeyValueKeyNotFound is returned when a key does not exist or was deleted.
+	ErrKeyValueKeyNotFound = errors.New("key not found")
+	// ErrKeyValueHistoryTooLarge is returned when the history exceeds what we allow.
+	ErrKeyValueHistoryTooLarge = fmt.Errorf("history limited to a max of %d", kvMaxHistory)
+)
+
+var (
+	validBucketRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	validKeyRe    = regexp.MustCompile(`^[-/_=\.a-zA-Z0-9]+$`)
+)
+
+// KeyValue is a server side handle to a key value bucket.
+// A bucket is backed by a stream and all operations go through the stream subjects
+// and the JetStream API, so they behave the same for clustered and single server setups.
+type KeyValue struct {
+	name   string
+	stream string
+	pre    string
+	ic     *jsInternalClient
+}
+
+// CreateKeyValue will create a key value bucket, or bind to it if it already exists with the same config.
+func (a *Account) CreateKeyValue(cfg *KeyValueConfig) (*KeyValue, error) {
+	if cfg == nil || !validBucketRe.MatchString(cfg.Bucket) {
+		return nil, ErrKeyValueInvalidBucket
+	}
+	if cfg.History > kvMaxHistory {
+		return nil, ErrKeyValueHistoryTooLarge
+	}
+	kv, err := a.newKeyValue(cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	history, storage := cfg.History, cfg.Storage
+	if history < 1 {
+		history = 1
+	}
+	if storage == 0 {
+		storage = FileStorage
+	}
+	scfg := &StreamConfig{
+		Name:        kv.stream,
+		Subjects:    []string{kv.pre + ">"},
+		MaxMsgsPer:  history,
+		MaxBytes:    cfg.MaxBytes,
+		MaxAge:      cfg.TTL,
+		MaxMsgSize:  cfg.MaxValueSize,
+		Storage:     storage,
+		Replicas:    cfg.Replicas,
+		Discard:     DiscardNew,
+		AllowRollup: true,
+	}
+	req, err := json.Marshal(scfg)
+	if err != nil {
+		return nil, err
+	}
+	var resp JSApiStreamCreateResponse
+	if err := kv.ic.apiRequest(fmt.Sprintf(JSApiStreamCreateT, kv.stream), req, &resp); err != nil {
+		return nil, err
+	}
+	if err := convertApiErrorToError(resp.Error); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+// KeyValue will bind to an existing key value bucket.
+func (a *Account) KeyValue(bucket string) (*KeyValue, error) {
+	if !validBucketRe.MatchString(bucket) {
+		return nil, ErrKeyValueInvalidBucket
+	}
+	kv, err := a.newKeyValue(bucket)
+	if err != nil {
+		return nil, err
+	}
+	var resp JSApiStreamInfoResponse
+	if err := kv.ic.apiRequest(fmt.Sprintf(JSApiStreamInfoT, kv.stream), nil, &resp); err != nil {
+		return nil, err
+	}
+	if err := convertApiErrorToError(resp.Error); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+// DeleteKeyValue will delete the key value bucket and all of its data.
+func (a *Account) DeleteKeyValue(bucket string) error {
+	if !validBucketRe.MatchString(bucket) {
+		return ErrKeyValueInvalidBucket
+	}
+	kv, err := a.newKeyValue(bucket)
+	if err != nil {
+		return err
+	}
+	var resp JSApiStreamDeleteResponse
+	if err := kv.ic.apiRequest(fmt.Sprintf(JSApiStreamDeleteT, kv.stream), nil, &resp); err != nil {
+		return err
+	}
+	return convertApiErrorToError(resp.Error)
+}
+
+func (a *Account) newKeyValue(bucket string) (*KeyValue, error) {
+	ic, err := a.newJSInternalClient()
+	if err != nil {
+		return nil, err
+	}
+	return &KeyValue{
+		name:   bucket,
+		stream: kvBucketNamePre + bucket,
+		pre:    fmt.Sprintf(kvSubjectsPreTmpl, bucket),
+		ic:     ic,
+	}, nil
+}
+
+// Bucket returns the name of the bucket.
+func (kv *KeyValue) Bucket() string {
+	return kv.name
+}
+
+// Get returns the latest value for the key.
+func (kv *KeyValue) Get(key string) (*KeyValueEntry, error) {
+	e, err := kv.last(key)
+	if err != nil {
+		return nil, err
+	}
+	if e.Operation != KeyValuePut {
+		return nil, ErrKeyValueKeyNotFound
+	}
+	return e, nil
+}
+
+// GetRevision returns a specific revision of the key.
+func (kv *KeyValue) GetRevision(key string, revision uint64) (*KeyValueEntry, error) {
+	if !validKey(key) {
+		return nil, ErrKeyValueInvalidKey
+	}
+	e, err := kv.load(&JSApiMsgGetRequest{Seq: revision})
+	if err != nil {
+		return nil, err
+	}
+	if e.Key != key {
+		return nil, ErrKeyValueKeyNotFound
+	}
+	return e, nil
+}
+
+// Put will place the new value for the key into the bucket and return its revision.
+func (kv *KeyValue) Put(key string, value []byte) (uint64, error) {
+	if !validKey(key) {
+		return 0, ErrKeyValueInvalidKey
+	}
+	return kv.ic.storeMsg(kv.pre+key, nil, value)
+}
+
+// Create will put the value only if the key does not exist or was deleted.
+func (kv *KeyValue) Create(key string, value []byte) (uint64, error) {
+	rev, err := kv.Update(key, value, 0)
+	if err == nil {
+		return rev, nil
+	}
+	// We allow creates on top of delete and purge markers.
+	if e, lerr := kv.last(key); lerr == nil && e.Operation != KeyValuePut {
+		return kv.Update(key, value, e.Revision)
+	}
+	return 0, err
+}
+
+// Update will put the value only if the latest revision for the key matches last.
+func (kv *KeyValue) Update(key string, value []byte, last uint64) (uint64, error) {
+	if !validKey(key) {
+		return 0, ErrKeyValueInvalidKey
+	}
+	hdr := genHeader(nil, JSExpectedLastSubjSeq, strconv.FormatUint(last, 10))
+	return kv.ic.storeMsg(kv.pre+key, hdr, value)
+}
+
+// Delete will place a delete marker for the key, leaving the history intact.
+func (kv *KeyValue) Delete(key string) error {
+	if !validKey(key) {
+		return ErrKeyValueInvalidKey
+	}
+	hdr := genHeader(nil, KeyValueOperationHdr, string(KeyValueDel))
+	_, err := kv.ic.storeMsg(kv.pre+key, hdr, nil)
+	return err
+}
+
+// Purge will place a purge marker for the key and remove all prior revisions.
+func (kv *KeyValue) Purge(key string) error {
+	if !validKey(key) {
+		return ErrKeyValueInvalidKey
+	}
+	hdr := genHeader(nil, KeyValueOperationHdr, string(KeyValuePurge))
+	hdr = genHeader(hdr, JSMsgRollup, JSMsgRollupSubject)
+	_, err := kv.ic.storeMsg(kv.pre+key, hdr, nil)
+	return err
+}
+
+// History returns all of the retained revisions for the key, oldest first.
+func (kv *KeyValue) History(key string) ([]*KeyValueEntry, error) {
+	if !validKey(key) {
+		return nil, ErrKeyValueInvalidKey
+	}
+	w, err := kv.watch(key, true)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	pending := w.o.numPending()
+	if pending == 0 {
+		return nil, ErrKeyValueKeyNotFound
+	}
+	var entries []*KeyValueEntry
+	timeout := time.NewTimer(jsInternalRequestTimeout)
+	defer timeout.Stop()
+	for uint64(len(entries)) < pending {
+		select {
+		case e := <-w.updates:
+			entries = append(entries, e)
+		case <-timeout.C:
+			return nil, fmt.Errorf("timeout waiting for history of %q", key)
+		}
+	}
+	return entries, nil
+}
+
+// Watch will watch for updates to keys, which can contain wildcards.
+// If includeHistory is set all retained revisions will be delivered first.
+func (kv *KeyValue) Watch(keys string, includeHistory bool) (*KeyValueWatcher, error) {
+	if !IsValidSubject(kv.pre + keys) {
+		return nil, ErrKeyValueInvalidKey
+	}
+	return kv.watch(keys, includeHistory)
+}
+
+// Returns the last entry for the key including delete and purge markers.
+func (kv *KeyValue) last(key string) (*KeyValueEntry, error) {
+	if !validKey(key) {
+		return nil, ErrKeyValueInvalidKey
+	}
+	return kv.load(&JSApiMsgGetRequest{LastFor: kv.pre + key})
+}
+
+// Load a message from the underlying stream and convert to an entry.
+func (kv *KeyValue) load(mreq *JSApiMsgGetRequest) (*KeyValueEntry, error) {
+	sm, apiErr, err := kv.ic.loadMsg(kv.stream, mreq)
+	if err != nil {
+		return nil, err
+	}
+	if apiErr != nil {
+		if apiErr.Code == 404 {
+			return nil, ErrKeyValueKeyNotFound
+		}
+		return nil, convertApiErrorToError(apiErr)
+	}
+	if sm == nil || !strings.HasPrefix(sm.Subject, kv.pre) {
+		return nil, ErrKeyValueKeyNotFound
+	}
+	return kv.newEntry(sm.Subject, sm.Header, sm.Data, sm.Sequence, sm.Time), nil
+}
+
+func (kv *KeyValue) newEntry(subject string, hdr, msg []byte, seq uint64, ts time.Time) *KeyValueEntry {
+	op := KeyValuePut
+	if len(hdr) > 0 {
+		if v := getHeader(KeyValueOperationHdr, hdr); len(v) > 0 {
+			op = KeyValueOp(v)
+		}
+	}
+	return &KeyValueEntry{
+		Bucket:    kv.name,
+		Key:       strings.TrimPrefix(subject, kv.pre),
+		Value:     msg,
+		Revision:  seq,
+		Created:   ts,
+		Operation: op,
+	}
+}
+
+// KeyValueWatcher delivers entries for watched keys in revision order.
+type KeyValueWatcher struct {
+	o       *jsInternalConsumer
+	updates chan *KeyValueEntry
+}
+
+// Updates returns the channel entries will be delivered on.
+func (w *KeyValueWatcher) Updates() <-chan *KeyValueEntry {
+	return w.updates
+}
+
+// Stop will stop the watcher and remove the underlying consumer.
+func (w *KeyValueWatcher) Stop() error {
+	return w.o.stop()
+}
+
+// Create a watcher that is backed by an ephemeral push consumer.
+func (kv *KeyValue) watch(keys string, includeHistory bool) (*KeyValueWatcher, error) {
+	w := &KeyValueWatcher{updates: make(chan *KeyValueEntry, 256)}
+	dp := DeliverNew
+	if includeHistory {
+		dp = DeliverAll
+	}
+	cfg := ConsumerConfig{
+		DeliverPolicy: dp,
+		AckPolicy:     AckNone,
+		FilterSubject: kv.pre + keys,
+	}
+	o, err := kv.ic.createConsumer(kv.stream, cfg, func(m *jsInternalMsg, qch chan struct{}) {
+		sseq, _, _, ts, _ := replyInfo(m.reply)
+		select {
+		case w.updates <- kv.newEntry(m.subj, m.hdr, m.msg, sseq, time.Unix(0, ts).UTC()):
+		case <-qch:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.o = o
+	return w, nil
+}
+
+// Keys are tokens in a subject so they follow the same rules minus wildcards.
+func validKey(key string) bool {
+	if len(key) == 0 || key[0] == '.' || key[len(key)-1] == '.' {
+		return false
+	}
+	return validKeyRe.MatchString(key)
+}
@@ -0,0 +1,274 @@
+// Copyright 2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKeyValueBasics(t *testing.T) {
+	cases := []struct {
+		name    string
+		storage StorageType
+	}{
+		{"MemoryStore", MemoryStorage},
+		{"FileStore", FileStorage},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			acc := s.GlobalAccount()
+			if _, err := acc.CreateKeyValue(&KeyValueConfig{Bucket: "bad.name"}); err != ErrKeyValueInvalidBucket {
+				t.Fatalf("Expected an invalid bucket error, got %v", err)
+			}
+			if _, err := acc.CreateKeyValue(&KeyValueConfig{Bucket: "TEST", History: 100}); err != ErrKeyValueHistoryTooLarge {
+				t.Fatalf("Expected a history too large error, got %v", err)
+			}
+
+			kv, err := acc.CreateKeyValue(&KeyValueConfig{Bucket: "TEST", History: 5, Storage: c.storage})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			mset, err := acc.lookupStream("KV_TEST")
+			if err != nil {
+				t.Fatalf("Expected the backing stream to exist: %v", err)
+			}
+			if cfg := mset.config(); cfg.MaxMsgsPer != 5 || len(cfg.Subjects) != 1 || cfg.Subjects[0] != "$KV.TEST.>" {
+				t.Fatalf("Unexpected stream config: %+v", cfg)
+			}
+
+			if _, err := kv.Put("bad key", []byte("x")); err != ErrKeyValueInvalidKey {
+				t.Fatalf("Expected an invalid key error, got %v", err)
+			}
+			if _, err := kv.Get("name"); err != ErrKeyValueKeyNotFound {
+				t.Fatalf("Expected a not found error, got %v", err)
+			}
+
+			rev, err := kv.Put("name", []byte("derek"))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if rev != 1 {
+				t.Fatalf("Expected revision of 1, got %d", rev)
+			}
+			kv.Put("age", []byte("22"))
+			if rev, _ = kv.Put("name", []byte("ivan")); rev != 3 {
+				t.Fatalf("Expected revision of 3, got %d", rev)
+			}
+
+			e, err := kv.Get("name")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(e.Value) != "ivan" || e.Revision != 3 || e.Operation != KeyValuePut {
+				t.Fatalf("Unexpected entry: %+v", e)
+			}
+			if e, err = kv.GetRevision("name", 1); err != nil || string(e.Value) != "derek" {
+				t.Fatalf("Expected first revision, got %+v, %v", e, err)
+			}
+			if _, err = kv.GetRevision("name", 2); err != ErrKeyValueKeyNotFound {
+				t.Fatalf("Expected a not found error for a revision of another key, got %v", err)
+			}
+
+			// Compare and set.
+			if _, err := kv.Update("name", []byte("bad"), 1); err == nil {
+				t.Fatalf("Expected an error with the wrong last revision")
+			}
+			if rev, err = kv.Update("name", []byte("waldemar"), 3); err != nil || rev != 4 {
+				t.Fatalf("Expected revision 4, got %d, %v", rev, err)
+			}
+			if _, err := kv.Create("name", []byte("bad")); err == nil {
+				t.Fatalf("Expected an error creating an existing key")
+			}
+			if rev, err = kv.Create("color", []byte("blue")); err != nil || rev != 5 {
+				t.Fatalf("Expected revision 5, got %d, %v", rev, err)
+			}
+
+			// Deletes keep history but hide the key.
+			if err := kv.Delete("color"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := kv.Get("color"); err != ErrKeyValueKeyNotFound {
+				t.Fatalf("Expected a not found error, got %v", err)
+			}
+			// Can create on top of a delete.
+			if rev, err = kv.Create("color", []byte("red")); err != nil || rev != 7 {
+				t.Fatalf("Expected revision 7, got %d, %v", rev, err)
+			}
+
+			hist, err := kv.History("name")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(hist) != 3 {
+				t.Fatalf("Expected 3 revisions, got %d", len(hist))
+			}
+			for i, v := range []string{"derek", "ivan", "waldemar"} {
+				if string(hist[i].Value) != v {
+					t.Fatalf("Expected %q at %d, got %q", v, i, hist[i].Value)
+				}
+			}
+
+			// History is bounded.
+			for i := 0; i < 10; i++ {
+				kv.Put("age", []byte("33"))
+			}
+			if hist, _ = kv.History("age"); len(hist) != 5 {
+				t.Fatalf("Expected 5 revisions, got %d", len(hist))
+			}
+
+			// Purge leaves only the purge marker.
+			if err := kv.Purge("age"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if hist, _ = kv.History("age"); len(hist) != 1 || hist[0].Operation != KeyValuePurge {
+				t.Fatalf("Expected only a purge marker, got %+v", hist)
+			}
+
+			// Bind to the bucket with a new handle.
+			kv2, err := acc.KeyValue("TEST")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if e, err = kv2.Get("color"); err != nil || string(e.Value) != "red" {
+				t.Fatalf("Expected red, got %+v, %v", e, err)
+			}
+			if _, err := acc.KeyValue("MISSING"); err == nil {
+				t.Fatalf("Expected an error binding to a missing bucket")
+			}
+
+			if err := acc.DeleteKeyValue("TEST"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := acc.lookupStream("KV_TEST"); err == nil {
+				t.Fatalf("Expected the backing stream to be removed")
+			}
+		})
+	}
+}
+
+func TestKeyValueWatch(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	kv, err := s.GlobalAccount().CreateKeyValue(&KeyValueConfig{Bucket: "WATCH", History: 10})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	kv.Put("t.22", []byte("old"))
+
+	w, err := kv.Watch("t.*", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer w.Stop()
+
+	expectUpdate := func(key, value string, op KeyValueOp) {
+		t.Helper()
+		select {
+		case e := <-w.Updates():
+			if e.Key != key || string(e.Value) != value || e.Operation != op {
+				t.Fatalf("Unexpected entry: %+v", e)
+			}
+			if e.Revision == 0 || e.Created.IsZero() {
+				t.Fatalf("Expected revision and created time to be set: %+v", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not receive an update for %q", key)
+		}
+	}
+
+	kv.Put("t.22", []byte("new"))
+	kv.Put("x.1", []byte("ignored"))
+	kv.Put("t.33", []byte("hello"))
+	kv.Delete("t.22")
+
+	expectUpdate("t.22", "new", KeyValuePut)
+	expectUpdate("t.33", "hello", KeyValuePut)
+	expectUpdate("t.22", "", KeyValueDel)
+
+	// With history we get everything that was retained.
+	hw, err := kv.Watch(">", true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-hw.Updates():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not receive all historical updates")
+		}
+	}
+	if err := hw.Stop(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mset, err := s.GlobalAccount().lookupStream("KV_WATCH")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := mset.numConsumers(); n != 1 {
+		t.Fatalf("Expected the stopped watcher's consumer to be removed, got %d consumers", n)
+	}
+}
+
+func TestKeyValueClustered(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	kv, err := c.randomServer().GlobalAccount().CreateKeyValue(&KeyValueConfig{Bucket: "CFG", History: 2, Replicas: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c.waitOnStreamLeader("$G", "KV_CFG")
+
+	for i := 0; i < 5; i++ {
+		if _, err := kv.Put("key", []byte("value")); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if _, err := kv.Update("key", []byte("bad"), 4); err == nil {
+		t.Fatalf("Expected an error with the wrong last revision")
+	}
+	if rev, err := kv.Update("key", []byte("good"), 5); err != nil || rev != 6 {
+		t.Fatalf("Expected revision 6, got %d, %v", rev, err)
+	}
+
+	// Access through a non-leader and make sure we see the same state.
+	kv2, err := c.randomNonStreamLeader("$G", "KV_CFG").GlobalAccount().KeyValue("CFG")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	e, err := kv2.Get("key")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(e.Value) != "good" || e.Revision != 6 {
+		t.Fatalf("Unexpected entry: %+v", e)
+	}
+	if hist, err := kv2.History("key"); err != nil || len(hist) != 2 {
+		t.Fatalf("Expected 2 revisions, got %d, %v", len(hist), err)
+	}
+}
@@ -27,9 +27,11 @@ type memStore struct {
 	cfg       StreamConfig
 	state     StreamState
 	msgs      map[uint64]*storedMsg
+	fss       map[string]*SimpleState
 	dmap      map[uint64]struct{}
 	scb       StorageUpdateHandler
 	ageChk    *time.Timer
+	ttls      msgTTLIndex
 	consumers int
 }
 
@@ -48,7 +50,13 @@ func newMemStore(cfg *StreamConfig) (*memStore, error) {
 	if cfg.Storage != MemoryStorage {
 		return nil, fmt.Errorf("memStore requires memory storage type in config")
 	}
-	return &memStore{msgs: make(map[uint64]*storedMsg), dmap: make(map[uint64]struct{}), cfg: *cfg}, nil
+	ms := &memStore{
+		msgs: make(map[uint64]*storedMsg),
+		fss:  make(map[string]*SimpleState),
+		dmap: make(map[uint64]struct{}),
+		cfg:  *cfg,
+	}
+	return ms, nil
 }
 
 func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
@@ -64,17 +72,19 @@ func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
 	// Limits checks and enforcement.
 	ms.enforceMsgLimit()
 	ms.enforceBytesLimit()
+	ms.enforcePerSubjectLimits()
 	// Do age timers.
 	if ms.ageChk == nil && ms.cfg.MaxAge != 0 {
 		ms.startAgeChk()
 	}
-	if ms.ageChk != nil && ms.cfg.MaxAge == 0 {
+	if ms.ageChk != nil && ((ms.cfg.MaxAge == 0 && ms.ttls.Len() == 0) || ms.cfg.Sealed) {
 		ms.ageChk.Stop()
 		ms.ageChk = nil
 	}
+	hasTTLs := ms.ttls.Len() > 0
 	ms.mu.Unlock()
 
-	if cfg.MaxAge != 0 {
+	if cfg.MaxAge != 0 || hasTTLs {
 		ms.expireMsgs()
 	}
 	return nil
@@ -83,6 +93,16 @@ func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
 // Stores a raw message with expected sequence number and timestamp.
 // Lock should be held.
 func (ms *memStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error {
+	if err := ms.addMsg(subj, hdr, msg, seq, ts); err != nil {
+		return err
+	}
+	ms.enforceLimits(subj)
+	return nil
+}
+
+// Adds a raw message with expected sequence number and timestamp, without enforcing our limits.
+// Lock should be held.
+func (ms *memStore) addMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error {
 	if ms.msgs == nil {
 		return ErrStoreClosed
 	}
@@ -126,18 +146,43 @@ func (ms *memStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts int
 	ms.state.LastSeq = seq
 	ms.state.LastTime = now
 
-	// Limits checks and enforcement.
-	ms.enforceMsgLimit()
-	ms.enforceBytesLimit()
+	// Track per subject.
+	if len(subj) > 0 {
+		if ss := ms.fss[subj]; ss != nil {
+			ss.Msgs++
+			ss.Last = seq
+		} else {
+			ms.fss[subj] = &SimpleState{Msgs: 1, First: seq, Last: seq}
+		}
+	}
 
 	// Check if we have and need the age expiration timer running.
 	if ms.ageChk == nil && ms.cfg.MaxAge != 0 {
 		ms.startAgeChk()
 	}
 
+	// Track any per message TTL. If this is the next to expire make sure our timer reflects that.
+	if ms.cfg.AllowMsgTTL && len(hdr) > 0 {
+		if ttl, _ := getMessageTTL(hdr); ttl > 0 && ms.ttls.add(seq, ts+ttl) {
+			ms.resetAgeChk(time.Now().UnixNano())
+		}
+	}
+
 	return nil
 }
 
+// Enforce our limits after adding a message on subj.
+// Lock should be held.
+func (ms *memStore) enforceLimits(subj string) {
+	// Check per subject limits.
+	if ss := ms.fss[subj]; ss != nil && ms.cfg.MaxMsgsPer > 0 && ss.Msgs > uint64(ms.cfg.MaxMsgsPer) {
+		ms.enforcePerSubjectLimit(ss)
+	}
+	// Limits checks and enforcement.
+	ms.enforceMsgLimit()
+	ms.enforceBytesLimit()
+}
+
 // StoreRawMsg stores a raw message with expected sequence number and timestamp.
 func (ms *memStore) StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error {
 	ms.mu.Lock()
@@ -169,12 +214,110 @@ func (ms *memStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error
 	return seq, ts, err
 }
 
+// StoreMsgs stores a batch of messages as one unit, starting at seq with timestamp ts, or at the
+// next sequence with the current time if seq is zero. Either all of them are stored or none are.
+// Our limits are only enforced once all of them have been added, since that may release our lock.
+func (ms *memStore) StoreMsgs(batch []*BatchMsg, seq uint64, ts int64) (uint64, int64, error) {
+	ms.mu.Lock()
+	if ms.msgs == nil {
+		ms.mu.Unlock()
+		return 0, 0, ErrStoreClosed
+	}
+	if seq == 0 {
+		seq, ts = ms.state.LastSeq+1, time.Now().UnixNano()
+	} else if seq != ms.state.LastSeq+1 {
+		ms.mu.Unlock()
+		return 0, 0, ErrSequenceMismatch
+	}
+
+	// Check the whole batch if we are discarding new messages when we reach the limit.
+	if ms.cfg.Discard == DiscardNew {
+		msgs, bytes := ms.state.Msgs, ms.state.Bytes
+		for _, bm := range batch {
+			if bm.Skip {
+				continue
+			}
+			if ms.cfg.MaxMsgs > 0 && msgs >= uint64(ms.cfg.MaxMsgs) {
+				ms.mu.Unlock()
+				return 0, 0, ErrMaxMsgs
+			}
+			if ms.cfg.MaxBytes > 0 && bytes+uint64(len(bm.Msg)) >= uint64(ms.cfg.MaxBytes) {
+				ms.mu.Unlock()
+				return 0, 0, ErrMaxBytes
+			}
+			msgs, bytes = msgs+1, bytes+memStoreMsgSize(bm.Subject, bm.Hdr, bm.Msg)
+		}
+	}
+
+	now := time.Unix(0, ts).UTC()
+	for i, bm := range batch {
+		if bm.Skip {
+			ms.skipMsg(now)
+		} else {
+			// We checked everything that could fail above.
+			ms.addMsg(bm.Subject, bm.Hdr, bm.Msg, seq+uint64(i), ts)
+		}
+	}
+	for _, bm := range batch {
+		if !bm.Skip {
+			ms.enforceLimits(bm.Subject)
+		}
+	}
+	cb := ms.scb
+	ms.mu.Unlock()
+
+	if cb != nil {
+		for i, bm := range batch {
+			if !bm.Skip {
+				cb(1, int64(memStoreMsgSize(bm.Subject, bm.Hdr, bm.Msg)), seq+uint64(i), bm.Subject)
+			}
+		}
+	}
+	return seq, ts, nil
+}
+
 // SkipMsg will use the next sequence number but not store anything.
 func (ms *memStore) SkipMsg() uint64 {
 	// Grab time.
 	now := time.Now().UTC()
 
 	ms.mu.Lock()
+	seq := ms.skipMsg(now)
+	ms.mu.Unlock()
+	return seq
+}
+
+// SkipMsgs will use the next num sequences starting at seq but not store anything.
+// The seq has to be our next sequence.
+func (ms *memStore) SkipMsgs(seq uint64, num uint64) error {
+	// Grab time.
+	now := time.Now().UTC()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if seq != ms.state.LastSeq+1 {
+		return ErrSequenceMismatch
+	}
+	if num == 0 {
+		return nil
+	}
+	lseq := seq + num - 1
+	ms.state.LastSeq = lseq
+	ms.state.LastTime = now
+	if ms.state.Msgs == 0 {
+		ms.state.FirstSeq = lseq + 1
+		ms.state.FirstTime = now
+	} else {
+		for ; seq <= lseq; seq++ {
+			ms.dmap[seq] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// Lock should be held.
+func (ms *memStore) skipMsg(now time.Time) uint64 {
 	seq := ms.state.LastSeq + 1
 	ms.state.LastSeq = seq
 	ms.state.LastTime = now
@@ -183,7 +326,6 @@ func (ms *memStore) SkipMsg() uint64 {
 		ms.state.FirstTime = now
 	}
 	ms.updateFirstSeq(seq)
-	ms.mu.Unlock()
 	return seq
 }
 
@@ -244,41 +386,108 @@ func (ms *memStore) enforceBytesLimit() {
 	}
 }
 
-// Will start the age check timer.
+// Will check the per subject msg limit and drop the oldest msgs for that subject if needed.
+// Lock should be held.
+func (ms *memStore) enforcePerSubjectLimit(ss *SimpleState) {
+	if ms.cfg.MaxMsgsPer <= 0 {
+		return
+	}
+	for nmsgs := ss.Msgs; nmsgs > uint64(ms.cfg.MaxMsgsPer); nmsgs = ss.Msgs {
+		if !ms.removeMsg(ss.First, false) {
+			break
+		}
+	}
+}
+
+// Will check all subjects against the per subject msg limit.
+// Used when the limit is lowered or set on an existing stream.
+// Lock should be held.
+func (ms *memStore) enforcePerSubjectLimits() {
+	if ms.cfg.MaxMsgsPer <= 0 {
+		return
+	}
+	var over []*SimpleState
+	for _, ss := range ms.fss {
+		if ss.Msgs > uint64(ms.cfg.MaxMsgsPer) {
+			over = append(over, ss)
+		}
+	}
+	for _, ss := range over {
+		ms.enforcePerSubjectLimit(ss)
+	}
+}
+
+// Will start the age check timer. Sealed streams do not expire messages.
 // Lock should be held.
 func (ms *memStore) startAgeChk() {
-	if ms.ageChk == nil && ms.cfg.MaxAge != 0 {
+	if ms.ageChk == nil && ms.cfg.MaxAge != 0 && !ms.cfg.Sealed {
 		ms.ageChk = time.AfterFunc(ms.cfg.MaxAge, ms.expireMsgs)
 	}
 }
 
-// Will expire msgs that are too old.
+// Will reset the age check timer to fire for the next message to expire,
+// either from our max age or a per message TTL.
+// Lock should be held.
+func (ms *memStore) resetAgeChk(now int64) {
+	var next int64
+	if ms.cfg.MaxAge != 0 && ms.state.Msgs > 0 {
+		if sm, ok := ms.msgs[ms.state.FirstSeq]; ok {
+			next = sm.ts + int64(ms.cfg.MaxAge)
+		}
+	}
+	if seq, expires := ms.ttls.next(); seq > 0 && (next == 0 || expires < next) {
+		next = expires
+	}
+	if next == 0 || ms.cfg.Sealed {
+		if ms.ageChk != nil {
+			ms.ageChk.Stop()
+			ms.ageChk = nil
+		}
+		return
+	}
+	fireIn := time.Duration(next - now)
+	if ms.ageChk != nil {
+		ms.ageChk.Reset(fireIn)
+	} else {
+		ms.ageChk = time.AfterFunc(fireIn, ms.expireMsgs)
+	}
+}
+
+// Will expire msgs that are too old or have reached their TTL.
 func (ms *memStore) expireMsgs() {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
+	if ms.cfg.Sealed {
+		return
+	}
+
 	now := time.Now().UnixNano()
-	minAge := now - int64(ms.cfg.MaxAge)
-	for {
-		if sm, ok := ms.msgs[ms.state.FirstSeq]; ok && sm.ts <= minAge {
+	if ms.cfg.MaxAge != 0 {
+		minAge := now - int64(ms.cfg.MaxAge)
+		for {
+			sm, ok := ms.msgs[ms.state.FirstSeq]
+			if !ok || sm.ts > minAge {
+				break
+			}
 			ms.deleteFirstMsgOrPanic()
-		} else {
-			if !ok {
-				if ms.ageChk != nil {
-					ms.ageChk.Stop()
-					ms.ageChk = nil
-				}
-			} else {
-				fireIn := time.Duration(sm.ts-now) + ms.cfg.MaxAge
-				if ms.ageChk != nil {
-					ms.ageChk.Reset(fireIn)
-				} else {
-					ms.ageChk = time.AfterFunc(fireIn, ms.expireMsgs)
-				}
+		}
+	}
+	// Per message TTLs are kept in expiration order.
+	for {
+		seq, expires := ms.ttls.next()
+		if seq == 0 || expires > now {
+			break
+		}
+		ms.ttls.remove()
+		// Make sure this is still the message that was indexed.
+		if sm, ok := ms.msgs[seq]; ok {
+			if ttl, _ := getMessageTTL(sm.hdr); sm.ts+ttl == expires {
+				ms.removeMsg(seq, false)
 			}
-			return
 		}
 	}
+	ms.resetAgeChk(now)
 }
 
 // Purge will remove all messages from this store.
@@ -293,7 +502,9 @@ func (ms *memStore) Purge() (uint64, error) {
 	ms.state.Bytes = 0
 	ms.state.Msgs = 0
 	ms.msgs = make(map[uint64]*storedMsg)
+	ms.fss = make(map[string]*SimpleState)
 	ms.dmap = make(map[uint64]struct{})
+	ms.ttls.reset()
 	ms.mu.Unlock()
 
 	if cb != nil {
@@ -303,6 +514,51 @@ func (ms *memStore) Purge() (uint64, error) {
 	return purged, nil
 }
 
+// PurgeEx will remove messages based on subject filters, sequence and number of messages to keep.
+// Messages with a sequence at or above seq are kept, as are the last keep messages for each subject.
+// Will return the number of purged messages.
+func (ms *memStore) PurgeEx(subject string, sequence, keep uint64) (purged uint64, err error) {
+	all := subject == _EMPTY_ || subject == fwcs
+
+	ms.mu.Lock()
+	first, last := ms.state.FirstSeq, ms.state.LastSeq
+	if all && keep == 0 && (sequence == 0 || sequence > last) {
+		ms.mu.Unlock()
+		return ms.Purge()
+	}
+	defer ms.mu.Unlock()
+
+	if sequence > 0 && sequence <= last {
+		last = sequence - 1
+	}
+	// If we need to keep some messages count what is below the cutoff per subject.
+	var counts map[string]uint64
+	if keep > 0 {
+		counts = make(map[string]uint64)
+		for seq := first; seq > 0 && seq <= last; seq++ {
+			if sm, ok := ms.msgs[seq]; ok && (all || subjectIsSubsetMatch(sm.subj, subject)) {
+				counts[sm.subj]++
+			}
+		}
+	}
+	for seq := first; seq > 0 && seq <= last; seq++ {
+		sm, ok := ms.msgs[seq]
+		if !ok || (!all && !subjectIsSubsetMatch(sm.subj, subject)) {
+			continue
+		}
+		if keep > 0 {
+			if counts[sm.subj] <= keep {
+				continue
+			}
+			counts[sm.subj]--
+		}
+		if ms.removeMsg(seq, false) {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
 // Compact will remove all messages from this store up to
 // but not including the seq parameter.
 // Will return the number of purged messages.
@@ -329,6 +585,8 @@ func (ms *memStore) Compact(seq uint64) (uint64, error) {
 				bytes += memStoreMsgSize(sm.subj, sm.hdr, sm.msg)
 				purged++
 				delete(ms.msgs, seq)
+				ms.removeSeqPerSubject(sm.subj, seq)
+				ms.ttls.removeSeq(seq)
 			} else {
 				delete(ms.dmap, seq)
 			}
@@ -346,6 +604,8 @@ func (ms *memStore) Compact(seq uint64) (uint64, error) {
 		ms.state.FirstTime = time.Time{}
 		ms.state.LastSeq = seq - 1
 		ms.msgs = make(map[uint64]*storedMsg)
+		ms.fss = make(map[string]*SimpleState)
+		ms.ttls.reset()
 	}
 	ms.mu.Unlock()
 
@@ -371,7 +631,9 @@ func (ms *memStore) Truncate(seq uint64) error {
 		if sm := ms.msgs[i]; sm != nil {
 			purged++
 			bytes += memStoreMsgSize(sm.subj, sm.hdr, sm.msg)
-			delete(ms.msgs, seq)
+			delete(ms.msgs, i)
+			ms.removeSeqPerSubject(sm.subj, i)
+			ms.ttls.removeSeq(i)
 		} else {
 			delete(ms.dmap, i)
 		}
@@ -419,6 +681,47 @@ func (ms *memStore) LoadMsg(seq uint64) (string, []byte, []byte, int64, error) {
 	return sm.subj, sm.hdr, sm.msg, sm.ts, nil
 }
 
+// LoadLastMsg will return the last message we have that matches the given subject.
+// The subject can contain wildcards. An empty subject will return the last message in the store.
+func (ms *memStore) LoadLastMsg(subject string) (subj string, seq uint64, hdr, msg []byte, ts int64, err error) {
+	var sm *storedMsg
+	ms.mu.RLock()
+	if subject == _EMPTY_ || subject == fwcs {
+		// Our last message may have been removed, so walk back to the last one we have.
+		for seq := ms.state.LastSeq; sm == nil && seq >= ms.state.FirstSeq && seq > 0; seq-- {
+			sm = ms.msgs[seq]
+		}
+	} else if !subjectHasWildcard(subject) {
+		if ss := ms.fss[subject]; ss != nil {
+			sm = ms.msgs[ss.Last]
+		}
+	} else {
+		var lseq uint64
+		for fsubj, ss := range ms.fss {
+			if ss.Last > lseq && subjectIsSubsetMatch(fsubj, subject) {
+				lseq = ss.Last
+			}
+		}
+		sm = ms.msgs[lseq]
+	}
+	ms.mu.RUnlock()
+
+	if sm == nil {
+		return _EMPTY_, 0, nil, nil, 0, ErrStoreMsgNotFound
+	}
+	return sm.subj, sm.seq, sm.hdr, sm.msg, sm.ts, nil
+}
+
+// LastSeqForSubject will return the last sequence stored for the literal subject, or 0 if none.
+func (ms *memStore) LastSeqForSubject(subj string) uint64 {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ss := ms.fss[subj]; ss != nil {
+		return ss.Last
+	}
+	return 0
+}
+
 // RemoveMsg will remove the message from this store.
 // Will return the number of bytes removed.
 func (ms *memStore) RemoveMsg(seq uint64) (bool, error) {
@@ -463,6 +766,36 @@ func (ms *memStore) updateFirstSeq(seq uint64) {
 	}
 }
 
+// Will remove the seq from the per subject tracking.
+// Lock should be held.
+func (ms *memStore) removeSeqPerSubject(subj string, seq uint64) {
+	ss := ms.fss[subj]
+	if ss == nil {
+		return
+	}
+	if ss.Msgs == 1 {
+		delete(ms.fss, subj)
+		return
+	}
+	ss.Msgs--
+	// Check if we need to select a new first or last for this subject.
+	if seq == ss.First {
+		for tseq := seq + 1; tseq <= ss.Last; tseq++ {
+			if sm := ms.msgs[tseq]; sm != nil && sm.subj == subj {
+				ss.First = tseq
+				break
+			}
+		}
+	} else if seq == ss.Last {
+		for tseq := seq - 1; tseq >= ss.First; tseq-- {
+			if sm := ms.msgs[tseq]; sm != nil && sm.subj == subj {
+				ss.Last = tseq
+				break
+			}
+		}
+	}
+}
+
 // Removes the message referenced by seq.
 // Lock should he held.
 func (ms *memStore) removeMsg(seq uint64, secure bool) bool {
@@ -478,6 +811,8 @@ func (ms *memStore) removeMsg(seq uint64, secure bool) bool {
 	ms.state.Msgs--
 	ms.state.Bytes -= ss
 	ms.updateFirstSeq(seq)
+	ms.removeSeqPerSubject(sm.subj, seq)
+	ms.ttls.removeSeq(seq)
 
 	if secure {
 		if len(sm.hdr) > 0 {
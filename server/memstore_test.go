@@ -390,3 +390,291 @@ func TestMemStoreStreamTruncate(t *testing.T) {
 		t.Fatalf("Expected deleted to be %+v, got %+v\n", expected, state.Deleted)
 	}
 }
+
+func TestMemStorePerSubjectMsgLimit(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, MaxMsgsPer: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+
+	msg := []byte("Hello World")
+	for i := 0; i < 10; i++ {
+		ms.StoreMsg("foo", nil, msg)
+		ms.StoreMsg("bar", nil, msg)
+	}
+	state := ms.State()
+	if state.Msgs != 6 {
+		t.Fatalf("Expected %d msgs, got %d", 6, state.Msgs)
+	}
+	if state.FirstSeq != 15 {
+		t.Fatalf("Expected the first sequence to be 15, got %d", state.FirstSeq)
+	}
+	// Only the last 3 for each subject should remain.
+	for seq := uint64(15); seq <= 20; seq++ {
+		if _, _, _, _, err := ms.LoadMsg(seq); err != nil {
+			t.Fatalf("Unexpected error looking up seq %d: %v", seq, err)
+		}
+	}
+
+	// Remove an interior message and make sure we still enforce correctly.
+	ms.RemoveMsg(17)
+	ms.StoreMsg("foo", nil, msg)
+	ms.StoreMsg("foo", nil, msg)
+	if state := ms.State(); state.Msgs != 6 {
+		t.Fatalf("Expected %d msgs, got %d", 6, state.Msgs)
+	}
+	if ss := ms.fss["foo"]; ss == nil || ss.Msgs != 3 || ss.First != 19 || ss.Last != 22 {
+		t.Fatalf("Unexpected per subject state for foo: %+v", ss)
+	}
+
+	// Lowering the limit should be applied to existing subjects.
+	cfg := ms.cfg
+	cfg.MaxMsgsPer = 1
+	if err := ms.UpdateConfig(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state := ms.State(); state.Msgs != 2 {
+		t.Fatalf("Expected %d msgs, got %d", 2, state.Msgs)
+	}
+	if subj, _, _, _, err := ms.LoadMsg(22); err != nil || subj != "foo" {
+		t.Fatalf("Expected last foo msg at seq 22, got %q, %v", subj, err)
+	}
+}
+
+func TestMemStoreLoadLastMsg(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+
+	msg := []byte("Hello World")
+	for i := 0; i < 10; i++ {
+		ms.StoreMsg("foo.A", nil, msg)
+		ms.StoreMsg("foo.B", nil, msg)
+		ms.StoreMsg("bar", nil, msg)
+	}
+
+	expectLast := func(filter string, lseq uint64) {
+		t.Helper()
+		_, seq, _, _, _, err := ms.LoadLastMsg(filter)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if seq != lseq {
+			t.Fatalf("Expected last seq of %d for %q, got %d", lseq, filter, seq)
+		}
+		if filter != _EMPTY_ && !subjectHasWildcard(filter) {
+			if seq := ms.LastSeqForSubject(filter); seq != lseq {
+				t.Fatalf("Expected indexed last seq of %d for %q, got %d", lseq, filter, seq)
+			}
+		}
+	}
+	expectLast("foo.A", 28)
+	expectLast("foo.B", 29)
+	expectLast("bar", 30)
+	expectLast("foo.*", 29)
+	expectLast(_EMPTY_, 30)
+
+	// Removing the last should select the prior one.
+	ms.RemoveMsg(29)
+	expectLast("foo.B", 26)
+	expectLast("foo.*", 28)
+	ms.RemoveMsg(30)
+	expectLast(_EMPTY_, 28)
+	expectLast(">", 28)
+	expectLast("bar", 27)
+
+	if _, _, _, _, _, err := ms.LoadLastMsg("baz"); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected a not found error, got %v", err)
+	}
+	if seq := ms.LastSeqForSubject("baz"); seq != 0 {
+		t.Fatalf("Expected no last seq, got %d", seq)
+	}
+}
+
+func TestMemStorePurgeEx(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+
+	msg := []byte("Hello World")
+	for i := 0; i < 10; i++ {
+		ms.StoreMsg("foo.A", nil, msg)
+		ms.StoreMsg("foo.B", nil, msg)
+		ms.StoreMsg("bar", nil, msg)
+	}
+
+	// Only purge foo.A before seq 10.
+	if purged, err := ms.PurgeEx("foo.A", 10, 0); err != nil || purged != 3 {
+		t.Fatalf("Expected 3 purged, got %d, %v", purged, err)
+	}
+	// Keep the last 2 for each foo subject.
+	if purged, err := ms.PurgeEx("foo.*", 0, 2); err != nil || purged != 13 {
+		t.Fatalf("Expected 13 purged, got %d, %v", purged, err)
+	}
+	if ss := ms.fss["foo.A"]; ss == nil || ss.Msgs != 2 || ss.First != 25 {
+		t.Fatalf("Unexpected per subject state for foo.A: %+v", ss)
+	}
+	if ss := ms.fss["bar"]; ss == nil || ss.Msgs != 10 {
+		t.Fatalf("Unexpected per subject state for bar: %+v", ss)
+	}
+	if state := ms.State(); state.Msgs != 14 {
+		t.Fatalf("Expected 14 msgs, got %d", state.Msgs)
+	}
+
+	// Keep only counts messages below the sequence cutoff.
+	ms.StoreMsg("foo.A", nil, msg)
+	if purged, err := ms.PurgeEx("foo.A", 31, 1); err != nil || purged != 1 {
+		t.Fatalf("Expected 1 purged, got %d, %v", purged, err)
+	}
+	if _, _, _, _, err := ms.LoadMsg(28); err != nil {
+		t.Fatalf("Expected foo.A at 28 to be kept, got %v", err)
+	}
+
+	// No filter and no keep is the same as a purge.
+	if purged, err := ms.PurgeEx(_EMPTY_, 0, 0); err != nil || purged != 14 {
+		t.Fatalf("Expected 14 purged, got %d, %v", purged, err)
+	}
+	if state := ms.State(); state.Msgs != 0 || state.FirstSeq != 32 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+}
+
+func TestMemStoreMsgTTL(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, AllowMsgTTL: true, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+
+	msg := []byte("Hello World")
+	ms.StoreMsg("foo", nil, msg)
+	ms.StoreMsg("foo", genHeader(nil, JSMessageTTL, "2s"), msg)
+	ms.StoreMsg("foo", genHeader(nil, JSMessageTTL, "1"), msg)
+	ms.StoreMsg("foo", nil, msg)
+
+	// The message with the shorter TTL should expire first even though stored later.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if _, _, _, _, err := ms.LoadMsg(3); err != ErrStoreMsgNotFound {
+			return fmt.Errorf("Expected msg 3 to be expired")
+		}
+		return nil
+	})
+	if state := ms.State(); state.Msgs != 3 {
+		t.Fatalf("Expected 3 msgs, got %d", state.Msgs)
+	}
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := ms.State(); state.Msgs != 2 || state.FirstSeq != 1 {
+			return fmt.Errorf("Unexpected state: %+v", state)
+		}
+		return nil
+	})
+}
+
+func TestMemStoreMsgTTLRemoved(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, AllowMsgTTL: true})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+
+	msg := []byte("Hello World")
+	ms.StoreMsg("foo", nil, msg)
+	ms.StoreMsg("foo", genHeader(nil, JSMessageTTL, "1s"), msg)
+	ms.StoreMsg("foo", genHeader(nil, JSMessageTTL, "1h"), msg)
+
+	// Removing a message removes its TTL.
+	ms.RemoveMsg(3)
+	if n := ms.ttls.Len(); n != 1 {
+		t.Fatalf("Expected 1 TTL, got %d", n)
+	}
+	// A truncated message should not expire the message that reuses its sequence.
+	if err := ms.Truncate(1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := ms.ttls.Len(); n != 0 {
+		t.Fatalf("Expected no TTLs, got %d", n)
+	}
+	if seq, _, err := ms.StoreMsg("foo", nil, msg); err != nil || seq != 2 {
+		t.Fatalf("Expected seq 2, got %d, %v", seq, err)
+	}
+	time.Sleep(1200 * time.Millisecond)
+	if _, _, _, _, err := ms.LoadMsg(2); err != nil {
+		t.Fatalf("Expected msg 2 to still be present, got %v", err)
+	}
+}
+
+func TestMemStoreStoreMsgs(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, MaxMsgs: 4})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+
+	msg := []byte("Hello World")
+	ms.StoreMsg("foo", nil, msg)
+	batch := []*BatchMsg{{Subject: "foo", Msg: msg}, {Subject: "bar", Skip: true}, {Subject: "baz", Msg: msg}}
+	seq, _, err := ms.StoreMsgs(batch, 0, 0)
+	if err != nil || seq != 2 {
+		t.Fatalf("Expected first seq of 2, got %d, %v", seq, err)
+	}
+	if state := ms.State(); state.Msgs != 3 || state.LastSeq != 4 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if _, _, _, _, err := ms.LoadMsg(3); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected skipped msg to not be found, got %v", err)
+	}
+
+	// Limits are enforced once the whole batch is stored.
+	if _, _, err := ms.StoreMsgs(batch, 0, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state := ms.State(); state.Msgs != 4 || state.FirstSeq != 2 || state.LastSeq != 7 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+
+	// With discard new none of the batch is stored if it does not fit.
+	cfg := ms.cfg
+	cfg.Discard = DiscardNew
+	if err := ms.UpdateConfig(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ms.RemoveMsg(4)
+	if _, _, err := ms.StoreMsgs(batch, 0, 0); err != ErrMaxMsgs {
+		t.Fatalf("Expected %v, got %v", ErrMaxMsgs, err)
+	}
+	if _, _, err := ms.StoreMsgs(batch, 9, time.Now().UnixNano()); err != ErrSequenceMismatch {
+		t.Fatalf("Expected %v, got %v", ErrSequenceMismatch, err)
+	}
+	if state := ms.State(); state.Msgs != 3 || state.LastSeq != 7 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+}
+
+func TestMemStoreSkipMsgs(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+
+	// On an empty store we just move our sequences.
+	if err := ms.SkipMsgs(1, 10); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state := ms.State(); state.Msgs != 0 || state.FirstSeq != 11 || state.LastSeq != 10 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+
+	msg := []byte("Hello World")
+	ms.StoreMsg("foo", nil, msg)
+	if err := ms.SkipMsgs(5, 10); err != ErrSequenceMismatch {
+		t.Fatalf("Expected %v, got %v", ErrSequenceMismatch, err)
+	}
+	if err := ms.SkipMsgs(12, 10); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if seq, _, err := ms.StoreMsg("foo", nil, msg); err != nil || seq != 22 {
+		t.Fatalf("Expected seq 22, got %d, %v", seq, err)
+	}
+	if state := ms.State(); state.Msgs != 2 || state.FirstSeq != 11 || state.LastSeq != 22 || len(state.Deleted) != 10 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+}
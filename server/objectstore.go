@@ -0,0 +1,521 @@
+// Copyright 2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// ObjectStoreConfig is the configuration for an object store bucket.
+type ObjectStoreConfig struct {
+	Bucket   string        `json:"bucket"`
+	TTL      time.Duration `json:"ttl,omitempty"`
+	MaxBytes int64         `json:"max_bytes,omitempty"`
+	Storage  StorageType   `json:"storage,omitempty"`
+	Replicas int           `json:"num_replicas,omitempty"`
+}
+
+// ObjectInfo is the meta record kept for each object.
+type ObjectInfo struct {
+	Name    string    `json:"name"`
+	Bucket  string    `json:"bucket"`
+	NUID    string    `json:"nuid"`
+	Size    uint64    `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Chunks  uint32    `json:"chunks"`
+	Digest  string    `json:"digest,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+const (
+	// Buckets are streams with this name prefix.
+	objBucketNamePre = "OBJ_"
+	// Chunks for an object are stored under this prefix followed by the object's NUID.
+	objChunksPreTmpl = "$O.%s.C."
+	// Meta records are stored under this prefix followed by the encoded object name.
+	objMetaPreTmpl = "$O.%s.M."
+	// Digest prefix for the encoded SHA-256 of the object.
+	objDigestType = "SHA-256="
+	// Objects are chunked the same way we chunk snapshots.
+	objChunkSize = defaultSnapshotChunkSize
+	// Maximum number of unacknowledged chunks in flight when reading an object.
+	objMaxPendingChunks = defaultSnapshotWindowSize / defaultSnapshotChunkSize
+)
+
+var (
+	// ErrObjectStoreInvalidBucket is returned when the bucket name is not valid.
+	ErrObjectStoreInvalidBucket = errors.New("invalid bucket name")
+	// ErrObjectNameRequired is returned when an object name is empty.
+	ErrObjectNameRequired = errors.New("object name is required")
+	// ErrObjectNotFound is returned when an object does not exist or was deleted.
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrObjectDigestMismatch is returned when the data read does not match the stored digest.
+	ErrObjectDigestMismatch = errors.New("object digest does not match")
+)
+
+// ObjectStore is a server side handle to an object store bucket.
+// Objects are split into chunks stored in a stream, with a meta record per object.
+type ObjectStore struct {
+	name     string
+	stream   string
+	chunkPre string
+	metaPre  string
+	ic       *jsInternalClient
+}
+
+// CreateObjectStore will create an object store bucket, or bind to it if it already exists with the same config.
+func (a *Account) CreateObjectStore(cfg *ObjectStoreConfig) (*ObjectStore, error) {
+	if cfg == nil || !validBucketRe.MatchString(cfg.Bucket) {
+		return nil, ErrObjectStoreInvalidBucket
+	}
+	obs, err := a.newObjectStore(cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	storage := cfg.Storage
+	if storage == 0 {
+		storage = FileStorage
+	}
+	scfg := &StreamConfig{
+		Name:     obs.stream,
+		Subjects: []string{obs.chunkPre + ">", obs.metaPre + ">"},
+		MaxBytes: cfg.MaxBytes,
+		MaxAge:   cfg.TTL,
+		Storage:  storage,
+		Replicas: cfg.Replicas,
+		Discard:  DiscardNew,
+	}
+	req, err := json.Marshal(scfg)
+	if err != nil {
+		return nil, err
+	}
+	var resp JSApiStreamCreateResponse
+	if err := obs.ic.apiRequest(fmt.Sprintf(JSApiStreamCreateT, obs.stream), req, &resp); err != nil {
+		return nil, err
+	}
+	if err := convertApiErrorToError(resp.Error); err != nil {
+		return nil, err
+	}
+	return obs, nil
+}
+
+// ObjectStore will bind to an existing object store bucket.
+func (a *Account) ObjectStore(bucket string) (*ObjectStore, error) {
+	if !validBucketRe.MatchString(bucket) {
+		return nil, ErrObjectStoreInvalidBucket
+	}
+	obs, err := a.newObjectStore(bucket)
+	if err != nil {
+		return nil, err
+	}
+	var resp JSApiStreamInfoResponse
+	if err := obs.ic.apiRequest(fmt.Sprintf(JSApiStreamInfoT, obs.stream), nil, &resp); err != nil {
+		return nil, err
+	}
+	if err := convertApiErrorToError(resp.Error); err != nil {
+		return nil, err
+	}
+	return obs, nil
+}
+
+// DeleteObjectStore will delete the object store bucket and all of its objects.
+func (a *Account) DeleteObjectStore(bucket string) error {
+	if !validBucketRe.MatchString(bucket) {
+		return ErrObjectStoreInvalidBucket
+	}
+	obs, err := a.newObjectStore(bucket)
+	if err != nil {
+		return err
+	}
+	var resp JSApiStreamDeleteResponse
+	if err := obs.ic.apiRequest(fmt.Sprintf(JSApiStreamDeleteT, obs.stream), nil, &resp); err != nil {
+		return err
+	}
+	return convertApiErrorToError(resp.Error)
+}
+
+func (a *Account) newObjectStore(bucket string) (*ObjectStore, error) {
+	ic, err := a.newJSInternalClient()
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectStore{
+		name:     bucket,
+		stream:   objBucketNamePre + bucket,
+		chunkPre: fmt.Sprintf(objChunksPreTmpl, bucket),
+		metaPre:  fmt.Sprintf(objMetaPreTmpl, bucket),
+		ic:       ic,
+	}, nil
+}
+
+// Bucket returns the name of the bucket.
+func (obs *ObjectStore) Bucket() string {
+	return obs.name
+}
+
+// Put will store the contents of r as the named object, replacing any prior version.
+func (obs *ObjectStore) Put(name string, r io.Reader) (*ObjectInfo, error) {
+	if name == _EMPTY_ {
+		return nil, ErrObjectNameRequired
+	}
+	// Grab the current version if present so we can remove it once the new one is in place.
+	einfo, emseq, err := obs.info(name)
+	if err != nil && err != ErrObjectNotFound {
+		return nil, err
+	}
+
+	info := &ObjectInfo{Name: name, Bucket: obs.name, NUID: nuid.Next()}
+	chunkSubj := obs.chunkPre + info.NUID
+
+	// Track what we stored in case we need to back it out.
+	var seqs []uint64
+	cleanup := func() {
+		for _, seq := range seqs {
+			obs.ic.deleteMsg(obs.stream, seq)
+		}
+	}
+
+	h := sha256.New()
+	chunk := make([]byte, objChunkSize)
+	for {
+		n, rerr := io.ReadFull(r, chunk)
+		if n > 0 {
+			h.Write(chunk[:n])
+			seq, err := obs.ic.storeMsg(chunkSubj, nil, chunk[:n])
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+			seqs = append(seqs, seq)
+			info.Chunks++
+			info.Size += uint64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			cleanup()
+			return nil, rerr
+		}
+	}
+	info.Digest = objDigest(h)
+	info.ModTime = time.Now().UTC()
+
+	meta, err := json.Marshal(info)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if _, err := obs.ic.storeMsg(obs.metaSubject(name), nil, meta); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	// Now remove the prior version.
+	if einfo != nil {
+		obs.removeChunks(einfo)
+		obs.ic.deleteMsg(obs.stream, emseq)
+	}
+
+	return info, nil
+}
+
+// GetInfo returns the meta record for the named object.
+// Deleted objects will have their deleted flag set.
+func (obs *ObjectStore) GetInfo(name string) (*ObjectInfo, error) {
+	info, _, err := obs.info(name)
+	return info, err
+}
+
+// Get returns a reader for the named object.
+// The digest is checked once all chunks have been read and a mismatch is returned as the read error.
+func (obs *ObjectStore) Get(name string) (*ObjectResult, error) {
+	info, _, err := obs.info(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.Deleted {
+		return nil, ErrObjectNotFound
+	}
+
+	pr, pw := io.Pipe()
+	result := &ObjectResult{info: info, r: pr}
+
+	if info.Chunks == 0 {
+		pw.CloseWithError(verifyObject(info, sha256.New(), 0))
+		return result, nil
+	}
+
+	h := sha256.New()
+	var size uint64
+	var received uint32
+	cfg := ConsumerConfig{
+		DeliverPolicy: DeliverAll,
+		AckPolicy:     AckExplicit,
+		MaxAckPending: objMaxPendingChunks,
+		FilterSubject: obs.chunkPre + info.NUID,
+	}
+	o, err := obs.ic.createConsumer(obs.stream, cfg, func(m *jsInternalMsg, _ chan struct{}) {
+		// We already have anything that is being redelivered.
+		if _, _, dc, _, _ := replyInfo(m.reply); dc > 1 || received >= info.Chunks {
+			return
+		}
+		h.Write(m.msg)
+		size += uint64(len(m.msg))
+		received++
+		if _, err := pw.Write(m.msg); err != nil {
+			return
+		}
+		obs.ic.publish(m.reply, _EMPTY_, nil, nil)
+		if received == info.Chunks {
+			pw.CloseWithError(verifyObject(info, h, size))
+		}
+	})
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+	result.o = o
+
+	// If chunks are missing we would never see the last one, so fail the read now.
+	if o.numPending() < uint64(info.Chunks) {
+		pw.CloseWithError(ErrObjectDigestMismatch)
+	}
+
+	return result, nil
+}
+
+// Delete will remove the named object's data and leave a deleted marker in its place.
+func (obs *ObjectStore) Delete(name string) error {
+	info, mseq, err := obs.info(name)
+	if err != nil {
+		return err
+	}
+	if info.Deleted {
+		return ErrObjectNotFound
+	}
+	dinfo := &ObjectInfo{
+		Name:    name,
+		Bucket:  obs.name,
+		NUID:    info.NUID,
+		ModTime: time.Now().UTC(),
+		Deleted: true,
+	}
+	meta, err := json.Marshal(dinfo)
+	if err != nil {
+		return err
+	}
+	if _, err := obs.ic.storeMsg(obs.metaSubject(name), nil, meta); err != nil {
+		return err
+	}
+	obs.removeChunks(info)
+	return obs.ic.deleteMsg(obs.stream, mseq)
+}
+
+// List returns the meta records for all objects that have not been deleted.
+func (obs *ObjectStore) List() ([]*ObjectInfo, error) {
+	w, err := obs.watch(true)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	pending := w.o.numPending()
+	latest := make(map[string]*ObjectInfo)
+	timeout := time.NewTimer(jsInternalRequestTimeout)
+	defer timeout.Stop()
+	for i := uint64(0); i < pending; i++ {
+		select {
+		case info := <-w.updates:
+			// We may see a prior version if a put is in progress.
+			if cur := latest[info.Name]; cur == nil || info.ModTime.After(cur.ModTime) {
+				latest[info.Name] = info
+			}
+		case <-timeout.C:
+			return nil, fmt.Errorf("timeout listing objects for %q", obs.name)
+		}
+	}
+	var infos []*ObjectInfo
+	for _, info := range latest {
+		if !info.Deleted {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// Watch will deliver meta records for objects as they are put or deleted.
+// If includeHistory is set the current records for all objects will be delivered first.
+func (obs *ObjectStore) Watch(includeHistory bool) (*ObjectWatcher, error) {
+	return obs.watch(includeHistory)
+}
+
+func (obs *ObjectStore) metaSubject(name string) string {
+	return obs.metaPre + base64.URLEncoding.EncodeToString([]byte(name))
+}
+
+// Returns the meta record for the object and its stream sequence.
+func (obs *ObjectStore) info(name string) (*ObjectInfo, uint64, error) {
+	if name == _EMPTY_ {
+		return nil, 0, ErrObjectNameRequired
+	}
+	sm, apiErr, err := obs.ic.loadMsg(obs.stream, &JSApiMsgGetRequest{LastFor: obs.metaSubject(name)})
+	if err != nil {
+		return nil, 0, err
+	}
+	if apiErr != nil {
+		if apiErr.Code == 404 {
+			return nil, 0, ErrObjectNotFound
+		}
+		return nil, 0, convertApiErrorToError(apiErr)
+	}
+	if sm == nil {
+		return nil, 0, ErrObjectNotFound
+	}
+	var info ObjectInfo
+	if err := json.Unmarshal(sm.Data, &info); err != nil {
+		return nil, 0, err
+	}
+	return &info, sm.Sequence, nil
+}
+
+// Remove all of the chunks for an object.
+// We walk the chunks with a consumer to find their sequences.
+func (obs *ObjectStore) removeChunks(info *ObjectInfo) error {
+	if info.Chunks == 0 {
+		return nil
+	}
+	seqs := make(chan uint64, info.Chunks)
+	cfg := ConsumerConfig{
+		DeliverPolicy: DeliverAll,
+		AckPolicy:     AckNone,
+		FilterSubject: obs.chunkPre + info.NUID,
+	}
+	o, err := obs.ic.createConsumer(obs.stream, cfg, func(m *jsInternalMsg, qch chan struct{}) {
+		sseq, _, _, _, _ := replyInfo(m.reply)
+		select {
+		case seqs <- sseq:
+		case <-qch:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer o.stop()
+
+	timeout := time.NewTimer(jsInternalRequestTimeout)
+	defer timeout.Stop()
+	for i := uint64(0); i < o.numPending(); i++ {
+		select {
+		case seq := <-seqs:
+			if err := obs.ic.deleteMsg(obs.stream, seq); err != nil {
+				return err
+			}
+		case <-timeout.C:
+			return fmt.Errorf("timeout removing chunks for %q", info.Name)
+		}
+	}
+	return nil
+}
+
+// ObjectResult is a reader for an object's data.
+type ObjectResult struct {
+	info *ObjectInfo
+	r    *io.PipeReader
+	o    *jsInternalConsumer
+}
+
+// Info returns the meta record for the object being read.
+func (r *ObjectResult) Info() *ObjectInfo {
+	return r.info
+}
+
+// Read will read the object's data.
+func (r *ObjectResult) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+// Close will release the resources used to read the object.
+func (r *ObjectResult) Close() error {
+	r.r.Close()
+	if r.o != nil {
+		return r.o.stop()
+	}
+	return nil
+}
+
+// ObjectWatcher delivers object meta records as they change.
+type ObjectWatcher struct {
+	o       *jsInternalConsumer
+	updates chan *ObjectInfo
+}
+
+// Updates returns the channel meta records will be delivered on.
+func (w *ObjectWatcher) Updates() <-chan *ObjectInfo {
+	return w.updates
+}
+
+// Stop will stop the watcher and remove the underlying consumer.
+func (w *ObjectWatcher) Stop() error {
+	return w.o.stop()
+}
+
+func (obs *ObjectStore) watch(includeHistory bool) (*ObjectWatcher, error) {
+	w := &ObjectWatcher{updates: make(chan *ObjectInfo, 256)}
+	dp := DeliverNew
+	if includeHistory {
+		dp = DeliverAll
+	}
+	cfg := ConsumerConfig{
+		DeliverPolicy: dp,
+		AckPolicy:     AckNone,
+		FilterSubject: obs.metaPre + ">",
+	}
+	o, err := obs.ic.createConsumer(obs.stream, cfg, func(m *jsInternalMsg, qch chan struct{}) {
+		var info ObjectInfo
+		if err := json.Unmarshal(m.msg, &info); err != nil {
+			return
+		}
+		select {
+		case w.updates <- &info:
+		case <-qch:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.o = o
+	return w, nil
+}
+
+func objDigest(h hash.Hash) string {
+	return objDigestType + base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Check the data we read against the meta record.
+func verifyObject(info *ObjectInfo, h hash.Hash, size uint64) error {
+	if size != info.Size || objDigest(h) != info.Digest {
+		return ErrObjectDigestMismatch
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+// Copyright 2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObjectStoreBasics(t *testing.T) {
+	cases := []struct {
+		name    string
+		storage StorageType
+	}{
+		{"MemoryStore", MemoryStorage},
+		{"FileStore", FileStorage},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			acc := s.GlobalAccount()
+			if _, err := acc.CreateObjectStore(&ObjectStoreConfig{Bucket: "bad.name"}); err != ErrObjectStoreInvalidBucket {
+				t.Fatalf("Expected an invalid bucket error, got %v", err)
+			}
+			obs, err := acc.CreateObjectStore(&ObjectStoreConfig{Bucket: "FILES", Storage: c.storage})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := obs.Get("missing"); err != ErrObjectNotFound {
+				t.Fatalf("Expected a not found error, got %v", err)
+			}
+
+			// Spans multiple chunks with a partial last one.
+			data := make([]byte, 2*objChunkSize+1024)
+			rand.Read(data)
+
+			info, err := obs.Put("blob", bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if info.Chunks != 3 || info.Size != uint64(len(data)) || info.Digest == _EMPTY_ {
+				t.Fatalf("Unexpected info: %+v", info)
+			}
+			obs.Put("empty", bytes.NewReader(nil))
+
+			r, err := obs.Get("blob")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			read, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("Unexpected error reading object: %v", err)
+			}
+			if !bytes.Equal(read, data) {
+				t.Fatalf("Data does not match")
+			}
+			if r.Info().NUID != info.NUID {
+				t.Fatalf("Unexpected info: %+v", r.Info())
+			}
+			if r, err = obs.Get("empty"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if read, err = ioutil.ReadAll(r); err != nil || len(read) != 0 {
+				t.Fatalf("Expected an empty object, got %d bytes, %v", len(read), err)
+			}
+			r.Close()
+
+			infos, err := obs.List()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(infos) != 2 {
+				t.Fatalf("Expected 2 objects, got %d", len(infos))
+			}
+
+			// Overwriting should remove the prior chunks.
+			mset, err := acc.lookupStream("OBJ_FILES")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := obs.Put("blob", bytes.NewReader(data[:100])); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			// One chunk and one meta record for each object.
+			if state := mset.state(); state.Msgs != 3 {
+				t.Fatalf("Expected 3 msgs, got %d", state.Msgs)
+			}
+
+			if err := obs.Delete("blob"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := obs.Get("blob"); err != ErrObjectNotFound {
+				t.Fatalf("Expected a not found error, got %v", err)
+			}
+			if info, err = obs.GetInfo("blob"); err != nil || !info.Deleted {
+				t.Fatalf("Expected a deleted marker, got %+v, %v", info, err)
+			}
+			if infos, _ = obs.List(); len(infos) != 1 || infos[0].Name != "empty" {
+				t.Fatalf("Unexpected objects: %+v", infos)
+			}
+			if state := mset.state(); state.Msgs != 2 {
+				t.Fatalf("Expected 2 msgs, got %d", state.Msgs)
+			}
+
+			if err := acc.DeleteObjectStore("FILES"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := acc.ObjectStore("FILES"); err == nil {
+				t.Fatalf("Expected an error binding to a deleted bucket")
+			}
+		})
+	}
+}
+
+func TestObjectStoreDigestMismatch(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	obs, err := s.GlobalAccount().CreateObjectStore(&ObjectStoreConfig{Bucket: "DIGEST"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	info, err := obs.Put("blob", bytes.NewReader(bytes.Repeat([]byte("A"), objChunkSize+10)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Replace the meta record with one that has the wrong digest.
+	// Base64 is case sensitive, so a digest that only differs in case is a different digest.
+	for _, digest := range []string{objDigestType + "bad", objDigestType + strings.ToLower(strings.TrimPrefix(info.Digest, objDigestType))} {
+		info.Digest = digest
+		meta, _ := json.Marshal(info)
+		if _, err := obs.ic.storeMsg(obs.metaSubject("blob"), nil, meta); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		r, err := obs.Get("blob")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err := ioutil.ReadAll(r); err != ErrObjectDigestMismatch {
+			t.Fatalf("Expected a digest mismatch error for %q, got %v", digest, err)
+		}
+		r.Close()
+	}
+}
+
+func TestObjectStoreWatch(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	obs, err := s.GlobalAccount().CreateObjectStore(&ObjectStoreConfig{Bucket: "WATCH"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	obs.Put("old", bytes.NewReader([]byte("old")))
+
+	w, err := obs.Watch(false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer w.Stop()
+
+	obs.Put("new", bytes.NewReader([]byte("new")))
+	obs.Delete("old")
+
+	for _, expected := range []struct {
+		name    string
+		deleted bool
+	}{{"new", false}, {"old", true}} {
+		select {
+		case info := <-w.Updates():
+			if info.Name != expected.name || info.Deleted != expected.deleted {
+				t.Fatalf("Unexpected info: %+v", info)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not receive an update for %q", expected.name)
+		}
+	}
+}
+
+func TestObjectStoreClustered(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	obs, err := c.randomServer().GlobalAccount().CreateObjectStore(&ObjectStoreConfig{Bucket: "FILES", Replicas: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c.waitOnStreamLeader("$G", "OBJ_FILES")
+
+	data := make([]byte, 3*objChunkSize)
+	rand.Read(data)
+	if _, err := obs.Put("blob", bytes.NewReader(data)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	obs2, err := c.randomNonStreamLeader("$G", "OBJ_FILES").GlobalAccount().ObjectStore("FILES")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	r, err := obs2.Get("blob")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer r.Close()
+	read, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error reading object: %v", err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatalf("Data does not match")
+	}
+}
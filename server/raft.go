@@ -52,6 +52,8 @@ type RaftNode interface {
 	HadPreviousLeader() bool
 	StepDown(preferred ...string) error
 	Campaign() error
+	SetObserver(isObserver bool)
+	IsObserver() bool
 	ID() string
 	Group() string
 	Peers() []*Peer
@@ -128,6 +130,8 @@ type raft struct {
 	id       string
 	wal      WAL
 	wtype    StorageType
+	prf      keyGen
+	sc       StoreCipher
 	track    bool
 	werr     error
 	state    RaftState
@@ -169,6 +173,9 @@ type raft struct {
 	// Are we doing a leadership transfer.
 	lxfer bool
 
+	// Observers follow the leader and vote, but do not campaign.
+	observer bool
+
 	// For holding term and vote and peerstate to be written.
 	wtv   []byte
 	wps   []byte
@@ -228,12 +235,18 @@ type RaftConfig struct {
 	Store string
 	Log   WAL
 	Track bool
+	// Observers will not campaign. This is recorded with our peer state so it holds across restarts.
+	Observer bool
+	// If set our snapshots, peer state and term and vote are encrypted.
+	prf    keyGen
+	cipher StoreCipher
 }
 
 var (
 	errProposalFailed  = errors.New("raft: proposal failed")
 	errNotLeader       = errors.New("raft: not leader")
 	errAlreadyLeader   = errors.New("raft: already leader")
+	errObserver        = errors.New("raft: observers can not campaign")
 	errNilCfg          = errors.New("raft: no config given")
 	errUnknownPeer     = errors.New("raft: unknown peer")
 	errCorruptPeers    = errors.New("raft: corrupt peer state")
@@ -308,7 +321,7 @@ func (s *Server) bootstrapRaftNode(cfg *RaftConfig, knownPeers []string, allPeer
 	}
 	os.Remove(tmpfile.Name())
 
-	return writePeerState(cfg.Store, &peerState{knownPeers, expected})
+	return writePeerState(cfg, &peerState{knownPeers, expected})
 }
 
 // startRaftNode will start the raft node.
@@ -326,7 +339,7 @@ func (s *Server) startRaftNode(cfg *RaftConfig) (RaftNode, error) {
 	hash := s.sys.shash
 	s.mu.Unlock()
 
-	ps, err := readPeerState(cfg.Store)
+	ps, observer, err := readLocalPeerState(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -341,7 +354,10 @@ func (s *Server) startRaftNode(cfg *RaftConfig) (RaftNode, error) {
 		sd:       cfg.Store,
 		wal:      cfg.Log,
 		wtype:    cfg.Log.Type(),
+		prf:      cfg.prf,
+		sc:       cfg.cipher,
 		track:    cfg.Track,
+		observer: observer,
 		state:    Follower,
 		csz:      ps.clusterSize,
 		qn:       ps.clusterSize/2 + 1,
@@ -849,7 +865,11 @@ func (n *raft) InstallSnapshot(data []byte) error {
 	// Remember our latest snapshot file.
 	n.snapfile = sfile
 
-	if err := ioutil.WriteFile(sfile, n.encodeSnapshot(snap), 0640); err != nil {
+	buf, err := sealRaftFile(n.prf, n.sc, n.group, n.encodeSnapshot(snap))
+	if err == nil {
+		err = ioutil.WriteFile(sfile, buf, 0640)
+	}
+	if err != nil {
 		n.Unlock()
 		n.setWriteErr(err)
 		return err
@@ -971,6 +991,7 @@ func (n *raft) loadLastSnapshot() (*snapshot, error) {
 		n.snapfile = _EMPTY_
 		return nil, err
 	}
+	buf = openRaftFile(n.prf, n.group, buf)
 	if len(buf) < minSnapshotLen {
 		n.warn("Snapshot corrupt, too short")
 		os.Remove(n.snapfile)
@@ -1147,11 +1168,30 @@ func (n *raft) campaign() error {
 	if n.state == Leader {
 		return errAlreadyLeader
 	}
+	if n.observer {
+		return errObserver
+	}
 	n.lxfer = true
 	n.resetElect(randCampaignTimeout())
 	return nil
 }
 
+// SetObserver will set if we are an observer. Observers will not campaign to become leader,
+// e.g. while they are new to a group and have not caught up yet.
+func (n *raft) SetObserver(isObserver bool) {
+	n.Lock()
+	defer n.Unlock()
+	n.observer = isObserver
+	n.writePeerState(&peerState{n.peerNames(), n.csz})
+}
+
+// IsObserver returns if we are an observer.
+func (n *raft) IsObserver() bool {
+	n.RLock()
+	defer n.RUnlock()
+	return n.observer
+}
+
 // State returns the current state for this node.
 func (n *raft) State() RaftState {
 	n.RLock()
@@ -1412,6 +1452,9 @@ func (n *raft) runAsFollower() {
 			if n.outOfResources() {
 				n.resetElectionTimeout()
 				n.debug("Not switching to candidate, no resources")
+			} else if n.IsObserver() {
+				n.resetElectionTimeout()
+				n.debug("Not switching to candidate, observer only")
 			} else {
 				n.switchToCandidate()
 				return
@@ -2822,7 +2865,7 @@ const peerStateFile = "peers.idx"
 
 // Lock should be held.
 func (n *raft) writePeerState(ps *peerState) {
-	pse := encodePeerState(ps)
+	pse := encodeLocalPeerState(ps, n.observer)
 	if bytes.Equal(n.wps, pse) {
 		return
 	}
@@ -2835,23 +2878,77 @@ func (n *raft) writePeerState(ps *peerState) {
 }
 
 // Writes out our peer state outside of a specific raft context.
-func writePeerState(sd string, ps *peerState) error {
-	psf := path.Join(sd, peerStateFile)
+func writePeerState(cfg *RaftConfig, ps *peerState) error {
+	psf := path.Join(cfg.Store, peerStateFile)
 	if _, err := os.Stat(psf); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	if err := ioutil.WriteFile(psf, encodePeerState(ps), 0640); err != nil {
+	buf, err := sealRaftFile(cfg.prf, cfg.cipher, cfg.Name, encodeLocalPeerState(ps, cfg.Observer))
+	if err != nil {
 		return err
 	}
-	return nil
+	return ioutil.WriteFile(psf, buf, 0640)
+}
+
+func readPeerState(cfg *RaftConfig) (ps *peerState, err error) {
+	ps, _, err = readLocalPeerState(cfg)
+	return ps, err
 }
 
-func readPeerState(sd string) (ps *peerState, err error) {
-	buf, err := ioutil.ReadFile(path.Join(sd, peerStateFile))
+// Reads our peer state along with whether we are an observer.
+func readLocalPeerState(cfg *RaftConfig) (ps *peerState, observer bool, err error) {
+	buf, err := ioutil.ReadFile(path.Join(cfg.Store, peerStateFile))
+	if err != nil {
+		return nil, false, err
+	}
+	buf = openRaftFile(cfg.prf, cfg.Name, buf)
+	if ps, err = decodePeerState(buf); err != nil {
+		return nil, false, err
+	}
+	observer = len(buf) > peerStateBufSize(ps) && buf[peerStateBufSize(ps)] == 1
+	return ps, observer, nil
+}
+
+// Our peer state file also records if we are an observer, which is only known to us.
+func encodeLocalPeerState(ps *peerState, observer bool) []byte {
+	buf := encodePeerState(ps)
+	if observer {
+		buf = append(buf, 1)
+	}
+	return buf
+}
+
+// Seal the contents of one of our files if we are encrypted. Like key files we record
+// the cipher so we can always recover regardless of configuration changes.
+func sealRaftFile(prf keyGen, sc StoreCipher, group string, buf []byte) ([]byte, error) {
+	if prf == nil {
+		return buf, nil
+	}
+	kek, err := genKeyEncryptionKey(prf, sc, group)
 	if err != nil {
 		return nil, err
 	}
-	return decodePeerState(buf)
+	sbuf, err := sealWithNonce(kek, buf)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(sc)}, sbuf...), nil
+}
+
+// Open the contents of one of our files if we are encrypted. Files that were written
+// in the clear are returned as is and will be encrypted when next written.
+func openRaftFile(prf keyGen, group string, buf []byte) []byte {
+	if prf == nil || len(buf) == 0 {
+		return buf
+	}
+	kek, err := genKeyEncryptionKey(prf, StoreCipher(buf[0]), group)
+	if err != nil {
+		return buf
+	}
+	if obuf, err := openWithNonce(kek, buf[1:]); err == nil {
+		return obuf
+	}
+	return buf
 }
 
 const termVoteFile = "tav.idx"
@@ -2864,6 +2961,7 @@ func (n *raft) readTermVote() (term uint64, voted string, err error) {
 	if err != nil {
 		return 0, noVote, err
 	}
+	buf = openRaftFile(n.prf, n.group, buf)
 	if len(buf) < termVoteLen {
 		return 0, noVote, nil
 	}
@@ -2903,6 +3001,7 @@ func (n *raft) fileWriter() {
 	n.RLock()
 	tvf := path.Join(n.sd, termVoteFile)
 	psf := path.Join(n.sd, peerStateFile)
+	prf, sc, group := n.prf, n.sc, n.group
 	n.RUnlock()
 
 	for s.isRunning() {
@@ -2914,14 +3013,22 @@ func (n *raft) fileWriter() {
 			n.RLock()
 			copy(buf[0:], n.wtv)
 			n.RUnlock()
-			if err := ioutil.WriteFile(tvf, buf[:], 0640); err != nil {
+			sbuf, err := sealRaftFile(prf, sc, group, buf[:])
+			if err == nil {
+				err = ioutil.WriteFile(tvf, sbuf, 0640)
+			}
+			if err != nil {
 				n.setWriteErr(err)
 			}
 		case <-n.wpsch:
 			n.RLock()
 			buf := append(n.wps[:0:0], n.wps...)
 			n.RUnlock()
-			if err := ioutil.WriteFile(psf, buf, 0640); err != nil {
+			sbuf, err := sealRaftFile(prf, sc, group, buf)
+			if err == nil {
+				err = ioutil.WriteFile(psf, sbuf, 0640)
+			}
+			if err != nil {
 				n.setWriteErr(err)
 			}
 		}
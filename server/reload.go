@@ -791,7 +791,8 @@ func imposeOrder(value interface{}) error {
 	case WebsocketOpts:
 		sort.Strings(value.AllowedOrigins)
 	case string, bool, int, int32, int64, time.Duration, float64, nil, LeafNodeOpts, ClusterOpts, *tls.Config,
-		*URLAccResolver, *MemAccResolver, *DirAccResolver, *CacheDirAccResolver, Authentication, MQTTOpts, jwt.TagList:
+		*URLAccResolver, *MemAccResolver, *DirAccResolver, *CacheDirAccResolver, Authentication, MQTTOpts, jwt.TagList,
+		StoreCipher:
 		// explicitly skipped types
 	default:
 		// this will fail during unit tests
@@ -1026,6 +1027,11 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 					return nil, fmt.Errorf("config reload not supported for jetstream storage directory")
 				}
 			}
+		case "jetstreamkey", "jetstreamcipher":
+			// Do not print the values here since they could expose our key.
+			if jsEnabled {
+				return nil, fmt.Errorf("config reload not supported for jetstream encryption settings")
+			}
 		case "jetstreammaxmemory", "jetstreammaxstore":
 			old := oldValue.(int64)
 			new := newValue.(int64)
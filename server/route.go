@@ -1418,7 +1418,12 @@ func (s *Server) addRoute(c *client, info *Info) (bool, bool) {
 	if !exists {
 		s.routes[c.cid] = c
 		s.remotes[id] = c
-		s.nodeToInfo.Store(c.route.hash, nodeInfo{c.route.remoteName, s.info.Cluster, id, false})
+		ni := nodeInfo{c.route.remoteName, s.info.Cluster, id, nil, false}
+		// Keep any tags we may have already learned from this server's updates.
+		if si, ok := s.nodeToInfo.Load(c.route.hash); ok && si != nil {
+			ni.tags = si.(nodeInfo).tags
+		}
+		s.nodeToInfo.Store(c.route.hash, ni)
 		c.mu.Lock()
 		c.route.connectURLs = info.ClientConnectURLs
 		c.route.wsConnURLs = info.WSConnectURLs
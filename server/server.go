@@ -250,6 +250,7 @@ type nodeInfo struct {
 	name    string
 	cluster string
 	id      string
+	tags    jwt.TagList
 	offline bool
 }
 
@@ -353,7 +354,7 @@ func NewServer(opts *Options) (*Server, error) {
 
 	// Place ourselves in some lookup maps.
 	ourNode := string(getHash(serverName))
-	s.nodeToInfo.Store(ourNode, nodeInfo{serverName, opts.Cluster.Name, info.ID, false})
+	s.nodeToInfo.Store(ourNode, nodeInfo{serverName, opts.Cluster.Name, info.ID, opts.Tags, false})
 
 	s.routeResolver = opts.Cluster.resolver
 	if s.routeResolver == nil {
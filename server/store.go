@@ -14,6 +14,7 @@
 package server
 
 import (
+	"container/heap"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -67,11 +68,16 @@ type StorageUpdateHandler func(msgs, bytes int64, seq uint64, subj string)
 type StreamStore interface {
 	StoreMsg(subject string, hdr, msg []byte) (uint64, int64, error)
 	StoreRawMsg(subject string, hdr, msg []byte, seq uint64, ts int64) error
+	StoreMsgs(batch []*BatchMsg, seq uint64, ts int64) (uint64, int64, error)
 	SkipMsg() uint64
+	SkipMsgs(seq uint64, num uint64) error
 	LoadMsg(seq uint64) (subject string, hdr, msg []byte, ts int64, err error)
+	LoadLastMsg(subject string) (subj string, seq uint64, hdr, msg []byte, ts int64, err error)
+	LastSeqForSubject(subject string) uint64
 	RemoveMsg(seq uint64) (bool, error)
 	EraseMsg(seq uint64) (bool, error)
 	Purge() (uint64, error)
+	PurgeEx(subject string, seq, keep uint64) (uint64, error)
 	Compact(seq uint64) (uint64, error)
 	Truncate(seq uint64) error
 	GetSeqFromTime(t time.Time) uint64
@@ -86,6 +92,15 @@ type StreamStore interface {
 	Snapshot(deadline time.Duration, includeConsumers, checkMsgs bool) (*SnapshotResult, error)
 }
 
+// BatchMsg is a message stored as part of a batch with StoreMsgs.
+// A skipped message will use its sequence without storing anything, as with SkipMsg.
+type BatchMsg struct {
+	Subject string
+	Hdr     []byte
+	Msg     []byte
+	Skip    bool
+}
+
 // RetentionPolicy determines how messages in a set are retained.
 type RetentionPolicy int
 
@@ -110,17 +125,43 @@ const (
 	DiscardNew
 )
 
+// StoreCompression determines how message blocks are compressed at rest.
+type StoreCompression int
+
+const (
+	// NoCompression is the default and will store message blocks as is.
+	NoCompression StoreCompression = iota
+	// S2Compression will compress message blocks with S2 once they are no longer being written to.
+	S2Compression
+)
+
 // StreamState is information about the given stream.
+// Bytes is always the uncompressed size of our messages, which is what limits are applied to.
+// CompressedBytes is what is actually stored when compression is being used.
+// ArchivedBytes is the part of Bytes that has been moved to an archive, the rest is hot.
 type StreamState struct {
-	Msgs      uint64          `json:"messages"`
-	Bytes     uint64          `json:"bytes"`
-	FirstSeq  uint64          `json:"first_seq"`
-	FirstTime time.Time       `json:"first_ts"`
-	LastSeq   uint64          `json:"last_seq"`
-	LastTime  time.Time       `json:"last_ts"`
-	Deleted   []uint64        `json:"deleted,omitempty"`
-	Lost      *LostStreamData `json:"lost,omitempty"`
-	Consumers int             `json:"consumer_count"`
+	Msgs            uint64          `json:"messages"`
+	Bytes           uint64          `json:"bytes"`
+	CompressedBytes uint64          `json:"compressed_bytes,omitempty"`
+	ArchivedBytes   uint64          `json:"archived_bytes,omitempty"`
+	FirstSeq        uint64          `json:"first_seq"`
+	FirstTime       time.Time       `json:"first_ts"`
+	LastSeq         uint64          `json:"last_seq"`
+	LastTime        time.Time       `json:"last_ts"`
+	Deleted         []uint64        `json:"deleted,omitempty"`
+	Lost            *LostStreamData `json:"lost,omitempty"`
+	Consumers       int             `json:"consumer_count"`
+}
+
+// SimpleState for filtered subject specific state.
+type SimpleState struct {
+	Msgs  uint64 `json:"messages"`
+	First uint64 `json:"first_seq"`
+	Last  uint64 `json:"last_seq"`
+
+	// Internal usage for when the first or last need to be updated before use.
+	firstNeedsUpdate bool
+	lastNeedsUpdate  bool
 }
 
 // LostStreamData indicates msgs that have been lost.
@@ -172,6 +213,107 @@ type Pending struct {
 	Timestamp int64
 }
 
+// Time ordered index of messages that have a per message TTL.
+// The stores remove entries when their messages are removed.
+type msgTTLIndex struct {
+	ttls []msgTTL
+	// Position in the heap for each sequence.
+	pos map[uint64]int
+}
+
+type msgTTL struct {
+	seq     uint64
+	expires int64 // nanoseconds
+}
+
+func (ti *msgTTLIndex) Len() int { return len(ti.ttls) }
+
+func (ti *msgTTLIndex) Less(i, j int) bool {
+	if ti.ttls[i].expires == ti.ttls[j].expires {
+		return ti.ttls[i].seq < ti.ttls[j].seq
+	}
+	return ti.ttls[i].expires < ti.ttls[j].expires
+}
+
+func (ti *msgTTLIndex) Swap(i, j int) {
+	ti.ttls[i], ti.ttls[j] = ti.ttls[j], ti.ttls[i]
+	ti.pos[ti.ttls[i].seq] = i
+	ti.pos[ti.ttls[j].seq] = j
+}
+
+func (ti *msgTTLIndex) Push(x interface{}) {
+	mt := x.(msgTTL)
+	ti.pos[mt.seq] = len(ti.ttls)
+	ti.ttls = append(ti.ttls, mt)
+}
+
+func (ti *msgTTLIndex) Pop() interface{} {
+	n := len(ti.ttls)
+	mt := ti.ttls[n-1]
+	ti.ttls = ti.ttls[:n-1]
+	delete(ti.pos, mt.seq)
+	return mt
+}
+
+// Add a message that will expire at the given time.
+// Returns true if this is now the next message to expire.
+func (ti *msgTTLIndex) add(seq uint64, expires int64) bool {
+	if ti.pos == nil {
+		ti.pos = make(map[uint64]int)
+	}
+	if i, ok := ti.pos[seq]; ok {
+		ti.ttls[i].expires = expires
+		heap.Fix(ti, i)
+	} else {
+		heap.Push(ti, msgTTL{seq, expires})
+	}
+	return ti.ttls[0].seq == seq
+}
+
+// Returns the next message to expire, or a zero sequence if there is none.
+func (ti *msgTTLIndex) next() (uint64, int64) {
+	if len(ti.ttls) == 0 {
+		return 0, 0
+	}
+	return ti.ttls[0].seq, ti.ttls[0].expires
+}
+
+// Remove the next message to expire.
+func (ti *msgTTLIndex) remove() {
+	if len(ti.ttls) > 0 {
+		heap.Pop(ti)
+	}
+}
+
+// Remove the entry for this sequence if we have one.
+func (ti *msgTTLIndex) removeSeq(seq uint64) {
+	if i, ok := ti.pos[seq]; ok {
+		heap.Remove(ti, i)
+	}
+}
+
+// Remove all entries for sequences outside of [first, last].
+func (ti *msgTTLIndex) removeOutside(first, last uint64) {
+	ttls := ti.ttls[:0]
+	for _, mt := range ti.ttls {
+		if mt.seq >= first && mt.seq <= last {
+			ttls = append(ttls, mt)
+		} else {
+			delete(ti.pos, mt.seq)
+		}
+	}
+	ti.ttls = ttls
+	for i, mt := range ti.ttls {
+		ti.pos[mt.seq] = i
+	}
+	heap.Init(ti)
+}
+
+// Remove all entries.
+func (ti *msgTTLIndex) reset() {
+	ti.ttls, ti.pos = nil, nil
+}
+
 // TemplateStore stores templates.
 type TemplateStore interface {
 	Store(*streamTemplate) error
@@ -262,6 +404,45 @@ func (dp *DiscardPolicy) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+const (
+	noCompressionString = "none"
+	s2CompressionString = "s2"
+)
+
+func (sc StoreCompression) String() string {
+	switch sc {
+	case NoCompression:
+		return "None"
+	case S2Compression:
+		return "S2"
+	default:
+		return "Unknown StoreCompression"
+	}
+}
+
+func (sc StoreCompression) MarshalJSON() ([]byte, error) {
+	switch sc {
+	case NoCompression:
+		return json.Marshal(noCompressionString)
+	case S2Compression:
+		return json.Marshal(s2CompressionString)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", sc)
+	}
+}
+
+func (sc *StoreCompression) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case jsonString(noCompressionString):
+		*sc = NoCompression
+	case jsonString(s2CompressionString):
+		*sc = S2Compression
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
 const (
 	memoryStorageString = "memory"
 	fileStorageString   = "file"
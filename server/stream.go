@@ -29,6 +29,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/klauspost/compress/s2"
@@ -44,6 +45,7 @@ type StreamConfig struct {
 	MaxConsumers int             `json:"max_consumers"`
 	MaxMsgs      int64           `json:"max_msgs"`
 	MaxBytes     int64           `json:"max_bytes"`
+	MaxMsgsPer   int64           `json:"max_msgs_per_subject"`
 	Discard      DiscardPolicy   `json:"discard"`
 	MaxAge       time.Duration   `json:"max_age"`
 	MaxMsgSize   int32           `json:"max_msg_size,omitempty"`
@@ -55,6 +57,20 @@ type StreamConfig struct {
 	Placement    *Placement      `json:"placement,omitempty"`
 	Mirror       *StreamSource   `json:"mirror,omitempty"`
 	Sources      []*StreamSource `json:"sources,omitempty"`
+	RePublish    *RePublish      `json:"republish,omitempty"`
+	Sealed       bool            `json:"sealed"`
+	DenyDelete   bool            `json:"deny_delete"`
+	DenyPurge    bool            `json:"deny_purge"`
+	AllowRollup  bool            `json:"allow_rollup"`
+	AllowMsgTTL  bool            `json:"allow_msg_ttl"`
+	AllowDirect  bool            `json:"allow_direct"`
+	AllowAtomic  bool            `json:"allow_atomic"`
+
+	// SubjectTransform is applied to the subject of messages received on the stream subjects before they are stored.
+	SubjectTransform *SubjectTransformConfig `json:"subject_transform,omitempty"`
+
+	// Compression is applied to message blocks at rest and is only supported for file storage.
+	Compression StoreCompression `json:"compression,omitempty"`
 }
 
 const JSApiPubAckResponseType = "io.nats.jetstream.api.v1.pub_ack_response"
@@ -71,6 +87,8 @@ type PubAck struct {
 	Stream    string `json:"stream"`
 	Sequence  uint64 `json:"seq"`
 	Duplicate bool   `json:"duplicate,omitempty"`
+	BatchId   string `json:"batch,omitempty"`
+	BatchSize int    `json:"count,omitempty"`
 }
 
 // StreamInfo shows config and current state for this stream.
@@ -89,6 +107,21 @@ type ClusterInfo struct {
 	Name     string      `json:"name,omitempty"`
 	Leader   string      `json:"leader,omitempty"`
 	Replicas []*PeerInfo `json:"replicas,omitempty"`
+	// Set while a stream is moving to new peers. Replicas will hold both the
+	// old and the new peers, and Migration how far each new peer has caught up.
+	Migrating bool             `json:"migrating,omitempty"`
+	Migration []*MigrationInfo `json:"migration,omitempty"`
+}
+
+// MigrationInfo shows how far a new peer of a stream being moved has caught up.
+// Seq is the last stream sequence the peer is known to have and LastSeq the one
+// it is catching up to. Raft entries the peer has not applied yet count as one
+// message each, so Seq is an estimate until the peer is current.
+type MigrationInfo struct {
+	Name    string `json:"name"`
+	Current bool   `json:"current"`
+	Seq     uint64 `json:"seq"`
+	LastSeq uint64 `json:"last_seq"`
 }
 
 // PeerInfo shows information about all the peers in the cluster that
@@ -111,11 +144,29 @@ type StreamSourceInfo struct {
 
 // StreamSource dictates how streams can source from other streams.
 type StreamSource struct {
-	Name          string          `json:"name"`
-	OptStartSeq   uint64          `json:"opt_start_seq,omitempty"`
-	OptStartTime  *time.Time      `json:"opt_start_time,omitempty"`
-	FilterSubject string          `json:"filter_subject,omitempty"`
-	External      *ExternalStream `json:"external,omitempty"`
+	Name             string                  `json:"name"`
+	OptStartSeq      uint64                  `json:"opt_start_seq,omitempty"`
+	OptStartTime     *time.Time              `json:"opt_start_time,omitempty"`
+	FilterSubject    string                  `json:"filter_subject,omitempty"`
+	SubjectTransform *SubjectTransformConfig `json:"subject_transform,omitempty"`
+	External         *ExternalStream         `json:"external,omitempty"`
+}
+
+// SubjectTransformConfig is for transforming the subject of messages before they are stored.
+// Source is a filter on the subject and Destination is a subject template using the same
+// wildcard references as subject mappings. Subjects that do not match are left as is.
+type SubjectTransformConfig struct {
+	Source      string `json:"src,omitempty"`
+	Destination string `json:"dest"`
+}
+
+// RePublish is for republishing messages once committed to a stream.
+// Source is a filter on the stream subjects, and Destination is a subject
+// template using the same wildcard references as subject mappings.
+type RePublish struct {
+	Source      string `json:"src,omitempty"`
+	Destination string `json:"dest"`
+	HeadersOnly bool   `json:"headers_only,omitempty"`
 }
 
 // ExternalStream allows you to qualify access to a stream source in another account.
@@ -163,6 +214,16 @@ type stream struct {
 	// For flowcontrol processing for source and mirror internal consumers.
 	fcr map[uint64]string
 
+	// Republish transform.
+	tr *transform
+
+	// Subject transform for messages received on our subjects.
+	itr *transform
+
+	// Direct get subscriptions, for us and our mirror origin.
+	directSub  *subscription
+	mdirectSub *subscription
+
 	// TODO(dlc) - Hide everything below behind two pointers.
 	// Clustered mode.
 	sa       *streamAssignment
@@ -174,12 +235,24 @@ type stream struct {
 	clseq    uint64
 	clfs     uint64
 	lqsent   time.Time
-	catchups map[string]uint64
+	catchups map[string]*catchupPeer
+	// Signaled when our stream assignment is updated.
+	uch chan struct{}
+	// Subjects with an expected last subject sequence proposal in flight.
+	lssip map[string]uint64
+
+	// Atomic batches being staged by the leader.
+	batches map[string]*batchGroup
+	// Total bytes of all batches being staged.
+	batchBytes uint64
+	// Held while storing messages so an atomic batch is stored contiguously.
+	smu sync.Mutex
 }
 
 type sourceInfo struct {
 	name  string
 	cname string
+	tr    *transform
 	sub   *subscription
 	msgs  *inbound
 	sseq  uint64
@@ -193,13 +266,35 @@ type sourceInfo struct {
 
 // Headers for published messages.
 const (
-	JSMsgId             = "Nats-Msg-Id"
-	JSExpectedStream    = "Nats-Expected-Stream"
-	JSExpectedLastSeq   = "Nats-Expected-Last-Sequence"
-	JSExpectedLastMsgId = "Nats-Expected-Last-Msg-Id"
-	JSStreamSource      = "Nats-Stream-Source"
-	JSLastConsumerSeq   = "Nats-Last-Consumer"
-	JSLastStreamSeq     = "Nats-Last-Stream"
+	JSMsgId               = "Nats-Msg-Id"
+	JSExpectedStream      = "Nats-Expected-Stream"
+	JSExpectedLastSeq     = "Nats-Expected-Last-Sequence"
+	JSExpectedLastMsgId   = "Nats-Expected-Last-Msg-Id"
+	JSExpectedLastSubjSeq = "Nats-Expected-Last-Subject-Sequence"
+	JSStreamSource        = "Nats-Stream-Source"
+	JSLastConsumerSeq     = "Nats-Last-Consumer"
+	JSLastStreamSeq       = "Nats-Last-Stream"
+	JSMsgRollup           = "Nats-Rollup"
+	JSMessageTTL          = "Nats-TTL"
+	JSBatchId             = "Nats-Batch-Id"
+	JSBatchSeq            = "Nats-Batch-Sequence"
+	JSBatchCommit         = "Nats-Batch-Commit"
+)
+
+// Rollups, can be subject only or all messages.
+const (
+	JSMsgRollupSubject = "sub"
+	JSMsgRollupAll     = "all"
+)
+
+// Headers for republished messages.
+const (
+	JSStream       = "Nats-Stream"
+	JSSequence     = "Nats-Sequence"
+	JSLastSequence = "Nats-Last-Sequence"
+	JSSubject      = "Nats-Subject"
+	JSTimeStamp    = "Nats-Time-Stamp"
+	JSMsgSize      = "Nats-Msg-Size"
 )
 
 // Dedupe entry
@@ -319,6 +414,14 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 		msgs:      &inbound{mch: make(chan struct{}, 1)},
 		rmch:      make(chan uint64, 8192),
 		qch:       make(chan struct{}),
+		uch:       make(chan struct{}, 1),
+	}
+	// Config has been checked so these can not fail.
+	if cfg.RePublish != nil {
+		mset.tr, _ = newStreamTransform(cfg.RePublish.Source, cfg.RePublish.Destination)
+	}
+	if cfg.SubjectTransform != nil {
+		mset.itr, _ = newStreamTransform(cfg.SubjectTransform.Source, cfg.SubjectTransform.Destination)
 	}
 
 	jsa.streams[cfg.Name] = mset
@@ -341,8 +444,16 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 		}
 	}
 	fsCfg.StoreDir = storeDir
+	fsCfg.Cipher = s.getOpts().JetStreamCipher
 	fsCfg.AsyncFlush = false
 	fsCfg.SyncInterval = 2 * time.Minute
+	fsCfg.srv = s
+	// Cold blocks can be moved to a secondary location if configured.
+	// The archive may be shared, so each server keeps its own blocks.
+	if opts := s.getOpts(); opts.JetStreamArchiveDir != _EMPTY_ {
+		fsCfg.Archive = NewDirBlockArchive(path.Join(opts.JetStreamArchiveDir, s.Name(), a.Name, streamsDir, cfg.Name))
+		fsCfg.ArchiveAge = opts.JetStreamArchiveAge
+	}
 
 	if err := mset.setupStore(fsCfg); err != nil {
 		mset.stop(true, false)
@@ -366,6 +477,18 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	// Setup our internal send go routine.
 	mset.setupSendCapabilities()
 
+	// Direct gets are answered by all replicas so setup here regardless of leadership.
+	// Replicas answer from their local store, so one that is behind may not have the message yet.
+	if cfg.AllowDirect {
+		mset.mu.Lock()
+		err := mset.subscribeToDirect()
+		mset.mu.Unlock()
+		if err != nil {
+			mset.stop(true, false)
+			return nil, err
+		}
+	}
+
 	// Call directly to set leader if not in clustered mode.
 	// This can be called though before we actually setup clustering, so check both.
 	if !s.JetStreamIsClustered() && s.standAloneMode() {
@@ -413,6 +536,12 @@ func (mset *stream) setStreamAssignment(sa *streamAssignment) {
 	// Set our node.
 	mset.node = sa.Group.node
 
+	// Let our monitor know our assignment changed.
+	select {
+	case mset.uch <- struct{}{}:
+	default:
+	}
+
 	// Setup our info sub here as well for all stream members. This is now by design.
 	if mset.infoSub == nil {
 		isubj := fmt.Sprintf(clusterStreamInfoT, mset.jsa.acc(), mset.cfg.Name)
@@ -421,6 +550,13 @@ func (mset *stream) setStreamAssignment(sa *streamAssignment) {
 	}
 }
 
+// Returns a channel that is signaled when our stream assignment is updated.
+func (mset *stream) updateC() <-chan struct{} {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.uch
+}
+
 // Lock should be held.
 func (mset *stream) isLeader() bool {
 	if mset.node != nil {
@@ -450,6 +586,10 @@ func (mset *stream) setLeader(isLeader bool) error {
 		// Clear catchup state
 		mset.clearAllCatchupPeers()
 	}
+	// Any in flight proposals are no longer tracked by us.
+	mset.lssip = nil
+	// Batches are only staged on the leader, so drop any partial ones.
+	mset.clearBatches()
 	mset.mu.Unlock()
 	return nil
 }
@@ -579,6 +719,38 @@ func (mset *stream) lastSeq() uint64 {
 	return lseq
 }
 
+// Returns our last applied sequence, accounting for any message assignments that we had to skip.
+func (mset *stream) appliedSeq() uint64 {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.lseq + mset.clfs
+}
+
+func (mset *stream) setCLFS(clfs uint64) {
+	mset.mu.Lock()
+	mset.clfs = clfs
+	mset.mu.Unlock()
+}
+
+// Called for a proposal we skip since our store already has its sequence, e.g. when replaying
+// our log after a restart. Failed proposals are only tracked in our snapshots, so check if the
+// message stored at its sequence is the one proposed, and if not count the proposal as failed.
+// If that message has since been removed we can not tell and assume it was stored.
+func (mset *stream) checkSkippedProposal(lseq uint64, ts int64, num uint64) {
+	mset.mu.RLock()
+	store, clfs := mset.store, mset.clfs
+	mset.mu.RUnlock()
+
+	if store == nil || lseq+1 <= clfs {
+		return
+	}
+	if _, _, _, sts, err := store.LoadMsg(lseq + 1 - clfs); err == nil && sts != ts {
+		mset.mu.Lock()
+		mset.clfs += num
+		mset.mu.Unlock()
+	}
+}
+
 func (mset *stream) setLastSeq(lseq uint64) {
 	mset.mu.Lock()
 	mset.lseq = lseq
@@ -695,6 +867,34 @@ func (jsa *jsAccount) subjectsOverlap(subjects []string) bool {
 // Default duplicates window.
 const StreamDefaultDuplicatesWindow = 2 * time.Minute
 
+// Creates the transform used for republish and subject transforms.
+// A literal destination will receive all messages that match the source.
+func newStreamTransform(src, dest string) (*transform, error) {
+	if IsValidSubject(src) && IsValidLiteralSubject(dest) {
+		literal := true
+		for _, token := range strings.Split(dest, tsep) {
+			if placeHolderIndex(token) >= 0 {
+				literal = false
+				break
+			}
+		}
+		if literal {
+			return &transform{src: src, dest: dest}, nil
+		}
+	}
+	return newTransform(src, dest)
+}
+
+// Returns the subject transform for a source if configured.
+// Config should have already been checked.
+func sourceTransform(ssi *StreamSource) *transform {
+	if ssi == nil || ssi.SubjectTransform == nil {
+		return nil
+	}
+	tr, _ := newStreamTransform(ssi.SubjectTransform.Source, ssi.SubjectTransform.Destination)
+	return tr
+}
+
 func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
 	if config == nil {
 		return StreamConfig{}, fmt.Errorf("stream configuration invalid")
@@ -711,6 +911,9 @@ func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
 	if cfg.Storage == 0 {
 		cfg.Storage = FileStorage
 	}
+	if cfg.Compression != NoCompression && cfg.Storage != FileStorage {
+		return StreamConfig{}, fmt.Errorf("compression is only supported for file storage")
+	}
 	if cfg.Replicas == 0 {
 		cfg.Replicas = 1
 	}
@@ -723,6 +926,9 @@ func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
 	if cfg.MaxBytes == 0 {
 		cfg.MaxBytes = -1
 	}
+	if cfg.MaxMsgsPer == 0 {
+		cfg.MaxMsgsPer = -1
+	}
 	if cfg.MaxMsgSize == 0 {
 		cfg.MaxMsgSize = -1
 	}
@@ -762,6 +968,85 @@ func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
 			dset[subj] = struct{}{}
 		}
 	}
+
+	// Rollups remove messages so need to be able to purge.
+	if cfg.AllowRollup && cfg.DenyPurge {
+		return StreamConfig{}, fmt.Errorf("stream rollups require the purge permission")
+	}
+
+	// Check for subject transforms. Mirrors need to keep the original subjects.
+	if cfg.Mirror != nil && (cfg.SubjectTransform != nil || cfg.Mirror.SubjectTransform != nil) {
+		return StreamConfig{}, fmt.Errorf("stream mirrors can not have subject transforms")
+	}
+	if cfg.SubjectTransform != nil {
+		st := *cfg.SubjectTransform
+		// Empty source means all messages received on our subjects.
+		if st.Source == _EMPTY_ {
+			if len(cfg.Subjects) == 1 {
+				st.Source = cfg.Subjects[0]
+			} else {
+				st.Source = ">"
+			}
+		}
+		if _, err := newStreamTransform(st.Source, st.Destination); err != nil {
+			return StreamConfig{}, fmt.Errorf("stream subject transform from %q to %q is not valid", st.Source, st.Destination)
+		}
+		cfg.SubjectTransform = &st
+	}
+	var copied bool
+	for i, ssi := range cfg.Sources {
+		if ssi.SubjectTransform == nil {
+			continue
+		}
+		st := *ssi.SubjectTransform
+		// Empty source means all messages we receive from this source.
+		if st.Source == _EMPTY_ {
+			if st.Source = ssi.FilterSubject; st.Source == _EMPTY_ {
+				st.Source = ">"
+			}
+		}
+		if _, err := newStreamTransform(st.Source, st.Destination); err != nil {
+			return StreamConfig{}, fmt.Errorf("stream source %q subject transform from %q to %q is not valid", ssi.Name, st.Source, st.Destination)
+		}
+		if ssi.FilterSubject != _EMPTY_ && !SubjectsCollide(st.Source, ssi.FilterSubject) {
+			return StreamConfig{}, fmt.Errorf("stream source %q subject transform does not match its filter subject", ssi.Name)
+		}
+		// Do not modify the original sources.
+		if !copied {
+			cfg.Sources = append([]*StreamSource(nil), cfg.Sources...)
+			copied = true
+		}
+		nssi := *ssi
+		nssi.SubjectTransform = &st
+		cfg.Sources[i] = &nssi
+	}
+
+	// Check for a republish config.
+	if cfg.RePublish != nil {
+		rp := *cfg.RePublish
+		// Empty source means all messages stored in the stream.
+		if rp.Source == _EMPTY_ {
+			rp.Source = ">"
+		}
+		if _, err := newStreamTransform(rp.Source, rp.Destination); err != nil {
+			return StreamConfig{}, fmt.Errorf("stream republish transform from %q to %q is not valid", rp.Source, rp.Destination)
+		}
+		// The destination must not overlap with our subjects, otherwise we would form a cycle.
+		// The source should overlap with them unless we store messages with other subjects.
+		var overlap bool
+		for _, subj := range cfg.Subjects {
+			if SubjectsCollide(rp.Destination, subj) {
+				return StreamConfig{}, fmt.Errorf("stream republish destination forms a cycle")
+			}
+			if SubjectsCollide(rp.Source, subj) {
+				overlap = true
+			}
+		}
+		if len(cfg.Subjects) > 0 && len(cfg.Sources) == 0 && cfg.SubjectTransform == nil && !overlap {
+			return StreamConfig{}, fmt.Errorf("stream republish source does not match any stream subjects")
+		}
+		cfg.RePublish = &rp
+	}
 	return cfg, nil
 }
 
@@ -811,6 +1096,19 @@ func (jsa *jsAccount) configUpdateCheck(old, new *StreamConfig) (*StreamConfig,
 	if cfg.Template != _EMPTY_ {
 		return nil, fmt.Errorf("stream configuration update can not be owned by a template")
 	}
+	// Once set these can not be removed.
+	if old.Sealed && !cfg.Sealed {
+		return nil, fmt.Errorf("stream configuration update can not unseal a sealed stream")
+	}
+	if old.DenyDelete && !cfg.DenyDelete {
+		return nil, fmt.Errorf("stream configuration update can not cancel deny message deletes")
+	}
+	if old.DenyPurge && !cfg.DenyPurge {
+		return nil, fmt.Errorf("stream configuration update can not cancel deny purge")
+	}
+	if old.AllowMsgTTL && !cfg.AllowMsgTTL {
+		return nil, fmt.Errorf("stream configuration update can not disable message TTLs")
+	}
 
 	// Check limits.
 	if err := jsa.checkLimits(&cfg); err != nil {
@@ -873,10 +1171,13 @@ func (mset *stream) update(config *StreamConfig) error {
 						mset.sources = make(map[string]*sourceInfo)
 					}
 					mset.cfg.Sources = append(mset.cfg.Sources, s)
-					si := &sourceInfo{name: s.Name, msgs: &inbound{mch: make(chan struct{}, 1)}}
+					si := &sourceInfo{name: s.Name, tr: sourceTransform(s), msgs: &inbound{mch: make(chan struct{}, 1)}}
 					mset.sources[s.Name] = si
 					mset.setStartingSequenceForSource(s.Name)
 					mset.setSourceConsumer(s.Name, si.sseq+1)
+				} else if si := mset.sources[s.Name]; si != nil {
+					// The subject transform may have changed.
+					si.tr = sourceTransform(s)
 				}
 				delete(current, s.Name)
 			}
@@ -886,11 +1187,46 @@ func (mset *stream) update(config *StreamConfig) error {
 				delete(mset.sources, sname)
 			}
 		}
+
+		// If we are being sealed we will no longer take in messages from a mirror or sources.
+		if cfg.Sealed && !ocfg.Sealed {
+			if mset.mirror != nil {
+				if mset.mirror.sub != nil {
+					mset.unsubscribe(mset.mirror.sub)
+					mset.mirror.sub = nil
+				}
+				mset.removeInternalConsumer(mset.mirror)
+			}
+			mset.stopSourceConsumers()
+			mset.sources = nil
+		}
+	}
+
+	// Check for republish and subject transform changes.
+	if cfg.RePublish != nil {
+		mset.tr, _ = newStreamTransform(cfg.RePublish.Source, cfg.RePublish.Destination)
+	} else {
+		mset.tr = nil
+	}
+	if cfg.SubjectTransform != nil {
+		mset.itr, _ = newStreamTransform(cfg.SubjectTransform.Source, cfg.SubjectTransform.Destination)
+	} else {
+		mset.itr = nil
 	}
 
 	// Now update config and store's version of our config.
 	mset.cfg = *cfg
 
+	// Direct gets are answered by all replicas.
+	if cfg.AllowDirect && !ocfg.AllowDirect {
+		if err := mset.subscribeToDirect(); err != nil {
+			mset.mu.Unlock()
+			return err
+		}
+	} else if !cfg.AllowDirect && ocfg.AllowDirect {
+		mset.unsubscribeToDirect()
+	}
+
 	var suppress bool
 	if mset.isClustered() && mset.sa != nil {
 		suppress = mset.sa.responded
@@ -906,23 +1242,42 @@ func (mset *stream) update(config *StreamConfig) error {
 }
 
 // Purge will remove all messages from the stream and underlying store.
-func (mset *stream) purge() (uint64, error) {
+// An optional request can filter by subject, purge up to a sequence or keep a number of messages per subject.
+func (mset *stream) purge(preq *JSApiStreamPurgeRequest) (uint64, error) {
+	var subj string
+	var seq, keep uint64
+	if preq != nil {
+		subj, seq, keep = preq.Subject, preq.Sequence, preq.Keep
+	}
+	full := (subj == _EMPTY_ || subj == fwcs) && seq == 0 && keep == 0
+
 	mset.mu.Lock()
 	if mset.client == nil {
 		mset.mu.Unlock()
 		return 0, errors.New("stream closed")
 	}
-	// Purge dedupe.
-	mset.ddmap = nil
 	var _obs [4]*consumer
 	obs := _obs[:0]
-	for _, o := range mset.consumers {
-		obs = append(obs, o)
+	if full {
+		// Purge dedupe.
+		mset.ddmap = nil
+		for _, o := range mset.consumers {
+			obs = append(obs, o)
+		}
 	}
 	mset.mu.Unlock()
 
-	purged, err := mset.store.Purge()
-	if err != nil {
+	var purged uint64
+	var err error
+	if full {
+		purged, err = mset.store.Purge()
+	} else {
+		purged, err = mset.store.PurgeEx(subj, seq, keep)
+	}
+	// Partial purges leave the consumers where they are. Stream pending is adjusted
+	// for each removed message and removed messages will be skipped on delivery.
+	// If we could only not clean up the archive the messages are still gone.
+	if (err != nil && !errors.Is(err, errArchiveRemove)) || !full {
 		return purged, err
 	}
 
@@ -931,7 +1286,38 @@ func (mset *stream) purge() (uint64, error) {
 	for _, o := range obs {
 		o.purge(state.FirstSeq)
 	}
-	return purged, nil
+	return purged, err
+}
+
+// Process a rollup for the message just stored at seq.
+// A subject rollup removes all prior messages for that subject, otherwise all prior messages are removed.
+func (mset *stream) processRollup(rollup, subject string, seq uint64) {
+	mset.mu.RLock()
+	store := mset.store
+	var _obs [4]*consumer
+	obs := _obs[:0]
+	if rollup == JSMsgRollupAll {
+		for _, o := range mset.consumers {
+			obs = append(obs, o)
+		}
+	}
+	mset.mu.RUnlock()
+
+	if rollup == JSMsgRollupSubject {
+		if _, err := store.PurgeEx(subject, seq, 0); err != nil {
+			mset.srv.Warnf("JetStream stream '%s > %s' rollup error: %v", mset.account().Name, mset.name(), err)
+		}
+		return
+	}
+	if _, err := store.Compact(seq); err != nil {
+		mset.srv.Warnf("JetStream stream '%s > %s' rollup error: %v", mset.account().Name, mset.name(), err)
+		if !errors.Is(err, errArchiveRemove) {
+			return
+		}
+	}
+	for _, o := range obs {
+		o.purge(seq)
+	}
 }
 
 // RemoveMsg will remove a message from a stream.
@@ -1160,7 +1546,7 @@ func (mset *stream) processMirrorMsgs() {
 			}
 		case <-t.C:
 			mset.mu.RLock()
-			stalled := mset.mirror != nil && time.Since(mset.mirror.last) > 3*sourceHealthCheckInterval
+			stalled := mset.mirror != nil && !mset.cfg.Sealed && time.Since(mset.mirror.last) > 3*sourceHealthCheckInterval
 			mset.mu.RUnlock()
 			if stalled {
 				mset.retryMirrorConsumer()
@@ -1261,7 +1647,7 @@ func (mset *stream) processInboundMirrorMsg(m *inMsg) bool {
 			err = node.Propose(encodeStreamMsg(m.subj, _EMPTY_, m.hdr, m.msg, sseq-1, ts))
 		}
 	} else {
-		err = mset.processJetStreamMsg(m.subj, _EMPTY_, m.hdr, m.msg, sseq-1, ts)
+		err = mset.processJetStreamMsg(m.subj, _EMPTY_, m.hdr, m.msg, sseq-1, ts, false)
 	}
 	if err != nil {
 		if err == errLastSeqMismatch {
@@ -1750,9 +2136,17 @@ func (mset *stream) processInboundSourceMsg(si *sourceInfo, m *inMsg) bool {
 	} else {
 		si.lag = pending - 1
 	}
+	tr := si.tr
 	mset.mu.Unlock()
 
-	hdr, msg := m.hdr, m.msg
+	hdr, msg, subject := m.hdr, m.msg, m.subj
+
+	// Apply our subject transform if configured.
+	if tr != nil {
+		if tsubj, err := tr.match(subject); err == nil {
+			subject = tsubj
+		}
+	}
 
 	// If we are daisy chained here make sure to remove the original one.
 	if len(hdr) > 0 {
@@ -1765,14 +2159,14 @@ func (mset *stream) processInboundSourceMsg(si *sourceInfo, m *inMsg) bool {
 	var clseq uint64
 	// If we are clustered we need to propose this message to the underlying raft group.
 	if node != nil {
-		clseq, err = mset.processClusteredInboundMsg(m.subj, _EMPTY_, hdr, msg)
+		clseq, err = mset.processClusteredInboundMsg(subject, _EMPTY_, hdr, msg)
 		if err == nil {
 			mset.mu.Lock()
 			si.clseq = clseq
 			mset.mu.Unlock()
 		}
 	} else {
-		err = mset.processJetStreamMsg(m.subj, _EMPTY_, hdr, msg, 0, 0)
+		err = mset.processJetStreamMsg(subject, _EMPTY_, hdr, msg, 0, 0, false)
 	}
 
 	if err != nil {
@@ -1851,7 +2245,7 @@ func (mset *stream) startingSequenceForSources() {
 		return
 	}
 	for _, ssi := range mset.cfg.Sources {
-		si := &sourceInfo{name: ssi.Name, msgs: &inbound{mch: make(chan struct{}, 1)}}
+		si := &sourceInfo{name: ssi.Name, tr: sourceTransform(ssi), msgs: &inbound{mch: make(chan struct{}, 1)}}
 		mset.sources[ssi.Name] = si
 	}
 
@@ -1933,12 +2327,12 @@ func (mset *stream) subscribeToStream() error {
 			return err
 		}
 	}
-	// Check if we need to setup mirroring.
-	if mset.cfg.Mirror != nil {
+	// Check if we need to setup mirroring. Sealed streams do not take in any new messages.
+	if mset.cfg.Mirror != nil && !mset.cfg.Sealed {
 		if err := mset.setupMirrorConsumer(); err != nil {
 			return err
 		}
-	} else if len(mset.cfg.Sources) > 0 {
+	} else if len(mset.cfg.Sources) > 0 && !mset.cfg.Sealed {
 		if err := mset.setupSourceConsumers(); err != nil {
 			return err
 		}
@@ -1992,6 +2386,11 @@ func (mset *stream) unsubscribeToStream() error {
 
 // Lock should be held.
 func (mset *stream) subscribeInternal(subject string, cb msgHandler) (*subscription, error) {
+	return mset.queueSubscribeInternal(subject, _EMPTY_, cb)
+}
+
+// Lock should be held.
+func (mset *stream) queueSubscribeInternal(subject, group string, cb msgHandler) (*subscription, error) {
 	c := mset.client
 	if c == nil {
 		return nil, fmt.Errorf("invalid stream")
@@ -2005,8 +2404,137 @@ func (mset *stream) subscribeInternal(subject string, cb msgHandler) (*subscript
 
 	mset.sid++
 
+	var queue []byte
+	if group != _EMPTY_ {
+		queue = []byte(group)
+	}
+
 	// Now create the subscription
-	return c.processSub([]byte(subject), nil, []byte(strconv.Itoa(mset.sid)), cb, false)
+	return c.processSub([]byte(subject), queue, []byte(strconv.Itoa(mset.sid)), cb, false)
+}
+
+// Queue group for direct gets so only one replica or mirror answers.
+const directGetGroup = "_dg"
+
+// Status responses for direct gets.
+var (
+	directGetBadRequest = []byte("NATS/1.0 400 Bad Request\r\n\r\n")
+	directGetNotFound   = []byte("NATS/1.0 404 Message Not Found\r\n\r\n")
+	directGetOverloaded = []byte("NATS/1.0 503 JetStream API limit exceeded\r\n\r\n")
+)
+
+// Will subscribe to our direct get subject, and our origin's if we are a mirror.
+// Lock should be held.
+func (mset *stream) subscribeToDirect() error {
+	if mset.directSub == nil {
+		sub, err := mset.queueSubscribeInternal(fmt.Sprintf(JSDirectMsgGetT, mset.cfg.Name), directGetGroup, mset.processDirectGetRequest)
+		if err != nil {
+			return err
+		}
+		mset.directSub = sub
+	}
+	// Mirrors in the same account can answer for their origin stream.
+	if m := mset.cfg.Mirror; m != nil && m.External == nil && mset.mdirectSub == nil {
+		sub, err := mset.queueSubscribeInternal(fmt.Sprintf(JSDirectMsgGetT, m.Name), directGetGroup, mset.processDirectGetRequest)
+		if err != nil {
+			return err
+		}
+		mset.mdirectSub = sub
+	}
+	return nil
+}
+
+// Lock should be held.
+func (mset *stream) unsubscribeToDirect() {
+	if mset.directSub != nil {
+		mset.unsubscribe(mset.directSub)
+		mset.directSub = nil
+	}
+	if mset.mdirectSub != nil {
+		mset.unsubscribe(mset.mdirectSub)
+		mset.mdirectSub = nil
+	}
+}
+
+// Process a direct get request. We answer from our local store with the raw message and its headers.
+// Any replica can answer, so a replica that has not caught up yet will answer not found for messages
+// it does not have yet, even though the stream leader has them.
+func (mset *stream) processDirectGetRequest(_ *subscription, c *client, subject, reply string, rmsg []byte) {
+	if len(reply) == 0 {
+		return
+	}
+	_, msg := c.msgParts(rmsg)
+
+	mset.mu.RLock()
+	store, outq := mset.store, mset.outq
+	mset.mu.RUnlock()
+	if store == nil || outq == nil {
+		return
+	}
+
+	// If this is direct from a client can proceed inline.
+	if c.kind == CLIENT {
+		mset.getDirectRequest(reply, msg)
+		return
+	}
+
+	// Otherwise we do not want to block a route or gateway while we load from our store.
+	js := mset.srv.getJetStream()
+	if js == nil {
+		return
+	}
+	if apiOut := atomic.AddInt64(&js.apiCalls, 1); apiOut > 1024 {
+		atomic.AddInt64(&js.apiCalls, -1)
+		outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, directGetOverloaded, nil, nil, 0, nil})
+		mset.srv.Warnf("JetStream API limit exceeded: %d calls outstanding", apiOut)
+		return
+	}
+
+	// Dispatch the request to its own Go routine.
+	msg = copyBytes(msg)
+	go func() {
+		mset.getDirectRequest(reply, msg)
+		atomic.AddInt64(&js.apiCalls, -1)
+	}()
+}
+
+// Load the requested message from our store and send it to reply.
+func (mset *stream) getDirectRequest(reply string, msg []byte) {
+	mset.mu.RLock()
+	store, name, outq := mset.store, mset.cfg.Name, mset.outq
+	mset.mu.RUnlock()
+	if store == nil || outq == nil {
+		return
+	}
+
+	var req JSApiMsgGetRequest
+	if err := json.Unmarshal(msg, &req); err != nil || (req.Seq > 0) == (req.LastFor != _EMPTY_) {
+		outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, directGetBadRequest, nil, nil, 0, nil})
+		return
+	}
+
+	var subj string
+	var seq uint64
+	var hdr []byte
+	var ts int64
+	var err error
+	if req.Seq > 0 {
+		seq = req.Seq
+		subj, hdr, msg, ts, err = store.LoadMsg(seq)
+	} else {
+		subj, seq, hdr, msg, ts, err = store.LoadLastMsg(req.LastFor)
+	}
+	if err != nil {
+		outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, directGetNotFound, nil, nil, 0, nil})
+		return
+	}
+
+	rhdr := copyBytes(hdr)
+	rhdr = genHeader(rhdr, JSStream, name)
+	rhdr = genHeader(rhdr, JSSubject, subj)
+	rhdr = genHeader(rhdr, JSSequence, strconv.FormatUint(seq, 10))
+	rhdr = genHeader(rhdr, JSTimeStamp, time.Unix(0, ts).UTC().Format(time.RFC3339Nano))
+	outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, rhdr, copyBytes(msg), nil, 0, nil})
 }
 
 // Helper for unlocked stream.
@@ -2069,7 +2597,7 @@ func (mset *stream) setupStore(fsCfg *FileStoreConfig) error {
 		}
 		mset.store = ms
 	case FileStorage:
-		fs, err := newFileStoreWithCreated(*fsCfg, mset.cfg, mset.created)
+		fs, err := newFileStoreWithCreated(*fsCfg, mset.cfg, mset.created, mset.srv.jsKeyGen(mset.acc.Name))
 		if err != nil {
 			mset.mu.Unlock()
 			return err
@@ -2185,6 +2713,11 @@ func getExpectedStream(hdr []byte) string {
 	return string(getHeader(JSExpectedStream, hdr))
 }
 
+// Fast lookup of rollups.
+func getRollup(hdr []byte) string {
+	return strings.ToLower(string(getHeader(JSMsgRollup, hdr)))
+}
+
 // Fast lookup of expected stream.
 func getExpectedLastSeq(hdr []byte) uint64 {
 	bseq := getHeader(JSExpectedLastSeq, hdr)
@@ -2194,6 +2727,41 @@ func getExpectedLastSeq(hdr []byte) uint64 {
 	return uint64(parseInt64(bseq))
 }
 
+// Fast lookup of expected last sequence for the message subject.
+// Returns false if the header is not present since zero is a valid value.
+func getExpectedLastSeqPerSubject(hdr []byte) (uint64, bool) {
+	bseq := getHeader(JSExpectedLastSubjSeq, hdr)
+	if len(bseq) == 0 {
+		return 0, false
+	}
+	return uint64(parseInt64(bseq)), true
+}
+
+// Minimum allowed per message TTL.
+const minMessageTTL = time.Second
+
+// Fast lookup of the per message TTL, returned in nanoseconds.
+// The value can be a duration, e.g. "10m", or a number of seconds.
+// Returns zero if the header is not present.
+func getMessageTTL(hdr []byte) (int64, error) {
+	bttl := getHeader(JSMessageTTL, hdr)
+	if len(bttl) == 0 {
+		return 0, nil
+	}
+	var ttl time.Duration
+	if secs := parseInt64(bttl); secs >= 0 {
+		ttl = time.Duration(secs) * time.Second
+	} else if d, err := time.ParseDuration(string(bttl)); err == nil {
+		ttl = d
+	} else {
+		return 0, fmt.Errorf("message TTL invalid: %q", bttl)
+	}
+	if ttl < minMessageTTL {
+		return 0, fmt.Errorf("message TTL must be at least %v", minMessageTTL)
+	}
+	return int64(ttl), nil
+}
+
 // Lock should be held.
 func (mset *stream) isClustered() bool {
 	return mset.node != nil
@@ -2260,7 +2828,7 @@ func (mset *stream) queueInboundMsg(subj, rply string, hdr, msg []byte) {
 // processInboundJetStreamMsg handles processing messages bound for a stream.
 func (mset *stream) processInboundJetStreamMsg(_ *subscription, c *client, subject, reply string, rmsg []byte) {
 	mset.mu.RLock()
-	isLeader, isClustered := mset.isLeader(), mset.node != nil
+	isLeader, isClustered, itr := mset.isLeader(), mset.node != nil, mset.itr
 	mset.mu.RUnlock()
 
 	// If we are not the leader just ignore.
@@ -2268,6 +2836,13 @@ func (mset *stream) processInboundJetStreamMsg(_ *subscription, c *client, subje
 		return
 	}
 
+	// Apply our subject transform if configured.
+	if itr != nil {
+		if tsubj, err := itr.match(subject); err == nil {
+			subject = tsubj
+		}
+	}
+
 	hdr, msg := c.msgParts(rmsg)
 
 	// If we are not receiving directly from a client we should move this this Go routine.
@@ -2276,18 +2851,32 @@ func (mset *stream) processInboundJetStreamMsg(_ *subscription, c *client, subje
 		return
 	}
 
+	mset.processInboundMsg(isClustered, subject, reply, hdr, msg)
+}
+
+// processInboundMsg is called by the leader for each inbound message.
+func (mset *stream) processInboundMsg(isClustered bool, subject, reply string, hdr, msg []byte) {
+	// Messages that are part of an atomic batch are staged until the batch is committed.
+	if len(hdr) > 0 && len(getHeader(JSBatchId, hdr)) > 0 {
+		mset.processBatchMsg(isClustered, subject, reply, hdr, msg)
+		return
+	}
 	// If we are clustered we need to propose this message to the underlying raft group.
 	if isClustered {
 		mset.processClusteredInboundMsg(subject, reply, hdr, msg)
 	} else {
-		mset.processJetStreamMsg(subject, reply, hdr, msg, 0, 0)
+		mset.processJetStreamMsg(subject, reply, hdr, msg, 0, 0, false)
 	}
 }
 
 var errLastSeqMismatch = errors.New("last sequence mismatch")
 
 // processJetStreamMsg is where we try to actually process the stream msg.
-func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte, lseq uint64, ts int64) error {
+// Imported msgs were already checked for duplicates by the stream they were exported from.
+func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte, lseq uint64, ts int64, imported bool) error {
+	mset.smu.Lock()
+	defer mset.smu.Unlock()
+
 	mset.mu.Lock()
 	store := mset.store
 	c, s := mset.client, mset.srv
@@ -2306,13 +2895,17 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 	name, stype := mset.cfg.Name, mset.cfg.Storage
 	maxMsgSize := int(mset.cfg.MaxMsgSize)
 	numConsumers := len(mset.consumers)
-	interestRetention := mset.cfg.Retention == InterestPolicy
 	// Snapshot if we are the leader and if we can respond.
 	isLeader := mset.isLeader()
 	canRespond := doAck && len(reply) > 0 && isLeader
 
 	var resp = &JSPubAckResponse{}
 
+	// If the leader was tracking this proposal for an expected last subject sequence we can release it now.
+	if pseq, ok := mset.lssip[subject]; ok && pseq == lseq {
+		delete(mset.lssip, subject)
+	}
+
 	// For clustering the lower layers will pass our expected lseq. If it is present check for that here.
 	if lseq > 0 && lseq != (mset.lseq+mset.clfs) {
 		isMisMatch := true
@@ -2339,6 +2932,20 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		}
 	}
 
+	// Sealed streams do not accept new messages.
+	if mset.cfg.Sealed {
+		mset.clfs++
+		outq := mset.outq
+		mset.mu.Unlock()
+		if canRespond && outq != nil {
+			resp.PubAck = &PubAck{Stream: name}
+			resp.Error = jsStreamSealedErr
+			b, _ := json.Marshal(resp)
+			outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0, nil})
+		}
+		return errors.New("invalid operation on sealed stream")
+	}
+
 	// If we have received this message across an account we may have request information attached.
 	// For now remove. TODO(dlc) - Should this be opt-in or opt-out?
 	if len(hdr) > 0 {
@@ -2346,11 +2953,11 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 	}
 
 	// Process additional msg headers if still present.
-	var msgId string
+	var msgId, rollup string
 	if len(hdr) > 0 {
 		msgId = getMsgId(hdr)
 		outq := mset.outq
-		if dde := mset.checkMsgId(msgId); dde != nil {
+		if dde := mset.checkMsgId(msgId); dde != nil && !imported {
 			mset.clfs++
 			mset.mu.Unlock()
 			if canRespond {
@@ -2386,6 +2993,22 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 			}
 			return fmt.Errorf("last sequence mismatch: %d vs %d", seq, mlseq)
 		}
+		// Expected last sequence per subject.
+		if seq, exists := getExpectedLastSeqPerSubject(hdr); exists {
+			// A subject with no messages has a last sequence of 0.
+			lss := store.LastSeqForSubject(subject)
+			if seq != lss {
+				mset.clfs++
+				mset.mu.Unlock()
+				if canRespond {
+					resp.PubAck = &PubAck{Stream: name}
+					resp.Error = jsWrongLastSubjSeqError(lss)
+					b, _ := json.Marshal(resp)
+					outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0, nil})
+				}
+				return fmt.Errorf("last sequence by subject mismatch: %d vs %d", seq, lss)
+			}
+		}
 		// Expected last msgId.
 		if lmsgId := getExpectedLastMsgId(hdr); lmsgId != _EMPTY_ && lmsgId != mset.lmsgId {
 			last := mset.lmsgId
@@ -2399,6 +3022,41 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 			}
 			return fmt.Errorf("last msgid mismatch: %q vs %q", lmsgId, last)
 		}
+		// Check for any rollups.
+		if rollup = getRollup(hdr); rollup != _EMPTY_ {
+			var rerr string
+			if !mset.cfg.AllowRollup || mset.cfg.DenyPurge {
+				rerr = "rollup not permitted"
+			} else if rollup != JSMsgRollupSubject && rollup != JSMsgRollupAll {
+				rerr = fmt.Sprintf("rollup value invalid: %q", rollup)
+			}
+			if rerr != _EMPTY_ {
+				mset.clfs++
+				mset.mu.Unlock()
+				if canRespond {
+					resp.PubAck = &PubAck{Stream: name}
+					resp.Error = &ApiError{Code: 400, Description: rerr}
+					b, _ := json.Marshal(resp)
+					outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0, nil})
+				}
+				return errors.New(rerr)
+			}
+		}
+		// Check for a per message TTL.
+		if ttl, terr := getMessageTTL(hdr); terr != nil || (ttl > 0 && !mset.cfg.AllowMsgTTL) {
+			if terr == nil {
+				terr = errors.New("per message TTL not enabled for stream")
+			}
+			mset.clfs++
+			mset.mu.Unlock()
+			if canRespond {
+				resp.PubAck = &PubAck{Stream: name}
+				resp.Error = &ApiError{Code: 400, Description: terr.Error()}
+				b, _ := json.Marshal(resp)
+				outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0, nil})
+			}
+			return terr
+		}
 	}
 
 	// Response Ack.
@@ -2439,23 +3097,9 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		return ErrJetStreamResourcesExceeded
 	}
 
-	var noInterest bool
-
-	// If we are interest based retention and have no consumers then we can skip.
-	if interestRetention {
-		if numConsumers == 0 {
-			noInterest = true
-		} else if mset.numFilter > 0 {
-			// Assume none.
-			noInterest = true
-			for _, o := range mset.consumers {
-				if o.cfg.FilterSubject != _EMPTY_ && subjectIsSubsetMatch(subject, o.cfg.FilterSubject) {
-					noInterest = false
-					break
-				}
-			}
-		}
-	}
+	// If we are interest based retention and have no interest then we can skip.
+	// Check if we need to republish this message once stored. Only the leader does this.
+	noInterest, tsubj := mset.checkInterestAndRepublish(subject, isLeader)
 
 	// Grab timestamp if not already set.
 	if ts == 0 && lseq > 0 {
@@ -2480,11 +3124,18 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		return nil
 	}
 
+	// We grab the last sequence for this subject now so subscribers can detect gaps.
+	var tlseq uint64
+	if tsubj != _EMPTY_ {
+		tlseq = store.LastSeqForSubject(subject)
+	}
+
 	// If here we will attempt to store the message.
 	// Assume this will succeed.
 	olmsgId := mset.lmsgId
 	mset.lmsgId = msgId
 	mset.lseq++
+	clfs := mset.clfs
 
 	// We hold the lock to this point to make sure nothing gets between us since we check for pre-conditions.
 	// Currently can not hold while calling store b/c we have inline storage update calls that may need the lock.
@@ -2495,7 +3146,8 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 	if lseq == 0 && ts == 0 {
 		seq, ts, err = store.StoreMsg(subject, hdr, msg)
 	} else {
-		seq = lseq + 1
+		// Make sure to take into account any message assignments that we had to skip (clfs).
+		seq = lseq + 1 - clfs
 		err = store.StoreRawMsg(subject, hdr, msg, seq, ts)
 	}
 
@@ -2533,9 +3185,10 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		store.RemoveMsg(seq)
 		seq = 0
 	} else {
-		// If we have a msgId make sure to save.
-		if msgId != _EMPTY_ {
-			mset.storeMsgId(&ddentry{msgId, seq, ts})
+		// Now that we are stored remove everything this message rolls up.
+		// This happens as part of applying the same entry on all replicas.
+		if rollup != _EMPTY_ {
+			mset.processRollup(rollup, subject, seq)
 		}
 		if canRespond {
 			response = append(pubAck, strconv.FormatUint(seq, 10)...)
@@ -2548,22 +3201,523 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		mset.outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0, nil})
 	}
 
-	if err == nil && seq > 0 && numConsumers > 0 {
-		mset.mu.Lock()
-		for _, o := range mset.consumers {
-			o.mu.Lock()
-			if o.isLeader() {
-				if o.isFilteredMatch(subject) {
-					o.sgap++
+	if err == nil && seq > 0 {
+		mset.processStoredMsg(subject, hdr, msg, msgId, seq, ts, tsubj, tlseq, numConsumers > 0)
+	}
+
+	return err
+}
+
+// checkInterestAndRepublish returns if a message on subject should be skipped since there is no interest,
+// and if not the subject to republish it to once stored. Only the leader republishes.
+// Lock should be held.
+func (mset *stream) checkInterestAndRepublish(subject string, isLeader bool) (bool, string) {
+	if mset.hasNoInterest(subject) {
+		return true, _EMPTY_
+	}
+	var tsubj string
+	if mset.tr != nil && isLeader {
+		tsubj, _ = mset.tr.match(subject)
+	}
+	return false, tsubj
+}
+
+// processStoredMsg is called once a message has been stored. It will remember its msgId for
+// duplicate detection, republish it to tsubj if set and signal our consumers.
+// tlseq is the last sequence for the subject before this message.
+func (mset *stream) processStoredMsg(subject string, hdr, msg []byte, msgId string, seq uint64, ts int64, tsubj string, tlseq uint64, signal bool) {
+	// If we have a msgId make sure to save.
+	if msgId != _EMPTY_ {
+		mset.storeMsgId(&ddentry{msgId, seq, ts})
+	}
+	// Republish if needed now that we are stored.
+	if tsubj != _EMPTY_ {
+		mset.mu.RLock()
+		name, hdrsOnly := mset.cfg.Name, mset.cfg.RePublish != nil && mset.cfg.RePublish.HeadersOnly
+		mset.mu.RUnlock()
+		mset.republishMsg(name, tsubj, subject, hdr, msg, seq, tlseq, ts, hdrsOnly)
+	}
+	if signal {
+		mset.signalConsumers(subject)
+	}
+}
+
+// hasNoInterest returns if we are interest based retention and no consumer would take a message on subject.
+// Lock should be held.
+func (mset *stream) hasNoInterest(subject string) bool {
+	if mset.cfg.Retention != InterestPolicy {
+		return false
+	}
+	if len(mset.consumers) == 0 {
+		return true
+	}
+	if mset.numFilter == 0 {
+		return false
+	}
+	for _, o := range mset.consumers {
+		o.mu.RLock()
+		match := o.isFiltered() && o.isFilteredMatch(subject)
+		o.mu.RUnlock()
+		if match {
+			return false
+		}
+	}
+	return true
+}
+
+// republishMsg will republish a stored message to tsubj.
+// tlseq is the last sequence for the subject before this message.
+func (mset *stream) republishMsg(name, tsubj, subject string, hdr, msg []byte, seq, tlseq uint64, ts int64, hdrsOnly bool) {
+	// Copy since genHeader may append into the original.
+	rhdr := copyBytes(hdr)
+	rhdr = genHeader(rhdr, JSStream, name)
+	rhdr = genHeader(rhdr, JSSubject, subject)
+	rhdr = genHeader(rhdr, JSSequence, strconv.FormatUint(seq, 10))
+	rhdr = genHeader(rhdr, JSTimeStamp, time.Unix(0, ts).UTC().Format(time.RFC3339Nano))
+	rhdr = genHeader(rhdr, JSLastSequence, strconv.FormatUint(tlseq, 10))
+	var rmsg []byte
+	if hdrsOnly {
+		rhdr = genHeader(rhdr, JSMsgSize, strconv.Itoa(len(msg)))
+	} else {
+		rmsg = copyBytes(msg)
+	}
+	mset.outq.send(&jsPubMsg{tsubj, _EMPTY_, _EMPTY_, rhdr, rmsg, nil, 0, nil})
+}
+
+// signalConsumers will let our consumers know a new message on subject was stored.
+func (mset *stream) signalConsumers(subject string) {
+	mset.mu.Lock()
+	for _, o := range mset.consumers {
+		o.mu.Lock()
+		if o.isLeader() {
+			if o.isFilteredMatch(subject) {
+				o.sgap++
+			}
+			o.signalNewMessages()
+		}
+		o.mu.Unlock()
+	}
+	mset.mu.Unlock()
+}
+
+// Limits for atomic batches.
+const (
+	// Maximum number of messages in a single batch.
+	maxBatchSize = 1000
+	// Maximum number of batches being staged at once per stream.
+	maxBatchesInflight = 64
+	// Maximum total size of all batches being staged at once per stream.
+	maxBatchBytesInflight = 64 * 1024 * 1024
+	// Maximum length of a batch id.
+	maxBatchIdLen = 64
+	// Partial batches that have not been committed are abandoned after this.
+	batchTimeout = 10 * time.Second
+)
+
+// A batch of messages staged by the leader until committed.
+type batchGroup struct {
+	msgs  []*inMsg
+	bytes uint64
+	tmr   *time.Timer
+}
+
+// Fast lookup of the batch sequence.
+func getBatchSequence(hdr []byte) uint64 {
+	bseq := getHeader(JSBatchSeq, hdr)
+	if len(bseq) == 0 {
+		return 0
+	}
+	if seq := parseInt64(bseq); seq > 0 {
+		return uint64(seq)
+	}
+	return 0
+}
+
+// Fast lookup of the batch commit marker.
+func isBatchCommit(hdr []byte) bool {
+	return string(getHeader(JSBatchCommit, hdr)) == "1"
+}
+
+// Lock should be held.
+func (mset *stream) clearBatches() {
+	for _, b := range mset.batches {
+		b.tmr.Stop()
+	}
+	mset.batches = nil
+	mset.batchBytes = 0
+}
+
+// Stops staging the batch b under id, releasing what it holds.
+// Lock should be held.
+func (mset *stream) removeBatch(id string, b *batchGroup) {
+	if mset.batches[id] != b {
+		return
+	}
+	b.tmr.Stop()
+	delete(mset.batches, id)
+	mset.batchBytes -= b.bytes
+}
+
+// Respond with an error to a batch publish.
+func (mset *stream) sendBatchError(reply string, apiErr *ApiError) {
+	mset.mu.RLock()
+	canRespond := !mset.cfg.NoAck && len(reply) > 0
+	name, outq := mset.cfg.Name, mset.outq
+	mset.mu.RUnlock()
+	if canRespond && outq != nil {
+		b, _ := json.Marshal(&JSPubAckResponse{PubAck: &PubAck{Stream: name}, Error: apiErr})
+		outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0, nil})
+	}
+}
+
+// processBatchMsg stages a message that is part of an atomic batch.
+// Messages in a batch are sequenced from 1 by the publisher and are not acknowledged individually.
+// When the commit marker is seen the whole batch is checked and stored as one unit with a single ack.
+func (mset *stream) processBatchMsg(isClustered bool, subject, reply string, hdr, msg []byte) {
+	id := string(getHeader(JSBatchId, hdr))
+	bseq, commit := getBatchSequence(hdr), isBatchCommit(hdr)
+
+	mset.mu.Lock()
+	var berr string
+	if !mset.cfg.AllowAtomic {
+		berr = "atomic publish is disabled"
+	} else if len(id) > maxBatchIdLen {
+		berr = "batch id is invalid"
+	} else if bseq == 0 {
+		berr = "batch sequence is invalid"
+	}
+	b := mset.batches[id]
+	if berr == _EMPTY_ {
+		if bseq == 1 {
+			// Starting over with an id in use abandons the old batch.
+			if b != nil {
+				mset.removeBatch(id, b)
+			}
+			if len(mset.batches) >= maxBatchesInflight {
+				berr = "too many batches in flight"
+			} else {
+				b = &batchGroup{}
+				b.tmr = time.AfterFunc(batchTimeout, func() {
+					mset.mu.Lock()
+					mset.removeBatch(id, b)
+					mset.mu.Unlock()
+				})
+				if mset.batches == nil {
+					mset.batches = make(map[string]*batchGroup)
 				}
-				o.signalNewMessages()
+				mset.batches[id] = b
 			}
-			o.mu.Unlock()
+		} else if b == nil || bseq != uint64(len(b.msgs)+1) {
+			berr = "batch is incomplete"
+		} else if bseq > maxBatchSize {
+			berr = "batch is too large"
+		}
+	}
+	if berr == _EMPTY_ && mset.batchBytes+uint64(len(hdr)+len(msg)) > maxBatchBytesInflight {
+		berr = "too many batch bytes in flight"
+	}
+	if berr != _EMPTY_ {
+		// Any error abandons the batch.
+		if b != nil {
+			mset.removeBatch(id, b)
 		}
 		mset.mu.Unlock()
+		mset.sendBatchError(reply, &ApiError{Code: 400, Description: berr})
+		return
 	}
 
-	return err
+	// We may be pointing into the client's read buffer here.
+	hdr = copyBytes(removeHeaderIfPresent(hdr, JSBatchCommit))
+	b.msgs = append(b.msgs, &inMsg{subj: subject, hdr: hdr, msg: copyBytes(msg)})
+	b.bytes += uint64(len(hdr) + len(msg))
+	mset.batchBytes += uint64(len(hdr) + len(msg))
+	if !commit {
+		mset.mu.Unlock()
+		return
+	}
+	mset.removeBatch(id, b)
+	mset.mu.Unlock()
+
+	if isClustered {
+		mset.processClusteredInboundBatch(id, reply, b.msgs)
+	} else if err := mset.checkBatchAccountLimits(b.msgs); err != nil {
+		mset.sendBatchError(reply, &ApiError{Code: 400, Description: "resource limits exceeded for account"})
+	} else {
+		mset.processJetStreamBatch(id, reply, b.msgs, 0, 0)
+	}
+}
+
+// checkBatchAccountLimits will make sure storing msgs on all of our replicas stays within our account limits.
+// This is done before the batch is proposed, since each server's view of the account differs and the
+// batch has to be stored or rejected as a whole on all of them.
+func (mset *stream) checkBatchAccountLimits(msgs []*inMsg) error {
+	mset.mu.RLock()
+	s, jsa, st, rf := mset.srv, mset.jsa, mset.cfg.Storage, mset.cfg.Replicas
+	mset.mu.RUnlock()
+
+	var size uint64
+	for _, m := range msgs {
+		if st == MemoryStorage {
+			size += memStoreMsgSize(m.subj, m.hdr, m.msg)
+		} else {
+			size += fileStoreMsgSize(m.subj, m.hdr, m.msg)
+		}
+	}
+	if rf < 1 {
+		rf = 1
+	}
+	var exceeded bool
+	jsa.mu.RLock()
+	total := jsa.storeTotal + int64(size*uint64(rf))
+	if st == MemoryStorage {
+		exceeded = jsa.limits.MaxMemory > 0 && total > jsa.limits.MaxMemory
+	} else {
+		exceeded = jsa.limits.MaxStore > 0 && total > jsa.limits.MaxStore
+	}
+	jsa.mu.RUnlock()
+	if exceeded {
+		err := fmt.Errorf("JetStream resource limits exceeded for account: %q", jsa.acc().Name)
+		s.Warnf(err.Error())
+		return err
+	}
+	return nil
+}
+
+// checkBatch will make sure all messages in a batch can be stored given our current state.
+// Expectations are checked in order as if the messages before them had already been stored.
+// Lock should be held.
+func (mset *stream) checkBatch(msgs []*inMsg, lseq uint64) *ApiError {
+	lmsgId, maxMsgSize := mset.lmsgId, int(mset.cfg.MaxMsgSize)
+	var ids map[string]struct{}
+	var lss map[string]uint64
+
+	// Track our limits as if each message was stored. The whole batch has to fit, since
+	// with discard new the store would reject part of it and otherwise the batch would
+	// remove its own messages.
+	var state StreamState
+	mset.store.FastState(&state)
+	nmsgs, nbytes, discardNew := state.Msgs, state.Bytes, mset.cfg.Discard == DiscardNew
+	var bmsgs, bbytes uint64
+	var bsubjs map[string]int64
+
+	for _, m := range msgs {
+		if maxMsgSize >= 0 && (len(m.hdr)+len(m.msg)) > maxMsgSize {
+			return &ApiError{Code: 400, Description: "message size exceeds maximum allowed"}
+		}
+		var msz uint64
+		if mset.cfg.Storage == MemoryStorage {
+			msz = memStoreMsgSize(m.subj, m.hdr, m.msg)
+		} else {
+			msz = fileStoreMsgSize(m.subj, m.hdr, m.msg)
+		}
+		if maxMsgs := mset.cfg.MaxMsgs; maxMsgs > 0 {
+			if (discardNew && nmsgs >= uint64(maxMsgs)) || bmsgs >= uint64(maxMsgs) {
+				return &ApiError{Code: 400, Description: ErrMaxMsgs.Error()}
+			}
+		}
+		if maxBytes := mset.cfg.MaxBytes; maxBytes > 0 {
+			if (discardNew && nbytes+uint64(len(m.hdr)+len(m.msg)) >= uint64(maxBytes)) || bbytes+msz > uint64(maxBytes) {
+				return &ApiError{Code: 400, Description: ErrMaxBytes.Error()}
+			}
+		}
+		if maxMsgsPer := mset.cfg.MaxMsgsPer; maxMsgsPer > 0 {
+			if bsubjs[m.subj] >= maxMsgsPer {
+				return &ApiError{Code: 400, Description: "maximum messages per subject exceeded"}
+			}
+			if bsubjs == nil {
+				bsubjs = make(map[string]int64)
+			}
+			bsubjs[m.subj]++
+		}
+		nmsgs, nbytes = nmsgs+1, nbytes+msz
+		bmsgs, bbytes = bmsgs+1, bbytes+msz
+
+		msgId := getMsgId(m.hdr)
+		if msgId != _EMPTY_ {
+			if _, ok := ids[msgId]; ok || mset.checkMsgId(msgId) != nil {
+				return &ApiError{Code: 400, Description: fmt.Sprintf("duplicate message id in batch: %q", msgId)}
+			}
+		}
+		if sname := getExpectedStream(m.hdr); sname != _EMPTY_ && sname != mset.cfg.Name {
+			return &ApiError{Code: 400, Description: "expected stream does not match"}
+		}
+		if seq := getExpectedLastSeq(m.hdr); seq > 0 && seq != lseq {
+			return &ApiError{Code: 400, Description: fmt.Sprintf("wrong last sequence: %d", lseq)}
+		}
+		if seq, exists := getExpectedLastSeqPerSubject(m.hdr); exists {
+			last, ok := lss[m.subj]
+			if !ok {
+				last = mset.store.LastSeqForSubject(m.subj)
+			}
+			if seq != last {
+				return jsWrongLastSubjSeqError(last)
+			}
+		}
+		if elid := getExpectedLastMsgId(m.hdr); elid != _EMPTY_ && elid != lmsgId {
+			return &ApiError{Code: 400, Description: fmt.Sprintf("wrong last msg ID: %s", lmsgId)}
+		}
+		if getRollup(m.hdr) != _EMPTY_ {
+			return &ApiError{Code: 400, Description: "rollup not permitted in batch"}
+		}
+		if ttl, err := getMessageTTL(m.hdr); err != nil {
+			return &ApiError{Code: 400, Description: err.Error()}
+		} else if ttl > 0 && !mset.cfg.AllowMsgTTL {
+			return &ApiError{Code: 400, Description: "per message TTL not enabled for stream"}
+		}
+
+		// Now update as if this one was stored.
+		lseq++
+		if msgId != _EMPTY_ {
+			if ids == nil {
+				ids = make(map[string]struct{})
+			}
+			ids[msgId] = struct{}{}
+		}
+		lmsgId = msgId
+		if lss == nil {
+			lss = make(map[string]uint64)
+		}
+		lss[m.subj] = lseq
+	}
+	return nil
+}
+
+// processJetStreamBatch will check and store all messages from a committed batch.
+// The whole batch is checked before anything is stored, and then stored as one unit so either
+// all messages are stored or none are. We respond with a single ack for all of them.
+// When clustered the lower layers will pass the lseq and timestamp for the batch.
+func (mset *stream) processJetStreamBatch(id, reply string, msgs []*inMsg, lseq uint64, ts int64) error {
+	// Make sure nothing else gets stored in between the messages of our batch.
+	mset.smu.Lock()
+	defer mset.smu.Unlock()
+
+	mset.mu.Lock()
+	store, s := mset.store, mset.srv
+	if mset.client == nil {
+		mset.mu.Unlock()
+		return nil
+	}
+	var accName string
+	if mset.acc != nil {
+		accName = mset.acc.Name
+	}
+	isLeader := mset.isLeader()
+	canRespond := !mset.cfg.NoAck && len(reply) > 0 && isLeader
+	name, stype, outq, js := mset.cfg.Name, mset.cfg.Storage, mset.outq, mset.js
+	numConsumers := len(mset.consumers)
+
+	respondErr := func(apiErr *ApiError) {
+		if canRespond {
+			b, _ := json.Marshal(&JSPubAckResponse{PubAck: &PubAck{Stream: name}, Error: apiErr})
+			outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0, nil})
+		}
+	}
+
+	// When clustered release any expected last subject sequence checks the leader was tracking.
+	if ts > 0 {
+		for i, m := range msgs {
+			if pseq, ok := mset.lssip[m.subj]; ok && pseq == lseq+uint64(i) {
+				delete(mset.lssip, m.subj)
+			}
+		}
+	}
+
+	// For clustering the lower layers will pass our expected lseq for the first message.
+	if lseq > 0 && lseq != (mset.lseq+mset.clfs) {
+		mset.mu.Unlock()
+		respondErr(&ApiError{Code: 503, Description: "expected stream sequence does not match"})
+		return errLastSeqMismatch
+	}
+
+	// Check the whole batch. Our account limits were checked before the batch was proposed
+	// so all replicas make the same decision here.
+	var apiErr *ApiError
+	if mset.cfg.Sealed {
+		apiErr = jsStreamSealedErr
+	} else if js.limitsExceeded(stype) {
+		s.resourcesExeededError()
+		apiErr = jsInsufficientErr
+	} else {
+		apiErr = mset.checkBatch(msgs, mset.lseq)
+	}
+	if apiErr != nil {
+		// When clustered the leader accounted for all of these.
+		if ts > 0 {
+			mset.clfs += uint64(len(msgs))
+		}
+		mset.mu.Unlock()
+		respondErr(apiErr)
+		return errors.New(apiErr.Description)
+	}
+
+	// Decide now which messages have no interest and what needs to be republished.
+	batch := make([]*BatchMsg, len(msgs))
+	tsubjs := make([]string, len(msgs))
+	tlseqs := make(map[string]uint64)
+	for i, m := range msgs {
+		// If we have received this message across an account we may have request information attached.
+		if len(m.hdr) > 0 {
+			m.hdr = removeHeaderIfPresent(m.hdr, ClientInfoHdr)
+		}
+		batch[i] = &BatchMsg{Subject: m.subj, Hdr: m.hdr, Msg: m.msg}
+		batch[i].Skip, tsubjs[i] = mset.checkInterestAndRepublish(m.subj, isLeader)
+		if tsubjs[i] != _EMPTY_ {
+			if _, ok := tlseqs[m.subj]; !ok {
+				tlseqs[m.subj] = store.LastSeqForSubject(m.subj)
+			}
+		}
+	}
+
+	// Make sure to take into account any message assignments that we had to skip (clfs).
+	var seq uint64
+	clustered := ts > 0
+	if clustered {
+		seq = lseq + 1 - mset.clfs
+	}
+
+	// Assume this will succeed.
+	olmsgId := mset.lmsgId
+	mset.lseq += uint64(len(msgs))
+	mset.lmsgId = getMsgId(msgs[len(msgs)-1].hdr)
+	mset.mu.Unlock()
+
+	seq, ts, err := store.StoreMsgs(batch, seq, ts)
+	if err != nil {
+		// Nothing from the batch was stored, so put those values back.
+		mset.mu.Lock()
+		var state StreamState
+		store.FastState(&state)
+		mset.lseq = state.LastSeq
+		mset.lmsgId = olmsgId
+		// When clustered the leader accounted for all of these.
+		if clustered {
+			mset.clfs += uint64(len(msgs))
+		}
+		mset.mu.Unlock()
+
+		if err != ErrStoreClosed {
+			s.Errorf("JetStream failed to store a batch on stream '%s > %s' -  %v", accName, name, err)
+		}
+		respondErr(&ApiError{Code: 503, Description: err.Error()})
+		return err
+	}
+
+	if canRespond {
+		b, _ := json.Marshal(&JSPubAckResponse{PubAck: &PubAck{Stream: name, Sequence: seq + uint64(len(msgs)) - 1, BatchId: id, BatchSize: len(msgs)}})
+		outq.send(&jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0, nil})
+	}
+
+	for i, m := range msgs {
+		if batch[i].Skip {
+			continue
+		}
+		mseq := seq + uint64(i)
+		mset.processStoredMsg(m.subj, m.hdr, m.msg, getMsgId(m.hdr), mseq, ts, tsubjs[i], tlseqs[m.subj], numConsumers > 0)
+		if tsubjs[i] != _EMPTY_ {
+			tlseqs[m.subj] = mseq
+		}
+	}
+	return nil
 }
 
 // Internal message for use by jetstream subsystem.
@@ -2675,7 +3829,6 @@ func (mset *stream) internalLoop() {
 	c.registerWithAccount(mset.acc)
 	defer c.closeConnection(ClientClosed)
 	outq, qch, mch, rmch := mset.outq, mset.qch, mset.msgs.mch, mset.rmch
-	isClustered := mset.cfg.Replicas > 1
 	mset.mu.RUnlock()
 
 	for {
@@ -2711,13 +3864,12 @@ func (mset *stream) internalLoop() {
 			}
 			c.flushClients(10 * time.Millisecond)
 		case <-mch:
+			// We can be scaled up or down so check each time.
+			mset.mu.RLock()
+			isClustered := mset.isClustered()
+			mset.mu.RUnlock()
 			for im := mset.pending(mset.msgs); im != nil; im = im.next {
-				// If we are clustered we need to propose this message to the underlying raft group.
-				if isClustered {
-					mset.processClusteredInboundMsg(im.subj, im.rply, im.hdr, im.msg)
-				} else {
-					mset.processJetStreamMsg(im.subj, im.rply, im.hdr, im.msg, 0, 0)
-				}
+				mset.processInboundMsg(isClustered, im.subj, im.rply, im.hdr, im.msg)
 			}
 		case seq := <-rmch:
 			mset.store.RemoveMsg(seq)
@@ -2770,6 +3922,10 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 	mset.stopClusterSubs()
 	// Unsubscribe from direct stream.
 	mset.unsubscribeToStream()
+	// Stop answering direct gets.
+	mset.unsubscribeToDirect()
+	// Drop any partial batches.
+	mset.clearBatches()
 
 	// Our info sub if we spun it up.
 	if mset.infoSub != nil {
@@ -2875,13 +4031,13 @@ func (mset *stream) numConsumers() int {
 
 func (mset *stream) setConsumer(o *consumer) {
 	mset.consumers[o.name] = o
-	if o.cfg.FilterSubject != _EMPTY_ {
+	if o.isFiltered() {
 		mset.numFilter++
 	}
 }
 
 func (mset *stream) removeConsumer(o *consumer) {
-	if o.cfg.FilterSubject != _EMPTY_ {
+	if o.isFiltered() {
 		mset.numFilter--
 	}
 	delete(mset.consumers, o.name)
@@ -2906,15 +4062,20 @@ func (mset *stream) state() StreamState {
 	return store.State()
 }
 
-// Determines if the new proposed partition is unique amongst all consumers.
+// Determines if the new proposed partitions are unique amongst all consumers.
 // Lock should be held.
-func (mset *stream) partitionUnique(partition string) bool {
+func (mset *stream) partitionUnique(partitions []string) bool {
 	for _, o := range mset.consumers {
-		if o.cfg.FilterSubject == _EMPTY_ {
+		filters := o.cfg.filterSubjects()
+		if len(filters) == 0 {
 			return false
 		}
-		if subjectIsSubsetMatch(partition, o.cfg.FilterSubject) {
-			return false
+		for _, partition := range partitions {
+			for _, filter := range filters {
+				if subjectIsSubsetMatch(partition, filter) {
+					return false
+				}
+			}
 		}
 	}
 	return true
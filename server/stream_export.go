@@ -0,0 +1,343 @@
+// Copyright 2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Stream exports are a portable format that does not depend on the storage layer.
+// An export is a sequence of JSON documents, one per line. The first line is a
+// StreamExportHeader and every line after that is a StoredMsg in sequence order,
+// with headers and data base64 encoded. Readers should reject versions they do not know.
+const JSStreamExportVersion = 1
+
+// StreamExportHeader is the first line of a stream export.
+type StreamExportHeader struct {
+	Version       int       `json:"version"`
+	Stream        string    `json:"stream"`
+	FilterSubject string    `json:"filter_subject,omitempty"`
+	Created       time.Time `json:"created"`
+}
+
+var (
+	errStreamExportHeader = errors.New("stream export header missing or invalid")
+	errStreamImportMirror = errors.New("stream import not allowed on a mirror")
+)
+
+// Headers that are only acted on when a message is first published.
+// We keep the msg id so it is still known for duplicate detection, but do not check it on import.
+var importStrippedHeaders = []string{
+	JSExpectedStream,
+	JSExpectedLastSeq,
+	JSExpectedLastMsgId,
+	JSExpectedLastSubjSeq,
+	JSMsgRollup,
+}
+
+// Write the messages selected by req to w in the stream export format.
+func (mset *stream) exportMsgs(w io.Writer, req *JSApiStreamExportRequest) error {
+	mset.mu.RLock()
+	store, name := mset.store, mset.cfg.Name
+	mset.mu.RUnlock()
+
+	var state StreamState
+	store.FastState(&state)
+
+	// Both ends of our range are inclusive.
+	start, end := state.FirstSeq, state.LastSeq
+	if req.StartSeq > start {
+		start = req.StartSeq
+	}
+	if req.StartTime != nil {
+		if seq := store.GetSeqFromTime(*req.StartTime); seq > start {
+			start = seq
+		}
+	}
+	if req.EndSeq > 0 && req.EndSeq < end {
+		end = req.EndSeq
+	}
+	var ets int64
+	if req.EndTime != nil {
+		ets = req.EndTime.UnixNano()
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+
+	hdr := &StreamExportHeader{
+		Version:       JSStreamExportVersion,
+		Stream:        name,
+		FilterSubject: req.FilterSubject,
+		Created:       time.Now().UTC(),
+	}
+	if err := enc.Encode(hdr); err != nil {
+		return err
+	}
+
+	for seq := start; seq > 0 && seq <= end; seq++ {
+		subj, mhdr, msg, ts, err := store.LoadMsg(seq)
+		if err == ErrStoreMsgNotFound || err == errDeletedMsg {
+			continue
+		}
+		if err == ErrStoreEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if ets > 0 && ts > ets {
+			break
+		}
+		if req.FilterSubject != _EMPTY_ && !subjectIsSubsetMatch(subj, req.FilterSubject) {
+			continue
+		}
+		sm := &StoredMsg{
+			Subject:  subj,
+			Sequence: seq,
+			Header:   mhdr,
+			Data:     msg,
+			Time:     time.Unix(0, ts).UTC(),
+		}
+		if err := enc.Encode(sm); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Tracks an import into a stream. Chunks can split lines,
+// so we hold on to any partial line until the rest arrives.
+type streamMsgImport struct {
+	mset     *stream
+	req      *JSApiStreamImportRequest
+	subjects []string
+	hdr      *StreamExportHeader
+	pending  []byte
+	count    uint64
+	last     uint64
+	allowTTL bool
+}
+
+func (mset *stream) newStreamMsgImport(req *JSApiStreamImportRequest) (*streamMsgImport, error) {
+	mset.mu.RLock()
+	isMirror, allowTTL := mset.cfg.Mirror != nil, mset.cfg.AllowMsgTTL
+	mset.mu.RUnlock()
+	if isMirror {
+		return nil, errStreamImportMirror
+	}
+	return &streamMsgImport{mset: mset, req: req, subjects: mset.subjects(), allowTTL: allowTTL}, nil
+}
+
+// Returns true if the stream would store a message published to subject.
+// Streams that only source messages do not have subjects of their own and take any subject.
+func (si *streamMsgImport) isStreamSubject(subject string) bool {
+	if len(si.subjects) == 0 {
+		return true
+	}
+	for _, subj := range si.subjects {
+		if subjectIsSubsetMatch(subject, subj) {
+			return true
+		}
+	}
+	return false
+}
+
+// Process a chunk of an export, storing each complete message.
+func (si *streamMsgImport) write(chunk []byte) error {
+	si.pending = append(si.pending, chunk...)
+	for {
+		i := bytes.IndexByte(si.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := si.pending[:i]
+		si.pending = si.pending[i+1:]
+		if err := si.processLine(line); err != nil {
+			return err
+		}
+	}
+	if len(si.pending) == 0 {
+		si.pending = nil
+	}
+	return nil
+}
+
+// Called once we have received all of the chunks.
+func (si *streamMsgImport) finish() error {
+	if len(si.pending) > 0 {
+		if err := si.processLine(si.pending); err != nil {
+			return err
+		}
+		si.pending = nil
+	}
+	if si.hdr == nil {
+		return errStreamExportHeader
+	}
+	return nil
+}
+
+func (si *streamMsgImport) processLine(line []byte) error {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil
+	}
+	if si.hdr == nil {
+		var hdr StreamExportHeader
+		if err := json.Unmarshal(line, &hdr); err != nil || hdr.Version == 0 {
+			return errStreamExportHeader
+		}
+		if hdr.Version > JSStreamExportVersion {
+			return fmt.Errorf("stream export version %d not supported", hdr.Version)
+		}
+		si.hdr = &hdr
+		return nil
+	}
+
+	var sm StoredMsg
+	if err := json.Unmarshal(line, &sm); err != nil {
+		return fmt.Errorf("invalid stream export message: %v", err)
+	}
+	if !IsValidPublishSubject(sm.Subject) {
+		return fmt.Errorf("invalid stream export message subject %q", sm.Subject)
+	}
+	if !si.isStreamSubject(sm.Subject) {
+		return fmt.Errorf("stream export message subject %q does not match the stream subjects", sm.Subject)
+	}
+	var seq uint64
+	var ts int64
+	if si.req.KeepSequences {
+		if seq = sm.Sequence; seq == 0 {
+			return fmt.Errorf("stream export message for %q is missing its sequence", sm.Subject)
+		}
+	}
+	if si.req.KeepTimestamps {
+		ts = sm.Time.UnixNano()
+	}
+	if ttl, err := getMessageTTL(sm.Header); err != nil {
+		return fmt.Errorf("stream export message for %q: %v", sm.Subject, err)
+	} else if ttl > 0 && !si.allowTTL {
+		return fmt.Errorf("stream export message for %q has a per message TTL but the stream does not allow them", sm.Subject)
+	}
+	lseq, err := si.mset.storeImportedMsg(sm.Subject, sm.Header, sm.Data, seq, ts)
+	if err != nil {
+		return err
+	}
+	si.count++
+	si.last = lseq
+	return nil
+}
+
+// Store an imported message. If seq is set the message keeps that sequence and we skip over
+// any gap before it, otherwise it gets the next one. A zero ts means we use the current time.
+// Returns the sequence we will have applied once the message is stored, which like our
+// proposals also counts any messages that were rejected.
+func (mset *stream) storeImportedMsg(subject string, hdr, msg []byte, seq uint64, ts int64) (uint64, error) {
+	if ts == 0 {
+		ts = time.Now().UnixNano()
+	}
+	// These were checked and acted on when the message was stored by the stream it was
+	// exported from. Checking them again would fail or drop what we are importing.
+	for _, key := range importStrippedHeaders {
+		if len(hdr) == 0 {
+			break
+		}
+		hdr = removeHeaderIfPresent(hdr, key)
+	}
+	mset.mu.RLock()
+	node, clfs := mset.node, mset.clfs
+	mset.mu.RUnlock()
+
+	if node == nil {
+		lseq := mset.lastSeq()
+		if seq > 0 {
+			if seq <= lseq {
+				return 0, fmt.Errorf("sequence %d is not past the last sequence %d of the stream", seq, lseq)
+			}
+			if seq > lseq+1 {
+				if err := mset.skipMsgs(lseq+clfs, seq-1); err != nil {
+					return 0, err
+				}
+				lseq = seq - 1
+			}
+		}
+		return lseq + clfs + 1, mset.processJetStreamMsg(subject, _EMPTY_, hdr, msg, lseq+clfs, ts, true)
+	}
+
+	// If we are clustered we propose in order with any other inbound messages.
+	mset.clMu.Lock()
+	defer mset.clMu.Unlock()
+
+	if mset.clseq == 0 {
+		mset.clseq = mset.appliedSeq()
+	}
+	if seq > 0 {
+		// The sequence we want to keep does not count rejected messages but our proposals do.
+		if lseq := mset.clseq - clfs; seq <= lseq {
+			return 0, fmt.Errorf("sequence %d is not past the last sequence %d of the stream", seq, lseq)
+		} else if seq > lseq+1 {
+			if err := node.Propose(encodeSkipMsgs(mset.clseq, seq-1)); err != nil {
+				return 0, err
+			}
+			mset.clseq = seq - 1 + clfs
+		}
+	}
+	if err := node.Propose(encodeImportMsg(subject, hdr, msg, mset.clseq, ts)); err != nil {
+		return 0, err
+	}
+	mset.clseq++
+	return mset.clseq, nil
+}
+
+// Skip all sequences up to and including last, so the next message stored will be last+1.
+// As with processJetStreamMsg, lseq is the last sequence we are expected to have applied.
+func (mset *stream) skipMsgs(lseq, last uint64) error {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	if lseq != mset.lseq+mset.clfs {
+		return errLastSeqMismatch
+	}
+
+	if last <= mset.lseq {
+		return nil
+	}
+	if err := mset.store.SkipMsgs(mset.lseq+1, last-mset.lseq); err != nil {
+		return err
+	}
+	mset.lseq = last
+	return nil
+}
+
+// When clustered, wait for the messages we proposed to be applied.
+func (si *streamMsgImport) waitApplied(timeout time.Duration) error {
+	if si.last == 0 || si.mset.raftNode() == nil {
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	for si.mset.appliedSeq() < si.last {
+		if time.Now().After(deadline) {
+			return errors.New("timeout waiting for imported messages to be stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}